@@ -23,6 +23,8 @@ type APIKey struct {
 	ExpiresAt  *time.Time `gorm:"index"`
 	LastUsedAt *time.Time
 	LastUsedIP string `gorm:"type:varchar(45)"`
+	// AllowedModels 为逗号分隔的模型模式（支持 * / ? 通配），为空表示沿用所属用户的模型权限。
+	AllowedModels string `gorm:"type:varchar(1024)"`
 	Basic
 }
 
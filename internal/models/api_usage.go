@@ -7,23 +7,31 @@ import (
 )
 
 type APIUsage struct {
-	UsageID       int64     `gorm:"primarykey"`
-	CompletionID  string    // 对话ID
-	UserID        int64     `gorm:"index"` // 用户ID
-	APIKeyID      *int64    `gorm:"index"` // API Key ID（可空）
-	AuthType      string    // jwt / api_key
-	Endpoint      string    // 调用的端点（如 /v1/chat/completions）
-	Model         string    // 使用的模型名称
-	RequestMethod string    // HTTP 方法
-	StatusCode    int       // 响应状态码
-	InputTokens   int       // 输入 Token 数（如果有）
-	OutputTokens  int       // 输出 Token 数（如果有）
-	TotalTokens   int       // 总 Token 数
-	LatencyMs     int       // 请求延迟（毫秒）
-	RequestSize   int       // 请求体大小（字节）
-	ResponseSize  int       // 响应体大小（字节）
-	ErrorMsg      string    // 错误信息（成功为空）
-	CreatedAt     time.Time `gorm:"index"`
+	UsageID        int64     `gorm:"primarykey"`
+	CompletionID   string    // 对话ID
+	UserID         int64     `gorm:"index"` // 用户ID
+	APIKeyID       *int64    `gorm:"index"` // API Key ID（可空）
+	AuthType       string    // jwt / api_key
+	Endpoint       string    // 调用的端点（如 /v1/chat/completions）
+	Model          string    // 使用的模型名称
+	RequestMethod  string    // HTTP 方法
+	StatusCode     int       // 响应状态码
+	InputTokens    int       // 输入 Token 数（如果有）
+	OutputTokens   int       // 输出 Token 数（如果有）
+	TotalTokens    int       // 总 Token 数
+	UsageEstimated bool      // Token 数由网关估算（上游未返回 usage）
+	LatencyMs      int       // 请求延迟（毫秒）
+	RequestSize    int       // 请求体大小（字节）
+	ResponseSize   int       // 响应体大小（字节）
+	ErrorMsg       string    // 错误信息（成功为空）
+	Upstream       string    // 实际转发的上游名称
+	Attempt        int       // 第几次上游尝试（从 1 开始，最终记录即总尝试次数）
+	AttemptFailed  bool      `gorm:"index"` // 是否为被重试掉的失败尝试（不计入用量统计）
+	CacheHit       bool      // 是否命中网关响应缓存（未请求上游）
+	Coalesced      bool      // 是否与相同在途请求合并，共享其他请求的上游响应
+	QueueDepth     int       // 进入准入队列时前面排队的请求数（未排队为 0）
+	QueueWaitMs    int       // 在准入队列中的累计等待时间（毫秒）
+	CreatedAt      time.Time `gorm:"index"`
 	Basic
 }
 
@@ -39,7 +47,9 @@ func CreateAPIUsage(usage *APIUsage) error {
 // 查询用户的用量统计（按天）
 func GetUserDailyUsage(userID int64, date string) ([]*APIUsage, error) {
 	var usages []*APIUsage
-	result := utils.DB.Where("user_id = ? AND DATE(created_at) = ?", userID, date).Find(&usages)
+	result := utils.DB.
+		Where("user_id = ? AND DATE(created_at) = ? AND attempt_failed = ?", userID, date, false).
+		Find(&usages)
 	return usages, result.Error
 }
 
@@ -56,7 +66,7 @@ func GetUserTotalUsage(userID int64) (map[string]interface{}, error) {
 	var stat UsageStat
 	err := utils.DB.
 		Model(&APIUsage{}).
-		Where("user_id = ?", userID).
+		Where("user_id = ? AND attempt_failed = ?", userID, false).
 		Select(
 			"COUNT(*) as total_requests",
 			"SUM(CASE WHEN status_code >= 200 AND status_code < 300 THEN 1 ELSE 0 END) as success_count",
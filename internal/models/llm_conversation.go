@@ -2,6 +2,7 @@ package models
 
 import (
 	"errors"
+	"slices"
 	"strings"
 	"time"
 
@@ -9,14 +10,29 @@ import (
 	"gorm.io/gorm"
 )
 
+// MaxLLMConversationTitleRunes 是会话标题的最大字符数，默认标题、自动生成、手动重命名与导入的标题共用。
+const MaxLLMConversationTitleRunes = 100
+
 type LLMConversation struct {
-	ConversationID     int64     `gorm:"primarykey"`
-	UserID             int64     `gorm:"index"`
-	Title              string    // 会话标题（默认截取首条 user 消息）
+	ConversationID int64 `gorm:"primarykey"`
+	UserID         int64 `gorm:"index"`
+	// Title 为会话标题（默认截取首条 user 消息，开启自动标题后由模型生成）；MySQL 下由 MigrateLLMConversationFulltextIndexes 建 ngram 全文索引供会话搜索使用。
+	Title              string    `gorm:"size:191"`
+	TitleManual        bool      // 标题是否由用户手动设置，手动设置后不再被自动标题覆盖
 	Model              string    // 最近一次使用的模型
 	MessageCount       int       // 会话总消息数（user/system/assistant）
 	LastMessagePreview string    // 最近一条消息预览
 	LastMessageAt      time.Time `gorm:"index"`
+	// ActiveMessageID 为当前分支的叶子消息，续聊未指定 parent_message_id 时接在其后；0 表示还没有 user/assistant 消息。
+	ActiveMessageID int64
+	Pinned          bool       `gorm:"index"` // 置顶的会话在列表中排在最前
+	PinnedAt        *time.Time // 置顶时间，多个置顶会话按置顶时间倒序
+	Archived        bool       `gorm:"index"` // 归档的会话默认不出现在列表中
+	ArchivedAt      *time.Time
+	// Tags 为逗号分隔的标签，首尾各带一个逗号（如 ",工作,Go,"），便于用 LIKE 精确匹配单个标签。
+	Tags string `gorm:"type:varchar(1024)"`
+	// Settings 为会话级设置，续聊请求未传对应参数时使用；system 提示词仍保存为会话中唯一的 system 消息。
+	Settings LLMConversationSettings `gorm:"embedded;embeddedPrefix:setting_"`
 	Basic
 }
 
@@ -24,14 +40,29 @@ func (c *LLMConversation) TableName() string {
 	return "llm_conversation"
 }
 
+// LLMConversationSettings 是会话保存的默认请求参数，空字符串 / nil 表示未设置。
+type LLMConversationSettings struct {
+	Model       string // 默认模型（可以是别名，续聊时与请求中的模型一样解析）
+	Temperature *float64
+	TopP        *float64
+	MaxTokens   *int64
+	// HistoryTokenBudget 覆盖按模型计算的历史拼接 token 预算。
+	HistoryTokenBudget *int64
+}
+
 type LLMConversationMessage struct {
-	MessageID      int64  `gorm:"primarykey"`
-	ConversationID int64  `gorm:"index"`
-	UserID         int64  `gorm:"index"`
-	Role           string // system/user/assistant
-	Content        string `gorm:"type:longtext"` // 文本内容（便于直接展示）
-	MessageJSON    string `gorm:"type:longtext"` // 原始消息JSON（便于还原转发）
-	Model          string
+	MessageID      int64 `gorm:"primarykey"`
+	ConversationID int64 `gorm:"index"`
+	UserID         int64 `gorm:"index"`
+	// ParentMessageID 为同一分支上的上一条 user/assistant 消息，0 为根；system 与摘要不在消息树中，始终为 0。
+	ParentMessageID int64  `gorm:"index"`
+	Role            string // system/user/assistant/summary
+	// Content 为文本内容（便于直接展示）；MySQL 下带 ngram 全文索引供会话搜索使用。
+	Content     string `gorm:"type:longtext"`
+	MessageJSON string `gorm:"type:longtext"` // 原始消息JSON（便于还原转发）
+	Model       string
+	// SummaryUntilMessageID 只用于摘要消息：摘要覆盖到的最后一条消息，覆盖位置在哪条分支的路径上，摘要就属于哪条分支。
+	SummaryUntilMessageID int64
 	Basic
 }
 
@@ -39,6 +70,10 @@ func (m *LLMConversationMessage) TableName() string {
 	return "llm_conversation_message"
 }
 
+// LLMConversationRoleSummary 是滚动摘要消息的角色：按覆盖位置区分分支，一条分支最多使用一条，不计入会话消息数，
+// 续聊时以 system 消息的形式注入，不会原样发给上游。
+const LLMConversationRoleSummary = "summary"
+
 func CreateLLMConversation(conversation *LLMConversation) error {
 	return utils.DB.Create(conversation).Error
 }
@@ -65,20 +100,42 @@ func ConversationBelongsToUser(conversationID int64, userID int64) (bool, error)
 	return count > 0, err
 }
 
+// LLMConversationFilter 是会话列表的筛选与排序条件。
+type LLMConversationFilter struct {
+	Archived    *bool    // nil 表示不按归档状态筛选
+	Tags        []string // 需同时带有全部标签
+	PinnedFirst bool     // 置顶会话排在最前
+}
+
+func (f LLMConversationFilter) apply(db *gorm.DB) *gorm.DB {
+	if f.Archived != nil {
+		db = db.Where("archived = ?", *f.Archived)
+	}
+	for _, tag := range f.Tags {
+		db = db.Where("tags LIKE ?", "%,"+escapeLike(tag)+",%")
+	}
+	return db
+}
+
 // CountLLMConversationsByUser + ListLLMConversationsByUser 组成分页查询。
-func CountLLMConversationsByUser(userID int64) (int64, error) {
+func CountLLMConversationsByUser(userID int64, filter LLMConversationFilter) (int64, error) {
 	var count int64
-	err := utils.DB.
+	err := filter.apply(utils.DB.
 		Model(&LLMConversation{}).
-		Where("user_id = ?", userID).
+		Where("user_id = ?", userID)).
 		Count(&count).Error
 	return count, err
 }
 
-func ListLLMConversationsByUser(userID int64, offset int, limit int) ([]*LLMConversation, error) {
+func ListLLMConversationsByUser(userID int64, filter LLMConversationFilter, offset int, limit int) ([]*LLMConversation, error) {
 	var list []*LLMConversation
-	err := utils.DB.
-		Where("user_id = ?", userID).
+	db := filter.apply(utils.DB.Where("user_id = ?", userID))
+	if filter.PinnedFirst {
+		db = db.
+			Order("pinned DESC").
+			Order("pinned_at DESC")
+	}
+	err := db.
 		Order("last_message_at DESC").
 		Order("conversation_id DESC").
 		Offset(offset).
@@ -87,6 +144,59 @@ func ListLLMConversationsByUser(userID int64, offset int, limit int) ([]*LLMConv
 	return list, err
 }
 
+// ListLLMConversationsByUserAfterID 按 conversation_id 升序返回用户 afterID 之后的会话（含归档），
+// 用于批量导出按主键游标分页，不受续聊改变 last_message_at 排序的影响。
+func ListLLMConversationsByUserAfterID(userID int64, afterID int64, limit int) ([]*LLMConversation, error) {
+	var list []*LLMConversation
+	err := utils.DB.
+		Where("user_id = ? AND conversation_id > ?", userID, afterID).
+		Order("conversation_id ASC").
+		Limit(limit).
+		Find(&list).Error
+	return list, err
+}
+
+// UpdateLLMConversation 按用户隔离更新会话的可编辑字段（标题、置顶、归档、标签等）。
+func UpdateLLMConversation(conversationID int64, userID int64, updates map[string]interface{}) error {
+	return utils.DB.
+		Model(&LLMConversation{}).
+		Where("conversation_id = ? AND user_id = ?", conversationID, userID).
+		Updates(updates).Error
+}
+
+// JoinLLMConversationTags 把标签编码为 Tags 列的存储格式，没有标签时为空字符串。
+func JoinLLMConversationTags(tags []string) string {
+	if len(tags) == 0 {
+		return ""
+	}
+	return "," + strings.Join(tags, ",") + ","
+}
+
+// SplitLLMConversationTags 把 Tags 列解码为标签列表。
+func SplitLLMConversationTags(tags string) []string {
+	out := []string{}
+	for _, tag := range strings.Split(tags, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			out = append(out, tag)
+		}
+	}
+	return out
+}
+
+// escapeLike 转义 LIKE 模式中的通配符，使其按字面匹配。
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+// UpdateLLMConversationGeneratedTitle 写入模型生成的标题；用户已手动设置标题时不覆盖，返回 false。
+func UpdateLLMConversationGeneratedTitle(conversationID int64, title string) (bool, error) {
+	result := utils.DB.
+		Model(&LLMConversation{}).
+		Where("conversation_id = ? AND title_manual = ?", conversationID, false).
+		Update("title", title)
+	return result.RowsAffected > 0, result.Error
+}
+
 func CreateLLMConversationMessages(messages []*LLMConversationMessage) error {
 	if len(messages) == 0 {
 		return nil
@@ -94,7 +204,7 @@ func CreateLLMConversationMessages(messages []*LLMConversationMessage) error {
 	return utils.DB.Create(messages).Error
 }
 
-// DeleteLLMConversationByIDAndUser 软删除会话与其消息（按用户隔离）。
+// DeleteLLMConversationByIDAndUser 软删除会话、其消息与 /v1/responses 保存的响应（按用户隔离）。
 func DeleteLLMConversationByIDAndUser(conversationID int64, userID int64) (int64, error) {
 	tx := utils.DB.Begin()
 	if tx.Error != nil {
@@ -123,6 +233,13 @@ func DeleteLLMConversationByIDAndUser(conversationID int64, userID int64) (int64
 		return rollback(err)
 	}
 
+	// 会话删除后 /v1/responses 保存的响应也不能再被读取或用作 previous_response_id。
+	if err := tx.
+		Where("conversation_id = ? AND user_id = ?", conversationID, userID).
+		Delete(&LLMResponse{}).Error; err != nil {
+		return rollback(err)
+	}
+
 	if err := tx.Commit().Error; err != nil {
 		return 0, err
 	}
@@ -220,8 +337,8 @@ func ListLLMConversationMessages(conversationID int64, offset int, limit int) ([
 	var list []*LLMConversationMessage
 	err := utils.DB.
 		Where("conversation_id = ?", conversationID).
-		// system 固定置顶，其他消息按时间顺序展示。
-		Order("CASE WHEN role = 'system' THEN 0 ELSE 1 END ASC").
+		// system 固定置顶，摘要紧随其后，其他消息按时间顺序展示。
+		Order("CASE WHEN role = 'system' THEN 0 WHEN role = 'summary' THEN 1 ELSE 2 END ASC").
 		Order("created_at ASC").
 		Order("message_id ASC").
 		Offset(offset).
@@ -230,6 +347,35 @@ func ListLLMConversationMessages(conversationID int64, offset int, limit int) ([
 	return list, err
 }
 
+// ImportLLMConversation 在一个事务中创建会话及其消息（消息需已按时间顺序设置 CreatedAt），然后刷新会话统计。
+func ImportLLMConversation(conversation *LLMConversation, messages []*LLMConversationMessage) error {
+	tx := utils.DB.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	if err := tx.Create(conversation).Error; err != nil {
+		_ = tx.Rollback().Error
+		return err
+	}
+	if len(messages) > 0 {
+		if err := tx.CreateInBatches(messages, 500).Error; err != nil {
+			_ = tx.Rollback().Error
+			return err
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	return RefreshLLMConversationStats(conversation.ConversationID, conversation.Model)
+}
+
+// DeleteLLMConversationSystemMessage 删除会话的 system 消息（按用户隔离），之后续聊不再带 system。
+func DeleteLLMConversationSystemMessage(conversationID int64, userID int64) error {
+	return utils.DB.
+		Where("conversation_id = ? AND user_id = ? AND role = ?", conversationID, userID, "system").
+		Delete(&LLMConversationMessage{}).Error
+}
+
 // GetLLMConversationSystemMessage 返回会话中的 system 消息（若不存在返回 nil, nil）。
 func GetLLMConversationSystemMessage(conversationID int64) (*LLMConversationMessage, error) {
 	var msg LLMConversationMessage
@@ -247,35 +393,120 @@ func GetLLMConversationSystemMessage(conversationID int64) (*LLMConversationMess
 	return &msg, nil
 }
 
-// GetRecentLLMConversationMessagesWithoutSystem 仅查询非 system 历史消息。
-// 会按时间正序返回，供续聊拼接上下文。
-func GetRecentLLMConversationMessagesWithoutSystem(conversationID int64, limit int) ([]*LLMConversationMessage, error) {
-	var list []*LLMConversationMessage
-	db := utils.DB.
-		Where("conversation_id = ? AND role <> ?", conversationID, "system").
-		Order("created_at DESC").
-		Order("message_id DESC")
-	if limit > 0 {
-		db = db.Limit(limit)
+// GetLLMConversationBranchSummary 返回覆盖位置在 path（从根到叶子的消息ID）上、覆盖最多的摘要，没有时返回 nil, nil。
+func GetLLMConversationBranchSummary(conversationID int64, path []int64) (*LLMConversationMessage, error) {
+	if len(path) == 0 {
+		return nil, nil
 	}
-	if err := db.Find(&list).Error; err != nil {
+	var list []*LLMConversationMessage
+	if err := utils.DB.
+		Where("conversation_id = ? AND role = ? AND summary_until_message_id IN ?", conversationID, LLMConversationRoleSummary, path).
+		Find(&list).Error; err != nil {
 		return nil, err
 	}
-	// 查询时按倒序拿最新 limit 条，这里反转成时间正序方便拼接上下文。
-	reverseMessages(list)
-	return list, nil
+	var best *LLMConversationMessage
+	bestIndex := -1
+	for _, summary := range list {
+		if i := slices.Index(path, summary.SummaryUntilMessageID); i > bestIndex {
+			best, bestIndex = summary, i
+		}
+	}
+	return best, nil
+}
+
+// SaveLLMConversationSummary 为 untilID 所在的分支写入覆盖到 untilID 的摘要，prevUntilID 为本次增量所基于的摘要覆盖位置（0 表示从头生成）。
+// 基于的摘要已被删除或同一位置已有摘要时放弃本次写入，返回 false。
+// 基于的摘要在 prevUntilID 之后没有分出其他分支时被新摘要取代并删除，否则保留给其他分支继续使用。
+func SaveLLMConversationSummary(conversationID int64, userID int64, model string, content string, prevUntilID int64, untilID int64) (bool, error) {
+	tree, err := LoadLLMConversationTree(conversationID)
+	if err != nil {
+		return false, err
+	}
+	dropPrevious := prevUntilID > 0 && !tree.HasBranchAfter(prevUntilID, untilID)
+
+	tx := utils.DB.Begin()
+	if tx.Error != nil {
+		return false, tx.Error
+	}
+
+	rollback := func(err error) (bool, error) {
+		_ = tx.Rollback().Error
+		return false, err
+	}
+	countAt := func(until int64) (int64, error) {
+		var count int64
+		err := tx.Model(&LLMConversationMessage{}).
+			Where("conversation_id = ? AND role = ? AND summary_until_message_id = ?", conversationID, LLMConversationRoleSummary, until).
+			Count(&count).Error
+		return count, err
+	}
+
+	existing, err := countAt(untilID)
+	if err != nil {
+		return rollback(err)
+	}
+	if existing > 0 {
+		return rollback(nil)
+	}
+	if prevUntilID > 0 {
+		previous, err := countAt(prevUntilID)
+		if err != nil {
+			return rollback(err)
+		}
+		if previous == 0 {
+			return rollback(nil)
+		}
+	}
+
+	summary := &LLMConversationMessage{
+		MessageID:             utils.GenerateID(),
+		ConversationID:        conversationID,
+		UserID:                userID,
+		Role:                  LLMConversationRoleSummary,
+		Content:               content,
+		Model:                 strings.TrimSpace(model),
+		SummaryUntilMessageID: untilID,
+	}
+	if err := tx.Create(summary).Error; err != nil {
+		return rollback(err)
+	}
+	if dropPrevious {
+		if err := tx.
+			Where("conversation_id = ? AND role = ? AND summary_until_message_id = ?", conversationID, LLMConversationRoleSummary, prevUntilID).
+			Delete(&LLMConversationMessage{}).Error; err != nil {
+			return rollback(err)
+		}
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// DeleteLLMConversationSummary 删除会话全部分支的摘要，之后续聊重新拼接完整历史（按用户隔离）。
+func DeleteLLMConversationSummary(conversationID int64, userID int64) (int64, error) {
+	result := utils.DB.
+		Where("conversation_id = ? AND user_id = ? AND role = ?", conversationID, userID, LLMConversationRoleSummary).
+		Delete(&LLMConversationMessage{})
+	return result.RowsAffected, result.Error
 }
 
 // RefreshLLMConversationStats 在每次写消息后刷新会话统计与预览字段。
+// 摘要消息不计入消息数，也不作为最近消息预览。
 func RefreshLLMConversationStats(conversationID int64, model string) error {
-	count, err := CountLLMConversationMessages(conversationID)
+	var count int64
+	err := utils.DB.
+		Model(&LLMConversationMessage{}).
+		Where("conversation_id = ? AND role <> ?", conversationID, LLMConversationRoleSummary).
+		Count(&count).Error
 	if err != nil {
 		return err
 	}
 
 	var last LLMConversationMessage
 	err = utils.DB.
-		Where("conversation_id = ?", conversationID).
+		Where("conversation_id = ? AND role <> ?", conversationID, LLMConversationRoleSummary).
 		Order("created_at DESC").
 		Order("message_id DESC").
 		First(&last).Error
@@ -299,12 +530,6 @@ func RefreshLLMConversationStats(conversationID int64, model string) error {
 		Updates(updates).Error
 }
 
-func reverseMessages(messages []*LLMConversationMessage) {
-	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
-		messages[i], messages[j] = messages[j], messages[i]
-	}
-}
-
 // truncateRunes 按字符截断，避免中文被按字节切坏。
 func truncateRunes(s string, limit int) string {
 	if limit <= 0 {
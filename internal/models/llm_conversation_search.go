@@ -0,0 +1,125 @@
+package models
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"github.com/nanami9426/imgo/internal/utils"
+	"gorm.io/gorm"
+)
+
+// ngramTokenSize 与 MySQL 默认的 ngram_token_size 一致：短于该长度的关键词无法命中 ngram 全文索引，改用 LIKE。
+const ngramTokenSize = 2
+
+// llmConversationFulltextIndexes 是会话搜索使用的 ngram 全文索引：表、索引名与列。
+var llmConversationFulltextIndexes = []struct {
+	model  interface{}
+	table  string
+	name   string
+	column string
+}{
+	{&LLMConversation{}, "llm_conversation", "idx_llm_conversation_title_fulltext", "title"},
+	{&LLMConversationMessage{}, "llm_conversation_message", "idx_llm_conversation_message_content_fulltext", "content"},
+}
+
+// MigrateLLMConversationFulltextIndexes 在 AutoMigrate 之后为会话标题与消息内容创建 FULLTEXT（ngram）索引。
+// 全文索引是 MySQL 专有的 DDL，不写在结构体 tag 中；其他驱动直接跳过，搜索退化为 LIKE。
+func MigrateLLMConversationFulltextIndexes(db *gorm.DB) error {
+	if db.Dialector.Name() != "mysql" {
+		return nil
+	}
+	for _, idx := range llmConversationFulltextIndexes {
+		if db.Migrator().HasIndex(idx.model, idx.name) {
+			continue
+		}
+		if err := db.Exec("CREATE FULLTEXT INDEX " + idx.name + " ON " + idx.table + " (" + idx.column + ") WITH PARSER ngram").Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LLMConversationSearch 是会话全文搜索的关键词，多个关键词需同时命中（同一标题或同一条消息）。
+type LLMConversationSearch struct {
+	Terms []string
+}
+
+// useFulltext 判断是否走 MySQL FULLTEXT（ngram）：其他驱动或存在过短的关键词时退化为 LIKE。
+func (s LLMConversationSearch) useFulltext() bool {
+	if utils.DB.Dialector.Name() != "mysql" {
+		return false
+	}
+	for _, term := range s.Terms {
+		if utf8.RuneCountInString(term) < ngramTokenSize {
+			return false
+		}
+	}
+	return true
+}
+
+// against 把关键词转为 BOOLEAN MODE 查询：每个关键词作为必须命中的短语，去掉会破坏语法的双引号。
+func (s LLMConversationSearch) against() string {
+	parts := make([]string, 0, len(s.Terms))
+	for _, term := range s.Terms {
+		parts = append(parts, `+"`+strings.ReplaceAll(term, `"`, " ")+`"`)
+	}
+	return strings.Join(parts, " ")
+}
+
+// match 为 column 增加关键词条件。
+func (s LLMConversationSearch) match(db *gorm.DB, column string) *gorm.DB {
+	if s.useFulltext() {
+		return db.Where("MATCH("+column+") AGAINST (? IN BOOLEAN MODE)", s.against())
+	}
+	for _, term := range s.Terms {
+		db = db.Where(column+" LIKE ?", "%"+escapeLike(term)+"%")
+	}
+	return db
+}
+
+// matchingMessages 返回用户消息中命中关键词的 user/assistant 消息查询。
+func (s LLMConversationSearch) matchingMessages(userID int64) *gorm.DB {
+	return s.match(utils.DB.
+		Model(&LLMConversationMessage{}).
+		Where("user_id = ? AND role IN ?", userID, []string{"user", "assistant"}), "content")
+}
+
+// conversations 返回标题或任一消息命中关键词的会话查询。
+func (s LLMConversationSearch) conversations(userID int64) *gorm.DB {
+	titleMatch := s.match(utils.DB, "title")
+	messageMatch := s.matchingMessages(userID).Select("conversation_id")
+	return utils.DB.
+		Model(&LLMConversation{}).
+		Where("user_id = ?", userID).
+		Where(titleMatch.Or("conversation_id IN (?)", messageMatch))
+}
+
+// CountLLMConversationsBySearch + SearchLLMConversations 组成会话搜索的分页查询，结果按最近消息时间倒序。
+func CountLLMConversationsBySearch(userID int64, search LLMConversationSearch) (int64, error) {
+	var count int64
+	err := search.conversations(userID).Count(&count).Error
+	return count, err
+}
+
+func SearchLLMConversations(userID int64, search LLMConversationSearch, offset int, limit int) ([]*LLMConversation, error) {
+	var list []*LLMConversation
+	err := search.conversations(userID).
+		Order("last_message_at DESC").
+		Order("conversation_id DESC").
+		Offset(offset).
+		Limit(limit).
+		Find(&list).Error
+	return list, err
+}
+
+// ListLLMConversationMessagesBySearch 返回会话中命中关键词的消息（按时间正序），最多 limit 条。
+func ListLLMConversationMessagesBySearch(userID int64, conversationID int64, search LLMConversationSearch, limit int) ([]*LLMConversationMessage, error) {
+	var list []*LLMConversationMessage
+	err := search.matchingMessages(userID).
+		Where("conversation_id = ?", conversationID).
+		Order("created_at ASC").
+		Order("message_id ASC").
+		Limit(limit).
+		Find(&list).Error
+	return list, err
+}
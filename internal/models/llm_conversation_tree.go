@@ -0,0 +1,251 @@
+package models
+
+import (
+	"slices"
+
+	"github.com/nanami9426/imgo/internal/utils"
+)
+
+// llmConversationTreeRoles 是参与消息树的角色：system 与摘要属于整个会话，不挂在任何分支上。
+var llmConversationTreeRoles = []string{"user", "assistant"}
+
+// LLMConversationTree 是会话中 user/assistant 消息的父子关系，只包含ID与角色，用于计算分支路径。
+type LLMConversationTree struct {
+	parents  map[int64]int64
+	roles    map[int64]string
+	children map[int64][]int64 // 子消息按创建时间正序，0 为根
+}
+
+// LoadLLMConversationTree 读取会话的消息树（不含消息内容）。
+func LoadLLMConversationTree(conversationID int64) (*LLMConversationTree, error) {
+	var list []*LLMConversationMessage
+	if err := utils.DB.
+		Select("message_id", "parent_message_id", "role").
+		Where("conversation_id = ? AND role IN ?", conversationID, llmConversationTreeRoles).
+		Order("created_at ASC").
+		Order("message_id ASC").
+		Find(&list).Error; err != nil {
+		return nil, err
+	}
+	tree := &LLMConversationTree{
+		parents:  make(map[int64]int64, len(list)),
+		roles:    make(map[int64]string, len(list)),
+		children: make(map[int64][]int64, len(list)),
+	}
+	for _, msg := range list {
+		tree.parents[msg.MessageID] = msg.ParentMessageID
+		tree.roles[msg.MessageID] = msg.Role
+		tree.children[msg.ParentMessageID] = append(tree.children[msg.ParentMessageID], msg.MessageID)
+	}
+	return tree, nil
+}
+
+// Contains 判断 messageID 是否为树中的 user/assistant 消息。
+func (t *LLMConversationTree) Contains(messageID int64) bool {
+	_, ok := t.parents[messageID]
+	return ok
+}
+
+// Role 返回消息的角色，不在树中时为空。
+func (t *LLMConversationTree) Role(messageID int64) string {
+	return t.roles[messageID]
+}
+
+// Path 返回从根到 leafID（含）的消息ID；leafID 为 0 或不在树中时返回空。
+func (t *LLMConversationTree) Path(leafID int64) []int64 {
+	var path []int64
+	seen := map[int64]struct{}{}
+	for id := leafID; id != 0; id = t.parents[id] {
+		if !t.Contains(id) {
+			break
+		}
+		if _, loop := seen[id]; loop {
+			break
+		}
+		seen[id] = struct{}{}
+		path = append(path, id)
+	}
+	reverseIDs(path)
+	return path
+}
+
+// Siblings 返回与 messageID 同一父消息的全部消息（含自身，按创建时间正序）。
+func (t *LLMConversationTree) Siblings(messageID int64) []int64 {
+	return t.children[t.parents[messageID]]
+}
+
+// HasBranchAfter 判断 ancestorID 之后（到 descendantID 为止的路径上）是否分出了其他分支，即路径上是否有消息存在兄弟消息；
+// ancestorID 不在 descendantID 的路径上时无法判断，按存在分支处理。
+func (t *LLMConversationTree) HasBranchAfter(ancestorID int64, descendantID int64) bool {
+	path := t.Path(descendantID)
+	i := slices.Index(path, ancestorID)
+	if i < 0 {
+		return true
+	}
+	for _, id := range path[i+1:] {
+		if len(t.Siblings(id)) > 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// LatestLeaf 从 messageID 开始沿最新的子消息向下，返回所在分支的叶子。
+func (t *LLMConversationTree) LatestLeaf(messageID int64) int64 {
+	seen := map[int64]struct{}{}
+	for {
+		children := t.children[messageID]
+		if len(children) == 0 {
+			return messageID
+		}
+		if _, loop := seen[messageID]; loop {
+			return messageID
+		}
+		seen[messageID] = struct{}{}
+		messageID = children[len(children)-1]
+	}
+}
+
+// EnsureLLMConversationActiveMessage 返回会话当前分支的叶子消息。
+// 引入消息树之前的会话没有 parent_message_id，首次访问时按时间顺序把消息串成一条分支，并把最后一条设为当前叶子。
+func EnsureLLMConversationActiveMessage(conversation *LLMConversation) (int64, error) {
+	if conversation.ActiveMessageID > 0 {
+		return conversation.ActiveMessageID, nil
+	}
+	var list []*LLMConversationMessage
+	if err := utils.DB.
+		Select("message_id", "parent_message_id").
+		Where("conversation_id = ? AND role IN ?", conversation.ConversationID, llmConversationTreeRoles).
+		Order("created_at ASC").
+		Order("message_id ASC").
+		Find(&list).Error; err != nil {
+		return 0, err
+	}
+	if len(list) == 0 {
+		return 0, nil
+	}
+
+	tx := utils.DB.Begin()
+	if tx.Error != nil {
+		return 0, tx.Error
+	}
+	var parentID int64
+	for _, msg := range list {
+		if msg.ParentMessageID != parentID {
+			if err := tx.Model(&LLMConversationMessage{}).
+				Where("message_id = ?", msg.MessageID).
+				Update("parent_message_id", parentID).Error; err != nil {
+				_ = tx.Rollback().Error
+				return 0, err
+			}
+		}
+		parentID = msg.MessageID
+	}
+	if err := tx.Model(&LLMConversation{}).
+		Where("conversation_id = ? AND active_message_id = ?", conversation.ConversationID, 0).
+		Update("active_message_id", parentID).Error; err != nil {
+		_ = tx.Rollback().Error
+		return 0, err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return 0, err
+	}
+	conversation.ActiveMessageID = list[len(list)-1].MessageID
+	return conversation.ActiveMessageID, nil
+}
+
+// AppendLLMConversationMessages 写入一组消息（ParentMessageID 需已设置），并把会话当前叶子切到最后一条。
+func AppendLLMConversationMessages(conversationID int64, messages []*LLMConversationMessage) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	tx := utils.DB.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	if err := tx.Create(messages).Error; err != nil {
+		_ = tx.Rollback().Error
+		return err
+	}
+	if err := tx.Model(&LLMConversation{}).
+		Where("conversation_id = ?", conversationID).
+		Update("active_message_id", messages[len(messages)-1].MessageID).Error; err != nil {
+		_ = tx.Rollback().Error
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// SetLLMConversationActiveMessage 切换会话当前分支的叶子消息（按用户隔离）。
+func SetLLMConversationActiveMessage(conversationID int64, userID int64, messageID int64) error {
+	return utils.DB.
+		Model(&LLMConversation{}).
+		Where("conversation_id = ? AND user_id = ?", conversationID, userID).
+		Update("active_message_id", messageID).Error
+}
+
+// GetLLMConversationTreeMessage 返回会话中的一条 user/assistant 消息。
+func GetLLMConversationTreeMessage(conversationID int64, messageID int64) (*LLMConversationMessage, error) {
+	var msg LLMConversationMessage
+	err := utils.DB.
+		Where("message_id = ? AND conversation_id = ? AND role IN ?", messageID, conversationID, llmConversationTreeRoles).
+		First(&msg).Error
+	if err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// ListLLMConversationMessagesByIDs 按 ids 的顺序返回会话中的消息，已删除的消息会被跳过。
+func ListLLMConversationMessagesByIDs(conversationID int64, ids []int64) ([]*LLMConversationMessage, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	var list []*LLMConversationMessage
+	if err := utils.DB.
+		Where("conversation_id = ? AND message_id IN ?", conversationID, ids).
+		Find(&list).Error; err != nil {
+		return nil, err
+	}
+	byID := make(map[int64]*LLMConversationMessage, len(list))
+	for _, msg := range list {
+		byID[msg.MessageID] = msg
+	}
+	out := make([]*LLMConversationMessage, 0, len(list))
+	for _, id := range ids {
+		if msg, ok := byID[id]; ok {
+			out = append(out, msg)
+		}
+	}
+	return out, nil
+}
+
+// ListLLMConversationBranchMessages 返回会话当前分支的消息：system（若有）在前，其后为从根到当前叶子的 user/assistant 消息，不含摘要。
+func ListLLMConversationBranchMessages(conversation *LLMConversation) ([]*LLMConversationMessage, error) {
+	activeID, err := EnsureLLMConversationActiveMessage(conversation)
+	if err != nil {
+		return nil, err
+	}
+	tree, err := LoadLLMConversationTree(conversation.ConversationID)
+	if err != nil {
+		return nil, err
+	}
+	branch, err := ListLLMConversationMessagesByIDs(conversation.ConversationID, tree.Path(activeID))
+	if err != nil {
+		return nil, err
+	}
+	system, err := GetLLMConversationSystemMessage(conversation.ConversationID)
+	if err != nil {
+		return nil, err
+	}
+	if system == nil {
+		return branch, nil
+	}
+	return append([]*LLMConversationMessage{system}, branch...), nil
+}
+
+func reverseIDs(ids []int64) {
+	for i, j := 0, len(ids)-1; i < j; i, j = i+1, j-1 {
+		ids[i], ids[j] = ids[j], ids[i]
+	}
+}
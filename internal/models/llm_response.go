@@ -0,0 +1,39 @@
+package models
+
+import (
+	"github.com/nanami9426/imgo/internal/utils"
+)
+
+// LLMResponse 记录 /v1/responses 生成的响应，把 response_id 映射到会话中的一个位置。
+// previous_response_id 续聊时据此找到会话，并以 MessageID 对应的 assistant 消息作为上下文终点。
+type LLMResponse struct {
+	ResponseID         string `gorm:"primarykey;type:varchar(64)"`
+	UserID             int64  `gorm:"index"`
+	ConversationID     int64  `gorm:"index"`
+	MessageID          int64  // 本次响应落库的 assistant 消息（内容为空时为 0）
+	PreviousResponseID string `gorm:"type:varchar(64)"`
+	Model              string
+	Status             string // completed/incomplete/failed
+	ResponseJSON       string `gorm:"type:longtext"` // 返回给客户端的完整 response 对象，用于 GET /v1/responses/{id}
+	Basic
+}
+
+func (r *LLMResponse) TableName() string {
+	return "llm_response"
+}
+
+func CreateLLMResponse(resp *LLMResponse) error {
+	return utils.DB.Create(resp).Error
+}
+
+// GetLLMResponseByIDAndUser 查询响应并做归属校验，不存在时返回 gorm.ErrRecordNotFound。
+func GetLLMResponseByIDAndUser(responseID string, userID int64) (*LLMResponse, error) {
+	var resp LLMResponse
+	err := utils.DB.
+		Where("response_id = ? AND user_id = ?", responseID, userID).
+		First(&resp).Error
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
@@ -0,0 +1,16 @@
+package router
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/nanami9426/imgo/internal/router/middlewares"
+	"github.com/nanami9426/imgo/internal/service"
+)
+
+func RegisterAdminRoutes(r *gin.Engine) {
+	admin := r.Group("/admin")
+	admin.Use(middlewares.AuthMiddleware())
+	admin.Use(middlewares.AdminMiddleware())
+	{
+		admin.GET("/upstreams", service.GetUpstreamPools)
+	}
+}
@@ -19,5 +19,6 @@ func Router() *gin.Engine {
 	RigisterChatRoutes(r)
 	RigisterVLLMRoutes(r)
 	RegisterUsageRoutes(r)
+	RegisterAdminRoutes(r)
 	return r
 }
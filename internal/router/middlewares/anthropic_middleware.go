@@ -0,0 +1,521 @@
+package middlewares
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	chatCompletionsPath   = "/v1/chat/completions"
+	anthropicMessagesPath = "/v1/messages"
+
+	anthropicMessageIDPrefix = "msg_"
+)
+
+// AnthropicMessagesMiddleware 为 POST /v1/messages 提供 Anthropic Messages API 兼容层：
+// 1) 请求体转换为 OpenAI chat/completions 格式，后续鉴权、限流、会话与用量中间件按 chat/completions 处理；
+// 2) 响应（JSON 与 SSE）在写回客户端前转换为 Anthropic 格式，错误统一为 {"type":"error","error":{...}}。
+// 需挂在其余 /v1 中间件之前，才能让其它中间件看到的始终是 OpenAI 格式的请求与响应。
+func AnthropicMessagesMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.Method != http.MethodPost || c.Request.URL.Path != anthropicMessagesPath {
+			c.Next()
+			return
+		}
+
+		rawBody, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			abortAnthropic(c, http.StatusBadRequest, "读取请求体失败")
+			return
+		}
+		req, payload, err := convertAnthropicRequest(rawBody)
+		if err != nil {
+			abortAnthropic(c, http.StatusBadRequest, err.Error())
+			return
+		}
+		body, err := json.Marshal(payload)
+		if err != nil {
+			abortAnthropic(c, http.StatusInternalServerError, "重写请求失败")
+			return
+		}
+		restoreRequestBody(c, body)
+
+		writer := newTranslatedResponseWriter(c.Writer, &anthropicTranslator{stops: req.StopSequences})
+		c.Writer = writer
+		c.Next()
+		writer.finalize()
+	}
+}
+
+type anthropicMessagesRequest struct {
+	Model         string             `json:"model"`
+	System        json.RawMessage    `json:"system"`
+	Messages      []anthropicMessage `json:"messages"`
+	MaxTokens     *json.Number       `json:"max_tokens"`
+	StopSequences []string           `json:"stop_sequences"`
+	Stream        bool               `json:"stream"`
+	Temperature   *json.Number       `json:"temperature"`
+	TopP          *json.Number       `json:"top_p"`
+	TopK          *json.Number       `json:"top_k"`
+	Metadata      *struct {
+		UserID string `json:"user_id"`
+	} `json:"metadata"`
+	// 网关会话扩展字段，原样交给 ChatHistoryMiddleware。
+	ConversationID  json.RawMessage `json:"conversation_id"`
+	NewChat         json.RawMessage `json:"new_chat"`
+	ParentMessageID json.RawMessage `json:"parent_message_id"`
+}
+
+type anthropicMessage struct {
+	Role    string          `json:"role"`
+	Content json.RawMessage `json:"content"`
+}
+
+type anthropicContentBlock struct {
+	Type   string `json:"type"`
+	Text   string `json:"text"`
+	Source *struct {
+		Type      string `json:"type"`
+		MediaType string `json:"media_type"`
+		Data      string `json:"data"`
+		URL       string `json:"url"`
+	} `json:"source"`
+}
+
+// convertAnthropicRequest 把 Messages API 请求转换为 chat/completions 请求。
+// 目前只支持 text 与 image 内容块，tool_use / tool_result 等其余块直接返回 400。
+func convertAnthropicRequest(rawBody []byte) (*anthropicMessagesRequest, map[string]interface{}, error) {
+	req := &anthropicMessagesRequest{}
+	dec := json.NewDecoder(bytes.NewReader(rawBody))
+	dec.UseNumber()
+	if err := dec.Decode(req); err != nil {
+		return nil, nil, errors.New("请求体必须是合法JSON对象")
+	}
+	if strings.TrimSpace(req.Model) == "" {
+		return nil, nil, errors.New("model: field required")
+	}
+	if req.MaxTokens == nil {
+		return nil, nil, errors.New("max_tokens: field required")
+	}
+	if maxTokens, err := req.MaxTokens.Int64(); err != nil || maxTokens <= 0 {
+		return nil, nil, errors.New("max_tokens: must be a positive integer")
+	}
+	if len(req.Messages) == 0 {
+		return nil, nil, errors.New("messages: at least one message is required")
+	}
+
+	messages := make([]map[string]interface{}, 0, len(req.Messages)+1)
+	if len(req.System) > 0 && string(req.System) != "null" {
+		system, err := convertAnthropicSystem(req.System)
+		if err != nil {
+			return nil, nil, err
+		}
+		if system != "" {
+			messages = append(messages, map[string]interface{}{"role": "system", "content": system})
+		}
+	}
+	for i, msg := range req.Messages {
+		if msg.Role != "user" && msg.Role != "assistant" {
+			return nil, nil, fmt.Errorf("messages.%d.role: must be user or assistant", i)
+		}
+		content, err := convertAnthropicContent(msg.Content)
+		if err != nil {
+			return nil, nil, fmt.Errorf("messages.%d.content: %w", i, err)
+		}
+		messages = append(messages, map[string]interface{}{"role": msg.Role, "content": content})
+	}
+
+	payload := map[string]interface{}{
+		"model":      req.Model,
+		"messages":   messages,
+		"max_tokens": *req.MaxTokens,
+	}
+	if len(req.StopSequences) > 0 {
+		payload["stop"] = req.StopSequences
+	}
+	if req.Temperature != nil {
+		payload["temperature"] = *req.Temperature
+	}
+	if req.TopP != nil {
+		payload["top_p"] = *req.TopP
+	}
+	if req.TopK != nil {
+		payload["top_k"] = *req.TopK
+	}
+	if req.Metadata != nil && req.Metadata.UserID != "" {
+		payload["user"] = req.Metadata.UserID
+	}
+	if req.Stream {
+		// Anthropic 流在 message_delta 中返回 output_tokens，需要上游在流末尾给出 usage。
+		payload["stream"] = true
+		payload["stream_options"] = map[string]interface{}{"include_usage": true}
+	}
+	if len(req.ConversationID) > 0 {
+		payload["conversation_id"] = req.ConversationID
+	}
+	if len(req.NewChat) > 0 {
+		payload["new_chat"] = req.NewChat
+	}
+	if len(req.ParentMessageID) > 0 {
+		payload["parent_message_id"] = req.ParentMessageID
+	}
+	return req, payload, nil
+}
+
+// convertAnthropicSystem 支持字符串或 text 块数组两种 system 写法。
+func convertAnthropicSystem(raw json.RawMessage) (string, error) {
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		return text, nil
+	}
+	var blocks []anthropicContentBlock
+	if err := json.Unmarshal(raw, &blocks); err != nil {
+		return "", errors.New("system: must be a string or an array of text blocks")
+	}
+	parts := make([]string, 0, len(blocks))
+	for _, block := range blocks {
+		if block.Type != "text" {
+			return "", fmt.Errorf("system: unsupported content block type: %s", block.Type)
+		}
+		parts = append(parts, block.Text)
+	}
+	return strings.Join(parts, "\n"), nil
+}
+
+// convertAnthropicContent 把消息内容转换为 OpenAI 格式：
+// 纯文本块合并为字符串，含图片时转换为 content parts 数组（会话按原始 JSON 落库，续聊时原样带上图片）。
+func convertAnthropicContent(raw json.RawMessage) (interface{}, error) {
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		return text, nil
+	}
+	var blocks []anthropicContentBlock
+	if err := json.Unmarshal(raw, &blocks); err != nil {
+		return nil, errors.New("must be a string or an array of content blocks")
+	}
+	parts := make([]map[string]interface{}, 0, len(blocks))
+	texts := make([]string, 0, len(blocks))
+	textOnly := true
+	for _, block := range blocks {
+		switch block.Type {
+		case "text":
+			texts = append(texts, block.Text)
+			parts = append(parts, map[string]interface{}{"type": "text", "text": block.Text})
+		case "image":
+			if block.Source == nil {
+				return nil, errors.New("image block requires source")
+			}
+			url := block.Source.URL
+			if block.Source.Type == "base64" {
+				url = "data:" + block.Source.MediaType + ";base64," + block.Source.Data
+			}
+			if url == "" {
+				return nil, fmt.Errorf("unsupported image source type: %s", block.Source.Type)
+			}
+			textOnly = false
+			parts = append(parts, map[string]interface{}{
+				"type":      "image_url",
+				"image_url": map[string]interface{}{"url": url},
+			})
+		default:
+			return nil, fmt.Errorf("unsupported content block type: %s", block.Type)
+		}
+	}
+	if textOnly {
+		return strings.Join(texts, "\n"), nil
+	}
+	return parts, nil
+}
+
+type anthropicUsage struct {
+	InputTokens  int64 `json:"input_tokens"`
+	OutputTokens int64 `json:"output_tokens"`
+}
+
+type anthropicTextBlock struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+type anthropicMessageResponse struct {
+	ID           string               `json:"id"`
+	Type         string               `json:"type"`
+	Role         string               `json:"role"`
+	Model        string               `json:"model"`
+	Content      []anthropicTextBlock `json:"content"`
+	StopReason   *string              `json:"stop_reason"`
+	StopSequence *string              `json:"stop_sequence"`
+	Usage        anthropicUsage       `json:"usage"`
+}
+
+type anthropicErrorBody struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
+type anthropicErrorResponse struct {
+	Type  string             `json:"type"`
+	Error anthropicErrorBody `json:"error"`
+}
+
+type openAIChatUsage struct {
+	PromptTokens     int64 `json:"prompt_tokens"`
+	CompletionTokens int64 `json:"completion_tokens"`
+}
+
+// openAIChatCompletion 同时覆盖非流式响应与流式 chunk。
+// stop_reason 是 vLLM 扩展字段，命中 stop 字符串时为该字符串。
+type openAIChatCompletion struct {
+	ID      string `json:"id"`
+	Model   string `json:"model"`
+	Choices []struct {
+		Message struct {
+			Content string `json:"content"`
+		} `json:"message"`
+		Delta struct {
+			Content string `json:"content"`
+		} `json:"delta"`
+		FinishReason string      `json:"finish_reason"`
+		StopReason   interface{} `json:"stop_reason"`
+	} `json:"choices"`
+	Usage *openAIChatUsage `json:"usage"`
+	Error json.RawMessage  `json:"error"`
+}
+
+func anthropicMessageID(id string) string {
+	if id == "" || strings.HasPrefix(id, anthropicMessageIDPrefix) {
+		return id
+	}
+	return anthropicMessageIDPrefix + strings.TrimPrefix(id, "chatcmpl-")
+}
+
+// anthropicStopReason 把 OpenAI finish_reason 映射为 Anthropic stop_reason，命中 stop_sequences 时返回对应序列。
+func anthropicStopReason(finishReason string, stopReason interface{}, stops []string) (string, *string) {
+	switch finishReason {
+	case "length":
+		return "max_tokens", nil
+	case "tool_calls", "function_call":
+		return "tool_use", nil
+	case "stop":
+		if matched, ok := stopReason.(string); ok {
+			for _, stop := range stops {
+				if stop == matched {
+					return "stop_sequence", &matched
+				}
+			}
+		}
+	}
+	return "end_turn", nil
+}
+
+// convertOpenAIResponse 把非流式 chat/completions 响应转换为 Anthropic message。
+func convertOpenAIResponse(body []byte, stops []string) ([]byte, bool) {
+	var resp openAIChatCompletion
+	if err := json.Unmarshal(body, &resp); err != nil || len(resp.Choices) == 0 {
+		return nil, false
+	}
+	choice := resp.Choices[0]
+	stopReason, stopSequence := anthropicStopReason(choice.FinishReason, choice.StopReason, stops)
+	out := anthropicMessageResponse{
+		ID:           anthropicMessageID(resp.ID),
+		Type:         "message",
+		Role:         "assistant",
+		Model:        resp.Model,
+		Content:      []anthropicTextBlock{{Type: "text", Text: choice.Message.Content}},
+		StopReason:   &stopReason,
+		StopSequence: stopSequence,
+	}
+	if resp.Usage != nil {
+		out.Usage = anthropicUsage{InputTokens: resp.Usage.PromptTokens, OutputTokens: resp.Usage.CompletionTokens}
+	}
+	converted, err := json.Marshal(out)
+	if err != nil {
+		return nil, false
+	}
+	return converted, true
+}
+
+// anthropicErrorType 按 HTTP 状态码给出 Anthropic 错误类型。
+func anthropicErrorType(status int) string {
+	switch {
+	case status == http.StatusUnauthorized:
+		return "authentication_error"
+	case status == http.StatusForbidden:
+		return "permission_error"
+	case status == http.StatusNotFound:
+		return "not_found_error"
+	case status == http.StatusRequestEntityTooLarge:
+		return "request_too_large"
+	case status == http.StatusTooManyRequests:
+		return "rate_limit_error"
+	case status == http.StatusServiceUnavailable || status == 529:
+		return "overloaded_error"
+	case status >= 400 && status < 500:
+		return "invalid_request_error"
+	default:
+		return "api_error"
+	}
+}
+
+// extractErrorMessage 兼容网关 {"success":false,"error":{...}}、OpenAI {"error":{...}} 与 vLLM {"message":...} 三种错误体。
+func extractErrorMessage(body []byte) string {
+	var resp struct {
+		Error   json.RawMessage `json:"error"`
+		Message string          `json:"message"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return ""
+	}
+	if len(resp.Error) > 0 {
+		var obj struct {
+			Message string `json:"message"`
+		}
+		if err := json.Unmarshal(resp.Error, &obj); err == nil && obj.Message != "" {
+			return obj.Message
+		}
+		var text string
+		if err := json.Unmarshal(resp.Error, &text); err == nil && text != "" {
+			return text
+		}
+	}
+	return resp.Message
+}
+
+func buildAnthropicError(status int, message string) []byte {
+	if message == "" {
+		message = http.StatusText(status)
+	}
+	body, _ := json.Marshal(anthropicErrorResponse{
+		Type:  "error",
+		Error: anthropicErrorBody{Type: anthropicErrorType(status), Message: message},
+	})
+	return body
+}
+
+func abortAnthropic(c *gin.Context, status int, message string) {
+	c.Abort()
+	c.Data(status, "application/json", buildAnthropicError(status, message))
+}
+
+// anthropicTranslator 把 chat/completions 响应转换为 Anthropic 格式，流式事件顺序为：
+// message_start -> content_block_start -> content_block_delta* -> content_block_stop -> message_delta -> message_stop。
+type anthropicTranslator struct {
+	stops        []string
+	started      bool
+	finished     bool
+	id           string
+	model        string
+	stopReason   string
+	stopSequence *string
+	usage        anthropicUsage
+}
+
+func writeAnthropicEvent(buf *bytes.Buffer, event string, data interface{}) {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return
+	}
+	writeSSEEvent(buf, event, encoded)
+}
+
+// convertBody 转换非流式响应，错误响应统一转换为 Anthropic 错误格式。
+func (t *anthropicTranslator) convertBody(status int, body []byte) []byte {
+	if status >= http.StatusBadRequest {
+		return buildAnthropicError(status, extractErrorMessage(body))
+	}
+	if converted, ok := convertOpenAIResponse(body, t.stops); ok {
+		return converted
+	}
+	return body
+}
+
+func (t *anthropicTranslator) start(buf *bytes.Buffer) {
+	if t.started {
+		return
+	}
+	t.started = true
+	writeAnthropicEvent(buf, "message_start", gin.H{
+		"type": "message_start",
+		"message": anthropicMessageResponse{
+			ID:      anthropicMessageID(t.id),
+			Type:    "message",
+			Role:    "assistant",
+			Model:   t.model,
+			Content: []anthropicTextBlock{},
+		},
+	})
+	writeAnthropicEvent(buf, "content_block_start", gin.H{
+		"type":          "content_block_start",
+		"index":         0,
+		"content_block": anthropicTextBlock{Type: "text", Text: ""},
+	})
+}
+
+// translateEvent 处理一个 SSE 事件的 data 内容，[DONE] 时输出收尾事件。
+func (t *anthropicTranslator) translateEvent(data []byte, buf *bytes.Buffer) {
+	if t.finished {
+		return
+	}
+	if bytes.Equal(data, []byte("[DONE]")) {
+		t.finishStream(buf)
+		return
+	}
+	var chunk openAIChatCompletion
+	if err := json.Unmarshal(data, &chunk); err != nil {
+		return
+	}
+	if len(chunk.Error) > 0 && string(chunk.Error) != "null" {
+		writeAnthropicEvent(buf, "error", anthropicErrorResponse{
+			Type:  "error",
+			Error: anthropicErrorBody{Type: "api_error", Message: extractErrorMessage(data)},
+		})
+		return
+	}
+	if t.id == "" {
+		t.id = chunk.ID
+	}
+	if t.model == "" {
+		t.model = chunk.Model
+	}
+	t.start(buf)
+	for _, choice := range chunk.Choices {
+		if choice.Delta.Content != "" {
+			writeAnthropicEvent(buf, "content_block_delta", gin.H{
+				"type":  "content_block_delta",
+				"index": 0,
+				"delta": gin.H{"type": "text_delta", "text": choice.Delta.Content},
+			})
+		}
+		if choice.FinishReason != "" {
+			t.stopReason, t.stopSequence = anthropicStopReason(choice.FinishReason, choice.StopReason, t.stops)
+		}
+	}
+	if chunk.Usage != nil {
+		t.usage = anthropicUsage{InputTokens: chunk.Usage.PromptTokens, OutputTokens: chunk.Usage.CompletionTokens}
+	}
+}
+
+func (t *anthropicTranslator) finishStream(buf *bytes.Buffer) {
+	if t.finished {
+		return
+	}
+	t.start(buf)
+	t.finished = true
+	if t.stopReason == "" {
+		t.stopReason = "end_turn"
+	}
+	writeAnthropicEvent(buf, "content_block_stop", gin.H{"type": "content_block_stop", "index": 0})
+	writeAnthropicEvent(buf, "message_delta", gin.H{
+		"type":  "message_delta",
+		"delta": gin.H{"stop_reason": t.stopReason, "stop_sequence": t.stopSequence},
+		"usage": t.usage,
+	})
+	writeAnthropicEvent(buf, "message_stop", gin.H{"type": "message_stop"})
+}
@@ -19,11 +19,15 @@ const (
 	contextKeyAPIKeyID      = "api_key_id"
 	contextKeyPrincipalID   = "principal_id"
 	contextKeyPrincipalType = "principal_type"
+	// contextKeyAPIKeyModels 是 API Key 额外限制的模型模式列表（[]string，为空表示不限制）。
+	contextKeyAPIKeyModels = "api_key_allowed_models"
 
 	authTypeJWT    = "jwt"
 	authTypeAPIKey = "api_key"
 
 	principalTypeAPIKey = "api_key"
+
+	roleAdmin = "admin"
 )
 
 var (
@@ -52,9 +56,25 @@ func AuthMiddleware() gin.HandlerFunc {
 	}
 }
 
+// AdminMiddleware 需挂在 AuthMiddleware 之后，仅允许 JWT 中 role=admin 的用户访问。
+func AdminMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		role, _ := c.Get(contextKeyRole)
+		if s, ok := role.(string); !ok || strings.TrimSpace(s) != roleAdmin {
+			utils.Abort(c, http.StatusForbidden, utils.StatForbidden, "需要管理员权限", nil)
+			return
+		}
+		c.Next()
+	}
+}
+
 func GatewayAuthMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		headerToken := tokenFromAuthorizationHeader(c)
+		if headerToken == "" {
+			// Anthropic SDK 通过 x-api-key 头传递密钥。
+			headerToken = strings.TrimSpace(c.GetHeader("X-Api-Key"))
+		}
 		if strings.HasPrefix(headerToken, "sk_") {
 			if err := authenticateAPIKey(c, headerToken); err != nil {
 				utils.Abort(c, http.StatusUnauthorized, utils.StatUnauthorized, "API Key无效或已过期", err)
@@ -136,6 +156,7 @@ func authenticateAPIKey(c *gin.Context, token string) error {
 	c.Set(contextKeyAPIKeyID, apiKey.APIKeyID)
 	c.Set(contextKeyPrincipalID, apiKey.APIKeyID)
 	c.Set(contextKeyPrincipalType, principalTypeAPIKey)
+	c.Set(contextKeyAPIKeyModels, utils.ParseModelPatterns(apiKey.AllowedModels))
 
 	if err := touchAPIKeyUsageFn(apiKey.APIKeyID, now, c.ClientIP()); err != nil {
 		utils.Log.Errorf("failed to update api key last used: api_key_id=%d err=%v", apiKey.APIKeyID, err)
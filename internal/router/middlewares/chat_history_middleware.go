@@ -6,22 +6,33 @@ import (
 	"errors"
 	"io"
 	"net/http"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/nanami9426/imgo/internal/models"
+	"github.com/nanami9426/imgo/internal/tokenizer"
 	"github.com/nanami9426/imgo/internal/utils"
+	"gorm.io/gorm"
 )
 
 const (
 	contextKeyChatCompletionResponseBody = "chat_completion_response_body"
-	responseHeaderConversationID         = "X-Conversation-ID"
+	contextKeyConversationID             = "conversation_id"
+	// contextKeyAssistantMessageID 是本轮落库的 assistant 消息ID，供 /v1/responses 记录响应在会话中的位置。
+	contextKeyAssistantMessageID = "assistant_message_id"
+	responseHeaderConversationID = "X-Conversation-ID"
+	// contextKeyConversationHistory 是 RateLimitMiddleware 估算成本时装配的续聊历史，ChatHistoryMiddleware 直接复用。
+	contextKeyConversationHistory = "conversation_history"
+	// responseHeaderHistoryMessages 是本次请求拼接进上下文的历史消息条数（不含 system 与本轮输入）。
+	responseHeaderHistoryMessages = "X-History-Messages"
 
 	defaultHistoryMaxMessages = 20
 	maxHistoryMaxMessages     = 200
-	maxConversationTitleRunes = 30
+	// defaultConversationTitleRunes 是新会话默认标题截取首条 user 消息的字符数。
+	defaultConversationTitleRunes = 30
 )
 
 type chatMessagePayload struct {
@@ -31,12 +42,14 @@ type chatMessagePayload struct {
 }
 
 // ChatHistoryMiddleware 为 /v1/chat/completions 增加会话能力：
-// 1) 解析并消费 conversation_id/new_chat
-// 2) 续聊时自动拼接历史消息
-// 3) 预写入 user/system 消息，响应后补写 assistant 消息
+// 1) 解析并消费 conversation_id/new_chat/parent_message_id
+// 2) 续聊时用会话设置补齐请求中未传的参数，并自动拼接从根到父消息的分支历史（有滚动摘要时注入摘要）
+// 3) 预写入 user/system 消息，响应后补写 assistant 消息，并按需更新被挤出窗口的历史摘要
+// 4) 新会话的首轮回复落库后按需生成会话标题
+// 5) 重新生成（见 ConversationRegenerateMiddleware）时不重复写入 user，新回复与原回复互为兄弟
 func ChatHistoryMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		if c.Request.Method != http.MethodPost || !shouldLogAPIPath(c.Request.URL.Path) {
+		if c.Request.Method != http.MethodPost || !isChatCompletionPath(c.Request.URL.Path) {
 			c.Next()
 			return
 		}
@@ -60,40 +73,98 @@ func ChatHistoryMiddleware() gin.HandlerFunc {
 			return
 		}
 
-		// 当前请求里 model/messages 是会话持久化和上下文拼接的基础输入。
-		modelName, _ := payload["model"].(string)
-		currentMessages, err := parseRequestMessages(payload)
+		opts, err := consumeConversationOptions(payload)
 		if err != nil {
 			utils.Abort(c, http.StatusBadRequest, utils.StatInvalidParam, err.Error(), nil)
 			return
 		}
+		conversationID := opts.conversationID
+
+		// 有 conversation_id 且没有 new_chat 时认为是续聊。
+		isContinue := opts.hasConversationID && !opts.newChat
+		// 续聊的会话；请求中未传的 model/temperature 等参数先用会话设置补齐，再做模型解析与校验。
+		// 限流中间件按 token 估算成本时已装配过同一会话与父消息的历史，这里直接复用，不再重复查询。
+		var conversation *models.LLMConversation
+		var history *conversationHistory
+		if isContinue {
+			history = cachedConversationHistory(c, userID, opts)
+			if history != nil {
+				conversation = history.conversation
+			} else {
+				conversation, err = models.GetLLMConversationByIDAndUser(conversationID, userID)
+				if err != nil {
+					if errors.Is(err, gorm.ErrRecordNotFound) {
+						utils.Abort(c, http.StatusNotFound, utils.StatNotFound, "会话不存在", nil)
+						return
+					}
+					utils.Abort(c, http.StatusInternalServerError, utils.StatDatabaseError, "查询会话失败", err)
+					return
+				}
+			}
+			applyConversationSettings(payload, conversation.Settings)
+		}
+
+		// 别名在落库前解析为真实模型，会话记录与用量统计都使用真实模型名。
+		// 无权使用的模型在创建会话前拦截，返回与上游一致的 404 model_not_found。
+		modelName := resolvePayloadModelAlias(payload)
+		if modelName != "" && !modelAllowedFromContext(c, userID, modelName) {
+			utils.AbortOpenAI(c, http.StatusNotFound, utils.ModelNotFoundError(modelName))
+			return
+		}
+		// 模型不支持的功能在落库前拦截。
+		if !checkModelFeatures(c, modelName, payload) {
+			return
+		}
 
-		conversationID, hasConversationID, newChat, err := consumeConversationOptions(payload)
+		// 当前请求里 model/messages 是会话持久化和上下文拼接的基础输入。
+		currentMessages, err := parseRequestMessages(payload)
 		if err != nil {
 			utils.Abort(c, http.StatusBadRequest, utils.StatInvalidParam, err.Error(), nil)
 			return
 		}
 
-		// 有 conversation_id 且没有 new_chat 时认为是续聊。
-		isContinue := hasConversationID && !newChat
+		// parentID 是本轮消息在消息树中接在其后的消息，新会话从根开始。
+		var parentID int64
 		if isContinue {
-			belongs, err := models.ConversationBelongsToUser(conversationID, userID)
-			if err != nil {
-				utils.Abort(c, http.StatusInternalServerError, utils.StatDatabaseError, "查询会话失败", err)
+			if err := validateContinueMessages(currentMessages); err != nil {
+				utils.Abort(c, http.StatusBadRequest, utils.StatInvalidParam, err.Error(), nil)
 				return
 			}
-			if !belongs {
-				utils.Abort(c, http.StatusNotFound, utils.StatNotFound, "会话不存在", nil)
+			if history != nil {
+				parentID = history.parentID
+			} else if parentID, err = resolveHistoryParent(conversation, opts.parentMessageID, opts.hasParentMessageID); err != nil {
+				if errors.Is(err, gorm.ErrRecordNotFound) {
+					utils.Abort(c, http.StatusNotFound, utils.StatNotFound, "parent_message_id 对应的消息不存在", nil)
+					return
+				}
+				utils.Abort(c, http.StatusInternalServerError, utils.StatDatabaseError, "查询会话消息失败", err)
 				return
 			}
-			if err := validateContinueMessages(currentMessages); err != nil {
-				utils.Abort(c, http.StatusBadRequest, utils.StatInvalidParam, err.Error(), nil)
+		}
+
+		// 续聊时把数据库历史和本轮输入合并，最终写回给上游模型的 messages。
+		var mergedMessages []map[string]interface{}
+		var historyCount int
+		var cutoff summaryCutoff
+		if history != nil {
+			mergedMessages, historyCount, cutoff = history.messages, history.historyCount, history.cutoff
+		} else {
+			mergedMessages, historyCount, cutoff, err = buildUpstreamMessages(conversationID, parentID, isContinue, currentMessages, conversationHistoryBudget(conversation, modelName, payload))
+			if err != nil {
+				utils.Abort(c, http.StatusInternalServerError, utils.StatDatabaseError, "组装历史消息失败", err)
 				return
 			}
-		} else {
+		}
+		payload["messages"] = messagesToInterfaces(mergedMessages)
+		// 上下文窗口按拼接历史后的最终 messages 检查，被拒绝时还没有任何落库。
+		if !fitContextWindow(c, modelName, payload) {
+			return
+		}
+
+		if !isContinue {
 			// 新会话在第一轮请求前创建，方便后续消息统一挂到 conversation_id。
 			conversationID = utils.GenerateID()
-			conversation := &models.LLMConversation{
+			conversation = &models.LLMConversation{
 				ConversationID: conversationID,
 				UserID:         userID,
 				Title:          buildConversationTitle(currentMessages),
@@ -106,14 +177,6 @@ func ChatHistoryMiddleware() gin.HandlerFunc {
 			}
 		}
 
-		// 续聊时把数据库历史和本轮输入合并，最终写回给上游模型的 messages。
-		mergedMessages, err := buildUpstreamMessages(conversationID, isContinue, currentMessages)
-		if err != nil {
-			utils.Abort(c, http.StatusInternalServerError, utils.StatDatabaseError, "组装历史消息失败", err)
-			return
-		}
-		payload["messages"] = mergedMessages
-
 		rewrittenBody, err := json.Marshal(payload)
 		if err != nil {
 			utils.Abort(c, http.StatusInternalServerError, utils.StatInternalError, "重写请求失败", err)
@@ -124,13 +187,21 @@ func ChatHistoryMiddleware() gin.HandlerFunc {
 		c.Request.Header.Set("Content-Length", strconv.Itoa(len(rewrittenBody)))
 
 		// 通过响应头把会话ID返回前端，便于后续继续聊天。
-		c.Set("conversation_id", conversationID)
+		c.Set(contextKeyConversationID, conversationID)
 		c.Writer.Header().Set(responseHeaderConversationID, strconv.FormatInt(conversationID, 10))
+		c.Writer.Header().Set(responseHeaderHistoryMessages, strconv.Itoa(historyCount))
 
 		// 在转发前先写入本轮 user/system 消息；assistant 需要等待上游响应后再落库。
-		if err := persistCurrentMessages(userID, conversationID, modelName, currentMessages); err != nil {
-			utils.Abort(c, http.StatusInternalServerError, utils.StatDatabaseError, "保存会话消息失败", err)
-			return
+		// 本轮的 user 消息接在 parentID 之后，assistant 再接在最后一条 user 之后。
+		// 重新生成时本轮的 user 就是已保存的那条消息，不再写入，新回复直接接在它之后。
+		if regenerateMessageID, _ := parseInt64ContextKey(c, contextKeyRegenerateMessageID); isContinue && regenerateMessageID > 0 {
+			parentID = regenerateMessageID
+		} else {
+			parentID, err = persistCurrentMessages(userID, conversationID, parentID, modelName, currentMessages)
+			if err != nil {
+				utils.Abort(c, http.StatusInternalServerError, utils.StatDatabaseError, "保存会话消息失败", err)
+				return
+			}
 		}
 		if err := models.RefreshLLMConversationStats(conversationID, modelName); err != nil {
 			utils.Abort(c, http.StatusInternalServerError, utils.StatDatabaseError, "更新会话统计失败", err)
@@ -140,23 +211,40 @@ func ChatHistoryMiddleware() gin.HandlerFunc {
 		c.Next()
 
 		// APILoggingMiddleware 会把响应体放到 context，这里读取后解析 assistant 内容并落库。
+		// 模型以网关实际使用的模型为准（发生降级时与请求模型不同）。
 		responseModel := strings.TrimSpace(modelName)
+		servedModel := strings.TrimSpace(c.GetString(contextKeyServedModel))
+		if servedModel != "" {
+			responseModel = servedModel
+		}
+		assistantSaved := false
 		if responseBody, ok := c.Get(contextKeyChatCompletionResponseBody); ok {
 			if body, ok := responseBody.([]byte); ok && len(body) > 0 {
 				content, parsedModel := extractAssistantContentAndModel(body)
-				if strings.TrimSpace(parsedModel) != "" {
+				if servedModel == "" && strings.TrimSpace(parsedModel) != "" {
 					responseModel = strings.TrimSpace(parsedModel)
 				}
 				if c.Writer.Status() >= 200 && c.Writer.Status() < 300 && strings.TrimSpace(content) != "" {
-					if err := saveAssistantMessage(userID, conversationID, responseModel, content); err != nil {
+					messageID, err := saveAssistantMessage(userID, conversationID, parentID, responseModel, content)
+					if err != nil {
 						utils.Log.Errorf("failed to save assistant message: %v", err)
 						return
 					}
+					c.Set(contextKeyAssistantMessageID, messageID)
+					assistantSaved = true
+					if !isContinue {
+						maybeGenerateConversationTitle(conversationID, responseModel, currentMessages, content)
+					}
 				}
 			}
 		}
 		if err := models.RefreshLLMConversationStats(conversationID, responseModel); err != nil {
 			utils.Log.Errorf("failed to refresh conversation stats: %v", err)
+			return
+		}
+		// 摘要依赖刷新后的会话消息数，只在本轮成功完成时触发。
+		if assistantSaved {
+			maybeSummarizeConversation(conversationID, userID, responseModel, cutoff)
 		}
 	}
 }
@@ -186,6 +274,25 @@ func parseUserIDFromContext(c *gin.Context) (int64, bool) {
 	}
 }
 
+// resolvePayloadModelAlias 把 payload 中的模型别名替换为真实模型，返回替换后的模型名。
+func resolvePayloadModelAlias(payload map[string]interface{}) string {
+	modelName, _ := payload["model"].(string)
+	modelName = strings.TrimSpace(modelName)
+	if modelName == "" {
+		return ""
+	}
+	resolved := utils.ResolveModelAlias(modelName)
+	payload["model"] = resolved
+	return resolved
+}
+
+// modelAllowedFromContext 同时检查用户级模型白名单与 API Key 的模型限制。
+func modelAllowedFromContext(c *gin.Context, userID int64, model string) bool {
+	patterns, _ := c.Get(contextKeyAPIKeyModels)
+	list, _ := patterns.([]string)
+	return utils.ModelAllowed(userID, list, model)
+}
+
 // parseRequestMessages 只接受文本 content，避免把复杂多模态结构直接落库导致脏数据。
 func parseRequestMessages(payload map[string]interface{}) ([]chatMessagePayload, error) {
 	rawMessages, ok := payload["messages"]
@@ -207,13 +314,12 @@ func parseRequestMessages(payload map[string]interface{}) ([]chatMessagePayload,
 		if !ok || strings.TrimSpace(roleRaw) == "" {
 			return nil, errors.New("messages.role 必须是非空字符串")
 		}
-		content, ok := msg["content"].(string)
-		if !ok {
-			return nil, errors.New("messages.content 仅支持文本字符串")
+		content, err := messageTextContent(msg["content"])
+		if err != nil {
+			return nil, err
 		}
 		role := strings.ToLower(strings.TrimSpace(roleRaw))
 		msg["role"] = role
-		msg["content"] = content
 		messages = append(messages, chatMessagePayload{
 			Raw:     msg,
 			Role:    role,
@@ -223,25 +329,98 @@ func parseRequestMessages(payload map[string]interface{}) ([]chatMessagePayload,
 	return messages, nil
 }
 
+// messageTextContent 返回消息的文本内容：content 为字符串时原样返回；
+// 为多段内容数组（text / image_url 等）时拼接其中的 text 段，原始数组保留在消息 JSON 中原样转发与落库。
+func messageTextContent(content interface{}) (string, error) {
+	switch val := content.(type) {
+	case string:
+		return val, nil
+	case []interface{}:
+		if len(val) == 0 {
+			return "", errors.New("messages.content 不能是空数组")
+		}
+		texts := make([]string, 0, len(val))
+		for _, item := range val {
+			part, ok := item.(map[string]interface{})
+			if !ok {
+				return "", errors.New("messages.content 数组中元素必须是对象")
+			}
+			partType, _ := part["type"].(string)
+			if strings.TrimSpace(partType) == "" {
+				return "", errors.New("messages.content[].type 必须是非空字符串")
+			}
+			if text, ok := part["text"].(string); ok && partType == "text" {
+				texts = append(texts, text)
+			}
+		}
+		return strings.Join(texts, "\n"), nil
+	default:
+		return "", errors.New("messages.content 必须是字符串或内容数组")
+	}
+}
+
+// conversationOptions 是请求体中的网关会话扩展字段。
+type conversationOptions struct {
+	conversationID     int64
+	hasConversationID  bool
+	newChat            bool
+	parentMessageID    int64
+	hasParentMessageID bool
+}
+
 // consumeConversationOptions 从请求体中读取网关扩展字段，并将其从 payload 删除。
 // 删除的原因：上游 vLLM 接口不识别这些字段。
-func consumeConversationOptions(payload map[string]interface{}) (conversationID int64, hasConversationID bool, newChat bool, err error) {
+func consumeConversationOptions(payload map[string]interface{}) (conversationOptions, error) {
+	var opts conversationOptions
+	var err error
 	if rawNewChat, ok := payload["new_chat"]; ok {
-		newChat, err = parseBool(rawNewChat)
+		opts.newChat, err = parseBool(rawNewChat)
 		if err != nil {
-			return 0, false, false, errors.New("new_chat 必须是布尔值")
+			return conversationOptions{}, errors.New("new_chat 必须是布尔值")
 		}
 		delete(payload, "new_chat")
 	}
 	if rawConversationID, ok := payload["conversation_id"]; ok {
-		conversationID, err = parseInt64(rawConversationID)
-		if err != nil || conversationID <= 0 {
-			return 0, false, false, errors.New("conversation_id 必须是正整数")
+		opts.conversationID, err = parseInt64(rawConversationID)
+		if err != nil || opts.conversationID <= 0 {
+			return conversationOptions{}, errors.New("conversation_id 必须是正整数")
 		}
-		hasConversationID = true
+		opts.hasConversationID = true
 		delete(payload, "conversation_id")
 	}
-	return conversationID, hasConversationID, newChat, nil
+	if rawParentMessageID, ok := payload["parent_message_id"]; ok {
+		opts.parentMessageID, err = parseInt64(rawParentMessageID)
+		if err != nil || opts.parentMessageID < 0 {
+			return conversationOptions{}, errors.New("parent_message_id 必须是非负整数")
+		}
+		if !opts.hasConversationID || opts.newChat {
+			return conversationOptions{}, errors.New("parent_message_id 只能在续聊（传 conversation_id 且不传 new_chat）时使用")
+		}
+		opts.hasParentMessageID = true
+		delete(payload, "parent_message_id")
+	}
+	return opts, nil
+}
+
+// resolveHistoryParent 返回续聊时本轮消息要接在其后的父消息：
+// 指定了 parent_message_id 时校验其为会话中的 user/assistant 消息（0 表示从根开始新的分支，即编辑第一条提问），
+// 未指定时接在会话当前分支的叶子之后。
+func resolveHistoryParent(conversation *models.LLMConversation, parentMessageID int64, hasParentMessageID bool) (int64, error) {
+	// 旧会话在这里补齐消息树，之后的路径计算才能覆盖全部历史。
+	activeID, err := models.EnsureLLMConversationActiveMessage(conversation)
+	if err != nil {
+		return 0, err
+	}
+	if !hasParentMessageID {
+		return activeID, nil
+	}
+	if parentMessageID == 0 {
+		return 0, nil
+	}
+	if _, err := models.GetLLMConversationTreeMessage(conversation.ConversationID, parentMessageID); err != nil {
+		return 0, err
+	}
+	return parentMessageID, nil
 }
 
 func parseBool(v interface{}) (bool, error) {
@@ -292,11 +471,14 @@ func validateContinueMessages(messages []chatMessagePayload) error {
 	return nil
 }
 
-// buildUpstreamMessages 根据是否续聊决定是否注入历史上下文。
-func buildUpstreamMessages(conversationID int64, isContinue bool, currentMessages []chatMessagePayload) ([]map[string]interface{}, error) {
+// buildUpstreamMessages 根据是否续聊决定是否注入历史上下文，返回最终 messages、其中的历史条数以及被挤出窗口的位置。
+// 续聊的历史是消息树中从根到 parentID 的分支：摘要覆盖位置在该分支上时只拼接其后的历史，否则不使用摘要；
+// 历史先按条数上限读取，再按 token 预算从最早的一轮开始丢弃。
+func buildUpstreamMessages(conversationID int64, parentID int64, isContinue bool, currentMessages []chatMessagePayload, budget historyBudget) ([]map[string]interface{}, int, summaryCutoff, error) {
 	if !isContinue {
 		systemMsg, nonSystem := splitCurrentMessages(currentMessages)
-		return mergeHistoryAndCurrentMessages(nil, systemMsg, nonSystem)
+		merged, err := mergeHistoryAndCurrentMessages(nil, systemMsg, nil, nonSystem)
+		return merged, 0, summaryCutoff{}, err
 	}
 
 	currentSystem, currentNonSystem := splitCurrentMessages(currentMessages)
@@ -304,27 +486,173 @@ func buildUpstreamMessages(conversationID int64, isContinue bool, currentMessage
 	if effectiveSystem == nil {
 		storedSystem, err := models.GetLLMConversationSystemMessage(conversationID)
 		if err != nil {
-			return nil, err
+			return nil, 0, summaryCutoff{}, err
 		}
 		effectiveSystem = storedSystem
 	}
+	tree, err := models.LoadLLMConversationTree(conversationID)
+	if err != nil {
+		return nil, 0, summaryCutoff{}, err
+	}
+	path := tree.Path(parentID)
+	// 未摘要的历史：当前分支有摘要时从其覆盖位置之后开始，否则整条分支都未摘要。
+	summary, err := models.GetLLMConversationBranchSummary(conversationID, path)
+	if err != nil {
+		return nil, 0, summaryCutoff{}, err
+	}
+	unsummarized := path
+	var summaryUntilID int64
+	if summary != nil {
+		summaryUntilID = summary.SummaryUntilMessageID
+		unsummarized = path[slices.Index(path, summaryUntilID)+1:]
+	}
 
-	nonSystemLimit := historyMessageLimit()
+	nonSystemLimit := historyMessageLimit(budget.tokens > 0)
 	if effectiveSystem != nil && nonSystemLimit > 0 {
 		nonSystemLimit--
 	}
-	history, err := models.GetRecentLLMConversationMessagesWithoutSystem(conversationID, nonSystemLimit)
+	historyIDs := unsummarized
+	if nonSystemLimit > 0 && len(historyIDs) > nonSystemLimit {
+		historyIDs = historyIDs[len(historyIDs)-nonSystemLimit:]
+	}
+	history, err := models.ListLLMConversationMessagesByIDs(conversationID, historyIDs)
+	if err != nil {
+		return nil, 0, summaryCutoff{}, err
+	}
+	merged, err := mergeHistoryAndCurrentMessages(history, effectiveSystem, summary, currentNonSystem)
 	if err != nil {
-		return nil, err
+		return nil, 0, summaryCutoff{}, err
+	}
+	prefix := 0
+	if effectiveSystem != nil {
+		prefix++
+	}
+	if summary != nil {
+		prefix++
+	}
+	merged, kept := trimHistoryToBudget(merged, prefix, len(history), budget)
+	return merged, kept, historySummaryCutoff(unsummarized, kept, summary, summaryUntilID), nil
+}
+
+// conversationHistory 是一次续聊请求装配好的上游历史：会话、本轮接在其后的父消息与拼接后的 messages。
+// 按 user_id + conversation_id + parent_message_id 缓存在 context 中，同一请求的后续中间件可直接复用。
+type conversationHistory struct {
+	userID             int64
+	conversationID     int64
+	parentMessageID    int64
+	hasParentMessageID bool
+
+	conversation *models.LLMConversation
+	parentID     int64
+	messages     []map[string]interface{}
+	historyCount int
+	cutoff       summaryCutoff
+}
+
+// cachedConversationHistory 返回 context 中与本次请求的会话与父消息一致的历史，没有时返回 nil。
+func cachedConversationHistory(c *gin.Context, userID int64, opts conversationOptions) *conversationHistory {
+	v, ok := c.Get(contextKeyConversationHistory)
+	if !ok {
+		return nil
+	}
+	history, ok := v.(*conversationHistory)
+	if !ok || history.userID != userID || history.conversationID != opts.conversationID ||
+		history.parentMessageID != opts.parentMessageID || history.hasParentMessageID != opts.hasParentMessageID {
+		return nil
+	}
+	return history
+}
+
+// historyBudget 是续聊时整个 prompt（system + 历史 + 本轮）可用的 token 预算，tokens<=0 表示只按条数限制。
+type historyBudget struct {
+	tokenizer tokenizer.Tokenizer
+	tokens    int64
+}
+
+// historyTokenBudget 按模型计算历史拼接的 token 预算：
+// 1) 模型能力表配置了 history_token_budget 时直接使用；
+// 2) 配置了 context_length 时为窗口减去输出预留（请求的 max_tokens，其次 max_output_tokens，都没有时取窗口的 1/4），预留最多半个窗口；
+// 3) 其余模型使用 vllm.history_token_budget，未配置时只按条数限制。
+func historyTokenBudget(model string, payload map[string]interface{}) historyBudget {
+	budget := historyBudget{tokenizer: tokenizer.ForModel(model)}
+	capability, ok := utils.GetModelCapability(model)
+	switch {
+	case ok && capability.HistoryTokenBudget > 0:
+		budget.tokens = capability.HistoryTokenBudget
+	case ok && capability.ContextLength > 0:
+		reserve := capability.ContextLength / 4
+		if _, maxTokens, ok := utils.RequestedMaxTokens(payload); ok {
+			reserve = maxTokens
+		} else if capability.MaxOutputTokens > 0 {
+			reserve = capability.MaxOutputTokens
+		}
+		budget.tokens = capability.ContextLength - min(reserve, capability.ContextLength/2)
+	default:
+		budget.tokens = utils.V.GetInt64("vllm.history_token_budget")
 	}
-	return mergeHistoryAndCurrentMessages(history, effectiveSystem, currentNonSystem)
+	return budget
 }
 
-// historyMessageLimit 从配置读取历史条数上限，未配置时使用默认值。
-func historyMessageLimit() int {
+// trimHistoryToBudget 在 token 预算内保留尽可能多的最近历史：开头的 start 条（system 与摘要）与本轮消息总是保留，
+// 从最早的历史开始丢弃，且保留的历史总是从 user 消息开始，避免开头是一条失去提问的 assistant 回复。
+// 返回裁剪后的 messages 与保留的历史条数。
+func trimHistoryToBudget(merged []map[string]interface{}, start int, historyCount int, budget historyBudget) ([]map[string]interface{}, int) {
+	if budget.tokens <= 0 || historyCount == 0 {
+		return merged, historyCount
+	}
+	history := merged[start : start+historyCount]
+	fixed := make([]interface{}, 0, len(merged)-historyCount)
+	for _, msg := range merged[:start] {
+		fixed = append(fixed, msg)
+	}
+	for _, msg := range merged[start+historyCount:] {
+		fixed = append(fixed, msg)
+	}
+	used := int64(tokenizer.CountMessages(budget.tokenizer, fixed))
+
+	first := len(history)
+	for first > 0 {
+		cost := int64(tokenizer.CountMessage(budget.tokenizer, history[first-1]))
+		if used+cost > budget.tokens {
+			break
+		}
+		used += cost
+		first--
+	}
+	for first < len(history) {
+		if role, _ := history[first]["role"].(string); role == "user" {
+			break
+		}
+		first++
+	}
+	if first == 0 {
+		return merged, historyCount
+	}
+	out := make([]map[string]interface{}, 0, len(merged)-first)
+	out = append(out, merged[:start]...)
+	out = append(out, history[first:]...)
+	out = append(out, merged[start+historyCount:]...)
+	return out, len(history) - first
+}
+
+// messagesToInterfaces 把合并后的 messages 转为 []interface{}，与 JSON 解码得到的 payload 结构保持一致。
+func messagesToInterfaces(messages []map[string]interface{}) []interface{} {
+	out := make([]interface{}, 0, len(messages))
+	for _, msg := range messages {
+		out = append(out, msg)
+	}
+	return out
+}
+
+// historyMessageLimit 从配置读取历史条数上限（含 system）。
+// 未配置时使用默认值；启用 token 预算时默认放宽到最大值，由预算决定实际条数。
+func historyMessageLimit(tokenBudgeted bool) int {
 	n := utils.V.GetInt("vllm.history_max_messages")
 	if n <= 0 {
 		n = defaultHistoryMaxMessages
+		if tokenBudgeted {
+			n = maxHistoryMaxMessages
+		}
 	}
 	if n > maxHistoryMaxMessages {
 		n = maxHistoryMaxMessages
@@ -332,9 +660,9 @@ func historyMessageLimit() int {
 	return n
 }
 
-// mergeHistoryAndCurrentMessages 保证顺序是：system(若有) -> 历史非system -> 本轮输入非system。
-func mergeHistoryAndCurrentMessages(history []*models.LLMConversationMessage, systemMessage *models.LLMConversationMessage, currentMessages []chatMessagePayload) ([]map[string]interface{}, error) {
-	merged := make([]map[string]interface{}, 0, 1+len(history)+len(currentMessages))
+// mergeHistoryAndCurrentMessages 保证顺序是：system(若有) -> 摘要(若有) -> 历史非system -> 本轮输入非system。
+func mergeHistoryAndCurrentMessages(history []*models.LLMConversationMessage, systemMessage *models.LLMConversationMessage, summary *models.LLMConversationMessage, currentMessages []chatMessagePayload) ([]map[string]interface{}, error) {
+	merged := make([]map[string]interface{}, 0, 2+len(history)+len(currentMessages))
 	if systemMessage != nil {
 		msg := map[string]interface{}{}
 		if strings.TrimSpace(systemMessage.MessageJSON) != "" {
@@ -353,6 +681,9 @@ func mergeHistoryAndCurrentMessages(history []*models.LLMConversationMessage, sy
 			})
 		}
 	}
+	if summary != nil {
+		merged = append(merged, summaryToMessage(summary))
+	}
 	for _, item := range history {
 		msg := map[string]interface{}{}
 		if strings.TrimSpace(item.MessageJSON) != "" {
@@ -372,11 +703,12 @@ func mergeHistoryAndCurrentMessages(history []*models.LLMConversationMessage, sy
 	return merged, nil
 }
 
-// persistCurrentMessages 会把 system 进行 upsert（覆盖写），user 正常追加。
-func persistCurrentMessages(userID int64, conversationID int64, model string, messages []chatMessagePayload) error {
+// persistCurrentMessages 会把 system 进行 upsert（覆盖写），user 依次接在 parentID 之后追加，返回最后一条 user 的消息ID
+// （没有 user 时返回 parentID），作为 assistant 的父消息。
+func persistCurrentMessages(userID int64, conversationID int64, parentID int64, model string, messages []chatMessagePayload) (int64, error) {
 	// 先清理历史遗留的重复 system，确保后续读写始终只有一条 system。
 	if err := models.CleanupLLMConversationSystemMessages(conversationID); err != nil {
-		return err
+		return 0, err
 	}
 
 	systemMsg, nonSystem := splitCurrentMessages(messages)
@@ -388,7 +720,7 @@ func persistCurrentMessages(userID int64, conversationID int64, model string, me
 			systemMsg.Content,
 			systemMsg.MessageJSON,
 		); err != nil {
-			return err
+			return 0, err
 		}
 	}
 
@@ -399,28 +731,30 @@ func persistCurrentMessages(userID int64, conversationID int64, model string, me
 		}
 		raw, err := json.Marshal(msg.Raw)
 		if err != nil {
-			return err
+			return 0, err
 		}
 		out = append(out, &models.LLMConversationMessage{
-			MessageID:      utils.GenerateID(),
-			ConversationID: conversationID,
-			UserID:         userID,
-			Role:           msg.Role,
-			Content:        msg.Content,
-			MessageJSON:    string(raw),
-			Model:          strings.TrimSpace(model),
+			MessageID:       utils.GenerateID(),
+			ConversationID:  conversationID,
+			UserID:          userID,
+			ParentMessageID: parentID,
+			Role:            msg.Role,
+			Content:         msg.Content,
+			MessageJSON:     string(raw),
+			Model:           strings.TrimSpace(model),
 		})
+		parentID = out[len(out)-1].MessageID
 	}
-	return models.CreateLLMConversationMessages(out)
+	return parentID, models.AppendLLMConversationMessages(conversationID, out)
 }
 
-// 新会话标题默认取首条 user 消息前 N 个字符。
+// 新会话标题默认取首条 user 消息前 N 个字符，开启自动标题后在首轮回复后被替换。
 func buildConversationTitle(messages []chatMessagePayload) string {
 	for _, msg := range messages {
 		if msg.Role == "user" {
 			title := strings.TrimSpace(msg.Content)
 			if title != "" {
-				return truncateRunes(title, maxConversationTitleRunes)
+				return truncateRunes(title, defaultConversationTitleRunes)
 			}
 		}
 	}
@@ -461,25 +795,26 @@ func truncateRunes(s string, limit int) string {
 	return string(rs[:limit])
 }
 
-// saveAssistantMessage 在拿到上游响应后补写 assistant。
-func saveAssistantMessage(userID int64, conversationID int64, model string, content string) error {
+// saveAssistantMessage 在拿到上游响应后把 assistant 接在 parentID 之后补写，并设为会话当前叶子，返回新消息ID。
+func saveAssistantMessage(userID int64, conversationID int64, parentID int64, model string, content string) (int64, error) {
 	raw, err := json.Marshal(map[string]interface{}{
 		"role":    "assistant",
 		"content": content,
 	})
 	if err != nil {
-		return err
+		return 0, err
 	}
 	msg := &models.LLMConversationMessage{
-		MessageID:      utils.GenerateID(),
-		ConversationID: conversationID,
-		UserID:         userID,
-		Role:           "assistant",
-		Content:        content,
-		MessageJSON:    string(raw),
-		Model:          strings.TrimSpace(model),
-	}
-	return models.CreateLLMConversationMessages([]*models.LLMConversationMessage{msg})
+		MessageID:       utils.GenerateID(),
+		ConversationID:  conversationID,
+		UserID:          userID,
+		ParentMessageID: parentID,
+		Role:            "assistant",
+		Content:         content,
+		MessageJSON:     string(raw),
+		Model:           strings.TrimSpace(model),
+	}
+	return msg.MessageID, models.AppendLLMConversationMessages(conversationID, []*models.LLMConversationMessage{msg})
 }
 
 // extractAssistantContentAndModel 同时兼容 JSON 和 SSE 两种响应格式。
@@ -493,6 +828,8 @@ func extractAssistantContentAndModel(body []byte) (string, string) {
 type responseChoice struct {
 	Message *responseMessage `json:"message"`
 	Delta   *responseMessage `json:"delta"`
+	// Text 为 /v1/completions 的生成文本，chat 类响应没有该字段。
+	Text string `json:"text"`
 }
 
 type responseMessage struct {
@@ -513,6 +850,7 @@ func parseAssistantFromJSON(body []byte) (string, string, bool) {
 	}
 	var builder strings.Builder
 	for _, choice := range resp.Choices {
+		builder.WriteString(choice.Text)
 		if choice.Message != nil {
 			if text := contentToString(choice.Message.Content); text != "" {
 				builder.WriteString(text)
@@ -552,6 +890,7 @@ func parseAssistantFromSSE(body []byte) (string, string) {
 			model = strings.TrimSpace(chunk.Model)
 		}
 		for _, choice := range chunk.Choices {
+			builder.WriteString(choice.Text)
 			if choice.Delta != nil {
 				if text := contentToString(choice.Delta.Content); text != "" {
 					builder.WriteString(text)
@@ -0,0 +1,175 @@
+package middlewares
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nanami9426/imgo/internal/models"
+	"github.com/nanami9426/imgo/internal/utils"
+	"gorm.io/gorm"
+)
+
+const (
+	// conversationRegenerateRoute 是重新生成接口的路由，用量记录使用该路由而不是带会话ID的实际路径。
+	conversationRegenerateRoute = "/v1/conversations/:conversation_id/regenerate"
+
+	// contextKeyRegenerateMessageID 是被重新回答的 user 消息ID：ChatHistoryMiddleware 据此不再写入 user，
+	// 并把新的 assistant 作为该消息的另一个子消息（与原回复互为兄弟）。
+	contextKeyRegenerateMessageID = "regenerate_message_id"
+)
+
+// isConversationRegeneratePath 判断是否为 POST /v1/conversations/:conversation_id/regenerate。
+func isConversationRegeneratePath(path string) bool {
+	rest, ok := strings.CutPrefix(path, "/v1/conversations/")
+	if !ok {
+		return false
+	}
+	id, ok := strings.CutSuffix(rest, "/regenerate")
+	return ok && id != "" && !strings.Contains(id, "/")
+}
+
+// regenerateRequest 是重新生成接口可选的覆盖参数，未传时使用会话设置（没有设置时模型沿用原回复）。
+type regenerateRequest struct {
+	Model       string       `json:"model"`
+	Temperature *json.Number `json:"temperature"`
+	Stream      *bool        `json:"stream"`
+}
+
+// ConversationRegenerateMiddleware 把 POST /v1/conversations/:conversation_id/regenerate 转换为 chat/completions 续聊请求：
+// 1) 取当前分支上最后一条 user 消息，以其父消息为 parent_message_id、该消息为本轮输入，历史与正常续聊一致；
+// 2) 模型依次取请求中的 model、会话设置的模型、原回复的模型、会话最近使用的模型；temperature / stream 按请求原样传递，其余参数取会话设置；
+// 3) 由 ChatHistoryMiddleware 把新回复写为该 user 消息的另一个子消息并设为当前分支，不会重复写入 user；
+// 4) 之后的限流、用量、路由与降级按 chat/completions 处理，不读取响应缓存。
+// 需挂在鉴权之后、限流之前。
+func ConversationRegenerateMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.Method != http.MethodPost || !isConversationRegeneratePath(c.Request.URL.Path) {
+			c.Next()
+			return
+		}
+		userID, ok := parseUserIDFromContext(c)
+		if !ok || userID <= 0 {
+			utils.Abort(c, http.StatusUnauthorized, utils.StatUnauthorized, "token无效或已过期", nil)
+			return
+		}
+		conversationID, err := strconv.ParseInt(strings.TrimSpace(c.Param("conversation_id")), 10, 64)
+		if err != nil || conversationID <= 0 {
+			utils.Abort(c, http.StatusBadRequest, utils.StatInvalidParam, "conversation_id 必须是正整数", nil)
+			return
+		}
+		rawBody, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			utils.Abort(c, http.StatusBadRequest, utils.StatInvalidParam, "读取请求体失败", err)
+			return
+		}
+		req := &regenerateRequest{}
+		if len(bytes.TrimSpace(rawBody)) > 0 {
+			dec := json.NewDecoder(bytes.NewReader(rawBody))
+			dec.UseNumber()
+			if err := dec.Decode(req); err != nil {
+				utils.Abort(c, http.StatusBadRequest, utils.StatInvalidParam, "请求体必须是合法JSON对象", err)
+				return
+			}
+		}
+
+		payload, userMessageID, err := buildRegeneratePayload(conversationID, userID, req)
+		if err != nil {
+			var paramErr *regenerateParamError
+			switch {
+			case errors.Is(err, gorm.ErrRecordNotFound):
+				utils.Abort(c, http.StatusNotFound, utils.StatNotFound, "会话不存在", nil)
+			case errors.As(err, &paramErr):
+				utils.Abort(c, http.StatusBadRequest, utils.StatInvalidParam, paramErr.message, nil)
+			default:
+				utils.Abort(c, http.StatusInternalServerError, utils.StatDatabaseError, "查询会话消息失败", err)
+			}
+			return
+		}
+		body, err := json.Marshal(payload)
+		if err != nil {
+			utils.Abort(c, http.StatusInternalServerError, utils.StatInternalError, "重写请求失败", err)
+			return
+		}
+		restoreRequestBody(c, body)
+		// 重新生成需要一个新的回复，跳过响应缓存的读取。
+		c.Request.Header.Set("Cache-Control", "no-cache")
+		c.Set(contextKeyRegenerateMessageID, userMessageID)
+		c.Next()
+	}
+}
+
+type regenerateParamError struct {
+	message string
+}
+
+func (e *regenerateParamError) Error() string {
+	return e.message
+}
+
+// buildRegeneratePayload 组装重新生成的 chat/completions 请求，返回请求体与被重新回答的 user 消息ID。
+func buildRegeneratePayload(conversationID int64, userID int64, req *regenerateRequest) (map[string]interface{}, int64, error) {
+	conversation, err := models.GetLLMConversationByIDAndUser(conversationID, userID)
+	if err != nil {
+		return nil, 0, err
+	}
+	activeID, err := models.EnsureLLMConversationActiveMessage(conversation)
+	if err != nil {
+		return nil, 0, err
+	}
+	tree, err := models.LoadLLMConversationTree(conversationID)
+	if err != nil {
+		return nil, 0, err
+	}
+	path := tree.Path(activeID)
+	last := len(path) - 1
+	for last >= 0 && tree.Role(path[last]) != "user" {
+		last--
+	}
+	if last < 0 {
+		return nil, 0, &regenerateParamError{message: "当前分支没有可重新回答的 user 消息"}
+	}
+	replies, err := models.ListLLMConversationMessagesByIDs(conversationID, path[last:])
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(replies) == 0 || replies[0].MessageID != path[last] {
+		return nil, 0, gorm.ErrRecordNotFound
+	}
+	userMsg := replies[0]
+
+	// 模型优先级：请求覆盖 > 会话设置 > 原回复的模型 > 会话最近使用的模型。
+	model := strings.TrimSpace(req.Model)
+	if model == "" {
+		model = strings.TrimSpace(conversation.Settings.Model)
+	}
+	if model == "" && len(replies) > 1 {
+		model = replies[1].Model
+	}
+	if model == "" {
+		model = conversation.Model
+	}
+	message := map[string]interface{}{}
+	if strings.TrimSpace(userMsg.MessageJSON) == "" || json.Unmarshal([]byte(userMsg.MessageJSON), &message) != nil {
+		message = map[string]interface{}{"role": userMsg.Role, "content": userMsg.Content}
+	}
+
+	payload := map[string]interface{}{
+		"model":             model,
+		"messages":          []interface{}{message},
+		"conversation_id":   conversationID,
+		"parent_message_id": userMsg.ParentMessageID,
+	}
+	if req.Temperature != nil {
+		payload["temperature"] = *req.Temperature
+	}
+	if req.Stream != nil {
+		payload["stream"] = *req.Stream
+	}
+	return payload, userMsg.MessageID, nil
+}
@@ -0,0 +1,39 @@
+package middlewares
+
+import (
+	"strings"
+
+	"github.com/nanami9426/imgo/internal/models"
+)
+
+// applyConversationSettings 把会话设置合并进续聊请求：只填充请求中未传的 model/temperature/top_p/max_tokens，
+// 请求显式传入的值总是优先。system 提示词由历史拼接时注入的 system 消息提供，这里不处理。
+func applyConversationSettings(payload map[string]interface{}, settings models.LLMConversationSettings) {
+	if model, _ := payload["model"].(string); strings.TrimSpace(model) == "" && strings.TrimSpace(settings.Model) != "" {
+		payload["model"] = strings.TrimSpace(settings.Model)
+	}
+	if _, ok := payload["temperature"]; !ok && settings.Temperature != nil {
+		payload["temperature"] = *settings.Temperature
+	}
+	if _, ok := payload["top_p"]; !ok && settings.TopP != nil {
+		payload["top_p"] = *settings.TopP
+	}
+	_, hasMaxTokens := payload["max_tokens"]
+	_, hasMaxCompletionTokens := payload["max_completion_tokens"]
+	if !hasMaxTokens && !hasMaxCompletionTokens && settings.MaxTokens != nil {
+		payload["max_tokens"] = *settings.MaxTokens
+	}
+}
+
+// conversationHistoryBudget 在按模型计算的历史预算上应用会话设置的 history_token_budget（conversation 为 nil 表示新会话）：
+// 会话设置只能收紧预算，按模型算出的预算（上下文窗口减去输出预留）仍是上限。
+func conversationHistoryBudget(conversation *models.LLMConversation, model string, payload map[string]interface{}) historyBudget {
+	budget := historyTokenBudget(model, payload)
+	if conversation != nil && conversation.Settings.HistoryTokenBudget != nil && *conversation.Settings.HistoryTokenBudget > 0 {
+		saved := *conversation.Settings.HistoryTokenBudget
+		if budget.tokens <= 0 || saved < budget.tokens {
+			budget.tokens = saved
+		}
+	}
+	return budget
+}
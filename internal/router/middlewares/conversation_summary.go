@@ -0,0 +1,150 @@
+package middlewares
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nanami9426/imgo/internal/models"
+	"github.com/nanami9426/imgo/internal/utils"
+)
+
+const (
+	// summaryMessagePrefix 是注入给上游的摘要 system 消息的开头。
+	summaryMessagePrefix = "以下是本次对话较早部分的摘要，供参考：\n"
+
+	defaultSummaryPrompt = "你负责为一段长对话维护滚动摘要。请把已有摘要与新增的对话内容合并成一份新的摘要：" +
+		"保留用户的目标、偏好、已确认的事实与结论、尚未解决的问题以及后续回答需要的关键细节，省略寒暄与重复内容。" +
+		"使用与对话相同的语言，只输出摘要正文。"
+)
+
+// ChatCompleter 由网关自身向上游发起一次非流式 chat/completions，返回回复文本。
+type ChatCompleter func(ctx context.Context, model string, messages []map[string]interface{}, maxTokens int) (string, error)
+
+var (
+	chatCompleter ChatCompleter
+
+	// summarizingConversations 保证同一实例内一个会话同时只有一个摘要任务。
+	summarizingConversations sync.Map
+)
+
+// SetChatCompleter 注入网关内部调用上游的实现（由 service 提供），未注入时不生成会话摘要。
+func SetChatCompleter(fn ChatCompleter) {
+	chatCompleter = fn
+}
+
+// summaryCutoff 记录本轮被挤出历史窗口、且尚未被摘要覆盖的消息（按分支顺序），为空表示本轮没有历史被挤出。
+// summary 为本轮分支使用的摘要（为 nil 时从头生成），untilID 为其覆盖位置，新摘要基于它增量生成。
+type summaryCutoff struct {
+	pending []int64
+	summary *models.LLMConversationMessage
+	untilID int64
+}
+
+// historySummaryCutoff 根据本轮未摘要的分支历史与最终保留的条数计算被挤出的消息：
+// 保留的是最近 kept 条，之前的都已不在窗口内（含按条数上限没有读取到的更早消息）。
+func historySummaryCutoff(unsummarized []int64, kept int, summary *models.LLMConversationMessage, untilID int64) summaryCutoff {
+	if kept >= len(unsummarized) {
+		return summaryCutoff{}
+	}
+	return summaryCutoff{
+		pending: unsummarized[:len(unsummarized)-kept],
+		summary: summary,
+		untilID: untilID,
+	}
+}
+
+// summaryToMessage 把摘要转换为注入上游的 system 消息。
+func summaryToMessage(summary *models.LLMConversationMessage) map[string]interface{} {
+	return map[string]interface{}{
+		"role":    "system",
+		"content": summaryMessagePrefix + summary.Content,
+	}
+}
+
+// maybeSummarizeConversation 在 assistant 落库后异步更新会话摘要：
+// 1) 未开启、未注入上游调用或本轮没有历史被挤出时直接返回；
+// 2) 会话消息数未达到 threshold，或被挤出且未摘要的消息不足 batch_messages 条时不调用上游；
+// 3) 把本分支已有的摘要与新挤出的消息交给上游合并成新摘要，覆盖到最后一条被摘要的消息；
+// 4) 摘要按覆盖位置区分分支：本分支没有摘要时从头生成，原摘要只在其后没有分出其他分支时被取代，不影响其他分支。
+func maybeSummarizeConversation(conversationID int64, userID int64, model string, cutoff summaryCutoff) {
+	cfg := utils.GetConversationSummaryConfig()
+	if !cfg.Enabled || chatCompleter == nil || len(cutoff.pending) == 0 {
+		return
+	}
+	if _, running := summarizingConversations.LoadOrStore(conversationID, struct{}{}); running {
+		return
+	}
+	go func() {
+		defer summarizingConversations.Delete(conversationID)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.TimeoutMs)*time.Millisecond)
+		defer cancel()
+		if err := summarizeConversation(ctx, cfg, conversationID, userID, model, cutoff); err != nil {
+			utils.Log.Errorf("failed to summarize conversation: conversation_id=%d err=%v", conversationID, err)
+		}
+	}()
+}
+
+func summarizeConversation(ctx context.Context, cfg utils.ConversationSummaryConfig, conversationID int64, userID int64, model string, cutoff summaryCutoff) error {
+	conversation, err := models.GetLLMConversationByIDAndUser(conversationID, userID)
+	if err != nil {
+		return err
+	}
+	if conversation.MessageCount < cfg.Threshold {
+		return nil
+	}
+	messages, err := models.ListLLMConversationMessagesByIDs(conversationID, cutoff.pending)
+	if err != nil {
+		return err
+	}
+	if len(messages) < cfg.BatchMessages {
+		return nil
+	}
+
+	if cfg.Model != "" {
+		model = cfg.Model
+	}
+	content, err := chatCompleter(ctx, model, buildSummaryPrompt(cfg, cutoff.summary, messages), cfg.MaxTokens)
+	if err != nil {
+		return err
+	}
+	saved, err := models.SaveLLMConversationSummary(
+		conversationID,
+		userID,
+		model,
+		content,
+		cutoff.untilID,
+		messages[len(messages)-1].MessageID,
+	)
+	if err != nil {
+		return err
+	}
+	if !saved {
+		utils.Log.Infof("conversation summary skipped: conversation_id=%d reason=summary changed concurrently", conversationID)
+	}
+	return nil
+}
+
+// buildSummaryPrompt 组装增量摘要请求：system 为摘要指令，user 为已有摘要与新增的对话内容。
+func buildSummaryPrompt(cfg utils.ConversationSummaryConfig, summary *models.LLMConversationMessage, messages []*models.LLMConversationMessage) []map[string]interface{} {
+	prompt := cfg.Prompt
+	if prompt == "" {
+		prompt = defaultSummaryPrompt
+	}
+	var builder strings.Builder
+	if summary != nil && strings.TrimSpace(summary.Content) != "" {
+		builder.WriteString("已有摘要：\n")
+		builder.WriteString(strings.TrimSpace(summary.Content))
+		builder.WriteString("\n\n")
+	}
+	builder.WriteString("新增对话：\n")
+	for _, msg := range messages {
+		fmt.Fprintf(&builder, "%s: %s\n", msg.Role, strings.TrimSpace(msg.Content))
+	}
+	return []map[string]interface{}{
+		{"role": "system", "content": prompt},
+		{"role": "user", "content": builder.String()},
+	}
+}
@@ -0,0 +1,82 @@
+package middlewares
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nanami9426/imgo/internal/models"
+	"github.com/nanami9426/imgo/internal/utils"
+)
+
+const defaultTitlePrompt = "请根据下面的对话为它起一个简短的标题，概括用户的主要意图。" +
+	"使用与对话相同的语言，中文不超过 15 个字，英文不超过 8 个单词；不要加引号、标点结尾或任何解释，只输出标题。"
+
+// titleQuoteChars 是模型常在标题两侧加上的引号与括号。
+const titleQuoteChars = "\"'`“”‘’「」『』《》【】*#"
+
+// maybeGenerateConversationTitle 在新会话的第一条 assistant 落库后异步请求标题模型生成标题：
+// 1) 未开启或未注入上游调用时直接返回，保留截取首条 user 消息的默认标题；
+// 2) 标题请求由网关内部发起，不经过限流，也不写入用户用量；
+// 3) 用户在生成完成前已手动改名时不覆盖。
+func maybeGenerateConversationTitle(conversationID int64, model string, messages []chatMessagePayload, reply string) {
+	cfg := utils.GetConversationTitleConfig()
+	if !cfg.Enabled || chatCompleter == nil {
+		return
+	}
+	if cfg.Model != "" {
+		model = cfg.Model
+	}
+	prompt := buildTitlePrompt(cfg, messages, reply)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.TimeoutMs)*time.Millisecond)
+		defer cancel()
+		content, err := chatCompleter(ctx, model, prompt, cfg.MaxTokens)
+		if err != nil {
+			utils.Log.Errorf("failed to generate conversation title: conversation_id=%d err=%v", conversationID, err)
+			return
+		}
+		title := cleanGeneratedTitle(content)
+		if title == "" {
+			return
+		}
+		if _, err := models.UpdateLLMConversationGeneratedTitle(conversationID, title); err != nil {
+			utils.Log.Errorf("failed to save conversation title: conversation_id=%d err=%v", conversationID, err)
+		}
+	}()
+}
+
+// buildTitlePrompt 组装标题请求：system 为标题指令，user 为首轮对话（每条消息按 max_input_runes 截断）。
+func buildTitlePrompt(cfg utils.ConversationTitleConfig, messages []chatMessagePayload, reply string) []map[string]interface{} {
+	prompt := cfg.Prompt
+	if prompt == "" {
+		prompt = defaultTitlePrompt
+	}
+	var builder strings.Builder
+	for _, msg := range messages {
+		if msg.Role != "user" {
+			continue
+		}
+		fmt.Fprintf(&builder, "user: %s\n", truncateRunes(strings.TrimSpace(msg.Content), cfg.MaxInputRunes))
+	}
+	fmt.Fprintf(&builder, "assistant: %s\n", truncateRunes(strings.TrimSpace(reply), cfg.MaxInputRunes))
+	return []map[string]interface{}{
+		{"role": "system", "content": prompt},
+		{"role": "user", "content": builder.String()},
+	}
+}
+
+// cleanGeneratedTitle 只取第一行，去掉"标题："前缀与两侧引号，再按会话标题长度截断。
+func cleanGeneratedTitle(content string) string {
+	title := strings.TrimSpace(content)
+	if i := strings.IndexByte(title, '\n'); i >= 0 {
+		title = strings.TrimSpace(title[:i])
+	}
+	for _, prefix := range []string{"标题：", "标题:", "Title:", "title:"} {
+		title = strings.TrimSpace(strings.TrimPrefix(title, prefix))
+	}
+	title = strings.Trim(title, titleQuoteChars+" ")
+	title = strings.TrimRight(title, titleQuoteChars+" 。.!！")
+	return truncateRunes(strings.TrimSpace(title), models.MaxLLMConversationTitleRunes)
+}
@@ -3,24 +3,58 @@ package middlewares
 import (
 	"bytes"
 	"encoding/json"
+	"io"
+	"net/http"
 	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/nanami9426/imgo/internal/models"
+	"github.com/nanami9426/imgo/internal/tokenizer"
 	"github.com/nanami9426/imgo/internal/utils"
 )
 
 var createAPIUsageFn = models.CreateAPIUsage
 
-func shouldLogAPIPath(path string) bool {
-	return path == "/v1/chat/completions"
+const (
+	contextKeyUpstreamName     = "upstream_name"
+	contextKeyUpstreamAttempts = "upstream_attempts"
+	contextKeyServedModel      = "served_model"
+	contextKeyCoalesced        = "coalesced"
+	contextKeyQueueDepth       = "queue_depth"
+	contextKeyQueueWaitMs      = "queue_wait_ms"
+)
+
+const (
+	completionsPath = "/v1/completions"
+	embeddingsPath  = "/v1/embeddings"
+)
+
+// isChatCompletionPath 判断是否为按 chat/completions 处理的接口（/v1/messages、/v1/responses、会话重新生成在入口处已转换为 chat/completions 请求）。
+func isChatCompletionPath(path string) bool {
+	return path == chatCompletionsPath || path == anthropicMessagesPath || path == responsesPath || isConversationRegeneratePath(path)
+}
+
+// usageEndpoint 返回用量记录的 endpoint：路径中带会话ID的接口记为路由模板，便于按接口汇总。
+func usageEndpoint(path string) string {
+	if isConversationRegeneratePath(path) {
+		return conversationRegenerateRoute
+	}
+	return path
 }
 
-// 记录 API 调用的中间件
+// 记录 API 调用的中间件，是否记录由路由策略的 log_usage 决定；chat 类接口的响应体无论是否记录都会透传给会话中间件
 func APILoggingMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		if !shouldLogAPIPath(c.Request.URL.Path) {
+		if !routePolicyFromContext(c).LogUsage {
+			// 不记录用量时仍需透传 chat/completions 响应体，否则会话中间件无法保存 assistant 回复。
+			if isChatCompletionPath(c.Request.URL.Path) {
+				writer := &responseWriter{ResponseWriter: c.Writer, body: []byte{}}
+				c.Writer = writer
+				c.Next()
+				c.Set(contextKeyChatCompletionResponseBody, append([]byte(nil), writer.body...))
+				return
+			}
 			c.Next()
 			return
 		}
@@ -33,6 +67,13 @@ func APILoggingMiddleware() gin.HandlerFunc {
 			requestSize = 0
 		}
 
+		// 保留最终转发的请求体（已拼接会话历史），上游没有返回 usage 时用于估算输入 token。
+		requestBody, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			utils.Log.Errorf("read request body for usage failed: %v", err)
+		}
+		restoreRequestBody(c, requestBody)
+
 		// 拦截响应体
 		writer := &responseWriter{ResponseWriter: c.Writer, body: []byte{}}
 		c.Writer = writer
@@ -40,7 +81,9 @@ func APILoggingMiddleware() gin.HandlerFunc {
 		// 继续处理请求
 		c.Next()
 		// 透传 chat/completions 响应体，供会话中间件在后置阶段提取 assistant 内容。
-		c.Set(contextKeyChatCompletionResponseBody, append([]byte(nil), writer.body...))
+		if isChatCompletionPath(c.Request.URL.Path) {
+			c.Set(contextKeyChatCompletionResponseBody, append([]byte(nil), writer.body...))
+		}
 
 		// 计算耗时
 		latency := time.Since(startTime).Milliseconds()
@@ -70,7 +113,7 @@ func APILoggingMiddleware() gin.HandlerFunc {
 			UserID:        userID,
 			APIKeyID:      usageAPIKeyID,
 			AuthType:      authType,
-			Endpoint:      c.Request.URL.Path,
+			Endpoint:      usageEndpoint(c.Request.URL.Path),
 			RequestMethod: c.Request.Method,
 			StatusCode:    c.Writer.Status(),
 			RequestSize:   int(requestSize),
@@ -79,12 +122,73 @@ func APILoggingMiddleware() gin.HandlerFunc {
 		}
 
 		// 尝试从响应中提取 Token 信息
-		extractTokenInfo(writer.body, usage)
+		extractTokenInfoForPath(c.Request.URL.Path, writer.body, usage)
+		if usage.InputTokens == 0 && usage.OutputTokens == 0 && usage.StatusCode < http.StatusBadRequest {
+			estimateUsageTokens(c.Request.URL.Path, requestBody, writer.body, usage)
+		}
+		// 发生模型降级时以网关实际使用的模型为准，而不是请求里的模型。
+		if servedModel := strings.TrimSpace(c.GetString(contextKeyServedModel)); servedModel != "" {
+			usage.Model = servedModel
+		}
+
+		// 上游重试信息：最终记录的 Attempt 为总尝试次数，失败的尝试逐条单独落库。
+		// 命中响应缓存或合并到其他请求时本请求没有上游尝试，Attempt 记为 0。
+		attempts := upstreamAttemptsFromContext(c)
+		usage.CacheHit = c.GetBool(contextKeyCacheHit)
+		usage.Coalesced = c.GetBool(contextKeyCoalesced)
+		usage.Upstream = c.GetString(contextKeyUpstreamName)
+		usage.QueueDepth = c.GetInt(contextKeyQueueDepth)
+		usage.QueueWaitMs = c.GetInt(contextKeyQueueWaitMs)
+		if !usage.CacheHit && !usage.Coalesced {
+			usage.Attempt = len(attempts) + 1
+		}
 
 		// 记录到数据库
 		if err := createAPIUsageFn(usage); err != nil {
 			utils.Log.Errorf("failed to create api usage record: %v", err)
 		}
+		for _, attempt := range attempts {
+			if err := createAPIUsageFn(buildFailedAttemptUsage(usage, attempt)); err != nil {
+				utils.Log.Errorf("failed to create api usage attempt record: %v", err)
+			}
+		}
+	}
+}
+
+func upstreamAttemptsFromContext(c *gin.Context) []utils.UpstreamAttempt {
+	v, ok := c.Get(contextKeyUpstreamAttempts)
+	if !ok {
+		return nil
+	}
+	attempts, _ := v.([]utils.UpstreamAttempt)
+	return attempts
+}
+
+// buildFailedAttemptUsage 为被重试掉的上游尝试生成一条用量记录，沿用最终记录的调用方信息。
+func buildFailedAttemptUsage(final *models.APIUsage, attempt utils.UpstreamAttempt) *models.APIUsage {
+	errMsg := attempt.Error
+	model := final.Model
+	if attempt.Model != "" {
+		model = attempt.Model
+	}
+	if attempt.Replica != "" {
+		errMsg = "replica=" + attempt.Replica + ": " + errMsg
+	}
+	return &models.APIUsage{
+		UsageID:       utils.GenerateID(),
+		UserID:        final.UserID,
+		APIKeyID:      final.APIKeyID,
+		AuthType:      final.AuthType,
+		Endpoint:      final.Endpoint,
+		Model:         model,
+		RequestMethod: final.RequestMethod,
+		StatusCode:    attempt.StatusCode,
+		RequestSize:   final.RequestSize,
+		LatencyMs:     attempt.LatencyMs,
+		ErrorMsg:      errMsg,
+		Upstream:      attempt.Upstream,
+		Attempt:       attempt.Attempt,
+		AttemptFailed: true,
 	}
 }
 
@@ -240,6 +344,25 @@ func parseOpenAISSE(body []byte) (*openAIResp, bool) {
 	return nil, false
 }
 
+// extractTokenInfoForPath 按接口提取 token：embeddings 响应只有输入 token 且不会是 SSE，其余接口按 chat/completions 口径解析。
+func extractTokenInfoForPath(path string, body []byte, usage *models.APIUsage) {
+	if path != embeddingsPath {
+		extractTokenInfo(body, usage)
+		return
+	}
+	if usage == nil || len(body) == 0 {
+		return
+	}
+	resp, ok := parseOpenAIJSON(body)
+	if !ok {
+		return
+	}
+	applyModelAndError(resp, usage)
+	if applyUsage(resp, usage) && usage.TotalTokens == 0 {
+		usage.TotalTokens = usage.InputTokens
+	}
+}
+
 // 从响应体中提取Token信息
 func extractTokenInfo(body []byte, usage *models.APIUsage) {
 	if usage == nil || len(body) == 0 {
@@ -256,3 +379,36 @@ func extractTokenInfo(body []byte, usage *models.APIUsage) {
 		_ = applyUsage(resp, usage)
 	}
 }
+
+// estimateUsageTokens 在上游没有返回 usage 时由网关分词器自行计数，并标记 UsageEstimated：
+// 输入按最终请求体估算，输出按响应中的生成文本计数，embeddings 没有输出 token。
+func estimateUsageTokens(path string, requestBody []byte, responseBody []byte, usage *models.APIUsage) {
+	payload := map[string]interface{}{}
+	dec := json.NewDecoder(bytes.NewReader(requestBody))
+	dec.UseNumber()
+	if err := dec.Decode(&payload); err != nil {
+		payload = nil
+	}
+	input, _ := estimateRequestTokens(path, payload, 0)
+	output := int64(0)
+	if path != embeddingsPath {
+		content, model := extractAssistantContentAndModel(responseBody)
+		if usage.Model == "" {
+			usage.Model = model
+		}
+		if usage.Model == "" {
+			usage.Model, _ = payload["model"].(string)
+		}
+		output = int64(tokenizer.ForModel(usage.Model).Count(content))
+	}
+	if input == 0 && output == 0 {
+		return
+	}
+	if usage.Model == "" {
+		usage.Model, _ = payload["model"].(string)
+	}
+	usage.InputTokens = int(input)
+	usage.OutputTokens = int(output)
+	usage.TotalTokens = int(input + output)
+	usage.UsageEstimated = true
+}
@@ -0,0 +1,33 @@
+package middlewares
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nanami9426/imgo/internal/tokenizer"
+	"github.com/nanami9426/imgo/internal/utils"
+)
+
+// checkModelFeatures 按模型能力表拒绝模型不支持的功能（tools / 图片输入 / JSON 模式），
+// 返回 OpenAI 风格 400，而不是让上游返回难以理解的错误。返回 false 表示已中止请求。
+func checkModelFeatures(c *gin.Context, model string, payload map[string]interface{}) bool {
+	if err := utils.CheckModelFeatures(model, payload); err != nil {
+		utils.AbortOpenAI(c, http.StatusBadRequest, err)
+		return false
+	}
+	return true
+}
+
+// fitContextWindow 按 utils.FitContextWindow 检查最终发给上游的 messages（已拼接历史）加上输出上限是否超出模型上下文窗口，
+// prompt 由网关分词器估算。返回 false 表示已中止请求。
+func fitContextWindow(c *gin.Context, model string, payload map[string]interface{}) bool {
+	promptTokens := func() int64 {
+		messages, _ := payload["messages"].([]interface{})
+		return int64(tokenizer.CountMessages(tokenizer.ForModel(model), messages))
+	}
+	if err := utils.FitContextWindow(model, payload, promptTokens); err != nil {
+		utils.AbortOpenAI(c, http.StatusBadRequest, err)
+		return false
+	}
+	return true
+}
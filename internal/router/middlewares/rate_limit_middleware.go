@@ -8,8 +8,11 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/nanami9426/imgo/internal/models"
+	"github.com/nanami9426/imgo/internal/tokenizer"
 	"github.com/nanami9426/imgo/internal/utils"
 )
 
@@ -17,21 +20,26 @@ var (
 	// 通过函数变量注入，方便单元测试替换依赖而不需要真实 Redis。
 	getRateLimitConfigFn         = utils.GetRateLimitConfig
 	consumeChatCompletionQuotaFn = utils.ConsumeChatCompletionQuota
+	refundTokenQuotaFn           = utils.RefundChatCompletionTokenQuota
 )
 
-// RateLimitMiddleware 仅拦截 POST /v1/chat/completions 做双维度限流。
+// contextKeyCacheHit 由 chat/completions handler 在命中响应缓存时写入。
+const contextKeyCacheHit = "cache_hit"
+
+// RateLimitMiddleware 对路由策略中 rate_limit=true 的路由做双维度限流。
 //
 // 执行流程：
-// 1) 非目标路由直接放行；
+// 1) 路由策略未开启限流时直接放行；
 // 2) 从上下文读取 principal_id/user_id（依赖鉴权中间件）；
 // 3) 读取限流配置，若两个维度都关闭则放行；
-// 4) 计算请求级和 token 级成本；
+// 4) 计算请求级和 token 级成本（token 级按策略的 cost：estimate 估算 / fixed 固定 / none 不计）；
 // 5) 调用 Redis 原子脚本检查+扣减；
-// 6) 超限返回 429，Redis 异常按 fail-open 放行。
+// 6) 超限返回 429，Redis 异常按 fail-open 放行；
+// 7) 请求命中响应缓存时退还本次 token 级扣费（请求级不退）。
 func RateLimitMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		// 仅对 chat/completions 生效，避免影响其他 /v1 路由。
-		if c.Request.Method != http.MethodPost || !shouldLogAPIPath(c.Request.URL.Path) {
+		policy := routePolicyFromContext(c)
+		if !policy.RateLimit {
 			c.Next()
 			return
 		}
@@ -54,33 +62,19 @@ func RateLimitMiddleware() gin.HandlerFunc {
 		reqCost := int64(1)
 		tokenCost := int64(0)
 		if cfg.TokenPerMin > 0 {
-			// token 级开启时才读取并解析 body，避免无意义的开销。
-			rawBody, err := io.ReadAll(c.Request.Body)
-			if err != nil {
-				utils.Abort(c, http.StatusBadRequest, utils.StatInvalidParam, "读取请求体失败", err)
-				return
-			}
-			// body 被读取后需要恢复，保证后续 ChatHistoryMiddleware/上游转发可继续读取。
-			restoreRequestBody(c, rawBody)
-
-			payload := map[string]interface{}{}
-			dec := json.NewDecoder(bytes.NewReader(rawBody))
-			dec.UseNumber()
-			if err := dec.Decode(&payload); err != nil {
-				utils.Abort(c, http.StatusBadRequest, utils.StatInvalidParam, "请求体必须是合法JSON对象", err)
-				return
-			}
-
-			// prompt_tokens_est 仅按本次请求 messages 估算，不包含历史拼接。
-			promptTokensEst := estimatePromptTokens(payload)
-			maxTokens := parseMaxTokens(payload, cfg.DefaultMaxTokens)
-			tokenCost = utils.CalculateTokenCost(promptTokensEst, maxTokens, cfg.TokenK)
-			// 只要 token 级开启，单次请求至少消耗 1，避免“零成本请求”。
-			if tokenCost < 1 {
-				tokenCost = 1
+			switch policy.Cost {
+			case utils.RouteCostFixed:
+				tokenCost = policy.TokenCost
+			case utils.RouteCostEstimate:
+				cost, ok := estimateRequestTokenCost(c, cfg)
+				if !ok {
+					return
+				}
+				tokenCost = cost
 			}
 		}
 
+		consumedAt := time.Now().UTC()
 		if err := consumeChatCompletionQuotaFn(c.Request.Context(), principalID, reqCost, tokenCost); err != nil {
 			var limitErr *utils.RateLimitExceededError
 			if errors.As(err, &limitErr) {
@@ -100,12 +94,65 @@ func RateLimitMiddleware() gin.HandlerFunc {
 			}
 			// 非超限错误（如 Redis 抖动）按“失败放行”处理，优先保证服务可用性。
 			utils.Log.Errorf("rate limit check failed (fail-open): principal_id=%d err=%v", principalID, err)
+			c.Next()
+			return
 		}
 
 		c.Next()
+
+		// 缓存命中不消耗上游算力，token 维度按未发生处理。
+		if tokenCost > 0 && c.GetBool(contextKeyCacheHit) {
+			if err := refundTokenQuotaFn(utils.Ctx, principalID, tokenCost, consumedAt); err != nil {
+				utils.Log.Errorf("rate limit token refund failed: principal_id=%d err=%v", principalID, err)
+			}
+		}
 	}
 }
 
+// estimateRequestTokenCost 读取请求体估算 token 级成本，返回 false 表示已中止请求。
+// 网关已知的模型接口要求请求体是合法 JSON 对象；其余路由的请求体无法解析时按 0 估算。
+func estimateRequestTokenCost(c *gin.Context, cfg utils.RateLimitConfig) (int64, bool) {
+	path := c.Request.URL.Path
+	rawBody, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		utils.Abort(c, http.StatusBadRequest, utils.StatInvalidParam, "读取请求体失败", err)
+		return 0, false
+	}
+	// body 被读取后需要恢复，保证后续 ChatHistoryMiddleware/上游转发可继续读取。
+	restoreRequestBody(c, rawBody)
+
+	payload := map[string]interface{}{}
+	dec := json.NewDecoder(bytes.NewReader(rawBody))
+	dec.UseNumber()
+	if err := dec.Decode(&payload); err != nil {
+		if isChatCompletionPath(path) || path == completionsPath || path == embeddingsPath {
+			utils.Abort(c, http.StatusBadRequest, utils.StatInvalidParam, "请求体必须是合法JSON对象", err)
+			return 0, false
+		}
+		payload = nil
+	}
+	// 模型别名在入口处改写为真实模型，后续中间件与上游只看到真实模型名。
+	if model, _ := payload["model"].(string); model != "" && resolvePayloadModelAlias(payload) != strings.TrimSpace(model) {
+		if rewritten, err := json.Marshal(payload); err == nil {
+			restoreRequestBody(c, rewritten)
+		}
+	}
+
+	// 续聊时按拼接历史后的 messages 估算，与实际发给上游的 prompt 一致。
+	if isChatCompletionPath(path) {
+		if withHistory, ok := historyPayloadForEstimate(c, payload); ok {
+			payload = withHistory
+		}
+	}
+	promptTokensEst, maxTokens := estimateRequestTokens(path, payload, cfg.DefaultMaxTokens)
+	tokenCost := utils.CalculateTokenCost(promptTokensEst, maxTokens, cfg.TokenK)
+	// 只要 token 级开启，单次请求至少消耗 1，避免“零成本请求”。
+	if tokenCost < 1 {
+		tokenCost = 1
+	}
+	return tokenCost, true
+}
+
 func parsePrincipalIDFromContext(c *gin.Context) (int64, bool) {
 	if principalID, ok := parseInt64ContextKey(c, contextKeyPrincipalID); ok && principalID > 0 {
 		return principalID, true
@@ -120,64 +167,80 @@ func restoreRequestBody(c *gin.Context, body []byte) {
 	c.Request.Header.Set("Content-Length", strconv.Itoa(len(body)))
 }
 
-// estimatePromptTokens 估算 prompt token：
-// 1) 遍历 messages；
-// 2) 累加 role/content 的 UTF-8 字节数；
-// 3) 按 ceil(bytes/4) 转成 token 估算值。
-// 说明：这是低成本估算，不是 tokenizer 的精确值。
-func estimatePromptTokens(payload map[string]interface{}) int64 {
-	rawMessages, ok := payload["messages"]
-	if !ok {
-		return 0
-	}
-	messages, ok := rawMessages.([]interface{})
-	if !ok || len(messages) == 0 {
-		return 0
+// estimateRequestTokens 按接口用模型对应的分词器估算 prompt token 与输出 token 上限：
+// 1) chat 类接口按 messages 估算，输出上限取 max_tokens；
+// 2) completions 按 prompt 估算，输出上限取 max_tokens；
+// 3) embeddings 按 input 估算，没有输出 token；
+// 4) 其余路由按整个请求体中的字符串估算，没有输出 token。
+func estimateRequestTokens(path string, payload map[string]interface{}, defaultMaxTokens int64) (int64, int64) {
+	model, _ := payload["model"].(string)
+	tok := tokenizer.ForModel(model)
+	switch {
+	case isChatCompletionPath(path):
+		return estimatePromptTokens(tok, payload), parseMaxTokens(payload, defaultMaxTokens)
+	case path == completionsPath:
+		return int64(tokenizer.CountInput(tok, payload["prompt"])), parseMaxTokens(payload, defaultMaxTokens)
+	case path == embeddingsPath:
+		return int64(tokenizer.CountInput(tok, payload["input"])), 0
+	default:
+		return int64(tokenizer.CountInput(tok, payload)), 0
 	}
+}
 
-	totalBytes := int64(0)
-	for _, item := range messages {
-		msg, ok := item.(map[string]interface{})
-		if !ok {
-			continue
-		}
-		if role, ok := msg["role"].(string); ok {
-			totalBytes += int64(len([]byte(role)))
-		}
-		totalBytes += estimateContentBytes(msg["content"])
-	}
-	if totalBytes <= 0 {
-		return 0
-	}
-	return (totalBytes + 3) / 4
+// estimatePromptTokens 估算 chat messages 的 prompt token（含每条消息的固定开销）。
+// 配置了词表的模型与上游计数基本一致，其余模型按 CJK 友好的启发式估算。
+func estimatePromptTokens(tok tokenizer.Tokenizer, payload map[string]interface{}) int64 {
+	messages, _ := payload["messages"].([]interface{})
+	return int64(tokenizer.CountMessages(tok, messages))
 }
 
-// estimateContentBytes 统计 content 的文本字节数。
-// 兼容三类输入：
-// 1) 纯字符串 content；
-// 2) 数组结构（例如多段内容）；
-// 3) 对象结构中的 text/content 字段。
-func estimateContentBytes(v interface{}) int64 {
-	switch val := v.(type) {
-	case string:
-		return int64(len([]byte(val)))
-	case []interface{}:
-		total := int64(0)
-		for _, item := range val {
-			total += estimateContentBytes(item)
-		}
-		return total
-	case map[string]interface{}:
-		if text, ok := val["text"].(string); ok {
-			return int64(len([]byte(text)))
-		}
-		if content, ok := val["content"].(string); ok {
-			return int64(len([]byte(content)))
-		}
-		return 0
-	default:
-		return 0
+// historyPayloadForEstimate 返回续聊时 ChatHistoryMiddleware 实际发给上游的请求：messages 为历史 + 本轮，并已补齐会话设置。
+// 装配好的历史缓存在 context 中，由 ChatHistoryMiddleware 复用，同一请求不重复查询会话与历史。
+// 非续聊、会话不属于当前用户、父消息不存在或查询失败时返回 false，由调用方按本轮 messages 估算；错误留给会话中间件处理。
+func historyPayloadForEstimate(c *gin.Context, payload map[string]interface{}) (map[string]interface{}, bool) {
+	userID, ok := parseUserIDFromContext(c)
+	if !ok || userID <= 0 {
+		return nil, false
+	}
+	withHistory := make(map[string]interface{}, len(payload))
+	for k, v := range payload {
+		withHistory[k] = v
+	}
+	opts, err := consumeConversationOptions(withHistory)
+	if err != nil || !opts.hasConversationID || opts.newChat {
+		return nil, false
+	}
+	conversation, err := models.GetLLMConversationByIDAndUser(opts.conversationID, userID)
+	if err != nil {
+		return nil, false
+	}
+	applyConversationSettings(withHistory, conversation.Settings)
+	model := resolvePayloadModelAlias(withHistory)
+	currentMessages, err := parseRequestMessages(withHistory)
+	if err != nil || validateContinueMessages(currentMessages) != nil {
+		return nil, false
+	}
+	parentID, err := resolveHistoryParent(conversation, opts.parentMessageID, opts.hasParentMessageID)
+	if err != nil {
+		return nil, false
 	}
+	merged, historyCount, cutoff, err := buildUpstreamMessages(opts.conversationID, parentID, true, currentMessages, conversationHistoryBudget(conversation, model, withHistory))
+	if err != nil {
+		return nil, false
+	}
+	c.Set(contextKeyConversationHistory, &conversationHistory{
+		userID:             userID,
+		conversationID:     opts.conversationID,
+		parentMessageID:    opts.parentMessageID,
+		hasParentMessageID: opts.hasParentMessageID,
+		conversation:       conversation,
+		parentID:           parentID,
+		messages:           merged,
+		historyCount:       historyCount,
+		cutoff:             cutoff,
+	})
+	withHistory["messages"] = messagesToInterfaces(merged)
+	return withHistory, true
 }
 
 // parseMaxTokens 解析 max_tokens；缺失或非法时回退到配置默认值。
@@ -190,47 +253,9 @@ func parseMaxTokens(payload map[string]interface{}, fallback int64) int64 {
 		return fallback
 	}
 
-	n, ok := parseInt64Value(raw)
+	n, ok := utils.ParseInt64Value(raw)
 	if !ok || n < 0 {
 		return fallback
 	}
 	return n
 }
-
-// parseInt64Value 兼容解析常见 JSON 类型为 int64，供 max_tokens 等字段复用。
-func parseInt64Value(v interface{}) (int64, bool) {
-	switch val := v.(type) {
-	case int:
-		return int64(val), true
-	case int64:
-		return val, true
-	case uint:
-		return int64(val), true
-	case uint64:
-		return int64(val), true
-	case float64:
-		return int64(val), true
-	case json.Number:
-		if n, err := val.Int64(); err == nil {
-			return n, true
-		}
-		if f, err := val.Float64(); err == nil {
-			return int64(f), true
-		}
-		return 0, false
-	case string:
-		s := strings.TrimSpace(val)
-		if s == "" {
-			return 0, false
-		}
-		if n, err := strconv.ParseInt(s, 10, 64); err == nil {
-			return n, true
-		}
-		if f, err := strconv.ParseFloat(s, 64); err == nil {
-			return int64(f), true
-		}
-		return 0, false
-	default:
-		return 0, false
-	}
-}
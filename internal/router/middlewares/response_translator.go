@@ -0,0 +1,155 @@
+package middlewares
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nanami9426/imgo/internal/utils"
+)
+
+// responseTranslator 把 chat/completions 响应转换为兼容接口（/v1/messages、/v1/responses）自己的格式。
+type responseTranslator interface {
+	// translateEvent 处理一个 SSE 事件的 data 内容，转换结果写入 buf。
+	translateEvent(data []byte, buf *bytes.Buffer)
+	// finishStream 输出流式响应的收尾事件，需要保证可重复调用。
+	finishStream(buf *bytes.Buffer)
+	// convertBody 转换完整的非流式响应（含错误响应）。
+	convertBody(status int, body []byte) []byte
+}
+
+const (
+	translateModeUnknown = iota
+	translateModeJSON
+	translateModeStream
+)
+
+// translatedResponseWriter 在写回客户端前转换响应：
+// JSON 响应整体缓存到请求结束再转换；SSE 响应按完整事件逐条转换并立即写出。
+// 需要挂在用量与会话中间件之外，它们看到的始终是原始 chat/completions 响应。
+type translatedResponseWriter struct {
+	gin.ResponseWriter
+	translator responseTranslator
+	mode       int
+	pending    bytes.Buffer
+	size       int
+}
+
+func newTranslatedResponseWriter(w gin.ResponseWriter, translator responseTranslator) *translatedResponseWriter {
+	return &translatedResponseWriter{ResponseWriter: w, translator: translator}
+}
+
+func (w *translatedResponseWriter) decideMode() {
+	if w.mode != translateModeUnknown {
+		return
+	}
+	w.Header().Del("Content-Length")
+	contentType := strings.ToLower(w.Header().Get("Content-Type"))
+	if strings.HasPrefix(contentType, "text/event-stream") && w.ResponseWriter.Status() < http.StatusBadRequest {
+		w.mode = translateModeStream
+		return
+	}
+	w.mode = translateModeJSON
+}
+
+func (w *translatedResponseWriter) Write(b []byte) (int, error) {
+	w.decideMode()
+	w.size += len(b)
+	w.pending.Write(b)
+	if w.mode == translateModeStream {
+		if err := w.flushEvents(false); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+func (w *translatedResponseWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// Size 返回上游（chat/completions 格式）响应的字节数，与 /v1/chat/completions 的用量记录口径一致。
+func (w *translatedResponseWriter) Size() int {
+	return w.size
+}
+
+func (w *translatedResponseWriter) Written() bool {
+	return w.size > 0 || w.ResponseWriter.Written()
+}
+
+func (w *translatedResponseWriter) Flush() {
+	if w.mode == translateModeStream {
+		w.ResponseWriter.Flush()
+	}
+}
+
+// flushEvents 转换 pending 中所有完整的 SSE 事件；final 为 true 时把剩余内容也当作一个事件并输出收尾事件。
+func (w *translatedResponseWriter) flushEvents(final bool) error {
+	var out bytes.Buffer
+	for {
+		data := w.pending.Bytes()
+		idx := bytes.Index(data, []byte("\n\n"))
+		if idx < 0 {
+			if !final || len(bytes.TrimSpace(data)) == 0 {
+				break
+			}
+			idx = len(data)
+		}
+		event := append([]byte(nil), data[:idx]...)
+		w.pending.Next(min(idx+2, len(data)))
+		if payload := sseEventData(event); len(payload) > 0 {
+			w.translator.translateEvent(payload, &out)
+		}
+	}
+	if final {
+		w.pending.Reset()
+		w.translator.finishStream(&out)
+	}
+	if out.Len() == 0 {
+		return nil
+	}
+	_, err := w.ResponseWriter.Write(out.Bytes())
+	return err
+}
+
+// sseEventData 合并一个 SSE 事件中的全部 data 行。
+func sseEventData(event []byte) []byte {
+	var data []byte
+	for _, line := range bytes.Split(event, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if !bytes.HasPrefix(line, []byte("data:")) {
+			continue
+		}
+		if len(data) > 0 {
+			data = append(data, '\n')
+		}
+		data = append(data, bytes.TrimSpace(bytes.TrimPrefix(line, []byte("data:")))...)
+	}
+	return data
+}
+
+// writeSSEEvent 按 "event: <name>\ndata: <json>\n\n" 写出一个命名事件。
+func writeSSEEvent(buf *bytes.Buffer, event string, data []byte) {
+	buf.WriteString("event: ")
+	buf.WriteString(event)
+	buf.WriteString("\ndata: ")
+	buf.Write(data)
+	buf.WriteString("\n\n")
+}
+
+// finalize 在请求处理结束后写出转换后的 JSON 响应，或补齐流式响应的收尾事件。
+func (w *translatedResponseWriter) finalize() {
+	switch w.mode {
+	case translateModeStream:
+		if err := w.flushEvents(true); err == nil {
+			w.ResponseWriter.Flush()
+		}
+	case translateModeJSON:
+		converted := w.translator.convertBody(w.ResponseWriter.Status(), w.pending.Bytes())
+		w.Header().Set("Content-Type", "application/json")
+		if _, err := w.ResponseWriter.Write(converted); err != nil {
+			utils.Log.Errorf("write translated response failed: %v", err)
+		}
+	}
+}
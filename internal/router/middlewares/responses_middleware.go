@@ -0,0 +1,576 @@
+package middlewares
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nanami9426/imgo/internal/models"
+	"github.com/nanami9426/imgo/internal/utils"
+	"gorm.io/gorm"
+)
+
+const (
+	responsesPath = "/v1/responses"
+
+	responseIDPrefix        = "resp_"
+	responseMessageIDPrefix = "msg_"
+
+	responseStatusInProgress = "in_progress"
+	responseStatusCompleted  = "completed"
+	responseStatusIncomplete = "incomplete"
+	responseStatusFailed     = "failed"
+)
+
+// ResponsesMiddleware 为 POST /v1/responses 提供 OpenAI Responses API：
+// 1) 请求体转换为 chat/completions 请求，previous_response_id 解析为对应会话后按续聊处理；
+// 2) 响应（JSON 与 SSE）转换为 response 对象与 response.* 流式事件；
+// 3) 成功的响应写入 llm_response，记录 response_id 在会话中的位置，供续聊与 GET /v1/responses/{id} 使用。
+// 需挂在鉴权之后（解析 previous_response_id 需要 user_id）、会话与用量中间件之前。
+func ResponsesMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.Method != http.MethodPost || c.Request.URL.Path != responsesPath {
+			c.Next()
+			return
+		}
+		userID, ok := parseUserIDFromContext(c)
+		if !ok || userID <= 0 {
+			utils.Abort(c, http.StatusUnauthorized, utils.StatUnauthorized, "token无效或已过期", nil)
+			return
+		}
+
+		rawBody, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			abortResponsesInvalid(c, "", "读取请求体失败")
+			return
+		}
+		req, payload, err := convertResponsesRequest(rawBody)
+		if err != nil {
+			var paramErr *responsesParamError
+			if errors.As(err, &paramErr) {
+				abortResponsesInvalid(c, paramErr.param, paramErr.message)
+				return
+			}
+			abortResponsesInvalid(c, "", err.Error())
+			return
+		}
+		if req.PreviousResponseID != "" {
+			prev, err := models.GetLLMResponseByIDAndUser(req.PreviousResponseID, userID)
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				utils.AbortOpenAI(c, http.StatusNotFound, &utils.Error{
+					Message: fmt.Sprintf("Previous response with id '%s' not found.", req.PreviousResponseID),
+					Type:    "invalid_request_error",
+					Param:   "previous_response_id",
+					Code:    "previous_response_not_found",
+				})
+				return
+			}
+			if err != nil {
+				utils.Abort(c, http.StatusInternalServerError, utils.StatDatabaseError, "查询响应失败", err)
+				return
+			}
+			// 从该响应所在的位置继续：不是会话最新一轮时在消息树中开出新的分支，原分支不受影响。
+			payload["conversation_id"] = prev.ConversationID
+			if prev.MessageID > 0 {
+				payload["parent_message_id"] = prev.MessageID
+			}
+		}
+		body, err := json.Marshal(payload)
+		if err != nil {
+			utils.Abort(c, http.StatusInternalServerError, utils.StatInternalError, "重写请求失败", err)
+			return
+		}
+		restoreRequestBody(c, body)
+
+		translator := newResponsesTranslator(req)
+		writer := newTranslatedResponseWriter(c.Writer, translator)
+		c.Writer = writer
+		c.Next()
+		writer.finalize()
+		persistResponse(c, userID, translator.final)
+	}
+}
+
+// persistResponse 保存成功生成的 response 对象；失败只记日志，不影响已经写出的响应。
+func persistResponse(c *gin.Context, userID int64, final *responsesObject) {
+	if final == nil || final.Status == responseStatusFailed {
+		return
+	}
+	conversationID, _ := parseInt64ContextKey(c, contextKeyConversationID)
+	if conversationID <= 0 {
+		return
+	}
+	messageID, _ := parseInt64ContextKey(c, contextKeyAssistantMessageID)
+	raw, err := json.Marshal(final)
+	if err != nil {
+		utils.Log.Errorf("marshal response object failed: response_id=%s err=%v", final.ID, err)
+		return
+	}
+	previousID := ""
+	if final.PreviousResponseID != nil {
+		previousID = *final.PreviousResponseID
+	}
+	record := &models.LLMResponse{
+		ResponseID:         final.ID,
+		UserID:             userID,
+		ConversationID:     conversationID,
+		MessageID:          messageID,
+		PreviousResponseID: previousID,
+		Model:              final.Model,
+		Status:             final.Status,
+		ResponseJSON:       string(raw),
+	}
+	if err := models.CreateLLMResponse(record); err != nil {
+		utils.Log.Errorf("failed to create llm response: response_id=%s err=%v", final.ID, err)
+	}
+}
+
+type responsesParamError struct {
+	param   string
+	message string
+}
+
+func (e *responsesParamError) Error() string {
+	return e.param + ": " + e.message
+}
+
+func abortResponsesInvalid(c *gin.Context, param string, message string) {
+	utils.AbortOpenAI(c, http.StatusBadRequest, &utils.Error{
+		Message: message,
+		Type:    "invalid_request_error",
+		Param:   param,
+	})
+}
+
+type responsesRequest struct {
+	Model              string                 `json:"model"`
+	Input              json.RawMessage        `json:"input"`
+	Instructions       *string                `json:"instructions"`
+	PreviousResponseID string                 `json:"previous_response_id"`
+	MaxOutputTokens    *json.Number           `json:"max_output_tokens"`
+	Temperature        *json.Number           `json:"temperature"`
+	TopP               *json.Number           `json:"top_p"`
+	Stream             bool                   `json:"stream"`
+	User               string                 `json:"user"`
+	Metadata           map[string]interface{} `json:"metadata"`
+	Tools              []json.RawMessage      `json:"tools"`
+	// 网关会话扩展字段，原样交给 ChatHistoryMiddleware。
+	ConversationID  json.RawMessage `json:"conversation_id"`
+	NewChat         json.RawMessage `json:"new_chat"`
+	ParentMessageID json.RawMessage `json:"parent_message_id"`
+}
+
+type responsesInputItem struct {
+	Type    string          `json:"type"`
+	Role    string          `json:"role"`
+	Content json.RawMessage `json:"content"`
+}
+
+type responsesContentPart struct {
+	Type     string `json:"type"`
+	Text     string `json:"text"`
+	ImageURL string `json:"image_url"`
+}
+
+// convertResponsesRequest 把 Responses API 请求转换为 chat/completions 请求。
+// input 支持字符串或 message 数组（input_text / output_text / input_image），暂不支持工具调用相关的输入项与 tools。
+func convertResponsesRequest(rawBody []byte) (*responsesRequest, map[string]interface{}, error) {
+	req := &responsesRequest{}
+	dec := json.NewDecoder(bytes.NewReader(rawBody))
+	dec.UseNumber()
+	if err := dec.Decode(req); err != nil {
+		return nil, nil, errors.New("请求体必须是合法JSON对象")
+	}
+	req.PreviousResponseID = strings.TrimSpace(req.PreviousResponseID)
+	if strings.TrimSpace(req.Model) == "" {
+		return nil, nil, &responsesParamError{param: "model", message: "Missing required parameter: 'model'."}
+	}
+	if len(req.Tools) > 0 {
+		return nil, nil, &responsesParamError{param: "tools", message: "tools are not supported by this gateway."}
+	}
+	if req.PreviousResponseID != "" && (len(req.ConversationID) > 0 || len(req.NewChat) > 0 || len(req.ParentMessageID) > 0) {
+		return nil, nil, &responsesParamError{param: "previous_response_id", message: "previous_response_id cannot be used together with conversation_id, new_chat or parent_message_id."}
+	}
+
+	messages := make([]map[string]interface{}, 0, 2)
+	if req.Instructions != nil && strings.TrimSpace(*req.Instructions) != "" {
+		messages = append(messages, map[string]interface{}{"role": "system", "content": *req.Instructions})
+	}
+	input, err := convertResponsesInput(req.Input)
+	if err != nil {
+		return nil, nil, err
+	}
+	messages = append(messages, input...)
+
+	payload := map[string]interface{}{
+		"model":    req.Model,
+		"messages": messages,
+	}
+	if req.MaxOutputTokens != nil {
+		payload["max_tokens"] = *req.MaxOutputTokens
+	}
+	if req.Temperature != nil {
+		payload["temperature"] = *req.Temperature
+	}
+	if req.TopP != nil {
+		payload["top_p"] = *req.TopP
+	}
+	if req.User != "" {
+		payload["user"] = req.User
+	}
+	if req.Stream {
+		// response.completed 需要带 usage，要求上游在流末尾给出 usage。
+		payload["stream"] = true
+		payload["stream_options"] = map[string]interface{}{"include_usage": true}
+	}
+	if len(req.ConversationID) > 0 {
+		payload["conversation_id"] = req.ConversationID
+	}
+	if len(req.NewChat) > 0 {
+		payload["new_chat"] = req.NewChat
+	}
+	if len(req.ParentMessageID) > 0 {
+		payload["parent_message_id"] = req.ParentMessageID
+	}
+	return req, payload, nil
+}
+
+func convertResponsesInput(raw json.RawMessage) ([]map[string]interface{}, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, &responsesParamError{param: "input", message: "Missing required parameter: 'input'."}
+	}
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		return []map[string]interface{}{{"role": "user", "content": text}}, nil
+	}
+	var items []responsesInputItem
+	if err := json.Unmarshal(raw, &items); err != nil {
+		return nil, &responsesParamError{param: "input", message: "input must be a string or an array of input items."}
+	}
+	out := make([]map[string]interface{}, 0, len(items))
+	for i, item := range items {
+		if item.Type != "" && item.Type != "message" {
+			return nil, &responsesParamError{param: fmt.Sprintf("input[%d].type", i), message: "unsupported input item type: " + item.Type}
+		}
+		role := item.Role
+		if role == "developer" {
+			role = "system"
+		}
+		if role != "user" && role != "assistant" && role != "system" {
+			return nil, &responsesParamError{param: fmt.Sprintf("input[%d].role", i), message: "role must be one of user, assistant, system, developer."}
+		}
+		content, err := convertResponsesContent(item.Content)
+		if err != nil {
+			return nil, &responsesParamError{param: fmt.Sprintf("input[%d].content", i), message: err.Error()}
+		}
+		out = append(out, map[string]interface{}{"role": role, "content": content})
+	}
+	return out, nil
+}
+
+// convertResponsesContent 纯文本内容合并为字符串，含图片时转换为 content parts 数组（会话按原始 JSON 落库，previous_response_id 续聊时原样带上图片）。
+func convertResponsesContent(raw json.RawMessage) (interface{}, error) {
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		return text, nil
+	}
+	var parts []responsesContentPart
+	if err := json.Unmarshal(raw, &parts); err != nil {
+		return nil, errors.New("content must be a string or an array of content parts")
+	}
+	out := make([]map[string]interface{}, 0, len(parts))
+	texts := make([]string, 0, len(parts))
+	textOnly := true
+	for _, part := range parts {
+		switch part.Type {
+		case "input_text", "output_text":
+			texts = append(texts, part.Text)
+			out = append(out, map[string]interface{}{"type": "text", "text": part.Text})
+		case "input_image":
+			if part.ImageURL == "" {
+				return nil, errors.New("input_image requires image_url")
+			}
+			textOnly = false
+			out = append(out, map[string]interface{}{
+				"type":      "image_url",
+				"image_url": map[string]interface{}{"url": part.ImageURL},
+			})
+		default:
+			return nil, errors.New("unsupported content part type: " + part.Type)
+		}
+	}
+	if textOnly {
+		return strings.Join(texts, "\n"), nil
+	}
+	return out, nil
+}
+
+type responsesOutputText struct {
+	Type        string        `json:"type"`
+	Text        string        `json:"text"`
+	Annotations []interface{} `json:"annotations"`
+}
+
+type responsesOutputMessage struct {
+	Type    string                `json:"type"`
+	ID      string                `json:"id"`
+	Status  string                `json:"status"`
+	Role    string                `json:"role"`
+	Content []responsesOutputText `json:"content"`
+}
+
+type responsesUsage struct {
+	InputTokens  int64 `json:"input_tokens"`
+	OutputTokens int64 `json:"output_tokens"`
+	TotalTokens  int64 `json:"total_tokens"`
+}
+
+type responsesIncompleteDetails struct {
+	Reason string `json:"reason"`
+}
+
+type responsesErrorDetail struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// responsesObject 是 Responses API 的 response 对象。
+type responsesObject struct {
+	ID                 string                      `json:"id"`
+	Object             string                      `json:"object"`
+	CreatedAt          int64                       `json:"created_at"`
+	Status             string                      `json:"status"`
+	Model              string                      `json:"model"`
+	Output             []responsesOutputMessage    `json:"output"`
+	PreviousResponseID *string                     `json:"previous_response_id"`
+	Instructions       *string                     `json:"instructions"`
+	MaxOutputTokens    *json.Number                `json:"max_output_tokens"`
+	Temperature        *json.Number                `json:"temperature"`
+	TopP               *json.Number                `json:"top_p"`
+	IncompleteDetails  *responsesIncompleteDetails `json:"incomplete_details"`
+	Error              *responsesErrorDetail       `json:"error"`
+	Usage              *responsesUsage             `json:"usage"`
+	Metadata           map[string]interface{}      `json:"metadata"`
+}
+
+// responsesTranslator 把 chat/completions 响应转换为 response 对象，流式事件顺序为：
+// response.created -> response.in_progress -> response.output_item.added -> response.content_part.added
+// -> response.output_text.delta* -> response.output_text.done -> response.content_part.done
+// -> response.output_item.done -> response.completed（截断为 response.incomplete，出错为 response.failed）。
+type responsesTranslator struct {
+	base         responsesObject
+	itemID       string
+	seq          int
+	started      bool
+	finished     bool
+	text         strings.Builder
+	finishReason string
+	usage        *responsesUsage
+	failure      *responsesErrorDetail
+	// final 是最终返回给客户端的 response 对象，出错时为 nil。
+	final *responsesObject
+}
+
+func newResponsesTranslator(req *responsesRequest) *responsesTranslator {
+	id := strconv.FormatInt(utils.GenerateID(), 10)
+	base := responsesObject{
+		ID:              responseIDPrefix + id,
+		Object:          "response",
+		CreatedAt:       time.Now().UTC().Unix(),
+		Status:          responseStatusInProgress,
+		Model:           req.Model,
+		Output:          []responsesOutputMessage{},
+		Instructions:    req.Instructions,
+		MaxOutputTokens: req.MaxOutputTokens,
+		Temperature:     req.Temperature,
+		TopP:            req.TopP,
+		Metadata:        req.Metadata,
+	}
+	if req.PreviousResponseID != "" {
+		previousID := req.PreviousResponseID
+		base.PreviousResponseID = &previousID
+	}
+	if base.Metadata == nil {
+		base.Metadata = map[string]interface{}{}
+	}
+	return &responsesTranslator{base: base, itemID: responseMessageIDPrefix + id}
+}
+
+// complete 根据生成的文本与 finish_reason 生成最终 response 对象。
+func (t *responsesTranslator) complete() *responsesObject {
+	final := t.base
+	if t.failure != nil {
+		final.Status = responseStatusFailed
+		final.Error = t.failure
+	} else if t.finishReason == "length" {
+		final.Status = responseStatusIncomplete
+		final.IncompleteDetails = &responsesIncompleteDetails{Reason: "max_output_tokens"}
+	} else {
+		final.Status = responseStatusCompleted
+	}
+	final.Output = []responsesOutputMessage{t.outputMessage(final.Status)}
+	final.Usage = t.usage
+	t.final = &final
+	return t.final
+}
+
+func (t *responsesTranslator) outputMessage(status string) responsesOutputMessage {
+	content := []responsesOutputText{}
+	if status != responseStatusInProgress {
+		content = append(content, t.outputText())
+	}
+	return responsesOutputMessage{
+		Type:    "message",
+		ID:      t.itemID,
+		Status:  status,
+		Role:    "assistant",
+		Content: content,
+	}
+}
+
+func (t *responsesTranslator) outputText() responsesOutputText {
+	return responsesOutputText{Type: "output_text", Text: t.text.String(), Annotations: []interface{}{}}
+}
+
+func (t *responsesTranslator) applyUsage(usage *openAIChatUsage) {
+	if usage == nil {
+		return
+	}
+	t.usage = &responsesUsage{
+		InputTokens:  usage.PromptTokens,
+		OutputTokens: usage.CompletionTokens,
+		TotalTokens:  usage.PromptTokens + usage.CompletionTokens,
+	}
+}
+
+// convertBody 转换非流式响应；错误响应已是 {"error":{...}} 结构，原样返回。
+func (t *responsesTranslator) convertBody(status int, body []byte) []byte {
+	if status >= http.StatusBadRequest {
+		return body
+	}
+	var resp openAIChatCompletion
+	if err := json.Unmarshal(body, &resp); err != nil || len(resp.Choices) == 0 {
+		return body
+	}
+	if resp.Model != "" {
+		t.base.Model = resp.Model
+	}
+	t.text.WriteString(resp.Choices[0].Message.Content)
+	t.finishReason = resp.Choices[0].FinishReason
+	t.applyUsage(resp.Usage)
+	converted, err := json.Marshal(t.complete())
+	if err != nil {
+		t.final = nil
+		return body
+	}
+	return converted
+}
+
+func (t *responsesTranslator) emit(buf *bytes.Buffer, event string, fields gin.H) {
+	fields["type"] = event
+	fields["sequence_number"] = t.seq
+	t.seq++
+	encoded, err := json.Marshal(fields)
+	if err != nil {
+		return
+	}
+	writeSSEEvent(buf, event, encoded)
+}
+
+func (t *responsesTranslator) start(buf *bytes.Buffer) {
+	if t.started {
+		return
+	}
+	t.started = true
+	t.emit(buf, "response.created", gin.H{"response": t.base})
+	t.emit(buf, "response.in_progress", gin.H{"response": t.base})
+	t.emit(buf, "response.output_item.added", gin.H{
+		"output_index": 0,
+		"item":         t.outputMessage(responseStatusInProgress),
+	})
+	t.emit(buf, "response.content_part.added", gin.H{
+		"item_id":       t.itemID,
+		"output_index":  0,
+		"content_index": 0,
+		"part":          responsesOutputText{Type: "output_text", Text: "", Annotations: []interface{}{}},
+	})
+}
+
+// translateEvent 处理一个 SSE 事件的 data 内容，[DONE] 时输出收尾事件。
+func (t *responsesTranslator) translateEvent(data []byte, buf *bytes.Buffer) {
+	if t.finished {
+		return
+	}
+	if bytes.Equal(data, []byte("[DONE]")) {
+		t.finishStream(buf)
+		return
+	}
+	var chunk openAIChatCompletion
+	if err := json.Unmarshal(data, &chunk); err != nil {
+		return
+	}
+	if len(chunk.Error) > 0 && string(chunk.Error) != "null" {
+		t.failure = &responsesErrorDetail{Code: "server_error", Message: extractErrorMessage(data)}
+		t.emit(buf, "error", gin.H{"code": t.failure.Code, "message": t.failure.Message, "param": nil})
+		return
+	}
+	if chunk.Model != "" && !t.started {
+		t.base.Model = chunk.Model
+	}
+	t.start(buf)
+	for _, choice := range chunk.Choices {
+		if choice.Delta.Content != "" {
+			t.text.WriteString(choice.Delta.Content)
+			t.emit(buf, "response.output_text.delta", gin.H{
+				"item_id":       t.itemID,
+				"output_index":  0,
+				"content_index": 0,
+				"delta":         choice.Delta.Content,
+			})
+		}
+		if choice.FinishReason != "" {
+			t.finishReason = choice.FinishReason
+		}
+	}
+	t.applyUsage(chunk.Usage)
+}
+
+func (t *responsesTranslator) finishStream(buf *bytes.Buffer) {
+	if t.finished {
+		return
+	}
+	t.start(buf)
+	t.finished = true
+	final := t.complete()
+	t.emit(buf, "response.output_text.done", gin.H{
+		"item_id":       t.itemID,
+		"output_index":  0,
+		"content_index": 0,
+		"text":          t.text.String(),
+	})
+	t.emit(buf, "response.content_part.done", gin.H{
+		"item_id":       t.itemID,
+		"output_index":  0,
+		"content_index": 0,
+		"part":          t.outputText(),
+	})
+	t.emit(buf, "response.output_item.done", gin.H{
+		"output_index": 0,
+		"item":         final.Output[0],
+	})
+	event := "response.completed"
+	switch final.Status {
+	case responseStatusIncomplete:
+		event = "response.incomplete"
+	case responseStatusFailed:
+		event = "response.failed"
+	}
+	t.emit(buf, event, gin.H{"response": final})
+}
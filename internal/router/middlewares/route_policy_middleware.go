@@ -0,0 +1,52 @@
+package middlewares
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nanami9426/imgo/internal/utils"
+)
+
+// contextKeyRoutePolicy 是本次请求命中的路由策略（utils.RoutePolicy）。
+const contextKeyRoutePolicy = "route_policy"
+
+// RoutePolicyMiddleware 按路由策略表拦截 /v1 请求：
+// 1) 被规则禁用的路由返回 403（code=route_disabled）；
+// 2) 未匹配任何规则且 default.action=deny 时返回 404（code=unknown_url），不暴露上游存在哪些路由；
+// 3) 放行时把命中的策略写入 context，限流与用量中间件据此决定是否处理以及如何计费。
+func RoutePolicyMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		method, path := c.Request.Method, c.Request.URL.Path
+		policy, matched := utils.MatchRoutePolicy(method, path)
+		if policy.Denied() {
+			if !matched {
+				utils.AbortOpenAI(c, http.StatusNotFound, &utils.Error{
+					Message: fmt.Sprintf("Unknown request URL: %s %s.", method, path),
+					Type:    "invalid_request_error",
+					Code:    "unknown_url",
+				})
+				return
+			}
+			utils.AbortOpenAI(c, http.StatusForbidden, &utils.Error{
+				Message: fmt.Sprintf("Route %s %s is disabled by gateway policy.", method, path),
+				Type:    "invalid_request_error",
+				Code:    "route_disabled",
+			})
+			return
+		}
+		c.Set(contextKeyRoutePolicy, policy)
+		c.Next()
+	}
+}
+
+// routePolicyFromContext 读取 RoutePolicyMiddleware 写入的策略，未挂载该中间件时现场匹配。
+func routePolicyFromContext(c *gin.Context) utils.RoutePolicy {
+	if v, ok := c.Get(contextKeyRoutePolicy); ok {
+		if policy, ok := v.(utils.RoutePolicy); ok {
+			return policy
+		}
+	}
+	policy, _ := utils.MatchRoutePolicy(c.Request.Method, c.Request.URL.Path)
+	return policy
+}
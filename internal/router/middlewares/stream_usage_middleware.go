@@ -0,0 +1,103 @@
+package middlewares
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nanami9426/imgo/internal/utils"
+)
+
+// StreamUsageMiddleware 保证流式响应总能拿到上游的 token 用量：
+// 1) 对 stream=true 的 chat 类接口与 /v1/completions 请求注入 stream_options.include_usage=true；
+// 2) 客户端本来没有要求 usage 时，把上游额外输出的 usage chunk（choices 为空）从返回给客户端的流中去掉。
+// 需挂在用量与会话中间件之外，它们看到的是包含 usage chunk 的完整上游响应。
+func StreamUsageMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		path := c.Request.URL.Path
+		if c.Request.Method != http.MethodPost || !(isChatCompletionPath(path) || path == completionsPath) {
+			c.Next()
+			return
+		}
+
+		rawBody, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			utils.Abort(c, http.StatusBadRequest, utils.StatInvalidParam, "读取请求体失败", err)
+			return
+		}
+		restoreRequestBody(c, rawBody)
+
+		payload := map[string]interface{}{}
+		dec := json.NewDecoder(bytes.NewReader(rawBody))
+		dec.UseNumber()
+		if err := dec.Decode(&payload); err != nil {
+			// 请求体错误交给后续中间件和上游按原逻辑返回。
+			c.Next()
+			return
+		}
+		if !injectStreamIncludeUsage(payload) {
+			c.Next()
+			return
+		}
+		body, err := json.Marshal(payload)
+		if err != nil {
+			c.Next()
+			return
+		}
+		restoreRequestBody(c, body)
+
+		writer := newTranslatedResponseWriter(c.Writer, streamUsageFilter{})
+		c.Writer = writer
+		c.Next()
+		writer.finalize()
+	}
+}
+
+// injectStreamIncludeUsage 为流式请求补上 stream_options.include_usage=true，
+// 返回 true 表示请求被改写（客户端原本没有要求 usage），响应中的 usage chunk 需要去掉。
+func injectStreamIncludeUsage(payload map[string]interface{}) bool {
+	if stream, _ := payload["stream"].(bool); !stream {
+		return false
+	}
+	options := map[string]interface{}{}
+	if raw, ok := payload["stream_options"]; ok && raw != nil {
+		existing, ok := raw.(map[string]interface{})
+		if !ok {
+			// 格式不合法时不改写，由上游返回参数错误。
+			return false
+		}
+		if includeUsage, _ := existing["include_usage"].(bool); includeUsage {
+			return false
+		}
+		options = existing
+	}
+	options["include_usage"] = true
+	payload["stream_options"] = options
+	return true
+}
+
+// streamUsageFilter 原样转发 SSE 事件，只丢弃 include_usage 产生的 usage chunk；非流式响应不做改动。
+type streamUsageFilter struct{}
+
+type streamUsageChunk struct {
+	Choices []json.RawMessage `json:"choices"`
+	Usage   json.RawMessage   `json:"usage"`
+}
+
+func (streamUsageFilter) translateEvent(data []byte, buf *bytes.Buffer) {
+	var chunk streamUsageChunk
+	if err := json.Unmarshal(data, &chunk); err == nil && len(chunk.Choices) == 0 && len(chunk.Usage) > 0 && !bytes.Equal(chunk.Usage, []byte("null")) {
+		return
+	}
+	buf.WriteString("data: ")
+	buf.Write(data)
+	buf.WriteString("\n\n")
+}
+
+func (streamUsageFilter) finishStream(buf *bytes.Buffer) {}
+
+func (streamUsageFilter) convertBody(status int, body []byte) []byte {
+	return body
+}
@@ -7,16 +7,44 @@ import (
 )
 
 func RigisterVLLMRoutes(r *gin.Engine) {
+	// 会话摘要、自动标题等网关内部发起的上游调用由 service 提供。
+	middlewares.SetChatCompleter(service.CompleteChat)
 	v1 := r.Group("/v1")
+	// Anthropic 兼容层最先执行，鉴权等错误也能按 Anthropic 格式返回。
+	v1.Use(middlewares.AnthropicMessagesMiddleware())
 	v1.Use(middlewares.GatewayAuthMiddleware())
+	// 路由策略决定后续是否限流、如何计费、是否记录用量，被禁用的路由在这里直接拒绝。
+	v1.Use(middlewares.RoutePolicyMiddleware())
+	// Responses API 需要 user_id 解析 previous_response_id，挂在鉴权之后。
+	v1.Use(middlewares.ResponsesMiddleware())
+	// 会话重新生成需要 user_id 读取会话，并在限流前转换为 chat/completions 请求。
+	v1.Use(middlewares.ConversationRegenerateMiddleware())
 	v1.Use(middlewares.RateLimitMiddleware())
+	// 流式请求强制要求上游返回 usage，需在会话与用量中间件之外去掉客户端没有要求的 usage chunk。
+	v1.Use(middlewares.StreamUsageMiddleware())
 	// 先做会话处理（改写请求、写入历史），再做 API 用量统计。
 	v1.Use(middlewares.ChatHistoryMiddleware())
 	v1.Use(middlewares.APILoggingMiddleware())
 	v1.GET("/conversations", service.GetConversations)
+	v1.GET("/conversations/search", service.SearchConversations)
+	v1.GET("/conversations/export", service.ExportConversations)
+	v1.POST("/conversations/import", service.ImportConversations)
 	v1.GET("/conversations/:conversation_id/messages", service.GetConversationMessages)
+	v1.GET("/conversations/:conversation_id/export", service.ExportConversation)
+	v1.PATCH("/conversations/:conversation_id", service.UpdateConversation)
+	v1.PUT("/conversations/:conversation_id/active_message", service.SetConversationActiveMessage)
+	v1.GET("/conversations/:conversation_id/settings", service.GetConversationSettings)
+	v1.PATCH("/conversations/:conversation_id/settings", service.UpdateConversationSettings)
 	v1.DELETE("/conversations/:conversation_id", service.DeleteConversation)
+	v1.DELETE("/conversations/:conversation_id/summary", service.DeleteConversationSummary)
+	v1.POST("/conversations/:conversation_id/regenerate", service.ChatCompletionsHandler())
 	v1.POST("/chat/completions", service.ChatCompletionsHandler())
+	v1.POST("/messages", service.ChatCompletionsHandler())
+	v1.POST("/responses", service.ChatCompletionsHandler())
+	v1.GET("/responses/:response_id", service.GetResponse)
+	v1.GET("/models", service.ListModelsHandler())
+	v1.GET("/models/*model", service.RetrieveModelHandler())
+	v1.POST("/tokenize", service.TokenizeHandler())
 	v1.Any("/:path", service.ProxyToVLLM())
 	v1.Any("/:path/*any", service.ProxyToVLLM())
 }
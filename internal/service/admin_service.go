@@ -0,0 +1,17 @@
+package service
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/nanami9426/imgo/internal/utils"
+)
+
+// @Summary 上游副本池状态
+// @Description 返回每个上游的负载均衡策略、副本在途请求数与摘除状态（仅管理员）
+// @Tags admin
+// @Produce json
+// @Router /admin/upstreams [get]
+func GetUpstreamPools(c *gin.Context) {
+	utils.Success(c, gin.H{
+		"upstreams": snapshotUpstreams(),
+	})
+}
@@ -0,0 +1,320 @@
+package service
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nanami9426/imgo/internal/utils"
+)
+
+const (
+	contextKeyQueueDepth  = "queue_depth"
+	contextKeyQueueWaitMs = "queue_wait_ms"
+
+	responseHeaderQueueDepth  = "X-Queue-Depth"
+	responseHeaderQueueWaitMs = "X-Queue-Wait-Ms"
+)
+
+var (
+	errAdmissionQueueFull = errors.New("admission queue is full")
+	errAdmissionTimeout   = errors.New("admission queue wait timeout")
+)
+
+// admissionError 描述一次准入失败：队列已满或排队超时。
+type admissionError struct {
+	err     error
+	scope   string
+	depth   int
+	waited  time.Duration
+	timeout time.Duration
+}
+
+func (e *admissionError) Error() string {
+	return fmt.Sprintf("%s: %s", e.scope, e.err)
+}
+
+func (e *admissionError) Unwrap() error {
+	return e.err
+}
+
+// admissionWaiter 是队列中的一个等待请求。
+// 排序使用加权公平排队的虚拟完成时间：finish = max(virtualTime, 该用户上一个 finish) + 1/weight，
+// 同一用户连续排队的请求 finish 依次递增，因此重度用户只会排在自己的请求后面，不会饿死其他用户。
+type admissionWaiter struct {
+	userID   int64
+	start    float64
+	finish   float64
+	seq      uint64
+	index    int
+	admitted bool
+	ready    chan struct{}
+}
+
+type admissionQueue []*admissionWaiter
+
+func (q admissionQueue) Len() int { return len(q) }
+
+func (q admissionQueue) Less(i, j int) bool {
+	if q[i].finish != q[j].finish {
+		return q[i].finish < q[j].finish
+	}
+	return q[i].seq < q[j].seq
+}
+
+func (q admissionQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *admissionQueue) Push(x interface{}) {
+	w := x.(*admissionWaiter)
+	w.index = len(*q)
+	*q = append(*q, w)
+}
+
+func (q *admissionQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	w := old[n-1]
+	old[n-1] = nil
+	w.index = -1
+	*q = old[:n-1]
+	return w
+}
+
+// admissionController 限制一个上游（或上游下的一个模型）的并发请求数。
+type admissionController struct {
+	scope string
+	cfg   utils.UpstreamAdmissionConfig
+
+	mu          sync.Mutex
+	inFlight    int
+	queue       admissionQueue
+	virtualTime float64
+	lastFinish  map[int64]float64
+	seq         uint64
+	rejected    uint64
+	timedOut    uint64
+}
+
+// admissionTicket 是一次成功准入的凭证，请求结束时必须调用 release。
+type admissionTicket struct {
+	ctrl   *admissionController
+	depth  int
+	waited time.Duration
+}
+
+// release 归还并发名额；无限制的上游返回 nil ticket，调用是安全的空操作。
+func (t *admissionTicket) release() {
+	if t == nil || t.ctrl == nil {
+		return
+	}
+	t.ctrl.release()
+	t.ctrl = nil
+}
+
+type admissionSnapshot struct {
+	Scope       string `json:"scope"`
+	MaxInFlight int    `json:"max_in_flight"`
+	InFlight    int    `json:"in_flight"`
+	Queued      int    `json:"queued"`
+	MaxQueue    int    `json:"max_queue"`
+	Rejected    uint64 `json:"rejected"`
+	TimedOut    uint64 `json:"timed_out"`
+}
+
+func newAdmissionController(scope string, cfg utils.UpstreamAdmissionConfig) *admissionController {
+	return &admissionController{
+		scope:      scope,
+		cfg:        cfg,
+		lastFinish: map[int64]float64{},
+	}
+}
+
+// acquire 申请一个并发名额：
+// 1) 有空闲名额且队列为空时直接放行；
+// 2) 队列已满时立即拒绝；
+// 3) 否则按用户权重入队等待，超过 queue_timeout_ms 或客户端断开时出队并返回错误。
+func (a *admissionController) acquire(ctx context.Context, userID int64) (*admissionTicket, error) {
+	a.mu.Lock()
+	if a.inFlight < a.cfg.MaxInFlight && len(a.queue) == 0 {
+		a.inFlight++
+		a.mu.Unlock()
+		return &admissionTicket{ctrl: a}, nil
+	}
+	depth := len(a.queue)
+	if depth >= a.cfg.MaxQueue {
+		a.rejected++
+		a.mu.Unlock()
+		return nil, &admissionError{err: errAdmissionQueueFull, scope: a.scope, depth: depth}
+	}
+	weight := utils.GetAdmissionWeight(userID)
+	start := a.virtualTime
+	if last, ok := a.lastFinish[userID]; ok && last > start {
+		start = last
+	}
+	a.seq++
+	w := &admissionWaiter{
+		userID: userID,
+		start:  start,
+		finish: start + 1/weight,
+		seq:    a.seq,
+		ready:  make(chan struct{}),
+	}
+	a.lastFinish[userID] = w.finish
+	heap.Push(&a.queue, w)
+	a.mu.Unlock()
+
+	startedAt := time.Now()
+	timeout := msDuration(a.cfg.QueueTimeoutMs)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	var waitErr error
+	select {
+	case <-w.ready:
+		return &admissionTicket{ctrl: a, depth: depth, waited: time.Since(startedAt)}, nil
+	case <-timer.C:
+		waitErr = errAdmissionTimeout
+	case <-ctx.Done():
+		waitErr = ctx.Err()
+	}
+
+	a.mu.Lock()
+	if w.admitted {
+		// 超时与出队同时发生：名额已经分给本请求，按成功处理。
+		a.mu.Unlock()
+		return &admissionTicket{ctrl: a, depth: depth, waited: time.Since(startedAt)}, nil
+	}
+	heap.Remove(&a.queue, w.index)
+	if errors.Is(waitErr, errAdmissionTimeout) {
+		a.timedOut++
+	}
+	a.resetIdleLocked()
+	a.mu.Unlock()
+	return nil, &admissionError{err: waitErr, scope: a.scope, depth: depth, waited: time.Since(startedAt), timeout: timeout}
+}
+
+// release 归还名额，并按虚拟完成时间依次唤醒排队请求。
+func (a *admissionController) release() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.inFlight > 0 {
+		a.inFlight--
+	}
+	for a.inFlight < a.cfg.MaxInFlight && len(a.queue) > 0 {
+		w := heap.Pop(&a.queue).(*admissionWaiter)
+		a.virtualTime = w.start
+		a.inFlight++
+		w.admitted = true
+		close(w.ready)
+	}
+	a.resetIdleLocked()
+}
+
+// resetIdleLocked 在队列清空后重置虚拟时间，公平性只在有积压时才有意义，也避免 lastFinish 无限增长。
+func (a *admissionController) resetIdleLocked() {
+	if len(a.queue) == 0 {
+		a.virtualTime = 0
+		a.lastFinish = map[int64]float64{}
+	}
+}
+
+func (a *admissionController) snapshot() admissionSnapshot {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return admissionSnapshot{
+		Scope:       a.scope,
+		MaxInFlight: a.cfg.MaxInFlight,
+		InFlight:    a.inFlight,
+		Queued:      len(a.queue),
+		MaxQueue:    a.cfg.MaxQueue,
+		Rejected:    a.rejected,
+		TimedOut:    a.timedOut,
+	}
+}
+
+// admissionFor 返回请求对应的准入控制器；未限制并发时返回 nil。
+func (rt *upstreamRuntime) admissionFor(model string) *admissionController {
+	cfg := rt.cfg.Admission
+	if cfg.MaxInFlight <= 0 {
+		return nil
+	}
+	scope := rt.cfg.Name
+	if cfg.Scope == utils.UpstreamAdmissionScopeModel && model != "" {
+		scope = rt.cfg.Name + "/" + model
+	}
+	rt.admissionMu.Lock()
+	defer rt.admissionMu.Unlock()
+	ctrl, ok := rt.admission[scope]
+	if !ok {
+		ctrl = newAdmissionController(scope, cfg)
+		rt.admission[scope] = ctrl
+	}
+	return ctrl
+}
+
+// admitUpstream 为一次上游请求申请并发名额，并把排队深度与累计等待时间写入响应头与 context。
+func admitUpstream(c *gin.Context, rt *upstreamRuntime, model string) (*admissionTicket, error) {
+	ctrl := rt.admissionFor(model)
+	if ctrl == nil {
+		return nil, nil
+	}
+	userID, _ := parseUserID(c)
+	ticket, err := ctrl.acquire(c.Request.Context(), userID)
+	depth, waited := 0, time.Duration(0)
+	if ticket != nil {
+		depth, waited = ticket.depth, ticket.waited
+	}
+	var admitErr *admissionError
+	if errors.As(err, &admitErr) {
+		depth, waited = admitErr.depth, admitErr.waited
+	}
+	recordQueueStats(c, depth, waited)
+	return ticket, err
+}
+
+// recordQueueStats 累加本请求的排队等待时间（重试可能多次排队），深度取最近一次。
+func recordQueueStats(c *gin.Context, depth int, waited time.Duration) {
+	totalWaitMs := c.GetInt(contextKeyQueueWaitMs) + int(waited.Milliseconds())
+	c.Set(contextKeyQueueDepth, depth)
+	c.Set(contextKeyQueueWaitMs, totalWaitMs)
+	c.Writer.Header().Set(responseHeaderQueueDepth, strconv.Itoa(depth))
+	c.Writer.Header().Set(responseHeaderQueueWaitMs, strconv.Itoa(totalWaitMs))
+}
+
+// abortAdmission 返回 OpenAI 风格 503：队列已满为 upstream_overloaded，排队超时为 queue_timeout。
+func abortAdmission(c *gin.Context, err error) {
+	var admitErr *admissionError
+	if !errors.As(err, &admitErr) {
+		writeUpstreamError(c.Writer)
+		return
+	}
+	var code, message string
+	switch {
+	case errors.Is(admitErr.err, errAdmissionQueueFull):
+		code = "upstream_overloaded"
+		message = fmt.Sprintf("upstream %s is overloaded: admission queue is full (%d waiting)", admitErr.scope, admitErr.depth)
+	case errors.Is(admitErr.err, errAdmissionTimeout):
+		code = "queue_timeout"
+		message = fmt.Sprintf("upstream %s is overloaded: request waited %dms in queue without being admitted", admitErr.scope, admitErr.timeout.Milliseconds())
+	default:
+		// 客户端在排队期间断开，响应大概率无人接收，只保证状态码与日志一致。
+		code = "queue_canceled"
+		message = fmt.Sprintf("request canceled while waiting in queue of upstream %s", admitErr.scope)
+	}
+	c.Header("Retry-After", "1")
+	utils.AbortOpenAI(c, http.StatusServiceUnavailable, &utils.Error{
+		Message: message,
+		Type:    "server_error",
+		Code:    code,
+	})
+}
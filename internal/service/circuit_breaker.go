@@ -0,0 +1,259 @@
+package service
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nanami9426/imgo/internal/utils"
+)
+
+type breakerState string
+
+const (
+	breakerClosed   breakerState = "closed"
+	breakerOpen     breakerState = "open"
+	breakerHalfOpen breakerState = "half_open"
+
+	// 滚动窗口切分成固定数量的桶，过期桶在访问时惰性清零。
+	breakerWindowBuckets = 10
+	// 每个熔断器保留的最近状态变更条数，供管理接口排查。
+	maxBreakerTransitions = 20
+)
+
+// breakerOutcome 是一次请求对熔断器的反馈。
+type breakerOutcome int
+
+const (
+	breakerSuccess breakerOutcome = iota
+	breakerFailure
+	// breakerIgnored 表示请求结果不计入统计（如客户端主动断开），只释放半开探测名额。
+	breakerIgnored
+)
+
+type breakerBucket struct {
+	startMs  int64
+	total    int
+	failures int
+}
+
+type breakerTransition struct {
+	From   breakerState `json:"from"`
+	To     breakerState `json:"to"`
+	Reason string       `json:"reason"`
+	At     string       `json:"at"`
+}
+
+// circuitBreaker 是上游级熔断器（closed/open/half_open）。
+type circuitBreaker struct {
+	name string
+	cfg  utils.UpstreamCircuitBreakerConfig
+
+	mu                  sync.Mutex
+	state               breakerState
+	consecutiveFailures int
+	buckets             [breakerWindowBuckets]breakerBucket
+	openedAt            time.Time
+	openReason          string
+	halfOpenInFlight    int
+	transitions         []breakerTransition
+}
+
+type breakerSnapshot struct {
+	Enabled             bool                `json:"enabled"`
+	State               breakerState        `json:"state"`
+	Reason              string              `json:"reason,omitempty"`
+	OpenedAt            string              `json:"opened_at,omitempty"`
+	RetryAfterSeconds   int                 `json:"retry_after_seconds,omitempty"`
+	ConsecutiveFailures int                 `json:"consecutive_failures"`
+	WindowRequests      int                 `json:"window_requests"`
+	WindowFailures      int                 `json:"window_failures"`
+	Transitions         []breakerTransition `json:"transitions"`
+}
+
+func newCircuitBreaker(name string, cfg utils.UpstreamCircuitBreakerConfig) *circuitBreaker {
+	return &circuitBreaker{
+		name:  name,
+		cfg:   cfg,
+		state: breakerClosed,
+	}
+}
+
+// allow 判断请求能否发往该上游；拒绝时返回建议的 Retry-After。
+// 半开状态下只放行有限个探测请求，放行的请求必须调用 record 归还名额。
+func (b *circuitBreaker) allow() (bool, time.Duration) {
+	if b == nil || b.cfg.Disabled {
+		return true, 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	switch b.state {
+	case breakerOpen:
+		openFor := msDuration(b.cfg.OpenMs)
+		if elapsed := now.Sub(b.openedAt); elapsed < openFor {
+			return false, openFor - elapsed
+		}
+		b.transitionLocked(breakerHalfOpen, "open timeout elapsed", now)
+		fallthrough
+	case breakerHalfOpen:
+		if b.halfOpenInFlight >= b.cfg.HalfOpenMaxRequests {
+			return false, time.Second
+		}
+		b.halfOpenInFlight++
+		return true, 0
+	default:
+		return true, 0
+	}
+}
+
+// record 根据请求结果推进状态机。
+func (b *circuitBreaker) record(outcome breakerOutcome) {
+	if b == nil || b.cfg.Disabled {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+
+	if b.state == breakerHalfOpen && b.halfOpenInFlight > 0 {
+		b.halfOpenInFlight--
+	}
+	if outcome == breakerIgnored {
+		return
+	}
+
+	bucket := b.bucketLocked(now)
+	bucket.total++
+	if outcome == breakerFailure {
+		bucket.failures++
+		b.consecutiveFailures++
+	} else {
+		b.consecutiveFailures = 0
+	}
+
+	switch b.state {
+	case breakerHalfOpen:
+		if outcome == breakerSuccess {
+			b.resetWindowLocked()
+			b.transitionLocked(breakerClosed, "half-open probe succeeded", now)
+		} else {
+			b.transitionLocked(breakerOpen, "half-open probe failed", now)
+		}
+	case breakerClosed:
+		if outcome != breakerFailure {
+			return
+		}
+		if b.consecutiveFailures >= b.cfg.ConsecutiveFailures {
+			b.transitionLocked(breakerOpen, fmt.Sprintf("%d consecutive failures", b.consecutiveFailures), now)
+			return
+		}
+		total, failures := b.windowCountsLocked(now)
+		if total >= b.cfg.MinRequests && float64(failures)/float64(total) >= b.cfg.ErrorRateThreshold {
+			b.transitionLocked(breakerOpen, fmt.Sprintf("error rate %d/%d over %dms window", failures, total, b.cfg.WindowMs), now)
+		}
+	}
+}
+
+func (b *circuitBreaker) transitionLocked(to breakerState, reason string, now time.Time) {
+	from := b.state
+	if from == to {
+		return
+	}
+	b.state = to
+	switch to {
+	case breakerOpen:
+		b.openedAt = now
+		b.openReason = reason
+		b.halfOpenInFlight = 0
+		utils.Log.Errorf("circuit breaker opened: upstream=%s from=%s reason=%s", b.name, from, reason)
+	case breakerHalfOpen:
+		b.halfOpenInFlight = 0
+		utils.Log.Infof("circuit breaker half-open: upstream=%s reason=%s", b.name, reason)
+	case breakerClosed:
+		b.consecutiveFailures = 0
+		b.openReason = ""
+		utils.Log.Infof("circuit breaker closed: upstream=%s from=%s reason=%s", b.name, from, reason)
+	}
+	b.transitions = append(b.transitions, breakerTransition{
+		From:   from,
+		To:     to,
+		Reason: reason,
+		At:     now.UTC().Format(time.RFC3339),
+	})
+	if len(b.transitions) > maxBreakerTransitions {
+		b.transitions = b.transitions[len(b.transitions)-maxBreakerTransitions:]
+	}
+}
+
+// bucketLocked 返回当前时间所在的桶，桶过期时先清零。
+func (b *circuitBreaker) bucketLocked(now time.Time) *breakerBucket {
+	width := b.bucketWidthMs()
+	startMs := now.UnixMilli() / width * width
+	bucket := &b.buckets[(startMs/width)%breakerWindowBuckets]
+	if bucket.startMs != startMs {
+		*bucket = breakerBucket{startMs: startMs}
+	}
+	return bucket
+}
+
+func (b *circuitBreaker) windowCountsLocked(now time.Time) (int, int) {
+	minStart := now.UnixMilli() - int64(b.cfg.WindowMs)
+	total, failures := 0, 0
+	for _, bucket := range b.buckets {
+		if bucket.startMs > minStart {
+			total += bucket.total
+			failures += bucket.failures
+		}
+	}
+	return total, failures
+}
+
+func (b *circuitBreaker) resetWindowLocked() {
+	b.buckets = [breakerWindowBuckets]breakerBucket{}
+}
+
+func (b *circuitBreaker) bucketWidthMs() int64 {
+	width := int64(b.cfg.WindowMs) / breakerWindowBuckets
+	if width <= 0 {
+		width = 1
+	}
+	return width
+}
+
+// snapshot 返回熔断器状态快照，包含最近的状态变更记录。
+func (b *circuitBreaker) snapshot() breakerSnapshot {
+	if b == nil {
+		return breakerSnapshot{State: breakerClosed}
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	total, failures := b.windowCountsLocked(now)
+	out := breakerSnapshot{
+		Enabled:             !b.cfg.Disabled,
+		State:               b.state,
+		Reason:              b.openReason,
+		ConsecutiveFailures: b.consecutiveFailures,
+		WindowRequests:      total,
+		WindowFailures:      failures,
+		Transitions:         append([]breakerTransition(nil), b.transitions...),
+	}
+	if b.state == breakerOpen {
+		out.OpenedAt = b.openedAt.UTC().Format(time.RFC3339)
+		if remaining := msDuration(b.cfg.OpenMs) - now.Sub(b.openedAt); remaining > 0 {
+			out.RetryAfterSeconds = int((remaining + time.Second - 1) / time.Second)
+		}
+	}
+	return out
+}
+
+// openReasonText 返回当前熔断原因，用于拒绝请求时的错误信息。
+func (b *circuitBreaker) openReasonText() string {
+	if b == nil {
+		return ""
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.openReason
+}
@@ -0,0 +1,174 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nanami9426/imgo/internal/utils"
+	"golang.org/x/sync/singleflight"
+)
+
+// contextKeyCoalesced 标记本次响应来自其他相同在途请求的上游调用，用量中间件据此打标。
+const contextKeyCoalesced = "coalesced"
+
+var (
+	// chatCoalesceGroup 负责同一实例内的合并，跨实例合并由 Redis 锁完成。
+	chatCoalesceGroup singleflight.Group
+
+	errCoalesceLeaderFailed = errors.New("coalesce leader failed")
+)
+
+// coalesceLookup 是一次可合并请求的合并上下文。
+type coalesceLookup struct {
+	cfg       utils.CoalesceConfig
+	hash      string
+	lockKey   string
+	resultKey string
+}
+
+// coalescedResponse 是 leader 拿到的完整上游响应，由所有等待者共享。
+type coalescedResponse struct {
+	entry *utils.CachedChatCompletion
+	// remote 为 true 表示结果来自其他网关实例的 leader。
+	remote bool
+}
+
+// prepareCoalesce 判断请求能否与相同在途请求合并，不能时返回 nil。
+// 只合并非流式且 temperature=0 的请求：流式响应无法在多个客户端之间同步回放，非确定性请求不应共享结果。
+func prepareCoalesce(payload map[string]interface{}) *coalesceLookup {
+	cfg := utils.GetCoalesceConfig()
+	if !cfg.Enabled || payload == nil {
+		return nil
+	}
+	if stream, _ := payload["stream"].(bool); stream {
+		return nil
+	}
+	if !utils.IsDeterministicChatRequest(payload) {
+		return nil
+	}
+	hash, err := utils.HashChatCompletionRequest(payload)
+	if err != nil {
+		utils.Log.Errorf("hash chat completion request failed: %v", err)
+		return nil
+	}
+	lockKey, resultKey := utils.BuildCoalesceKeys(cfg, hash)
+	return &coalesceLookup{
+		cfg:       cfg,
+		hash:      hash,
+		lockKey:   lockKey,
+		resultKey: resultKey,
+	}
+}
+
+// serve 以合并方式处理请求，返回 false 表示需要调用方自行转发：
+// 1) 同一实例内相同请求通过 singleflight 只由 leader 调用一次上游；
+// 2) leader 失败时已向自己的客户端写出错误，其余等待者各自转发，避免把一次失败扩散给所有人；
+// 3) 每个调用方都写出共享响应，用量按各自的 user_id 记录。
+func (l *coalesceLookup) serve(c *gin.Context, rawBody []byte, cache *responseCacheLookup) bool {
+	executed := false
+	v, err, _ := chatCoalesceGroup.Do(l.hash, func() (interface{}, error) {
+		executed = true
+		return l.lead(c, rawBody, cache)
+	})
+	if err != nil {
+		return executed
+	}
+	res := v.(*coalescedResponse)
+	if !executed || res.remote {
+		c.Set(contextKeyCoalesced, true)
+		setServedModel(c, res.entry.Model)
+	}
+	writeCachedResponse(c, res.entry)
+	return true
+}
+
+// lead 是本实例 leader 的执行逻辑：
+// 1) 抢 Redis 锁成为跨实例 leader；没抢到则等待其他实例发布结果，等不到再自行转发；
+// 2) 转发并完整读取上游响应，持锁时发布结果供其他实例取走；
+// 3) Redis 异常时退化为仅实例内合并。
+func (l *coalesceLookup) lead(c *gin.Context, rawBody []byte, cache *responseCacheLookup) (*coalescedResponse, error) {
+	ctx := c.Request.Context()
+	token := strconv.FormatInt(utils.GenerateID(), 10)
+	locked, err := utils.AcquireCoalesceLock(ctx, l.lockKey, token, msDuration(l.cfg.LockTTLMs))
+	if err != nil {
+		utils.Log.Errorf("acquire coalesce lock failed: key=%s err=%v", l.lockKey, err)
+	} else if !locked {
+		if entry := l.waitRemote(ctx); entry != nil {
+			return &coalescedResponse{entry: entry, remote: true}, nil
+		}
+	}
+	if locked {
+		defer func() {
+			err := runDetached(func(ctx context.Context) error {
+				return utils.ReleaseCoalesceLock(ctx, l.lockKey, token)
+			})
+			if err != nil {
+				utils.Log.Errorf("release coalesce lock failed: key=%s err=%v", l.lockKey, err)
+			}
+		}()
+	}
+
+	result, ok := forwardChatCompletionWithFallback(c, rawBody)
+	if !ok {
+		return nil, errCoalesceLeaderFailed
+	}
+	defer result.release()
+	defer result.resp.Body.Close()
+	body, err := io.ReadAll(result.resp.Body)
+	if err != nil {
+		writeUpstreamError(c.Writer)
+		return nil, err
+	}
+	entry := &utils.CachedChatCompletion{
+		StatusCode:  result.resp.StatusCode,
+		ContentType: result.resp.Header.Get("Content-Type"),
+		Model:       c.GetString(contextKeyServedModel),
+		Body:        body,
+		CreatedAt:   time.Now().UTC().Unix(),
+	}
+	if locked {
+		err := runDetached(func(ctx context.Context) error {
+			return utils.SetCachedChatCompletion(ctx, l.resultKey, entry, msDuration(l.cfg.ResultTTLMs))
+		})
+		if err != nil {
+			utils.Log.Errorf("publish coalesced result failed: key=%s err=%v", l.resultKey, err)
+		}
+	}
+	if cache != nil {
+		cache.store(c, entry.StatusCode, entry.ContentType, entry.Body)
+	}
+	return &coalescedResponse{entry: entry}, nil
+}
+
+// waitRemote 轮询其他实例 leader 发布的结果。
+// leader 先发布结果再释放锁，所以看到锁消失后需要再查一次结果；仍没有说明 leader 失败，返回 nil 由调用方自行转发。
+func (l *coalesceLookup) waitRemote(ctx context.Context) *utils.CachedChatCompletion {
+	deadline := time.Now().Add(msDuration(l.cfg.WaitTimeoutMs))
+	interval := msDuration(l.cfg.PollIntervalMs)
+	for {
+		entry, err := utils.GetCachedChatCompletion(ctx, l.resultKey)
+		if err != nil {
+			utils.Log.Errorf("read coalesced result failed: key=%s err=%v", l.resultKey, err)
+			return nil
+		}
+		if entry != nil {
+			return entry
+		}
+		exists, err := utils.CoalesceLockExists(ctx, l.lockKey)
+		if err != nil {
+			utils.Log.Errorf("check coalesce lock failed: key=%s err=%v", l.lockKey, err)
+			return nil
+		}
+		if !exists {
+			entry, _ := utils.GetCachedChatCompletion(ctx, l.resultKey)
+			return entry
+		}
+		if time.Now().After(deadline) || !sleepWithContext(ctx, interval) {
+			return nil
+		}
+	}
+}
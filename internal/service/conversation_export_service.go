@@ -0,0 +1,253 @@
+package service
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nanami9426/imgo/internal/models"
+	"github.com/nanami9426/imgo/internal/utils"
+	"gorm.io/gorm"
+)
+
+const (
+	conversationFormatJSON     = "json"
+	conversationFormatMarkdown = "markdown"
+	conversationFormatJSONL    = "jsonl"
+	// conversationFormatChatGPT 只用于导入：ChatGPT 数据导出中的 conversations.json。
+	conversationFormatChatGPT = "chatgpt"
+
+	// 批量导出时每次从数据库读取的会话数。
+	exportConversationBatchSize = 100
+)
+
+// exportedConversation 是 format=json 的导出结构，也是 json 导入接受的结构。
+type exportedConversation struct {
+	ConversationID int64             `json:"conversation_id,omitempty"`
+	Title          string            `json:"title"`
+	Model          string            `json:"model,omitempty"`
+	Tags           []string          `json:"tags,omitempty"`
+	CreatedAt      string            `json:"created_at,omitempty"`
+	Messages       []exportedMessage `json:"messages"`
+}
+
+type exportedMessage struct {
+	MessageID int64  `json:"message_id,omitempty"`
+	Role      string `json:"role"`
+	Content   string `json:"content"`
+	Model     string `json:"model,omitempty"`
+	CreatedAt string `json:"created_at,omitempty"`
+}
+
+// fineTuningRecord 是 format=jsonl 的一行，与 OpenAI 微调数据格式一致。
+type fineTuningRecord struct {
+	Messages []json.RawMessage `json:"messages"`
+}
+
+// ExportConversation 导出当前登录用户的指定会话，format=json（默认）/ markdown / jsonl，以附件形式返回。
+// jsonl 为 OpenAI 微调格式的一行 {"messages":[...]}，消息取自原始 MessageJSON；只导出当前分支，不含滚动摘要。
+func ExportConversation(c *gin.Context) {
+	userID, ok := parseUserID(c)
+	if !ok || userID <= 0 {
+		utils.Fail(c, http.StatusUnauthorized, utils.StatUnauthorized, "token无效或已过期", nil)
+		return
+	}
+	conversationID, err := strconv.ParseInt(strings.TrimSpace(c.Param("conversation_id")), 10, 64)
+	if err != nil || conversationID <= 0 {
+		utils.Fail(c, http.StatusOK, utils.StatInvalidParam, "conversation_id 必须是正整数", nil)
+		return
+	}
+	format, err := parseExportFormat(c)
+	if err != nil {
+		utils.Fail(c, http.StatusOK, utils.StatInvalidParam, err.Error(), nil)
+		return
+	}
+
+	conversation, err := models.GetLLMConversationByIDAndUser(conversationID, userID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			utils.Fail(c, http.StatusOK, utils.StatNotFound, "会话不存在", nil)
+			return
+		}
+		utils.Fail(c, http.StatusOK, utils.StatDatabaseError, "查询会话失败", err)
+		return
+	}
+	var buf bytes.Buffer
+	if err := writeConversationExport(&buf, conversation, format); err != nil {
+		utils.Fail(c, http.StatusOK, utils.StatDatabaseError, "导出会话失败", err)
+		return
+	}
+
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, exportFileName(conversation.ConversationID, format)))
+	c.Data(http.StatusOK, exportContentType(format), buf.Bytes())
+}
+
+// ExportConversations 把当前登录用户的全部会话（含归档）打包为 zip 导出，每个会话一个文件，格式同单个导出。
+func ExportConversations(c *gin.Context) {
+	userID, ok := parseUserID(c)
+	if !ok || userID <= 0 {
+		utils.Fail(c, http.StatusUnauthorized, utils.StatUnauthorized, "token无效或已过期", nil)
+		return
+	}
+	format, err := parseExportFormat(c)
+	if err != nil {
+		utils.Fail(c, http.StatusOK, utils.StatInvalidParam, err.Error(), nil)
+		return
+	}
+	batch, err := models.ListLLMConversationsByUserAfterID(userID, 0, exportConversationBatchSize)
+	if err != nil {
+		utils.Fail(c, http.StatusOK, utils.StatDatabaseError, "查询会话列表失败", err)
+		return
+	}
+
+	// 开始写 zip 后响应头已发出，之后的错误只能记录日志并中断输出。
+	c.Header("Content-Type", "application/zip")
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="conversations-%s.zip"`, time.Now().UTC().Format("20060102")))
+	c.Status(http.StatusOK)
+	zw := zip.NewWriter(c.Writer)
+	for {
+		for _, conversation := range batch {
+			w, err := zw.CreateHeader(&zip.FileHeader{
+				Name:     exportFileName(conversation.ConversationID, format),
+				Method:   zip.Deflate,
+				Modified: conversation.LastMessageAt,
+			})
+			if err == nil {
+				err = writeConversationExport(w, conversation, format)
+			}
+			if err != nil {
+				utils.Log.Errorf("failed to export conversations: user_id=%d err=%v", userID, err)
+				return
+			}
+		}
+		if len(batch) < exportConversationBatchSize {
+			break
+		}
+		// 按 conversation_id 游标翻页：导出期间有会话续聊或新建也不会重复或遗漏已有会话。
+		afterID := batch[len(batch)-1].ConversationID
+		if batch, err = models.ListLLMConversationsByUserAfterID(userID, afterID, exportConversationBatchSize); err != nil {
+			utils.Log.Errorf("failed to export conversations: user_id=%d err=%v", userID, err)
+			return
+		}
+	}
+	if err := zw.Close(); err != nil {
+		utils.Log.Errorf("failed to export conversations: user_id=%d err=%v", userID, err)
+	}
+}
+
+func parseExportFormat(c *gin.Context) (string, error) {
+	format := strings.ToLower(strings.TrimSpace(c.DefaultQuery("format", conversationFormatJSON)))
+	switch format {
+	case conversationFormatJSON, conversationFormatMarkdown, conversationFormatJSONL:
+		return format, nil
+	default:
+		return "", errors.New("format 必须是 json、markdown 或 jsonl")
+	}
+}
+
+func exportFileName(conversationID int64, format string) string {
+	ext := format
+	if format == conversationFormatMarkdown {
+		ext = "md"
+	}
+	return fmt.Sprintf("conversation-%d.%s", conversationID, ext)
+}
+
+func exportContentType(format string) string {
+	switch format {
+	case conversationFormatMarkdown:
+		return "text/markdown; charset=utf-8"
+	case conversationFormatJSONL:
+		return "application/jsonl; charset=utf-8"
+	default:
+		return "application/json; charset=utf-8"
+	}
+}
+
+// writeConversationExport 读取会话当前分支的消息并按 format 写出。
+func writeConversationExport(w io.Writer, conversation *models.LLMConversation, format string) error {
+	messages, err := models.ListLLMConversationBranchMessages(conversation)
+	if err != nil {
+		return err
+	}
+	switch format {
+	case conversationFormatMarkdown:
+		return writeMarkdownExport(w, conversation, messages)
+	case conversationFormatJSONL:
+		return writeJSONLExport(w, messages)
+	default:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(toExportedConversation(conversation, messages))
+	}
+}
+
+func toExportedConversation(conversation *models.LLMConversation, messages []*models.LLMConversationMessage) exportedConversation {
+	out := exportedConversation{
+		ConversationID: conversation.ConversationID,
+		Title:          conversation.Title,
+		Model:          conversation.Model,
+		Tags:           models.SplitLLMConversationTags(conversation.Tags),
+		CreatedAt:      conversation.CreatedAt.UTC().Format(time.RFC3339Nano),
+		Messages:       make([]exportedMessage, 0, len(messages)),
+	}
+	for _, msg := range messages {
+		out.Messages = append(out.Messages, exportedMessage{
+			MessageID: msg.MessageID,
+			Role:      msg.Role,
+			Content:   msg.Content,
+			Model:     msg.Model,
+			CreatedAt: msg.CreatedAt.UTC().Format(time.RFC3339Nano),
+		})
+	}
+	return out
+}
+
+// writeMarkdownExport 输出标题、会话信息，再按 "## role" 分节输出每条消息；导入时按同样的分节解析。
+func writeMarkdownExport(w io.Writer, conversation *models.LLMConversation, messages []*models.LLMConversationMessage) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s\n\n", conversation.Title)
+	fmt.Fprintf(&b, "- conversation_id: %d\n", conversation.ConversationID)
+	if conversation.Model != "" {
+		fmt.Fprintf(&b, "- model: %s\n", conversation.Model)
+	}
+	if tags := models.SplitLLMConversationTags(conversation.Tags); len(tags) > 0 {
+		fmt.Fprintf(&b, "- tags: %s\n", strings.Join(tags, ", "))
+	}
+	fmt.Fprintf(&b, "- created_at: %s\n", conversation.CreatedAt.UTC().Format(time.RFC3339Nano))
+	for _, msg := range messages {
+		fmt.Fprintf(&b, "\n## %s\n\n%s\n", msg.Role, strings.TrimSpace(msg.Content))
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// writeJSONLExport 输出一行 OpenAI 微调格式记录，消息优先使用原始 MessageJSON（保留 name 等字段）。
+func writeJSONLExport(w io.Writer, messages []*models.LLMConversationMessage) error {
+	record := fineTuningRecord{Messages: make([]json.RawMessage, 0, len(messages))}
+	for _, msg := range messages {
+		raw := json.RawMessage(strings.TrimSpace(msg.MessageJSON))
+		if len(raw) == 0 || !json.Valid(raw) {
+			fallback, err := json.Marshal(map[string]string{"role": msg.Role, "content": msg.Content})
+			if err != nil {
+				return err
+			}
+			raw = fallback
+		}
+		record.Messages = append(record.Messages, raw)
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(line, '\n'))
+	return err
+}
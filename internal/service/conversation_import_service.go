@@ -0,0 +1,505 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nanami9426/imgo/internal/models"
+	"github.com/nanami9426/imgo/internal/utils"
+)
+
+const (
+	maxImportBytes                   = 32 << 20
+	maxImportConversations           = 500
+	maxImportMessagesPerConversation = 10000
+	// importDefaultTitleRunes 与会话中间件的默认标题一致：没有标题时截取首条 user 消息。
+	importDefaultTitleRunes = 30
+	importFallbackTitle     = "新对话"
+)
+
+// importedConversation 是各导入格式解析后的统一结构。
+type importedConversation struct {
+	Title    string
+	Model    string
+	Tags     []string
+	Messages []importedMessage
+}
+
+type importedMessage struct {
+	Role    string
+	Content string
+	Model   string
+	// Raw 为 jsonl 中的原始消息，写入 MessageJSON 以保留 name 等字段；其他格式为 nil。
+	Raw       map[string]interface{}
+	CreatedAt time.Time
+}
+
+// ImportConversations 把导出的会话导入为当前登录用户的新会话，返回新建的会话ID。
+// format=json（默认，单个对象或数组）/ markdown / jsonl（每行一个会话）/ chatgpt（ChatGPT 数据导出中的 conversations.json）；
+// 数据可以是请求体，也可以是 multipart 表单中的 file 字段。只导入 system/user/assistant 文本消息，多条 system 时保留最后一条。
+func ImportConversations(c *gin.Context) {
+	userID, ok := parseUserID(c)
+	if !ok || userID <= 0 {
+		utils.Fail(c, http.StatusUnauthorized, utils.StatUnauthorized, "token无效或已过期", nil)
+		return
+	}
+	format := strings.ToLower(strings.TrimSpace(c.DefaultQuery("format", conversationFormatJSON)))
+	parse, ok := conversationImporters[format]
+	if !ok {
+		utils.Fail(c, http.StatusOK, utils.StatInvalidParam, "format 必须是 json、markdown、jsonl 或 chatgpt", nil)
+		return
+	}
+	data, err := readImportData(c)
+	if err != nil {
+		utils.Fail(c, http.StatusOK, utils.StatInvalidParam, err.Error(), nil)
+		return
+	}
+	conversations, err := parse(data)
+	if err != nil {
+		utils.Fail(c, http.StatusOK, utils.StatInvalidParam, "解析导入数据失败: "+err.Error(), nil)
+		return
+	}
+	if len(conversations) == 0 {
+		utils.Fail(c, http.StatusOK, utils.StatInvalidParam, "没有可导入的会话", nil)
+		return
+	}
+	if len(conversations) > maxImportConversations {
+		utils.Fail(c, http.StatusOK, utils.StatInvalidParam, fmt.Sprintf("单次最多导入 %d 个会话", maxImportConversations), nil)
+		return
+	}
+
+	// 先全部校验再写库，避免导入到一半因数据问题失败。
+	type importRecord struct {
+		conversation *models.LLMConversation
+		messages     []*models.LLMConversationMessage
+	}
+	records := make([]importRecord, 0, len(conversations))
+	for i, item := range conversations {
+		conversation, messages, err := buildImportRecords(userID, item)
+		if err != nil {
+			utils.Fail(c, http.StatusOK, utils.StatInvalidParam, fmt.Sprintf("第 %d 个会话: %s", i+1, err.Error()), nil)
+			return
+		}
+		records = append(records, importRecord{conversation: conversation, messages: messages})
+	}
+	ids := make([]int64, 0, len(records))
+	for _, record := range records {
+		if err := models.ImportLLMConversation(record.conversation, record.messages); err != nil {
+			// 已导入的会话不回滚，在提示中告知数量，避免重复导入。
+			utils.Fail(c, http.StatusOK, utils.StatDatabaseError, fmt.Sprintf("导入会话失败，已导入 %d 个", len(ids)), err)
+			return
+		}
+		ids = append(ids, record.conversation.ConversationID)
+	}
+
+	utils.Success(c, gin.H{
+		"conversation_ids": ids,
+		"count":            len(ids),
+	})
+}
+
+var conversationImporters = map[string]func([]byte) ([]importedConversation, error){
+	conversationFormatJSON:     parseJSONImport,
+	conversationFormatMarkdown: parseMarkdownImport,
+	conversationFormatJSONL:    parseJSONLImport,
+	conversationFormatChatGPT:  parseChatGPTImport,
+}
+
+// readImportData 读取 multipart 的 file 字段或整个请求体，最多 32MB。
+func readImportData(c *gin.Context) ([]byte, error) {
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxImportBytes)
+	var r io.Reader = c.Request.Body
+	if c.ContentType() == gin.MIMEMultipartPOSTForm {
+		header, err := c.FormFile("file")
+		if err != nil {
+			return nil, errors.New("读取上传文件失败")
+		}
+		file, err := header.Open()
+		if err != nil {
+			return nil, errors.New("读取上传文件失败")
+		}
+		defer file.Close()
+		r = file
+	}
+	data, err := io.ReadAll(io.LimitReader(r, maxImportBytes+1))
+	if err != nil {
+		return nil, errors.New("读取导入数据失败")
+	}
+	if len(data) > maxImportBytes {
+		return nil, fmt.Errorf("导入数据不能超过 %dMB", maxImportBytes>>20)
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil, errors.New("导入数据不能为空")
+	}
+	return data, nil
+}
+
+// buildImportRecords 把解析结果转换为待写入的会话与消息：
+// 1) 过滤非文本与空消息，developer 视为 system，只保留最后一条 system 并放在最前；
+// 2) 消息时间缺失或早于上一条时顺延 1ms，保证导入后的顺序与原顺序一致；
+// 3) 没有标题时与新会话一致，截取首条 user 消息；
+// 4) 导入的消息是一条线性分支。
+func buildImportRecords(userID int64, item importedConversation) (*models.LLMConversation, []*models.LLMConversationMessage, error) {
+	var system *importedMessage
+	messages := make([]importedMessage, 0, len(item.Messages))
+	for _, msg := range item.Messages {
+		msg.Role = strings.ToLower(strings.TrimSpace(msg.Role))
+		if msg.Role == "developer" {
+			msg.Role = "system"
+		}
+		if strings.TrimSpace(msg.Content) == "" {
+			continue
+		}
+		switch msg.Role {
+		case "system":
+			system = &msg
+		case "user", "assistant":
+			messages = append(messages, msg)
+		}
+	}
+	if len(messages) == 0 {
+		return nil, nil, errors.New("没有可导入的 user/assistant 消息")
+	}
+	if len(messages) > maxImportMessagesPerConversation {
+		return nil, nil, fmt.Errorf("单个会话最多导入 %d 条消息", maxImportMessagesPerConversation)
+	}
+	if system != nil {
+		messages = append([]importedMessage{*system}, messages...)
+	}
+	tags, err := normalizeConversationTags(item.Tags)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	conversation := &models.LLMConversation{
+		ConversationID: utils.GenerateID(),
+		UserID:         userID,
+		Title:          importTitle(item.Title, messages),
+		Model:          strings.TrimSpace(item.Model),
+		Tags:           models.JoinLLMConversationTags(tags),
+	}
+
+	prev := time.Now().UTC()
+	for _, msg := range messages {
+		if !msg.CreatedAt.IsZero() {
+			prev = msg.CreatedAt.UTC()
+			break
+		}
+	}
+	prev = prev.Add(-time.Millisecond)
+	out := make([]*models.LLMConversationMessage, 0, len(messages))
+	for _, msg := range messages {
+		createdAt := msg.CreatedAt.UTC()
+		if msg.CreatedAt.IsZero() || !createdAt.After(prev) {
+			createdAt = prev.Add(time.Millisecond)
+		}
+		prev = createdAt
+
+		raw := msg.Raw
+		if raw == nil {
+			raw = map[string]interface{}{}
+		}
+		raw["role"] = msg.Role
+		raw["content"] = msg.Content
+		messageJSON, err := json.Marshal(raw)
+		if err != nil {
+			return nil, nil, err
+		}
+		model := strings.TrimSpace(msg.Model)
+		if model == "" {
+			model = conversation.Model
+		}
+		record := &models.LLMConversationMessage{
+			MessageID:      utils.GenerateID(),
+			ConversationID: conversation.ConversationID,
+			UserID:         userID,
+			Role:           msg.Role,
+			Content:        msg.Content,
+			MessageJSON:    string(messageJSON),
+			Model:          model,
+			Basic:          models.Basic{CreatedAt: createdAt, UpdatedAt: createdAt},
+		}
+		// user/assistant 依次串成一条分支，最后一条为当前叶子；system 不在消息树中。
+		if msg.Role != "system" {
+			record.ParentMessageID = conversation.ActiveMessageID
+			conversation.ActiveMessageID = record.MessageID
+		}
+		out = append(out, record)
+	}
+	conversation.CreatedAt = out[0].CreatedAt
+	conversation.LastMessageAt = prev
+	return conversation, out, nil
+}
+
+func importTitle(title string, messages []importedMessage) string {
+	title = strings.TrimSpace(title)
+	if title != "" {
+		return truncateRunes(title, models.MaxLLMConversationTitleRunes)
+	}
+	for _, msg := range messages {
+		if msg.Role == "user" {
+			return truncateRunes(strings.TrimSpace(msg.Content), importDefaultTitleRunes)
+		}
+	}
+	return importFallbackTitle
+}
+
+func truncateRunes(s string, limit int) string {
+	rs := []rune(s)
+	if len(rs) <= limit {
+		return s
+	}
+	return string(rs[:limit])
+}
+
+// parseJSONImport 解析 format=json 导出的单个会话对象或其数组。
+func parseJSONImport(data []byte) ([]importedConversation, error) {
+	var list []exportedConversation
+	if err := decodeObjectOrArray(data, &list); err != nil {
+		return nil, err
+	}
+	out := make([]importedConversation, 0, len(list))
+	for _, item := range list {
+		conversation := importedConversation{
+			Title:    item.Title,
+			Model:    item.Model,
+			Tags:     item.Tags,
+			Messages: make([]importedMessage, 0, len(item.Messages)),
+		}
+		for _, msg := range item.Messages {
+			createdAt, _ := time.Parse(time.RFC3339Nano, strings.TrimSpace(msg.CreatedAt))
+			conversation.Messages = append(conversation.Messages, importedMessage{
+				Role:      msg.Role,
+				Content:   msg.Content,
+				Model:     msg.Model,
+				CreatedAt: createdAt,
+			})
+		}
+		out = append(out, conversation)
+	}
+	return out, nil
+}
+
+// parseJSONLImport 解析 OpenAI 微调格式：每行一个 {"messages":[...]}，content 为多段时只拼接其中的文本。
+func parseJSONLImport(data []byte) ([]importedConversation, error) {
+	out := []importedConversation{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), maxImportBytes)
+	for line := 1; scanner.Scan(); line++ {
+		text := bytes.TrimSpace(scanner.Bytes())
+		if len(text) == 0 {
+			continue
+		}
+		var record struct {
+			Messages []map[string]interface{} `json:"messages"`
+		}
+		if err := json.Unmarshal(text, &record); err != nil {
+			return nil, fmt.Errorf("第 %d 行不是合法 JSON", line)
+		}
+		conversation := importedConversation{Messages: make([]importedMessage, 0, len(record.Messages))}
+		for _, raw := range record.Messages {
+			role, _ := raw["role"].(string)
+			conversation.Messages = append(conversation.Messages, importedMessage{
+				Role:    role,
+				Content: importContentText(raw["content"]),
+				Raw:     raw,
+			})
+		}
+		out = append(out, conversation)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// importContentText 取出字符串 content，或多段 content 中 text 段拼接后的文本。
+func importContentText(v interface{}) string {
+	switch val := v.(type) {
+	case string:
+		return val
+	case []interface{}:
+		parts := make([]string, 0, len(val))
+		for _, item := range val {
+			switch part := item.(type) {
+			case string:
+				parts = append(parts, part)
+			case map[string]interface{}:
+				if text, ok := part["text"].(string); ok {
+					parts = append(parts, text)
+				}
+			}
+		}
+		return strings.Join(parts, "\n")
+	default:
+		return ""
+	}
+}
+
+// parseMarkdownImport 解析 format=markdown 导出：首个 "# " 行为标题，"- model:" / "- tags:" 为会话信息，
+// 每个 "## system|user|assistant" 行开始一条消息。
+func parseMarkdownImport(data []byte) ([]importedConversation, error) {
+	conversation := importedConversation{}
+	var current *importedMessage
+	var body []string
+	flush := func() {
+		if current != nil {
+			current.Content = strings.TrimSpace(strings.Join(body, "\n"))
+			conversation.Messages = append(conversation.Messages, *current)
+		}
+		body = nil
+	}
+	for _, line := range strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "## ") {
+			role := strings.ToLower(strings.TrimSpace(strings.TrimPrefix(trimmed, "## ")))
+			if role == "system" || role == "user" || role == "assistant" {
+				flush()
+				current = &importedMessage{Role: role}
+				continue
+			}
+		}
+		if current != nil {
+			body = append(body, line)
+			continue
+		}
+		switch {
+		case strings.HasPrefix(trimmed, "# ") && conversation.Title == "":
+			conversation.Title = strings.TrimSpace(strings.TrimPrefix(trimmed, "# "))
+		case strings.HasPrefix(trimmed, "- model:"):
+			conversation.Model = strings.TrimSpace(strings.TrimPrefix(trimmed, "- model:"))
+		case strings.HasPrefix(trimmed, "- tags:"):
+			conversation.Tags = strings.Split(strings.TrimPrefix(trimmed, "- tags:"), ",")
+		}
+	}
+	flush()
+	if len(conversation.Messages) == 0 {
+		return nil, errors.New("没有找到 ## user / ## assistant 消息分节")
+	}
+	return []importedConversation{conversation}, nil
+}
+
+// chatGPTConversation 是 ChatGPT 数据导出 conversations.json 中的一个会话：消息以树的形式保存在 mapping 中，
+// current_node 为当前显示分支的叶子节点。
+type chatGPTConversation struct {
+	Title       string                 `json:"title"`
+	Mapping     map[string]chatGPTNode `json:"mapping"`
+	CurrentNode string                 `json:"current_node"`
+}
+
+type chatGPTNode struct {
+	Parent   string          `json:"parent"`
+	Children []string        `json:"children"`
+	Message  *chatGPTMessage `json:"message"`
+}
+
+type chatGPTMessage struct {
+	Author struct {
+		Role string `json:"role"`
+	} `json:"author"`
+	Content struct {
+		ContentType string        `json:"content_type"`
+		Parts       []interface{} `json:"parts"`
+	} `json:"content"`
+	CreateTime *float64 `json:"create_time"`
+	Metadata   struct {
+		ModelSlug string `json:"model_slug"`
+		Hidden    bool   `json:"is_visually_hidden_from_conversation"`
+	} `json:"metadata"`
+}
+
+// parseChatGPTImport 解析 ChatGPT 数据导出：沿 current_node 回溯到根得到当前分支（没有 current_node 时从根沿最后一个子节点向下），
+// 只保留 text / multimodal_text 中的文本段，跳过隐藏消息与工具消息。
+func parseChatGPTImport(data []byte) ([]importedConversation, error) {
+	var list []chatGPTConversation
+	if err := decodeObjectOrArray(data, &list); err != nil {
+		return nil, err
+	}
+	out := make([]importedConversation, 0, len(list))
+	for _, item := range list {
+		conversation := importedConversation{Title: item.Title}
+		for _, node := range chatGPTBranch(item) {
+			msg := node.Message
+			if msg == nil || msg.Metadata.Hidden {
+				continue
+			}
+			if msg.Content.ContentType != "text" && msg.Content.ContentType != "multimodal_text" {
+				continue
+			}
+			imported := importedMessage{
+				Role:    msg.Author.Role,
+				Content: importContentText(msg.Content.Parts),
+				Model:   msg.Metadata.ModelSlug,
+			}
+			if msg.CreateTime != nil && *msg.CreateTime > 0 {
+				sec, frac := math.Modf(*msg.CreateTime)
+				imported.CreatedAt = time.Unix(int64(sec), int64(frac*1e9)).UTC()
+			}
+			if imported.Model != "" && conversation.Model == "" {
+				conversation.Model = imported.Model
+			}
+			conversation.Messages = append(conversation.Messages, imported)
+		}
+		out = append(out, conversation)
+	}
+	return out, nil
+}
+
+// chatGPTBranch 返回从根到当前叶子的节点（时间正序）。
+func chatGPTBranch(item chatGPTConversation) []chatGPTNode {
+	leaf := item.CurrentNode
+	if _, ok := item.Mapping[leaf]; !ok {
+		leaf = ""
+		for id, node := range item.Mapping {
+			if node.Parent == "" {
+				leaf = id
+				break
+			}
+		}
+		for leaf != "" && len(item.Mapping[leaf].Children) > 0 {
+			children := item.Mapping[leaf].Children
+			leaf = children[len(children)-1]
+		}
+	}
+	var branch []chatGPTNode
+	seen := map[string]struct{}{}
+	for id := leaf; id != ""; {
+		node, ok := item.Mapping[id]
+		if !ok {
+			break
+		}
+		if _, loop := seen[id]; loop {
+			break
+		}
+		seen[id] = struct{}{}
+		branch = append(branch, node)
+		id = node.Parent
+	}
+	for i, j := 0, len(branch)-1; i < j; i, j = i+1, j-1 {
+		branch[i], branch[j] = branch[j], branch[i]
+	}
+	return branch
+}
+
+// decodeObjectOrArray 把单个 JSON 对象或对象数组解码到 out（切片指针）。
+func decodeObjectOrArray[T any](data []byte, out *[]T) error {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '{' {
+		var item T
+		if err := json.Unmarshal(data, &item); err != nil {
+			return err
+		}
+		*out = []T{item}
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
@@ -0,0 +1,187 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nanami9426/imgo/internal/models"
+	"github.com/nanami9426/imgo/internal/utils"
+)
+
+const (
+	maxSearchTerms             = 5
+	maxSearchTermRunes         = 64
+	maxSearchMatchedMessageIDs = 20
+	maxSearchSnippets          = 3
+	searchSnippetRunes         = 120
+
+	searchHighlightOpen  = "<em>"
+	searchHighlightClose = "</em>"
+)
+
+type conversationSearchSnippet struct {
+	MessageID int64  `json:"message_id"`
+	Role      string `json:"role"`
+	Snippet   string `json:"snippet"`
+}
+
+type conversationSearchResp struct {
+	Conversation      conversationResp            `json:"conversation"`
+	TitleHighlight    string                      `json:"title_highlight"`
+	MatchedMessageIDs []int64                     `json:"matched_message_ids"`
+	Snippets          []conversationSearchSnippet `json:"snippets"`
+}
+
+// SearchConversations 在当前登录用户的会话标题与消息内容中搜索关键词（含归档会话），按最近消息时间倒序分页返回。
+// q 按空白拆分为多个关键词，需同时命中同一标题或同一条消息；每个会话返回命中的消息ID（最多 20 个）
+// 与前 3 条命中消息的高亮片段。片段已做 HTML 转义，命中部分用 <em></em> 包裹。
+func SearchConversations(c *gin.Context) {
+	userID, ok := parseUserID(c)
+	if !ok || userID <= 0 {
+		utils.Fail(c, http.StatusUnauthorized, utils.StatUnauthorized, "token无效或已过期", nil)
+		return
+	}
+	terms, err := parseSearchTerms(c.Query("q"))
+	if err != nil {
+		utils.Fail(c, http.StatusOK, utils.StatInvalidParam, err.Error(), nil)
+		return
+	}
+	page, pageSize, err := parsePagination(c, defaultConversationPage, defaultConversationPageSize, maxConversationPageSize)
+	if err != nil {
+		utils.Fail(c, http.StatusOK, utils.StatInvalidParam, err.Error(), nil)
+		return
+	}
+	search := models.LLMConversationSearch{Terms: terms}
+
+	total, err := models.CountLLMConversationsBySearch(userID, search)
+	if err != nil {
+		utils.Fail(c, http.StatusOK, utils.StatDatabaseError, "搜索会话失败", err)
+		return
+	}
+	offset := (page - 1) * pageSize
+	conversations, err := models.SearchLLMConversations(userID, search, offset, pageSize)
+	if err != nil {
+		utils.Fail(c, http.StatusOK, utils.StatDatabaseError, "搜索会话失败", err)
+		return
+	}
+
+	items := make([]conversationSearchResp, 0, len(conversations))
+	for _, conversation := range conversations {
+		messages, err := models.ListLLMConversationMessagesBySearch(userID, conversation.ConversationID, search, maxSearchMatchedMessageIDs)
+		if err != nil {
+			utils.Fail(c, http.StatusOK, utils.StatDatabaseError, "搜索会话失败", err)
+			return
+		}
+		item := conversationSearchResp{
+			Conversation:      toConversationResp(conversation),
+			TitleHighlight:    highlightSnippet(conversation.Title, terms, models.MaxLLMConversationTitleRunes),
+			MatchedMessageIDs: make([]int64, 0, len(messages)),
+			Snippets:          make([]conversationSearchSnippet, 0, maxSearchSnippets),
+		}
+		for _, msg := range messages {
+			item.MatchedMessageIDs = append(item.MatchedMessageIDs, msg.MessageID)
+			if len(item.Snippets) < maxSearchSnippets {
+				item.Snippets = append(item.Snippets, conversationSearchSnippet{
+					MessageID: msg.MessageID,
+					Role:      msg.Role,
+					Snippet:   highlightSnippet(msg.Content, terms, searchSnippetRunes),
+				})
+			}
+		}
+		items = append(items, item)
+	}
+
+	utils.Success(c, gin.H{
+		"list":      items,
+		"page":      page,
+		"page_size": pageSize,
+		"total":     total,
+	})
+}
+
+// parseSearchTerms 按空白拆分关键词并去重（忽略大小写）。
+func parseSearchTerms(q string) ([]string, error) {
+	terms := make([]string, 0, maxSearchTerms)
+	seen := map[string]struct{}{}
+	for _, term := range strings.Fields(q) {
+		key := strings.ToLower(term)
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		if utf8.RuneCountInString(term) > maxSearchTermRunes {
+			return nil, fmt.Errorf("单个关键词不能超过 %d 个字符", maxSearchTermRunes)
+		}
+		terms = append(terms, term)
+	}
+	if len(terms) == 0 {
+		return nil, errors.New("q 不能为空")
+	}
+	if len(terms) > maxSearchTerms {
+		return nil, fmt.Errorf("关键词最多 %d 个", maxSearchTerms)
+	}
+	return terms, nil
+}
+
+// highlightSnippet 截取以第一个命中位置为中心、最多 maxRunes 个字符的片段（空白折叠为空格），
+// 转义 HTML 后用 <em></em> 包裹所有命中的关键词（忽略大小写）；没有命中时返回开头的片段。
+func highlightSnippet(text string, terms []string, maxRunes int) string {
+	runes := []rune(text)
+	lower := make([]rune, len(runes))
+	for i, r := range runes {
+		lower[i] = unicode.ToLower(r)
+		if unicode.IsSpace(r) {
+			runes[i] = ' '
+		}
+	}
+	marked := make([]bool, len(runes))
+	first := -1
+	for _, term := range terms {
+		needle := []rune(strings.ToLower(term))
+		for i := 0; i+len(needle) <= len(lower); i++ {
+			if !slices.Equal(lower[i:i+len(needle)], needle) {
+				continue
+			}
+			for j := i; j < i+len(needle); j++ {
+				marked[j] = true
+			}
+			if first < 0 || i < first {
+				first = i
+			}
+		}
+	}
+
+	start := 0
+	if first > maxRunes/4 {
+		start = first - maxRunes/4
+	}
+	end := min(len(runes), start+maxRunes)
+	if end-start < maxRunes {
+		start = max(0, end-maxRunes)
+	}
+
+	var builder strings.Builder
+	if start > 0 {
+		builder.WriteString("…")
+	}
+	for i := start; i < end; i++ {
+		if marked[i] && (i == start || !marked[i-1]) {
+			builder.WriteString(searchHighlightOpen)
+		}
+		builder.WriteString(html.EscapeString(string(runes[i])))
+		if marked[i] && (i+1 == end || !marked[i+1]) {
+			builder.WriteString(searchHighlightClose)
+		}
+	}
+	if end < len(runes) {
+		builder.WriteString("…")
+	}
+	return strings.TrimSpace(builder.String())
+}
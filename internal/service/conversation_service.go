@@ -2,9 +2,12 @@ package service
 
 import (
 	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/gin-gonic/gin"
 	"github.com/nanami9426/imgo/internal/models"
@@ -20,27 +23,43 @@ const (
 	defaultMessagePage     = 1
 	defaultMessagePageSize = 50
 	maxMessagePageSize     = 200
+
+	// 消息列表的两种视图：branch 为当前分支（默认），tree 为全部分支的消息。
+	conversationViewBranch = "branch"
+	conversationViewTree   = "tree"
+
+	maxConversationTags     = 10
+	maxConversationTagRunes = 32
 )
 
 type conversationResp struct {
-	ConversationID     int64  `json:"conversation_id"`
-	Title              string `json:"title"`
-	Model              string `json:"model"`
-	MessageCount       int    `json:"message_count"`
-	LastMessagePreview string `json:"last_message_preview"`
-	LastMessageAt      string `json:"last_message_at"`
+	ConversationID     int64    `json:"conversation_id"`
+	Title              string   `json:"title"`
+	Model              string   `json:"model"`
+	MessageCount       int      `json:"message_count"`
+	LastMessagePreview string   `json:"last_message_preview"`
+	LastMessageAt      string   `json:"last_message_at"`
+	Pinned             bool     `json:"pinned"`
+	Archived           bool     `json:"archived"`
+	Tags               []string `json:"tags"`
 }
 
 type conversationMessageResp struct {
-	MessageID  int64  `json:"message_id"`
-	Role       string `json:"role"`
-	Content    string `json:"content"`
-	Model      string `json:"model"`
-	CreatedAt  string `json:"created_at"`
-	ModifiedAt string `json:"updated_at"`
+	MessageID       int64  `json:"message_id"`
+	ParentMessageID int64  `json:"parent_message_id"`
+	Role            string `json:"role"`
+	Content         string `json:"content"`
+	Model           string `json:"model"`
+	CreatedAt       string `json:"created_at"`
+	ModifiedAt      string `json:"updated_at"`
+	// SiblingIDs 只在 branch 视图中返回：同一父消息下的全部消息（含自身），多于一条时说明该位置有其他分支。
+	SiblingIDs []int64 `json:"sibling_ids,omitempty"`
+	// SummaryUntilMessageID 只在摘要消息上返回：摘要覆盖到的最后一条消息，覆盖位置在哪条分支上摘要就属于哪条分支。
+	SummaryUntilMessageID int64 `json:"summary_until_message_id,omitempty"`
 }
 
-// GetConversations 返回当前登录用户的会话列表（按最近消息时间倒序）。
+// GetConversations 返回当前登录用户的会话列表（默认置顶在前，其余按最近消息时间倒序）。
+// 查询参数：archived=false|true|all（默认 false，不含归档会话）、tags=a,b（需同时带有全部标签）、pinned_first=true|false（默认 true）。
 func GetConversations(c *gin.Context) {
 	userID, ok := parseUserID(c)
 	if !ok || userID <= 0 {
@@ -53,7 +72,13 @@ func GetConversations(c *gin.Context) {
 		return
 	}
 
-	total, err := models.CountLLMConversationsByUser(userID)
+	filter, err := parseConversationFilter(c)
+	if err != nil {
+		utils.Fail(c, http.StatusOK, utils.StatInvalidParam, err.Error(), nil)
+		return
+	}
+
+	total, err := models.CountLLMConversationsByUser(userID, filter)
 	if err != nil {
 		utils.Fail(c, http.StatusOK, utils.StatDatabaseError, "查询会话列表失败", err)
 		return
@@ -61,7 +86,7 @@ func GetConversations(c *gin.Context) {
 
 	// 列表接口使用 page/page_size，内部转换成 offset/limit。
 	offset := (page - 1) * pageSize
-	conversations, err := models.ListLLMConversationsByUser(userID, offset, pageSize)
+	conversations, err := models.ListLLMConversationsByUser(userID, filter, offset, pageSize)
 	if err != nil {
 		utils.Fail(c, http.StatusOK, utils.StatDatabaseError, "查询会话列表失败", err)
 		return
@@ -69,14 +94,7 @@ func GetConversations(c *gin.Context) {
 
 	items := make([]conversationResp, 0, len(conversations))
 	for _, item := range conversations {
-		items = append(items, conversationResp{
-			ConversationID:     item.ConversationID,
-			Title:              item.Title,
-			Model:              item.Model,
-			MessageCount:       item.MessageCount,
-			LastMessagePreview: item.LastMessagePreview,
-			LastMessageAt:      item.LastMessageAt.UTC().Format("2006-01-02T15:04:05.999999999Z07:00"),
-		})
+		items = append(items, toConversationResp(item))
 	}
 
 	utils.Success(c, gin.H{
@@ -88,6 +106,7 @@ func GetConversations(c *gin.Context) {
 }
 
 // GetConversationMessages 返回指定会话的消息列表，并校验会话归属。
+// view=branch（默认）返回 system、摘要与当前分支上从根到叶子的消息；view=tree 返回全部分支的消息，由 parent_message_id 还原消息树。
 func GetConversationMessages(c *gin.Context) {
 	userID, ok := parseUserID(c)
 	if !ok || userID <= 0 {
@@ -104,6 +123,11 @@ func GetConversationMessages(c *gin.Context) {
 		utils.Fail(c, http.StatusOK, utils.StatInvalidParam, err.Error(), nil)
 		return
 	}
+	view := strings.ToLower(strings.TrimSpace(c.DefaultQuery("view", conversationViewBranch)))
+	if view != conversationViewBranch && view != conversationViewTree {
+		utils.Fail(c, http.StatusOK, utils.StatInvalidParam, "view 必须是 branch 或 tree", nil)
+		return
+	}
 
 	conversation, err := models.GetLLMConversationByIDAndUser(conversationID, userID)
 	if err != nil {
@@ -115,7 +139,7 @@ func GetConversationMessages(c *gin.Context) {
 		return
 	}
 
-	total, err := models.CountLLMConversationMessages(conversationID)
+	activeID, err := models.EnsureLLMConversationActiveMessage(conversation)
 	if err != nil {
 		utils.Fail(c, http.StatusOK, utils.StatDatabaseError, "查询会话消息失败", err)
 		return
@@ -123,7 +147,25 @@ func GetConversationMessages(c *gin.Context) {
 
 	// 消息详情同样走分页，避免长会话一次性返回过大。
 	offset := (page - 1) * pageSize
-	messages, err := models.ListLLMConversationMessages(conversationID, offset, pageSize)
+	var total int64
+	var messages []*models.LLMConversationMessage
+	var tree *models.LLMConversationTree
+	if view == conversationViewTree {
+		total, err = models.CountLLMConversationMessages(conversationID)
+		if err == nil {
+			messages, err = models.ListLLMConversationMessages(conversationID, offset, pageSize)
+		}
+	} else {
+		tree, err = models.LoadLLMConversationTree(conversationID)
+		if err == nil {
+			var ids []int64
+			ids, err = branchMessageIDs(conversationID, tree.Path(activeID))
+			total = int64(len(ids))
+			if err == nil && offset < len(ids) {
+				messages, err = models.ListLLMConversationMessagesByIDs(conversationID, ids[offset:min(offset+pageSize, len(ids))])
+			}
+		}
+	}
 	if err != nil {
 		utils.Fail(c, http.StatusOK, utils.StatDatabaseError, "查询会话消息失败", err)
 		return
@@ -131,29 +173,114 @@ func GetConversationMessages(c *gin.Context) {
 
 	items := make([]conversationMessageResp, 0, len(messages))
 	for _, msg := range messages {
-		items = append(items, conversationMessageResp{
-			MessageID:  msg.MessageID,
-			Role:       msg.Role,
-			Content:    msg.Content,
-			Model:      msg.Model,
-			CreatedAt:  msg.CreatedAt.UTC().Format("2006-01-02T15:04:05.999999999Z07:00"),
-			ModifiedAt: msg.UpdatedAt.UTC().Format("2006-01-02T15:04:05.999999999Z07:00"),
-		})
+		item := conversationMessageResp{
+			MessageID:             msg.MessageID,
+			ParentMessageID:       msg.ParentMessageID,
+			Role:                  msg.Role,
+			Content:               msg.Content,
+			Model:                 msg.Model,
+			CreatedAt:             msg.CreatedAt.UTC().Format("2006-01-02T15:04:05.999999999Z07:00"),
+			ModifiedAt:            msg.UpdatedAt.UTC().Format("2006-01-02T15:04:05.999999999Z07:00"),
+			SummaryUntilMessageID: msg.SummaryUntilMessageID,
+		}
+		if tree != nil && tree.Contains(msg.MessageID) {
+			if siblings := tree.Siblings(msg.MessageID); len(siblings) > 1 {
+				item.SiblingIDs = siblings
+			}
+		}
+		items = append(items, item)
 	}
 
 	utils.Success(c, gin.H{
-		"conversation": conversationResp{
-			ConversationID:     conversation.ConversationID,
-			Title:              conversation.Title,
-			Model:              conversation.Model,
-			MessageCount:       conversation.MessageCount,
-			LastMessagePreview: conversation.LastMessagePreview,
-			LastMessageAt:      conversation.LastMessageAt.UTC().Format("2006-01-02T15:04:05.999999999Z07:00"),
-		},
-		"messages":  items,
-		"page":      page,
-		"page_size": pageSize,
-		"total":     total,
+		"conversation":      toConversationResp(conversation),
+		"view":              view,
+		"active_message_id": activeID,
+		"messages":          items,
+		"page":              page,
+		"page_size":         pageSize,
+		"total":             total,
+	})
+}
+
+// branchMessageIDs 返回 branch 视图展示的消息ID：system、摘要（覆盖位置在该分支上时）在前，其后为分支上的消息。
+func branchMessageIDs(conversationID int64, path []int64) ([]int64, error) {
+	ids := make([]int64, 0, len(path)+2)
+	system, err := models.GetLLMConversationSystemMessage(conversationID)
+	if err != nil {
+		return nil, err
+	}
+	if system != nil {
+		ids = append(ids, system.MessageID)
+	}
+	summary, err := models.GetLLMConversationBranchSummary(conversationID, path)
+	if err != nil {
+		return nil, err
+	}
+	if summary != nil {
+		ids = append(ids, summary.MessageID)
+	}
+	return append(ids, path...), nil
+}
+
+type setActiveMessageReq struct {
+	MessageID int64 `json:"message_id" form:"message_id"`
+}
+
+// SetConversationActiveMessage 切换会话的当前分支：message_id 可以是任意 user/assistant 消息，
+// 不是叶子时沿最新的子消息下行到叶子；之后续聊默认接在该叶子之后，branch 视图也展示该分支。
+func SetConversationActiveMessage(c *gin.Context) {
+	userID, ok := parseUserID(c)
+	if !ok || userID <= 0 {
+		utils.Fail(c, http.StatusUnauthorized, utils.StatUnauthorized, "token无效或已过期", nil)
+		return
+	}
+	conversationID, err := strconv.ParseInt(strings.TrimSpace(c.Param("conversation_id")), 10, 64)
+	if err != nil || conversationID <= 0 {
+		utils.Fail(c, http.StatusOK, utils.StatInvalidParam, "conversation_id 必须是正整数", nil)
+		return
+	}
+	req := &setActiveMessageReq{}
+	if err := c.ShouldBind(req); err != nil {
+		utils.Fail(c, http.StatusOK, utils.StatInvalidParam, "参数错误", err)
+		return
+	}
+	if req.MessageID <= 0 {
+		utils.Fail(c, http.StatusOK, utils.StatInvalidParam, "message_id 必须是正整数", nil)
+		return
+	}
+
+	conversation, err := models.GetLLMConversationByIDAndUser(conversationID, userID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			utils.Fail(c, http.StatusOK, utils.StatNotFound, "会话不存在", nil)
+			return
+		}
+		utils.Fail(c, http.StatusOK, utils.StatDatabaseError, "查询会话失败", err)
+		return
+	}
+	// 旧会话先补齐消息树，否则其消息都会被当作根。
+	if _, err := models.EnsureLLMConversationActiveMessage(conversation); err != nil {
+		utils.Fail(c, http.StatusOK, utils.StatDatabaseError, "查询会话消息失败", err)
+		return
+	}
+	tree, err := models.LoadLLMConversationTree(conversationID)
+	if err != nil {
+		utils.Fail(c, http.StatusOK, utils.StatDatabaseError, "查询会话消息失败", err)
+		return
+	}
+	if !tree.Contains(req.MessageID) {
+		utils.Fail(c, http.StatusOK, utils.StatNotFound, "消息不存在", nil)
+		return
+	}
+	leafID := tree.LatestLeaf(req.MessageID)
+	if err := models.SetLLMConversationActiveMessage(conversationID, userID, leafID); err != nil {
+		utils.Fail(c, http.StatusOK, utils.StatDatabaseError, "切换分支失败", err)
+		return
+	}
+
+	utils.Success(c, gin.H{
+		"conversation_id":   conversationID,
+		"active_message_id": leafID,
 	})
 }
 
@@ -183,6 +310,164 @@ func DeleteConversation(c *gin.Context) {
 	utils.SuccessMessage(c, "删除成功")
 }
 
+type updateConversationReq struct {
+	Title    *string   `json:"title" form:"title"`
+	Pinned   *bool     `json:"pinned" form:"pinned"`
+	Archived *bool     `json:"archived" form:"archived"`
+	Tags     *[]string `json:"tags" form:"tags"`
+}
+
+// UpdateConversation 修改当前登录用户的指定会话，只更新请求中出现的字段：
+// title 重命名（之后不再被自动标题覆盖）、pinned 置顶/取消置顶、archived 归档/取消归档、tags 整体替换标签。
+func UpdateConversation(c *gin.Context) {
+	userID, ok := parseUserID(c)
+	if !ok || userID <= 0 {
+		utils.Fail(c, http.StatusUnauthorized, utils.StatUnauthorized, "token无效或已过期", nil)
+		return
+	}
+	conversationID, err := strconv.ParseInt(strings.TrimSpace(c.Param("conversation_id")), 10, 64)
+	if err != nil || conversationID <= 0 {
+		utils.Fail(c, http.StatusOK, utils.StatInvalidParam, "conversation_id 必须是正整数", nil)
+		return
+	}
+	req := &updateConversationReq{}
+	if err := c.ShouldBind(req); err != nil {
+		utils.Fail(c, http.StatusOK, utils.StatInvalidParam, "参数错误", err)
+		return
+	}
+	updates, err := buildConversationUpdates(req)
+	if err != nil {
+		utils.Fail(c, http.StatusOK, utils.StatInvalidParam, err.Error(), nil)
+		return
+	}
+
+	belongs, err := models.ConversationBelongsToUser(conversationID, userID)
+	if err != nil {
+		utils.Fail(c, http.StatusOK, utils.StatDatabaseError, "查询会话失败", err)
+		return
+	}
+	if !belongs {
+		utils.Fail(c, http.StatusOK, utils.StatNotFound, "会话不存在", nil)
+		return
+	}
+	if err := models.UpdateLLMConversation(conversationID, userID, updates); err != nil {
+		utils.Fail(c, http.StatusOK, utils.StatDatabaseError, "修改会话失败", err)
+		return
+	}
+	conversation, err := models.GetLLMConversationByIDAndUser(conversationID, userID)
+	if err != nil {
+		utils.Fail(c, http.StatusOK, utils.StatDatabaseError, "查询会话失败", err)
+		return
+	}
+
+	utils.Success(c, toConversationResp(conversation))
+}
+
+// buildConversationUpdates 校验修改请求并转换为要更新的列。
+func buildConversationUpdates(req *updateConversationReq) (map[string]interface{}, error) {
+	updates := map[string]interface{}{}
+	if req.Title != nil {
+		title := strings.TrimSpace(*req.Title)
+		if title == "" {
+			return nil, errors.New("title 不能为空")
+		}
+		if utf8.RuneCountInString(title) > models.MaxLLMConversationTitleRunes {
+			return nil, fmt.Errorf("title 不能超过 %d 个字符", models.MaxLLMConversationTitleRunes)
+		}
+		updates["title"] = title
+		updates["title_manual"] = true
+	}
+	now := time.Now().UTC()
+	if req.Pinned != nil {
+		updates["pinned"] = *req.Pinned
+		updates["pinned_at"] = nil
+		if *req.Pinned {
+			updates["pinned_at"] = now
+		}
+	}
+	if req.Archived != nil {
+		updates["archived"] = *req.Archived
+		updates["archived_at"] = nil
+		if *req.Archived {
+			updates["archived_at"] = now
+		}
+	}
+	if req.Tags != nil {
+		tags, err := normalizeConversationTags(*req.Tags)
+		if err != nil {
+			return nil, err
+		}
+		updates["tags"] = models.JoinLLMConversationTags(tags)
+	}
+	if len(updates) == 0 {
+		return nil, errors.New("没有需要修改的字段")
+	}
+	return updates, nil
+}
+
+// normalizeConversationTags 去掉首尾空白与重复标签（保留首次出现的顺序），并校验数量与长度。
+func normalizeConversationTags(tags []string) ([]string, error) {
+	out := make([]string, 0, len(tags))
+	seen := map[string]struct{}{}
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			continue
+		}
+		if strings.Contains(tag, ",") {
+			return nil, errors.New("tags 中的标签不能包含逗号")
+		}
+		if utf8.RuneCountInString(tag) > maxConversationTagRunes {
+			return nil, fmt.Errorf("单个标签不能超过 %d 个字符", maxConversationTagRunes)
+		}
+		if _, ok := seen[tag]; ok {
+			continue
+		}
+		seen[tag] = struct{}{}
+		out = append(out, tag)
+	}
+	if len(out) > maxConversationTags {
+		return nil, fmt.Errorf("tags 最多 %d 个", maxConversationTags)
+	}
+	return out, nil
+}
+
+// DeleteConversationSummary 删除指定会话的滚动摘要，之后续聊重新按历史窗口拼接完整历史。
+// 摘要本身作为 role=summary 的消息出现在消息列表中。
+func DeleteConversationSummary(c *gin.Context) {
+	userID, ok := parseUserID(c)
+	if !ok || userID <= 0 {
+		utils.Fail(c, http.StatusUnauthorized, utils.StatUnauthorized, "token无效或已过期", nil)
+		return
+	}
+	conversationID, err := strconv.ParseInt(strings.TrimSpace(c.Param("conversation_id")), 10, 64)
+	if err != nil || conversationID <= 0 {
+		utils.Fail(c, http.StatusOK, utils.StatInvalidParam, "conversation_id 必须是正整数", nil)
+		return
+	}
+
+	belongs, err := models.ConversationBelongsToUser(conversationID, userID)
+	if err != nil {
+		utils.Fail(c, http.StatusOK, utils.StatDatabaseError, "查询会话失败", err)
+		return
+	}
+	if !belongs {
+		utils.Fail(c, http.StatusOK, utils.StatNotFound, "会话不存在", nil)
+		return
+	}
+	rows, err := models.DeleteLLMConversationSummary(conversationID, userID)
+	if err != nil {
+		utils.Fail(c, http.StatusOK, utils.StatDatabaseError, "删除会话摘要失败", err)
+		return
+	}
+	if rows == 0 {
+		utils.Fail(c, http.StatusOK, utils.StatNotFound, "会话摘要不存在", nil)
+		return
+	}
+
+	utils.SuccessMessage(c, "删除成功")
+}
+
 // parseUserID 统一处理鉴权中间件写入 user_id 的多种类型。
 func parseUserID(c *gin.Context) (int64, bool) {
 	v, ok := c.Get("user_id")
@@ -208,6 +493,50 @@ func parseUserID(c *gin.Context) (int64, bool) {
 	}
 }
 
+// parseConversationFilter 解析会话列表的 archived / tags / pinned_first 查询参数。
+func parseConversationFilter(c *gin.Context) (models.LLMConversationFilter, error) {
+	archived := false
+	filter := models.LLMConversationFilter{Archived: &archived, PinnedFirst: true}
+	switch raw := strings.ToLower(strings.TrimSpace(c.Query("archived"))); raw {
+	case "", "false":
+	case "true":
+		archived = true
+	case "all":
+		filter.Archived = nil
+	default:
+		return filter, errors.New("archived 必须是 true、false 或 all")
+	}
+	if raw := strings.TrimSpace(c.Query("pinned_first")); raw != "" {
+		v, err := strconv.ParseBool(raw)
+		if err != nil {
+			return filter, errors.New("pinned_first 必须是布尔值")
+		}
+		filter.PinnedFirst = v
+	}
+	if raw := strings.TrimSpace(c.Query("tags")); raw != "" {
+		tags, err := normalizeConversationTags(strings.Split(raw, ","))
+		if err != nil {
+			return filter, err
+		}
+		filter.Tags = tags
+	}
+	return filter, nil
+}
+
+func toConversationResp(item *models.LLMConversation) conversationResp {
+	return conversationResp{
+		ConversationID:     item.ConversationID,
+		Title:              item.Title,
+		Model:              item.Model,
+		MessageCount:       item.MessageCount,
+		LastMessagePreview: item.LastMessagePreview,
+		LastMessageAt:      item.LastMessageAt.UTC().Format("2006-01-02T15:04:05.999999999Z07:00"),
+		Pinned:             item.Pinned,
+		Archived:           item.Archived,
+		Tags:               models.SplitLLMConversationTags(item.Tags),
+	}
+}
+
 // parsePagination 统一处理分页默认值、边界和参数合法性。
 func parsePagination(c *gin.Context, defaultPage int, defaultPageSize int, maxPageSize int) (int, int, error) {
 	page := defaultPage
@@ -0,0 +1,241 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nanami9426/imgo/internal/models"
+	"github.com/nanami9426/imgo/internal/utils"
+	"gorm.io/gorm"
+)
+
+const maxConversationSettingModelRunes = 128
+
+// conversationSettingsResp 是会话级设置：续聊请求未传 model/temperature/top_p/max_tokens 时使用这里的值，
+// system_prompt 即会话中保存的 system 消息，history_token_budget 收紧按模型计算的历史拼接预算（不会超过后者）。
+type conversationSettingsResp struct {
+	Model              string   `json:"model"`
+	SystemPrompt       string   `json:"system_prompt"`
+	Temperature        *float64 `json:"temperature"`
+	TopP               *float64 `json:"top_p"`
+	MaxTokens          *int64   `json:"max_tokens"`
+	HistoryTokenBudget *int64   `json:"history_token_budget"`
+}
+
+// GetConversationSettings 返回当前登录用户指定会话的设置。
+func GetConversationSettings(c *gin.Context) {
+	userID, ok := parseUserID(c)
+	if !ok || userID <= 0 {
+		utils.Fail(c, http.StatusUnauthorized, utils.StatUnauthorized, "token无效或已过期", nil)
+		return
+	}
+	conversationID, err := strconv.ParseInt(strings.TrimSpace(c.Param("conversation_id")), 10, 64)
+	if err != nil || conversationID <= 0 {
+		utils.Fail(c, http.StatusOK, utils.StatInvalidParam, "conversation_id 必须是正整数", nil)
+		return
+	}
+
+	conversation, err := models.GetLLMConversationByIDAndUser(conversationID, userID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			utils.Fail(c, http.StatusOK, utils.StatNotFound, "会话不存在", nil)
+			return
+		}
+		utils.Fail(c, http.StatusOK, utils.StatDatabaseError, "查询会话失败", err)
+		return
+	}
+	resp, err := toConversationSettingsResp(conversation)
+	if err != nil {
+		utils.Fail(c, http.StatusOK, utils.StatDatabaseError, "查询会话设置失败", err)
+		return
+	}
+
+	utils.Success(c, resp)
+}
+
+// UpdateConversationSettings 修改会话设置，只更新请求中出现的字段，字段为 null 时清除该项：
+// model/temperature/top_p/max_tokens/history_token_budget 保存在会话上，
+// system_prompt 写入会话的 system 消息（空字符串或 null 删除 system 消息）。
+func UpdateConversationSettings(c *gin.Context) {
+	userID, ok := parseUserID(c)
+	if !ok || userID <= 0 {
+		utils.Fail(c, http.StatusUnauthorized, utils.StatUnauthorized, "token无效或已过期", nil)
+		return
+	}
+	conversationID, err := strconv.ParseInt(strings.TrimSpace(c.Param("conversation_id")), 10, 64)
+	if err != nil || conversationID <= 0 {
+		utils.Fail(c, http.StatusOK, utils.StatInvalidParam, "conversation_id 必须是正整数", nil)
+		return
+	}
+	// 需要区分“未传”和“传 null”，按原始 JSON 字段解析。
+	req := map[string]json.RawMessage{}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		utils.Fail(c, http.StatusOK, utils.StatInvalidParam, "参数错误", err)
+		return
+	}
+	updates, systemPrompt, err := buildConversationSettingsUpdates(req)
+	if err != nil {
+		utils.Fail(c, http.StatusOK, utils.StatInvalidParam, err.Error(), nil)
+		return
+	}
+
+	conversation, err := models.GetLLMConversationByIDAndUser(conversationID, userID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			utils.Fail(c, http.StatusOK, utils.StatNotFound, "会话不存在", nil)
+			return
+		}
+		utils.Fail(c, http.StatusOK, utils.StatDatabaseError, "查询会话失败", err)
+		return
+	}
+	if len(updates) > 0 {
+		if err := models.UpdateLLMConversation(conversationID, userID, updates); err != nil {
+			utils.Fail(c, http.StatusOK, utils.StatDatabaseError, "修改会话设置失败", err)
+			return
+		}
+	}
+	if systemPrompt != nil {
+		if err := saveConversationSystemPrompt(conversation, *systemPrompt); err != nil {
+			utils.Fail(c, http.StatusOK, utils.StatDatabaseError, "修改会话设置失败", err)
+			return
+		}
+	}
+	conversation, err = models.GetLLMConversationByIDAndUser(conversationID, userID)
+	if err != nil {
+		utils.Fail(c, http.StatusOK, utils.StatDatabaseError, "查询会话失败", err)
+		return
+	}
+	resp, err := toConversationSettingsResp(conversation)
+	if err != nil {
+		utils.Fail(c, http.StatusOK, utils.StatDatabaseError, "查询会话设置失败", err)
+		return
+	}
+
+	utils.Success(c, resp)
+}
+
+// buildConversationSettingsUpdates 校验设置修改请求，返回要更新的列与新的 system_prompt（nil 表示不修改）。
+func buildConversationSettingsUpdates(req map[string]json.RawMessage) (map[string]interface{}, *string, error) {
+	updates := map[string]interface{}{}
+	var systemPrompt *string
+	for key, raw := range req {
+		isNull := strings.TrimSpace(string(raw)) == "null"
+		switch key {
+		case "model":
+			model := ""
+			if !isNull {
+				if err := json.Unmarshal(raw, &model); err != nil {
+					return nil, nil, errors.New("model 必须是字符串")
+				}
+			}
+			model = strings.TrimSpace(model)
+			if utf8.RuneCountInString(model) > maxConversationSettingModelRunes {
+				return nil, nil, fmt.Errorf("model 不能超过 %d 个字符", maxConversationSettingModelRunes)
+			}
+			updates["setting_model"] = model
+		case "system_prompt":
+			prompt := ""
+			if !isNull {
+				if err := json.Unmarshal(raw, &prompt); err != nil {
+					return nil, nil, errors.New("system_prompt 必须是字符串")
+				}
+			}
+			systemPrompt = &prompt
+		case "temperature":
+			v, err := parseSettingFloat(key, raw, isNull, 0, 2)
+			if err != nil {
+				return nil, nil, err
+			}
+			updates["setting_temperature"] = v
+		case "top_p":
+			v, err := parseSettingFloat(key, raw, isNull, 0, 1)
+			if err != nil {
+				return nil, nil, err
+			}
+			updates["setting_top_p"] = v
+		case "max_tokens":
+			v, err := parseSettingPositiveInt(key, raw, isNull)
+			if err != nil {
+				return nil, nil, err
+			}
+			updates["setting_max_tokens"] = v
+		case "history_token_budget":
+			v, err := parseSettingPositiveInt(key, raw, isNull)
+			if err != nil {
+				return nil, nil, err
+			}
+			updates["setting_history_token_budget"] = v
+		default:
+			return nil, nil, fmt.Errorf("不支持的设置项: %s", key)
+		}
+	}
+	if len(updates) == 0 && systemPrompt == nil {
+		return nil, nil, errors.New("没有需要修改的字段")
+	}
+	return updates, systemPrompt, nil
+}
+
+// parseSettingFloat 解析 [lo, hi] 范围内的数值设置，null 返回 nil 表示清除。
+func parseSettingFloat(key string, raw json.RawMessage, isNull bool, lo float64, hi float64) (*float64, error) {
+	if isNull {
+		return nil, nil
+	}
+	var v float64
+	if err := json.Unmarshal(raw, &v); err != nil || v < lo || v > hi {
+		return nil, fmt.Errorf("%s 必须是 %g 到 %g 之间的数值", key, lo, hi)
+	}
+	return &v, nil
+}
+
+// parseSettingPositiveInt 解析正整数设置，null 返回 nil 表示清除。
+func parseSettingPositiveInt(key string, raw json.RawMessage, isNull bool) (*int64, error) {
+	if isNull {
+		return nil, nil
+	}
+	var v int64
+	if err := json.Unmarshal(raw, &v); err != nil || v <= 0 {
+		return nil, fmt.Errorf("%s 必须是正整数", key)
+	}
+	return &v, nil
+}
+
+// saveConversationSystemPrompt 把 system_prompt 写为会话的 system 消息（与续聊请求中传入新 system 的效果一致），
+// 空内容时删除 system 消息，然后刷新会话统计。
+func saveConversationSystemPrompt(conversation *models.LLMConversation, prompt string) error {
+	var err error
+	if strings.TrimSpace(prompt) == "" {
+		err = models.DeleteLLMConversationSystemMessage(conversation.ConversationID, conversation.UserID)
+	} else {
+		messageJSON, _ := json.Marshal(map[string]interface{}{"role": "system", "content": prompt})
+		err = models.UpsertLLMConversationSystemMessage(conversation.ConversationID, conversation.UserID, conversation.Model, prompt, string(messageJSON))
+	}
+	if err != nil {
+		return err
+	}
+	return models.RefreshLLMConversationStats(conversation.ConversationID, conversation.Model)
+}
+
+func toConversationSettingsResp(conversation *models.LLMConversation) (conversationSettingsResp, error) {
+	settings := conversation.Settings
+	resp := conversationSettingsResp{
+		Model:              settings.Model,
+		Temperature:        settings.Temperature,
+		TopP:               settings.TopP,
+		MaxTokens:          settings.MaxTokens,
+		HistoryTokenBudget: settings.HistoryTokenBudget,
+	}
+	system, err := models.GetLLMConversationSystemMessage(conversation.ConversationID)
+	if err != nil {
+		return resp, err
+	}
+	if system != nil {
+		resp.SystemPrompt = system.Content
+	}
+	return resp, nil
+}
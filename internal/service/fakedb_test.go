@@ -0,0 +1,357 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nanami9426/imgo/internal/utils"
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// fakeDB 是测试用的内存数据库驱动，只理解 gorm mysql 方言生成的简单 INSERT/SELECT/UPDATE/DELETE：
+// WHERE 只支持以 AND 连接的 "col = ?"、"col <> ?"、"col IS NULL"，事务不支持回滚。
+type fakeDB struct {
+	mu     sync.Mutex
+	tables map[string]*fakeTable
+}
+
+type fakeTable struct {
+	columns []string
+	rows    []map[string]driver.Value
+}
+
+var fakeDBSeq int
+
+// useFakeDB 把 utils.DB 替换为一个空的内存数据库，测试结束后还原。
+func useFakeDB(t *testing.T) *fakeDB {
+	t.Helper()
+	db := &fakeDB{tables: map[string]*fakeTable{}}
+	fakeDBSeq++
+	name := fmt.Sprintf("imgo-fake-%d", fakeDBSeq)
+	sql.Register(name, db)
+	sqlDB, err := sql.Open(name, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gdb, err := gorm.Open(mysql.New(mysql.Config{Conn: sqlDB, SkipInitializeWithVersion: true}), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := utils.DB
+	utils.DB = gdb
+	t.Cleanup(func() {
+		utils.DB = prev
+		_ = sqlDB.Close()
+	})
+	return db
+}
+
+func (db *fakeDB) Open(string) (driver.Conn, error) {
+	return &fakeConn{db: db}, nil
+}
+
+type fakeConn struct {
+	db *fakeDB
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{db: c.db, query: query}, nil
+}
+
+func (c *fakeConn) Close() error { return nil }
+
+func (c *fakeConn) Begin() (driver.Tx, error) { return fakeTx{}, nil }
+
+type fakeTx struct{}
+
+func (fakeTx) Commit() error   { return nil }
+func (fakeTx) Rollback() error { return nil }
+
+type fakeStmt struct {
+	db    *fakeDB
+	query string
+}
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return -1 }
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	n, err := s.db.exec(s.query, args)
+	if err != nil {
+		return nil, err
+	}
+	return fakeResult(n), nil
+}
+
+// fakeResult 的 LastInsertId 总是 0：测试中的主键都由调用方生成。
+type fakeResult int64
+
+func (r fakeResult) LastInsertId() (int64, error) { return 0, nil }
+func (r fakeResult) RowsAffected() (int64, error) { return int64(r), nil }
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	return s.db.query(s.query, args)
+}
+
+func (c *fakeConn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	return (&fakeStmt{db: c.db, query: query}).Exec(namedValues(args))
+}
+
+func (c *fakeConn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	return (&fakeStmt{db: c.db, query: query}).Query(namedValues(args))
+}
+
+func namedValues(args []driver.NamedValue) []driver.Value {
+	out := make([]driver.Value, len(args))
+	for i, arg := range args {
+		out[i] = arg.Value
+	}
+	return out
+}
+
+var (
+	fakeInsertRe = regexp.MustCompile("(?s)^INSERT INTO `(\\w+)` \\((.*?)\\) VALUES (.*)$")
+	fakeSelectRe = regexp.MustCompile("(?s)^SELECT (.*?) FROM `(\\w+)`(?: WHERE (.*?))?(?: ORDER BY .*?)?(?: LIMIT (\\S+))?(?: OFFSET \\S+)?$")
+	fakeUpdateRe = regexp.MustCompile("(?s)^UPDATE `(\\w+)` SET (.*?) WHERE (.*)$")
+	fakeDeleteRe = regexp.MustCompile("(?s)^DELETE FROM `(\\w+)` WHERE (.*)$")
+	fakeCondRe   = regexp.MustCompile("^(?:`?\\w+`?\\.)?`?(\\w+)`? *(=|<>|>|<|IS NULL)(?: *\\?)?$")
+)
+
+func (db *fakeDB) table(name string) *fakeTable {
+	t, ok := db.tables[name]
+	if !ok {
+		t = &fakeTable{}
+		db.tables[name] = t
+	}
+	return t
+}
+
+func (db *fakeDB) exec(query string, args []driver.Value) (int64, error) {
+	query = strings.TrimSpace(query)
+	if m := fakeInsertRe.FindStringSubmatch(query); m != nil {
+		t := db.table(m[1])
+		columns := splitFakeColumns(m[2])
+		for _, col := range columns {
+			t.addColumn(col)
+		}
+		rowCount := strings.Count(m[3], "(")
+		if len(args) != rowCount*len(columns) {
+			return 0, fmt.Errorf("fakedb: insert arg count mismatch: %s", query)
+		}
+		for r := 0; r < rowCount; r++ {
+			row := map[string]driver.Value{}
+			for i, col := range columns {
+				row[col] = args[r*len(columns)+i]
+			}
+			t.rows = append(t.rows, row)
+		}
+		return int64(rowCount), nil
+	}
+	if m := fakeUpdateRe.FindStringSubmatch(query); m != nil {
+		t := db.table(m[1])
+		sets := splitFakeColumns(m[2])
+		for i, set := range sets {
+			sets[i] = strings.Trim(strings.TrimSpace(strings.TrimSuffix(set, "=?")), "`")
+			t.addColumn(sets[i])
+		}
+		match, err := fakeMatcher(m[3], args[len(sets):])
+		if err != nil {
+			return 0, err
+		}
+		var n int64
+		for _, row := range t.rows {
+			if match(row) {
+				for i, col := range sets {
+					row[col] = args[i]
+				}
+				n++
+			}
+		}
+		return n, nil
+	}
+	if m := fakeDeleteRe.FindStringSubmatch(query); m != nil {
+		t := db.table(m[1])
+		match, err := fakeMatcher(m[2], args)
+		if err != nil {
+			return 0, err
+		}
+		kept := t.rows[:0]
+		for _, row := range t.rows {
+			if !match(row) {
+				kept = append(kept, row)
+			}
+		}
+		n := int64(len(t.rows) - len(kept))
+		t.rows = kept
+		return n, nil
+	}
+	return 0, fmt.Errorf("fakedb: unsupported exec: %s", query)
+}
+
+func (db *fakeDB) query(query string, args []driver.Value) (driver.Rows, error) {
+	query = strings.TrimSpace(query)
+	m := fakeSelectRe.FindStringSubmatch(query)
+	if m == nil || strings.TrimSpace(m[1]) != "*" {
+		return nil, fmt.Errorf("fakedb: unsupported query: %s", query)
+	}
+	t := db.table(m[2])
+	condArgs := args
+	limit := -1
+	if m[4] != "" {
+		if m[4] == "?" {
+			n, err := fakeInt(args[len(args)-1])
+			if err != nil {
+				return nil, err
+			}
+			limit = int(n)
+			condArgs = args[:len(args)-1]
+		} else {
+			n, err := strconv.Atoi(m[4])
+			if err != nil {
+				return nil, err
+			}
+			limit = n
+		}
+	}
+	match, err := fakeMatcher(m[3], condArgs)
+	if err != nil {
+		return nil, err
+	}
+	rows := &fakeRows{columns: t.columns}
+	for _, row := range t.rows {
+		if limit >= 0 && len(rows.values) >= limit {
+			break
+		}
+		if match(row) {
+			values := make([]driver.Value, len(t.columns))
+			for i, col := range t.columns {
+				values[i] = row[col]
+			}
+			rows.values = append(rows.values, values)
+		}
+	}
+	return rows, nil
+}
+
+func (t *fakeTable) addColumn(col string) {
+	for _, c := range t.columns {
+		if c == col {
+			return
+		}
+	}
+	t.columns = append(t.columns, col)
+}
+
+func splitFakeColumns(list string) []string {
+	parts := strings.Split(list, ",")
+	for i, p := range parts {
+		parts[i] = strings.Trim(strings.TrimSpace(p), "`")
+	}
+	return parts
+}
+
+// fakeMatcher 把 WHERE 子句解析为逐行判断函数，参数按 ? 的顺序消费。
+func fakeMatcher(where string, args []driver.Value) (func(map[string]driver.Value) bool, error) {
+	where = strings.NewReplacer("(", "", ")", "").Replace(strings.TrimSpace(where))
+	if where == "" {
+		return func(map[string]driver.Value) bool { return true }, nil
+	}
+	type cond struct {
+		col string
+		op  string
+		arg driver.Value
+	}
+	var conds []cond
+	next := 0
+	for _, part := range strings.Split(where, " AND ") {
+		m := fakeCondRe.FindStringSubmatch(strings.TrimSpace(part))
+		if m == nil {
+			return nil, fmt.Errorf("fakedb: unsupported condition: %s", part)
+		}
+		c := cond{col: m[1], op: m[2]}
+		if c.op != "IS NULL" {
+			if next >= len(args) {
+				return nil, fmt.Errorf("fakedb: missing argument for: %s", part)
+			}
+			c.arg = args[next]
+			next++
+		}
+		conds = append(conds, c)
+	}
+	return func(row map[string]driver.Value) bool {
+		for _, c := range conds {
+			v := row[c.col]
+			switch c.op {
+			case "IS NULL":
+				if v != nil {
+					return false
+				}
+			case "=", "<>":
+				if (fakeString(v) == fakeString(c.arg)) != (c.op == "=") {
+					return false
+				}
+			default:
+				a, errA := fakeInt(v)
+				b, errB := fakeInt(c.arg)
+				if errA != nil || errB != nil || (c.op == ">") != (a > b) || a == b {
+					return false
+				}
+			}
+		}
+		return true
+	}, nil
+}
+
+func fakeString(v driver.Value) string {
+	switch x := v.(type) {
+	case []byte:
+		return string(x)
+	case time.Time:
+		return x.UTC().Format(time.RFC3339Nano)
+	case bool:
+		if x {
+			return "1"
+		}
+		return "0"
+	}
+	return fmt.Sprint(v)
+}
+
+func fakeInt(v driver.Value) (int64, error) {
+	return strconv.ParseInt(fakeString(v), 10, 64)
+}
+
+type fakeRows struct {
+	columns []string
+	values  [][]driver.Value
+	next    int
+}
+
+func (r *fakeRows) Columns() []string { return r.columns }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.next >= len(r.values) {
+		return io.EOF
+	}
+	copy(dest, r.values[r.next])
+	r.next++
+	return nil
+}
@@ -0,0 +1,105 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/nanami9426/imgo/internal/utils"
+)
+
+type internalCompletionResponse struct {
+	Choices []struct {
+		Message struct {
+			Content string `json:"content"`
+		} `json:"message"`
+	} `json:"choices"`
+}
+
+// CompleteChat 由网关自身发起一次非流式 chat/completions（例如会话摘要），返回第一条回复的文本。
+// 不依赖客户端请求：按路由表依次尝试能服务该模型的上游，跳过熔断中的上游，
+// 上游配置了并发上限时与普通请求一样排队准入；结果同样回报给副本池与熔断器。
+func CompleteChat(ctx context.Context, model string, messages []map[string]interface{}, maxTokens int) (string, error) {
+	model = utils.ResolveModelAlias(strings.TrimSpace(model))
+	candidates := lookupUpstreamCandidates(model)
+	if len(candidates) == 0 {
+		return "", fmt.Errorf("no upstream serves model %s", model)
+	}
+	payload := map[string]interface{}{
+		"model":    model,
+		"messages": messages,
+		"stream":   false,
+	}
+	if maxTokens > 0 {
+		payload["max_tokens"] = maxTokens
+	}
+	rawBody, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+
+	var lastErr error
+	for _, rt := range candidates {
+		if allowed, _ := rt.breaker.allow(); !allowed {
+			lastErr = fmt.Errorf("upstream %s circuit open", rt.cfg.Name)
+			continue
+		}
+		content, err := completeChatOnce(ctx, rt, model, rawBody)
+		if err == nil {
+			return content, nil
+		}
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return "", lastErr
+}
+
+func completeChatOnce(ctx context.Context, rt *upstreamRuntime, model string, rawBody []byte) (string, error) {
+	var ticket *admissionTicket
+	if ctrl := rt.admissionFor(model); ctrl != nil {
+		var err error
+		if ticket, err = ctrl.acquire(ctx, 0); err != nil {
+			rt.breaker.record(breakerIgnored)
+			return "", err
+		}
+	}
+	defer ticket.release()
+	replica := rt.pool.pick(nil)
+	replica.acquire()
+	defer replica.release()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, buildUpstreamURL(replica.url, &url.URL{Path: chatCompletionsPath}), bytes.NewReader(rawBody))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	rewriteUpstreamHeaders(req.Header, rt.cfg.APIKey)
+	resp, err := rt.client.Do(req)
+	statusCode := 0
+	if resp != nil {
+		statusCode = resp.StatusCode
+	}
+	rt.reportResult(replica, statusCode, err)
+	if err != nil {
+		return "", err
+	}
+	defer drainAndClose(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("upstream %s status %d", rt.cfg.Name, resp.StatusCode)
+	}
+	var out internalCompletionResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return "", err
+	}
+	if len(out.Choices) == 0 || strings.TrimSpace(out.Choices[0].Message.Content) == "" {
+		return "", errors.New("upstream returned empty completion")
+	}
+	return strings.TrimSpace(out.Choices[0].Message.Content), nil
+}
@@ -0,0 +1,172 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nanami9426/imgo/internal/tokenizer"
+	"github.com/nanami9426/imgo/internal/utils"
+)
+
+const (
+	// contextKeyServedModel 是实际服务本次请求的模型，会话与用量记录以它为准。
+	contextKeyServedModel     = "served_model"
+	responseHeaderServedModel = "X-Served-Model"
+)
+
+// forwardChatCompletionWithFallback 按“请求模型 -> 降级链”的顺序转发 chat/completions：
+// 1) 每个模型内部先走 doChatCompletionWithRetry 的重试与上游故障转移；
+// 2) 模型的上游全部不可用、熔断、排队被拒，或最终响应为 429/5xx 时，改写 model 字段换下一个模型重发；
+// 3) 降级链上没有可用上游、调用方无权使用、不支持请求所用功能或上下文窗口放不下本次请求的模型直接跳过，之后没有可用模型时返回当前模型的响应或失败原因；
+// 4) 成功时通过 X-Served-Model 响应头与 context 告知实际使用的模型。
+// 返回 false 时已向客户端写入错误响应。
+func forwardChatCompletionWithFallback(c *gin.Context, rawBody []byte) (*chatUpstreamResult, bool) {
+	rawBody, requested := resolveRequestModelAlias(c, rawBody)
+	if !modelAllowed(c, requested) {
+		abortModelNotFound(c, requested)
+		return nil, false
+	}
+	primary := lookupUpstreamCandidates(requested)
+	if len(primary) == 0 {
+		abortUpstreamNotFound(c, requested)
+		return nil, false
+	}
+
+	models := append([]string{requested}, utils.GetModelFallbacks(requested)...)
+	attempts := make([]utils.UpstreamAttempt, 0)
+	defer func() {
+		c.Set(contextKeyUpstreamAttempts, attempts)
+	}()
+
+	target := fallbackTarget{model: requested, candidates: primary, body: rawBody}
+	for i := 0; ; {
+		result, failure := doChatCompletionWithRetry(c, target.candidates, target.model, target.body, &attempts)
+		if result != nil && !utils.ShouldFallbackStatus(result.resp.StatusCode) {
+			setServedModel(c, target.model)
+			return result, true
+		}
+		if failure != nil && c.Request.Context().Err() != nil {
+			failure.write(c)
+			return nil, false
+		}
+
+		// 先确认链上还有能实际发起请求的模型再放弃当前结果，否则把当前模型的真实响应或失败原因返回给客户端。
+		next, nextIdx, ok := nextFallbackTarget(c, models, i+1, rawBody)
+		if !ok {
+			if result != nil {
+				setServedModel(c, target.model)
+				return result, true
+			}
+			failure.write(c)
+			return nil, false
+		}
+
+		if result != nil {
+			attempts = append(attempts, utils.UpstreamAttempt{
+				Attempt:    len(attempts) + 1,
+				Upstream:   result.rt.cfg.Name,
+				Replica:    result.replica.url.String(),
+				Model:      target.model,
+				StatusCode: result.resp.StatusCode,
+				Error:      "fallback to next model",
+			})
+			result.close()
+		} else {
+			record := utils.UpstreamAttempt{
+				Attempt:  len(attempts) + 1,
+				Upstream: failure.rt.cfg.Name,
+				Model:    target.model,
+				Error:    "fallback to next model",
+			}
+			if failure.circuitOpen {
+				record.StatusCode = http.StatusServiceUnavailable
+				record.Error = "circuit open, fallback to next model"
+			} else if failure.admissionErr != nil {
+				record.StatusCode = http.StatusServiceUnavailable
+				record.Error = failure.admissionErr.Error() + ", fallback to next model"
+			} else if failure.err != nil {
+				record.Error = failure.err.Error() + ", fallback to next model"
+			}
+			attempts = append(attempts, record)
+		}
+		target, i = next, nextIdx
+	}
+}
+
+// fallbackTarget 是降级链上一个可以实际发起请求的模型：上游候选与改写了 model 的请求体。
+type fallbackTarget struct {
+	model      string
+	candidates []*upstreamRuntime
+	body       []byte
+}
+
+// nextFallbackTarget 从 models[from:] 中找出下一个可用的降级模型，跳过调用方无权使用、没有上游、不支持请求所用功能或上下文窗口放不下的模型；
+// 返回目标及其在 models 中的下标，没有可用模型时 ok 为 false。
+func nextFallbackTarget(c *gin.Context, models []string, from int, rawBody []byte) (fallbackTarget, int, bool) {
+	for i := from; i < len(models); i++ {
+		model := utils.ResolveModelAlias(models[i])
+		if !modelAllowed(c, model) {
+			continue
+		}
+		candidates := lookupUpstreamCandidates(model)
+		if len(candidates) == 0 {
+			utils.Log.Errorf("skip fallback model without upstream: model=%s", model)
+			continue
+		}
+		body, err := rewriteFallbackBody(rawBody, model)
+		if err != nil {
+			utils.Log.Errorf("skip fallback model: model=%s err=%v", model, err)
+			continue
+		}
+		return fallbackTarget{model: model, candidates: candidates, body: body}, i, true
+	}
+	return fallbackTarget{}, len(models), false
+}
+
+func setServedModel(c *gin.Context, model string) {
+	model = strings.TrimSpace(model)
+	if model == "" {
+		return
+	}
+	c.Set(contextKeyServedModel, model)
+	c.Writer.Header().Set(responseHeaderServedModel, model)
+}
+
+// rewriteModelField 改写请求体中的 model 字段，其余字段原样保留（数字保持原始精度）。
+func rewriteModelField(rawBody []byte, model string) ([]byte, error) {
+	payload := map[string]interface{}{}
+	dec := json.NewDecoder(bytes.NewReader(rawBody))
+	dec.UseNumber()
+	if err := dec.Decode(&payload); err != nil {
+		return nil, err
+	}
+	payload["model"] = model
+	return json.Marshal(payload)
+}
+
+// rewriteFallbackBody 同 rewriteModelField 改写为降级模型；入口只按请求模型检查过功能支持与上下文窗口，
+// 这里用 utils.CheckModelFeatures 与 utils.FitContextWindow 按降级模型的能力重新检查，不支持或放不下时返回错误。
+func rewriteFallbackBody(rawBody []byte, model string) ([]byte, error) {
+	payload := map[string]interface{}{}
+	dec := json.NewDecoder(bytes.NewReader(rawBody))
+	dec.UseNumber()
+	if err := dec.Decode(&payload); err != nil {
+		return nil, err
+	}
+	payload["model"] = model
+	if err := utils.CheckModelFeatures(model, payload); err != nil {
+		return nil, errors.New(err.Message)
+	}
+	promptTokens := func() int64 {
+		messages, _ := payload["messages"].([]interface{})
+		return int64(tokenizer.CountMessages(tokenizer.ForModel(model), messages))
+	}
+	if err := utils.FitContextWindow(model, payload, promptTokens); err != nil {
+		return nil, errors.New(err.Message)
+	}
+	return json.Marshal(payload)
+}
@@ -0,0 +1,148 @@
+package service
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nanami9426/imgo/internal/utils"
+)
+
+// setFallbackConfig 写入测试用的上游、降级链、模型权限与重试配置，测试结束后清除。
+func setFallbackConfig(t *testing.T, values map[string]interface{}) {
+	t.Helper()
+	for key, value := range values {
+		utils.V.Set(key, value)
+	}
+	reload := func() {
+		utils.InitUpstreamConfig()
+		utils.InitModelFallbackConfig()
+		utils.InitModelAccessConfig()
+		utils.InitRetryConfig()
+	}
+	t.Cleanup(func() {
+		for key := range values {
+			utils.V.Set(key, nil)
+		}
+		reload()
+	})
+	reload()
+}
+
+func TestFallbackKeepsPrimaryResponseWhenNoFallbackEligible(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	const userID = int64(7)
+	tests := []struct {
+		name          string
+		allowed       []string
+		wantStatus    int
+		wantServed    string
+		wantFallbacks int32
+	}{
+		{name: "fallback not allowed", allowed: []string{"primary-model"}, wantStatus: http.StatusTooManyRequests, wantServed: "primary-model"},
+		{name: "fallback allowed", allowed: []string{"*"}, wantStatus: http.StatusOK, wantServed: "fallback-model", wantFallbacks: 1},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Retry-After", "7")
+				w.WriteHeader(http.StatusTooManyRequests)
+				_, _ = w.Write([]byte(`{"error":{"message":"rate limited"}}`))
+			}))
+			defer primary.Close()
+			var fallbackHits atomic.Int32
+			fallback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fallbackHits.Add(1)
+				_, _ = w.Write([]byte(`{"id":"ok"}`))
+			}))
+			defer fallback.Close()
+
+			// 上游运行时按名称缓存在进程内，每个用例使用不同的上游名。
+			setFallbackConfig(t, map[string]interface{}{
+				"upstreams": []map[string]interface{}{
+					{"name": fmt.Sprintf("fb-primary-%d", i), "base_url": primary.URL, "models": []string{"primary-model"}},
+					{"name": fmt.Sprintf("fb-fallback-%d", i), "base_url": fallback.URL, "models": []string{"fallback-model"}},
+				},
+				"model_fallbacks":    []map[string]interface{}{{"chain": []string{"primary-model", "fallback-model"}}},
+				"model_access.users": []map[string]interface{}{{"user_id": userID, "models": tt.allowed}},
+				"retry.max_attempts": 1,
+			})
+
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"model":"primary-model","messages":[]}`))
+			c.Request.Header.Set("Content-Type", "application/json")
+			c.Set("user_id", userID)
+
+			result, ok := forwardChatCompletionWithFallback(c, []byte(`{"model":"primary-model","messages":[]}`))
+			if !ok {
+				t.Fatalf("forward failed: status = %d, body = %s", w.Code, w.Body.String())
+			}
+			defer result.close()
+			if result.resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", result.resp.StatusCode, tt.wantStatus)
+			}
+			if tt.wantStatus == http.StatusTooManyRequests && result.resp.Header.Get("Retry-After") != "7" {
+				t.Fatalf("Retry-After = %q, want 7", result.resp.Header.Get("Retry-After"))
+			}
+			if got := c.GetString(contextKeyServedModel); got != tt.wantServed {
+				t.Fatalf("served model = %q, want %q", got, tt.wantServed)
+			}
+			if got := fallbackHits.Load(); got != tt.wantFallbacks {
+				t.Fatalf("fallback upstream hits = %d, want %d", got, tt.wantFallbacks)
+			}
+		})
+	}
+}
+
+func TestRewriteFallbackBodyChecksCapability(t *testing.T) {
+	utils.V.Set("model_capabilities", []map[string]interface{}{
+		{"models": []string{"no-tools"}, "tools": false},
+		{"models": []string{"no-vision"}, "vision": false},
+		{"models": []string{"small-clamp"}, "context_length": 100, "max_output_tokens": 50, "overflow": "clamp"},
+		{"models": []string{"small-reject"}, "context_length": 100, "overflow": "reject"},
+	})
+	t.Cleanup(func() {
+		utils.V.Set("model_capabilities", nil)
+		utils.InitModelCapabilityConfig()
+	})
+	utils.InitModelCapabilityConfig()
+
+	long := strings.Repeat("word ", 200)
+	tests := []struct {
+		name    string
+		model   string
+		body    string
+		wantErr bool
+		want    string
+	}{
+		{name: "tools unsupported", model: "no-tools", body: `{"messages":[],"tools":[{"type":"function"}]}`, wantErr: true},
+		{name: "image unsupported", model: "no-vision", body: `{"messages":[{"role":"user","content":[{"type":"image_url"}]}]}`, wantErr: true},
+		{name: "prompt exceeds window", model: "small-clamp", body: `{"messages":[{"role":"user","content":"` + long + `"}]}`, wantErr: true},
+		{name: "max_tokens clamped", model: "small-clamp", body: `{"max_tokens":80,"messages":[{"role":"user","content":"hi"}]}`, want: `"max_tokens":50`},
+		{name: "max_tokens rejected", model: "small-reject", body: `{"max_tokens":200,"messages":[{"role":"user","content":"hi"}]}`, wantErr: true},
+		{name: "no capability", model: "other", body: `{"max_tokens":80,"messages":[]}`, want: `"model":"other"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := rewriteFallbackBody([]byte(tt.body), tt.model)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got %s", out)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(out), tt.want) {
+				t.Fatalf("body = %s, want it to contain %s", out, tt.want)
+			}
+		})
+	}
+}
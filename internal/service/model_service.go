@@ -0,0 +1,195 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nanami9426/imgo/internal/utils"
+)
+
+const (
+	// 上游模型列表在进程内缓存一段时间，避免每次 /v1/models 都请求全部上游。
+	upstreamModelsCacheTTL     = 30 * time.Second
+	upstreamModelsFetchTimeout = 5 * time.Second
+	upstreamModelsPath         = "/v1/models"
+
+	modelOwnerGateway = "gateway"
+)
+
+// openAIModel 是 /v1/models 返回的单个模型，Root 为别名指向的真实模型。
+type openAIModel struct {
+	ID      string `json:"id"`
+	Object  string `json:"object"`
+	Created int64  `json:"created"`
+	OwnedBy string `json:"owned_by"`
+	Root    string `json:"root,omitempty"`
+}
+
+type openAIModelList struct {
+	Object string        `json:"object"`
+	Data   []openAIModel `json:"data"`
+}
+
+type upstreamModelsEntry struct {
+	models    []openAIModel
+	expiresAt time.Time
+}
+
+var (
+	upstreamModelsCache   = map[string]upstreamModelsEntry{}
+	upstreamModelsCacheMu sync.Mutex
+)
+
+// ListModelsHandler 由网关直接应答 GET /v1/models：
+// 1) 并发拉取全部上游的模型列表并去重合并（按路由表顺序，只保留路由到该上游的模型）；
+// 2) 追加运维配置的模型别名；
+// 3) 过滤掉当前用户 / API Key 无权使用的模型。
+func ListModelsHandler() gin.HandlerFunc {
+	initUpstreamRuntimes()
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, openAIModelList{
+			Object: "list",
+			Data:   listVisibleModels(c),
+		})
+	}
+}
+
+// RetrieveModelHandler 应答 GET /v1/models/{model}，只返回当前调用方可见的模型（含别名）。
+func RetrieveModelHandler() gin.HandlerFunc {
+	initUpstreamRuntimes()
+	return func(c *gin.Context) {
+		id := strings.TrimPrefix(c.Param("model"), "/")
+		for _, model := range listVisibleModels(c) {
+			if model.ID == id {
+				c.JSON(http.StatusOK, model)
+				return
+			}
+		}
+		abortModelNotFound(c, id)
+	}
+}
+
+func listVisibleModels(c *gin.Context) []openAIModel {
+	configs := utils.GetUpstreamConfigs()
+	results := make([][]openAIModel, len(configs))
+	var wg sync.WaitGroup
+	for i, cfg := range configs {
+		wg.Add(1)
+		go func(i int, cfg utils.UpstreamConfig) {
+			defer wg.Done()
+			results[i] = listUpstreamModels(c.Request.Context(), cfg)
+		}(i, cfg)
+	}
+	wg.Wait()
+
+	seen := map[string]openAIModel{}
+	data := make([]openAIModel, 0)
+	for _, list := range results {
+		for _, model := range list {
+			if _, ok := seen[model.ID]; ok {
+				continue
+			}
+			seen[model.ID] = model
+			if modelAllowed(c, model.ID) {
+				data = append(data, model)
+			}
+		}
+	}
+	for _, alias := range utils.GetModelAliases() {
+		if _, ok := seen[alias.Alias]; ok {
+			continue
+		}
+		if !modelAllowed(c, alias.Model) || len(utils.ResolveUpstreamsForModel(alias.Model)) == 0 {
+			continue
+		}
+		data = append(data, openAIModel{
+			ID:      alias.Alias,
+			Object:  "model",
+			Created: seen[alias.Model].Created,
+			OwnedBy: modelOwnerGateway,
+			Root:    alias.Model,
+		})
+	}
+	return data
+}
+
+// listUpstreamModels 返回单个上游的模型列表（带缓存）。
+// 拉取失败时退化为配置中不含通配符的模型名，保证上游故障时列表仍然可用。
+func listUpstreamModels(ctx context.Context, cfg utils.UpstreamConfig) []openAIModel {
+	upstreamModelsCacheMu.Lock()
+	entry, ok := upstreamModelsCache[cfg.Name]
+	upstreamModelsCacheMu.Unlock()
+	if ok && time.Now().Before(entry.expiresAt) {
+		return entry.models
+	}
+
+	models, err := fetchUpstreamModels(ctx, cfg)
+	if err != nil {
+		utils.Log.Errorf("fetch upstream models failed: upstream=%s err=%v", cfg.Name, err)
+		models = staticUpstreamModels(cfg)
+	}
+	upstreamModelsCacheMu.Lock()
+	upstreamModelsCache[cfg.Name] = upstreamModelsEntry{models: models, expiresAt: time.Now().Add(upstreamModelsCacheTTL)}
+	upstreamModelsCacheMu.Unlock()
+	return models
+}
+
+func fetchUpstreamModels(ctx context.Context, cfg utils.UpstreamConfig) ([]openAIModel, error) {
+	rt, err := getUpstreamRuntime(cfg)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, upstreamModelsFetchTimeout)
+	defer cancel()
+	replica := rt.pool.pick(nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, buildUpstreamURL(replica.url, &url.URL{Path: upstreamModelsPath}), nil)
+	if err != nil {
+		return nil, err
+	}
+	rewriteUpstreamHeaders(req.Header, rt.cfg.APIKey)
+	resp, err := rt.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer drainAndClose(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("upstream status %d", resp.StatusCode)
+	}
+	var list openAIModelList
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, err
+	}
+	out := make([]openAIModel, 0, len(list.Data))
+	for _, model := range list.Data {
+		model.ID = strings.TrimSpace(model.ID)
+		// 只保留路由表会转发到该上游的模型，避免列出请求后会被路由到别处的模型。
+		if model.ID == "" || !cfg.MatchModel(model.ID) {
+			continue
+		}
+		model.Object = "model"
+		if model.OwnedBy == "" {
+			model.OwnedBy = cfg.Name
+		}
+		model.Root = ""
+		out = append(out, model)
+	}
+	return out, nil
+}
+
+func staticUpstreamModels(cfg utils.UpstreamConfig) []openAIModel {
+	out := make([]openAIModel, 0, len(cfg.Models))
+	for _, pattern := range cfg.Models {
+		if strings.ContainsAny(pattern, "*?") {
+			continue
+		}
+		out = append(out, openAIModel{ID: pattern, Object: "model", OwnedBy: cfg.Name})
+	}
+	return out
+}
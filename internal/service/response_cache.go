@@ -0,0 +1,196 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nanami9426/imgo/internal/utils"
+)
+
+const (
+	contextKeyCacheHit  = "cache_hit"
+	responseHeaderCache = "X-Cache"
+
+	// 响应结束后的 Redis 写操作不依赖请求 context，单独限定超时。
+	detachedRedisTimeout = 2 * time.Second
+)
+
+// responseCacheLookup 是一次可缓存请求的缓存上下文。
+type responseCacheLookup struct {
+	cfg   utils.ResponseCacheConfig
+	key   string
+	model string
+	ttl   time.Duration
+	// bypass 为 true 时跳过读缓存（Cache-Control: no-cache），但仍会用新响应刷新缓存。
+	bypass bool
+}
+
+// decodeChatPayload 解析 chat/completions 请求体，供缓存与合并判断共用；非法 JSON 返回 nil。
+func decodeChatPayload(rawBody []byte) map[string]interface{} {
+	payload := map[string]interface{}{}
+	dec := json.NewDecoder(bytes.NewReader(rawBody))
+	dec.UseNumber()
+	if err := dec.Decode(&payload); err != nil {
+		return nil
+	}
+	return payload
+}
+
+// prepareResponseCache 判断请求能否走响应缓存，不能时返回 nil：
+// 1) 未开启缓存、请求带 Cache-Control: no-store、或 temperature 不是 0 时不缓存；
+// 2) 模型 TTL<=0 时不缓存；
+// 3) 请求体是会话中间件改写后的内容，即已包含拼接的历史消息。
+func prepareResponseCache(c *gin.Context, payload map[string]interface{}) *responseCacheLookup {
+	cfg := utils.GetResponseCacheConfig()
+	if !cfg.Enabled || payload == nil {
+		return nil
+	}
+	cacheControl := strings.ToLower(c.GetHeader("Cache-Control"))
+	if strings.Contains(cacheControl, "no-store") {
+		return nil
+	}
+	if !utils.IsDeterministicChatRequest(payload) {
+		return nil
+	}
+	model, _ := payload["model"].(string)
+	model = strings.TrimSpace(model)
+	ttl := cfg.TTLForModel(model)
+	if model == "" || ttl <= 0 {
+		return nil
+	}
+	key, err := utils.BuildResponseCacheKey(cfg, payload)
+	if err != nil {
+		utils.Log.Errorf("build response cache key failed: %v", err)
+		return nil
+	}
+	return &responseCacheLookup{
+		cfg:    cfg,
+		key:    key,
+		model:  model,
+		ttl:    ttl,
+		bypass: strings.Contains(cacheControl, "no-cache"),
+	}
+}
+
+// serveHit 查询缓存，命中时直接回写缓存的响应并返回 true。
+// Redis 异常按未命中处理，不影响正常转发。
+func (l *responseCacheLookup) serveHit(c *gin.Context) bool {
+	c.Writer.Header().Set(responseHeaderCache, "MISS")
+	if l.bypass {
+		return false
+	}
+	entry, err := utils.GetCachedChatCompletion(c.Request.Context(), l.key)
+	if err != nil {
+		utils.Log.Errorf("read response cache failed: key=%s err=%v", l.key, err)
+		return false
+	}
+	if entry == nil {
+		return false
+	}
+
+	c.Set(contextKeyCacheHit, true)
+	setServedModel(c, entry.Model)
+	c.Writer.Header().Set(responseHeaderCache, "HIT")
+	writeCachedResponse(c, entry)
+	return true
+}
+
+// writeCachedResponse 回写一份完整的上游响应，SSE 响应按事件逐条回放。
+func writeCachedResponse(c *gin.Context, entry *utils.CachedChatCompletion) {
+	header := c.Writer.Header()
+	if entry.ContentType != "" {
+		header.Set("Content-Type", entry.ContentType)
+	}
+	if !entry.Stream {
+		c.Writer.WriteHeader(entry.StatusCode)
+		_, _ = c.Writer.Write(entry.Body)
+		return
+	}
+
+	header.Set("Cache-Control", "no-cache")
+	header.Set("Connection", "keep-alive")
+	header.Set("X-Accel-Buffering", "no")
+	c.Writer.WriteHeader(entry.StatusCode)
+	replayCachedSSE(c, entry.Body)
+}
+
+// replayCachedSSE 按事件（空行分隔）逐条写出缓存的 SSE 响应，保持客户端的流式体验。
+func replayCachedSSE(c *gin.Context, body []byte) {
+	flusher, _ := c.Writer.(http.Flusher)
+	for len(body) > 0 {
+		event := body
+		if idx := bytes.Index(body, []byte("\n\n")); idx >= 0 {
+			event = body[:idx+2]
+		}
+		body = body[len(event):]
+		if _, err := c.Writer.Write(event); err != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		if c.Request.Context().Err() != nil {
+			return
+		}
+	}
+}
+
+// newCapture 返回一个用于旁路收集上游响应的 writer，超过 max_body_bytes 后放弃收集。
+func (l *responseCacheLookup) newCapture() *responseCacheCapture {
+	return &responseCacheCapture{limit: l.cfg.MaxBodyBytes}
+}
+
+// store 在上游响应完整转发后写入缓存。
+// 只缓存 200 响应，且实际服务的模型必须是请求模型（降级得到的响应不缓存）。
+func (l *responseCacheLookup) store(c *gin.Context, statusCode int, contentType string, body []byte) {
+	if statusCode != http.StatusOK || len(body) == 0 || len(body) > l.cfg.MaxBodyBytes {
+		return
+	}
+	if servedModel := c.GetString(contextKeyServedModel); servedModel != "" && servedModel != l.model {
+		return
+	}
+	entry := &utils.CachedChatCompletion{
+		Stream:      strings.HasPrefix(strings.ToLower(contentType), "text/event-stream"),
+		StatusCode:  statusCode,
+		ContentType: contentType,
+		Model:       l.model,
+		Body:        body,
+		CreatedAt:   time.Now().UTC().Unix(),
+	}
+	err := runDetached(func(ctx context.Context) error {
+		return utils.SetCachedChatCompletion(ctx, l.key, entry, l.ttl)
+	})
+	if err != nil {
+		utils.Log.Errorf("write response cache failed: key=%s err=%v", l.key, err)
+	}
+}
+
+// runDetached 执行响应结束后的 Redis 写操作，不受客户端断开影响。
+func runDetached(fn func(ctx context.Context) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), detachedRedisTimeout)
+	defer cancel()
+	return fn(ctx)
+}
+
+type responseCacheCapture struct {
+	buf      bytes.Buffer
+	limit    int
+	overflow bool
+}
+
+func (w *responseCacheCapture) Write(p []byte) (int, error) {
+	if w.overflow {
+		return len(p), nil
+	}
+	if w.buf.Len()+len(p) > w.limit {
+		w.overflow = true
+		w.buf = bytes.Buffer{}
+		return len(p), nil
+	}
+	return w.buf.Write(p)
+}
@@ -0,0 +1,41 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nanami9426/imgo/internal/models"
+	"github.com/nanami9426/imgo/internal/utils"
+	"gorm.io/gorm"
+)
+
+// GetResponse 返回 POST /v1/responses 生成并保存的 response 对象（按用户隔离）。
+func GetResponse(c *gin.Context) {
+	userID, ok := parseUserID(c)
+	if !ok || userID <= 0 {
+		utils.Abort(c, http.StatusUnauthorized, utils.StatUnauthorized, "token无效或已过期", nil)
+		return
+	}
+	responseID := strings.TrimSpace(c.Param("response_id"))
+	resp, err := models.GetLLMResponseByIDAndUser(responseID, userID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			utils.AbortOpenAI(c, http.StatusNotFound, &utils.Error{
+				Message: fmt.Sprintf("Response with id '%s' not found.", responseID),
+				Type:    "invalid_request_error",
+				Param:   "response_id",
+				Code:    "response_not_found",
+			})
+			return
+		}
+		utils.AbortOpenAI(c, http.StatusInternalServerError, &utils.Error{
+			Message: "failed to load response",
+			Type:    "server_error",
+		})
+		return
+	}
+	c.Data(http.StatusOK, "application/json; charset=utf-8", []byte(resp.ResponseJSON))
+}
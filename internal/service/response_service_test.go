@@ -0,0 +1,55 @@
+package service
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nanami9426/imgo/internal/models"
+)
+
+func TestGetResponseAfterConversationDeleted(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	useFakeDB(t)
+
+	const userID, conversationID = int64(7), int64(1001)
+	if err := models.CreateLLMConversation(&models.LLMConversation{
+		ConversationID: conversationID,
+		UserID:         userID,
+		Title:          "hello",
+		LastMessageAt:  time.Now().UTC(),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := models.CreateLLMResponse(&models.LLMResponse{
+		ResponseID:     "resp_1",
+		UserID:         userID,
+		ConversationID: conversationID,
+		Status:         "completed",
+		ResponseJSON:   `{"id":"resp_1","object":"response"}`,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	r := gin.New()
+	r.Use(func(c *gin.Context) { c.Set("user_id", userID) })
+	r.GET("/v1/responses/:response_id", GetResponse)
+	r.DELETE("/v1/conversations/:conversation_id", DeleteConversation)
+	do := func(method string, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+		return w
+	}
+
+	if w := do(http.MethodGet, "/v1/responses/resp_1"); w.Code != http.StatusOK {
+		t.Fatalf("GET before delete: status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if w := do(http.MethodDelete, "/v1/conversations/1001"); w.Code != http.StatusOK {
+		t.Fatalf("DELETE: status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if w := do(http.MethodGet, "/v1/responses/resp_1"); w.Code != http.StatusNotFound {
+		t.Fatalf("GET after delete: status = %d, want 404, body = %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,84 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nanami9426/imgo/internal/tokenizer"
+	"github.com/nanami9426/imgo/internal/utils"
+)
+
+type tokenizeRequest struct {
+	Model    string        `json:"model"`
+	Prompt   interface{}   `json:"prompt"`
+	Messages []interface{} `json:"messages"`
+}
+
+// tokenizeResponse 中 Estimated 为 true 表示该模型没有配置词表，Count 为启发式估算值且不返回 Tokens。
+type tokenizeResponse struct {
+	Model     string `json:"model"`
+	Tokenizer string `json:"tokenizer"`
+	Estimated bool   `json:"estimated"`
+	Count     int    `json:"count"`
+	Tokens    []int  `json:"tokens,omitempty"`
+}
+
+// TokenizeHandler 由网关直接应答 POST /v1/tokenize，使用与限流、用量估算相同的分词器：
+// 1) messages 按 chat 口径计数（含每条消息的固定开销）；
+// 2) prompt 可以是字符串、字符串数组或 token id 数组，字符串 prompt 且有词表时同时返回 token id。
+func TokenizeHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req tokenizeRequest
+		dec := json.NewDecoder(c.Request.Body)
+		dec.UseNumber()
+		if err := dec.Decode(&req); err != nil {
+			utils.AbortOpenAI(c, http.StatusBadRequest, &utils.Error{
+				Message: "request body must be a JSON object",
+				Type:    "invalid_request_error",
+			})
+			return
+		}
+		model := strings.TrimSpace(req.Model)
+		if model == "" {
+			utils.AbortOpenAI(c, http.StatusBadRequest, &utils.Error{
+				Message: "model is required",
+				Type:    "invalid_request_error",
+				Param:   "model",
+			})
+			return
+		}
+		model = utils.ResolveModelAlias(model)
+		if !modelAllowed(c, model) {
+			abortModelNotFound(c, model)
+			return
+		}
+		if req.Messages == nil && req.Prompt == nil {
+			utils.AbortOpenAI(c, http.StatusBadRequest, &utils.Error{
+				Message: "either prompt or messages is required",
+				Type:    "invalid_request_error",
+			})
+			return
+		}
+
+		tok := tokenizer.ForModel(model)
+		resp := tokenizeResponse{
+			Model:     model,
+			Tokenizer: tok.Name(),
+			Estimated: !tokenizer.Exact(tok),
+		}
+		if req.Messages != nil {
+			resp.Count = tokenizer.CountMessages(tok, req.Messages)
+		} else if prompt, ok := req.Prompt.(string); ok {
+			if resp.Tokens = tok.Encode(prompt); resp.Tokens != nil {
+				resp.Count = len(resp.Tokens)
+			} else {
+				resp.Count = tok.Count(prompt)
+			}
+		} else {
+			resp.Count = tokenizer.CountInput(tok, req.Prompt)
+		}
+		c.JSON(http.StatusOK, resp)
+	}
+}
@@ -0,0 +1,382 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nanami9426/imgo/internal/utils"
+)
+
+// upstreamRuntime 是单个上游在进程内的运行时对象：独立连接池与副本池。
+// 每个上游使用各自的 Transport，避免不同上游的连接参数互相影响。
+type upstreamRuntime struct {
+	cfg     utils.UpstreamConfig
+	client  *http.Client
+	pool    *upstreamPool
+	breaker *circuitBreaker
+
+	// admission 按计数范围（上游名或 上游名/模型）懒加载准入控制器。
+	admission   map[string]*admissionController
+	admissionMu sync.Mutex
+}
+
+var (
+	upstreamRuntimes   = map[string]*upstreamRuntime{}
+	upstreamRuntimesMu sync.Mutex
+	upstreamInitOnce   sync.Once
+)
+
+// initUpstreamRuntimes 在注册路由时为全部上游创建运行时对象并启动主动探活。
+func initUpstreamRuntimes() {
+	upstreamInitOnce.Do(func() {
+		for _, cfg := range utils.GetUpstreamConfigs() {
+			if _, err := getUpstreamRuntime(cfg); err != nil {
+				utils.Log.Errorf("init upstream failed: upstream=%s err=%v", cfg.Name, err)
+			}
+		}
+	})
+}
+
+// getUpstreamRuntime 按上游名称懒加载运行时对象，同名上游复用同一连接池。
+func getUpstreamRuntime(cfg utils.UpstreamConfig) (*upstreamRuntime, error) {
+	upstreamRuntimesMu.Lock()
+	defer upstreamRuntimesMu.Unlock()
+	if rt, ok := upstreamRuntimes[cfg.Name]; ok {
+		return rt, nil
+	}
+	rt, err := newUpstreamRuntime(cfg)
+	if err != nil {
+		return nil, err
+	}
+	upstreamRuntimes[cfg.Name] = rt
+	rt.pool.startHealthCheck()
+	return rt, nil
+}
+
+func newUpstreamRuntime(cfg utils.UpstreamConfig) (*upstreamRuntime, error) {
+	transport := newUpstreamTransport(cfg.Transport)
+	client := &http.Client{
+		// http.Client.Timeout 是一个总超时
+		// 包含建立连接、重定向、读取响应 body（包括 stream 期间一直读）等整个请求生命周期。
+		// 设置为0表示不启用这个总超时，请求可以一直持续下去。
+		Timeout:   0,
+		Transport: transport,
+	}
+	pool := &upstreamPool{
+		name:     cfg.Name,
+		balancer: cfg.Balancer,
+		ejection: cfg.Ejection,
+		health:   cfg.HealthCheck,
+		client:   client,
+		apiKey:   cfg.APIKey,
+	}
+	rt := &upstreamRuntime{
+		cfg:     cfg,
+		client:  client,
+		pool:    pool,
+		breaker: newCircuitBreaker(cfg.Name, cfg.CircuitBreaker),
+
+		admission: map[string]*admissionController{},
+	}
+	for _, replicaCfg := range cfg.Replicas {
+		target, err := utils.ParseUpstreamURL(replicaCfg.URL)
+		if err != nil {
+			return nil, err
+		}
+		replica := &upstreamReplica{
+			url:    target,
+			weight: replicaCfg.Weight,
+		}
+		replica.proxy = newReplicaProxy(rt, replica, transport)
+		pool.replicas = append(pool.replicas, replica)
+	}
+	if len(pool.replicas) == 0 {
+		return nil, errors.New("no replicas")
+	}
+	return rt, nil
+}
+
+// reportResult 把一次上游请求结果同时回报给副本池（被动摘除）与熔断器。
+func (rt *upstreamRuntime) reportResult(replica *upstreamReplica, statusCode int, err error) {
+	rt.pool.reportResult(replica, statusCode, err)
+	switch {
+	case err != nil && errors.Is(err, context.Canceled):
+		rt.breaker.record(breakerIgnored)
+	case err != nil || statusCode >= http.StatusInternalServerError:
+		rt.breaker.record(breakerFailure)
+	default:
+		rt.breaker.record(breakerSuccess)
+	}
+}
+
+// abortCircuitOpen 在熔断期间快速失败，返回 OpenAI 风格 503 与 Retry-After。
+func abortCircuitOpen(c *gin.Context, rt *upstreamRuntime, retryAfter time.Duration) {
+	seconds := int((retryAfter + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	message := fmt.Sprintf("upstream %s is temporarily unavailable (circuit open)", rt.cfg.Name)
+	if reason := rt.breaker.openReasonText(); reason != "" {
+		message += ": " + reason
+	}
+	c.Header("Retry-After", strconv.Itoa(seconds))
+	utils.AbortOpenAI(c, http.StatusServiceUnavailable, &utils.Error{
+		Message: message,
+		Type:    "server_error",
+		Code:    "circuit_open",
+	})
+}
+
+// newReplicaProxy 为单个副本创建反向代理，并把响应状态/错误回报给副本池与熔断器。
+func newReplicaProxy(rt *upstreamRuntime, replica *upstreamReplica, transport http.RoundTripper) *httputil.ReverseProxy {
+	apiKey := rt.cfg.APIKey
+	target := replica.url
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	originalDirector := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		originalDirector(req)
+		rewriteUpstreamHeaders(req.Header, apiKey)
+		req.Host = target.Host
+	}
+	proxy.FlushInterval = 50 * time.Millisecond
+	proxy.Transport = transport
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		rt.reportResult(replica, resp.StatusCode, nil)
+		return nil
+	}
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		rt.reportResult(replica, 0, err)
+		writeUpstreamError(w)
+	}
+	return proxy
+}
+
+// newUpstreamTransport 根据上游配置构造 http.Transport（默认值已在加载配置时填充）。
+func newUpstreamTransport(cfg utils.UpstreamTransportConfig) *http.Transport {
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		// 自定义拨号上下文，控制TCP连接的行为
+		DialContext: (&net.Dialer{
+			Timeout:   msDuration(cfg.DialTimeoutMs),
+			KeepAlive: msDuration(cfg.KeepAliveMs),
+		}).DialContext,
+		MaxIdleConns:          cfg.MaxIdleConns,
+		MaxIdleConnsPerHost:   cfg.MaxIdleConnsPerHost,
+		IdleConnTimeout:       msDuration(cfg.IdleConnTimeoutMs),
+		TLSHandshakeTimeout:   msDuration(cfg.TLSHandshakeTimeoutMs),
+		ResponseHeaderTimeout: msDuration(cfg.ResponseHeaderTimeoutMs),
+		ExpectContinueTimeout: 1 * time.Second,
+		// 禁用HTTP压缩，网关、代理服务器自己解压再压缩会浪费CPU资源
+		DisableCompression: true,
+	}
+	if cfg.InsecureSkipVerify {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	return transport
+}
+
+func msDuration(ms int) time.Duration {
+	if ms <= 0 {
+		return 0
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// resolveUpstreamRuntime 根据请求中的 model 选择上游。
+// 找不到匹配的上游时直接返回 OpenAI 风格 404，不再盲目转发。
+func resolveUpstreamRuntime(c *gin.Context, model string) (*upstreamRuntime, bool) {
+	cfg, err := utils.ResolveUpstreamForModel(model)
+	if err != nil {
+		abortUpstreamNotFound(c, model)
+		return nil, false
+	}
+	rt, err := getUpstreamRuntime(cfg)
+	if err != nil {
+		utils.AbortOpenAI(c, http.StatusInternalServerError, &utils.Error{
+			Message: fmt.Sprintf("invalid upstream %s: %v", cfg.Name, err),
+			Type:    "server_error",
+			Code:    "upstream_misconfigured",
+		})
+		return nil, false
+	}
+	c.Set(contextKeyUpstreamName, rt.cfg.Name)
+	return rt, true
+}
+
+// lookupUpstreamCandidates 返回所有能服务该模型的上游（按路由表顺序），首项为主上游。
+func lookupUpstreamCandidates(model string) []*upstreamRuntime {
+	configs := utils.ResolveUpstreamsForModel(model)
+	out := make([]*upstreamRuntime, 0, len(configs))
+	for _, cfg := range configs {
+		rt, err := getUpstreamRuntime(cfg)
+		if err != nil {
+			utils.Log.Errorf("skip invalid upstream: upstream=%s err=%v", cfg.Name, err)
+			continue
+		}
+		out = append(out, rt)
+	}
+	return out
+}
+
+// abortUpstreamNotFound 区分两种情况：请求带了 model 但没有上游服务它（404），
+// 以及没有 model 且未配置任何默认上游（503）。
+func abortUpstreamNotFound(c *gin.Context, model string) {
+	if strings.TrimSpace(model) == "" {
+		utils.AbortOpenAI(c, http.StatusServiceUnavailable, &utils.Error{
+			Message: "no upstream configured",
+			Type:    "server_error",
+			Code:    "upstream_not_configured",
+		})
+		return
+	}
+	abortModelNotFound(c, model)
+}
+
+func abortModelNotFound(c *gin.Context, model string) {
+	utils.AbortOpenAI(c, http.StatusNotFound, utils.ModelNotFoundError(model))
+}
+
+// peekRequestModel 读取 JSON 请求体中的 model 字段，并把 body 挂回请求。
+// model 是别名时会把请求体改写为真实模型名，返回值也是真实模型名。
+// GET 请求或非 JSON 请求（如 multipart 音频上传）不读 body，返回空 model 交给默认上游处理。
+func peekRequestModel(c *gin.Context) (string, error) {
+	if c.Request.Body == nil || c.Request.Method == http.MethodGet || c.Request.Method == http.MethodHead {
+		return "", nil
+	}
+	contentType := strings.ToLower(c.Request.Header.Get("Content-Type"))
+	if contentType != "" && !strings.Contains(contentType, "json") {
+		return "", nil
+	}
+	rawBody, err := readRequestBody(c)
+	if err != nil {
+		return "", err
+	}
+	_, model := resolveRequestModelAlias(c, rawBody)
+	return model, nil
+}
+
+// resolveRequestModelAlias 把请求体中的别名 model 改写为真实模型名，返回（可能改写后的）请求体与真实模型名。
+// 改写失败时保留原请求体，由上游返回具体错误。
+func resolveRequestModelAlias(c *gin.Context, rawBody []byte) ([]byte, string) {
+	model := parseModelField(rawBody)
+	canonical := utils.ResolveModelAlias(model)
+	if canonical == model {
+		return rawBody, model
+	}
+	rewritten, err := rewriteModelField(rawBody, canonical)
+	if err != nil {
+		utils.Log.Errorf("rewrite model alias failed: alias=%s err=%v", model, err)
+		return rawBody, model
+	}
+	setRequestBody(c, rewritten)
+	return rewritten, canonical
+}
+
+// readRequestBody 读取完整请求体并重新挂回请求，便于后续重复读取。
+func readRequestBody(c *gin.Context) ([]byte, error) {
+	if c.Request.Body == nil {
+		return nil, nil
+	}
+	rawBody, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		return nil, err
+	}
+	setRequestBody(c, rawBody)
+	return rawBody, nil
+}
+
+func setRequestBody(c *gin.Context, body []byte) {
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+	c.Request.ContentLength = int64(len(body))
+	c.Request.Header.Set("Content-Length", strconv.Itoa(len(body)))
+}
+
+// modelAllowed 判断当前调用方（用户 + 可选的 API Key 限制）能否使用 model（真实模型名）。
+func modelAllowed(c *gin.Context, model string) bool {
+	userID, _ := parseUserID(c)
+	patterns, _ := c.Get(contextKeyAPIKeyModels)
+	list, _ := patterns.([]string)
+	return utils.ModelAllowed(userID, list, model)
+}
+
+// parseModelField 解析失败时返回空字符串，不拦截请求，交给上游返回具体错误。
+func parseModelField(rawBody []byte) string {
+	var payload struct {
+		Model string `json:"model"`
+	}
+	if err := json.Unmarshal(rawBody, &payload); err != nil {
+		return ""
+	}
+	return strings.TrimSpace(payload.Model)
+}
+
+func writeUpstreamError(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadGateway)
+	_, _ = w.Write([]byte(`{"error":{"message":"upstream error","type":"bad_gateway"}}`))
+}
+
+// upstreamState 是单个上游的状态快照，供管理接口展示。
+type upstreamState struct {
+	Name           string                 `json:"name"`
+	Models         []string               `json:"models"`
+	Default        bool                   `json:"default"`
+	Balancer       string                 `json:"balancer"`
+	Replicas       []upstreamReplicaState `json:"replicas"`
+	CircuitBreaker breakerSnapshot        `json:"circuit_breaker"`
+	Admission      []admissionSnapshot    `json:"admission"`
+}
+
+// snapshotAdmission 返回该上游已创建的准入控制器状态，按计数范围排序。
+func (rt *upstreamRuntime) snapshotAdmission() []admissionSnapshot {
+	rt.admissionMu.Lock()
+	ctrls := make([]*admissionController, 0, len(rt.admission))
+	for _, ctrl := range rt.admission {
+		ctrls = append(ctrls, ctrl)
+	}
+	rt.admissionMu.Unlock()
+	out := make([]admissionSnapshot, 0, len(ctrls))
+	for _, ctrl := range ctrls {
+		out = append(out, ctrl.snapshot())
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Scope < out[j].Scope })
+	return out
+}
+
+// snapshotUpstreams 按路由表顺序返回全部上游的副本状态。
+func snapshotUpstreams() []upstreamState {
+	initUpstreamRuntimes()
+	configs := utils.GetUpstreamConfigs()
+	out := make([]upstreamState, 0, len(configs))
+	for _, cfg := range configs {
+		rt, err := getUpstreamRuntime(cfg)
+		if err != nil {
+			continue
+		}
+		out = append(out, upstreamState{
+			Name:     cfg.Name,
+			Models:   cfg.Models,
+			Default:  cfg.Default,
+			Balancer: cfg.Balancer,
+			Replicas: rt.pool.snapshot(),
+
+			CircuitBreaker: rt.breaker.snapshot(),
+			Admission:      rt.snapshotAdmission(),
+		})
+	}
+	return out
+}
@@ -0,0 +1,268 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nanami9426/imgo/internal/utils"
+)
+
+// upstreamReplica 是上游下的一个副本，记录负载与健康状态。
+type upstreamReplica struct {
+	url    *url.URL
+	weight int
+	proxy  *httputil.ReverseProxy
+
+	inFlight int64
+
+	mu                  sync.Mutex
+	consecutiveFailures int
+	ejectedUntil        time.Time
+	ejectReason         string
+	lastProbeAt         time.Time
+	lastProbeOK         bool
+	// currentWeight 用于平滑加权轮询（nginx smooth weighted round-robin）。
+	currentWeight int
+}
+
+// upstreamPool 负责在副本间做负载均衡，并根据被动失败与主动探活维护可用状态。
+type upstreamPool struct {
+	name     string
+	balancer string
+	ejection utils.UpstreamEjectionConfig
+	health   utils.UpstreamHealthCheckConfig
+	replicas []*upstreamReplica
+	client   *http.Client
+	apiKey   string
+
+	rrCounter uint64
+	wrrMu     sync.Mutex
+}
+
+// upstreamReplicaState 是副本状态快照，供管理接口展示。
+type upstreamReplicaState struct {
+	URL                 string `json:"url"`
+	Weight              int    `json:"weight"`
+	InFlight            int64  `json:"in_flight"`
+	Healthy             bool   `json:"healthy"`
+	ConsecutiveFailures int    `json:"consecutive_failures"`
+	EjectedUntil        string `json:"ejected_until,omitempty"`
+	EjectReason         string `json:"eject_reason,omitempty"`
+	LastProbeAt         string `json:"last_probe_at,omitempty"`
+	LastProbeOK         bool   `json:"last_probe_ok"`
+}
+
+// isAvailable 判断副本当前是否可以接流量（未被摘除）。
+func (r *upstreamReplica) isAvailable() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.ejectedUntil.IsZero()
+}
+
+// pick 按配置的策略选择一个可用副本，exclude 中的副本（如本次请求已失败过的）优先跳过。
+// 所有副本都被摘除时退化为在全部副本中选择，避免整个上游彻底不可用。
+func (p *upstreamPool) pick(exclude map[*upstreamReplica]struct{}) *upstreamReplica {
+	p.readmitExpired(time.Now())
+	candidates := make([]*upstreamReplica, 0, len(p.replicas))
+	for _, replica := range p.replicas {
+		if _, skip := exclude[replica]; skip {
+			continue
+		}
+		if replica.isAvailable() {
+			candidates = append(candidates, replica)
+		}
+	}
+	if len(candidates) == 0 {
+		for _, replica := range p.replicas {
+			if _, skip := exclude[replica]; !skip {
+				candidates = append(candidates, replica)
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = p.replicas
+	}
+	if len(candidates) == 1 {
+		return candidates[0]
+	}
+
+	switch p.balancer {
+	case utils.UpstreamBalancerLeastInFlight:
+		// 在途请求数相同时从轮询位置开始找，避免总是压在第一个副本上。
+		start := int(atomic.AddUint64(&p.rrCounter, 1) % uint64(len(candidates)))
+		best := candidates[start]
+		bestLoad := atomic.LoadInt64(&best.inFlight)
+		for i := 1; i < len(candidates); i++ {
+			replica := candidates[(start+i)%len(candidates)]
+			if load := atomic.LoadInt64(&replica.inFlight); load < bestLoad {
+				best = replica
+				bestLoad = load
+			}
+		}
+		return best
+	case utils.UpstreamBalancerWeighted:
+		p.wrrMu.Lock()
+		defer p.wrrMu.Unlock()
+		total := 0
+		var best *upstreamReplica
+		for _, replica := range candidates {
+			replica.currentWeight += replica.weight
+			total += replica.weight
+			if best == nil || replica.currentWeight > best.currentWeight {
+				best = replica
+			}
+		}
+		best.currentWeight -= total
+		return best
+	default:
+		idx := atomic.AddUint64(&p.rrCounter, 1) % uint64(len(candidates))
+		return candidates[idx]
+	}
+}
+
+// acquire/release 维护副本在途请求数，供 least_in_flight 策略与管理接口使用。
+func (r *upstreamReplica) acquire() {
+	atomic.AddInt64(&r.inFlight, 1)
+}
+
+func (r *upstreamReplica) release() {
+	atomic.AddInt64(&r.inFlight, -1)
+}
+
+// reportResult 做被动健康检查：连接错误或 5xx 计为失败，连续失败达到阈值后摘除。
+// 客户端主动断开（context canceled）不计入失败。
+func (p *upstreamPool) reportResult(replica *upstreamReplica, statusCode int, err error) {
+	if err != nil && errors.Is(err, context.Canceled) {
+		return
+	}
+	failed := err != nil || statusCode >= http.StatusInternalServerError
+	replica.mu.Lock()
+	defer replica.mu.Unlock()
+	if !failed {
+		replica.consecutiveFailures = 0
+		return
+	}
+	replica.consecutiveFailures++
+	if replica.consecutiveFailures < p.ejection.ConsecutiveFailures || !replica.ejectedUntil.IsZero() {
+		return
+	}
+	reason := "upstream 5xx"
+	if err != nil {
+		reason = err.Error()
+	}
+	replica.ejectedUntil = time.Now().Add(msDuration(p.ejection.CooldownMs))
+	replica.ejectReason = reason
+	utils.Log.Errorf("upstream replica ejected: upstream=%s replica=%s failures=%d reason=%s",
+		p.name, replica.url.String(), replica.consecutiveFailures, reason)
+}
+
+// readmitExpired 在关闭主动探活时，冷却期结束的副本直接恢复。
+func (p *upstreamPool) readmitExpired(now time.Time) {
+	if p.health.IntervalMs > 0 {
+		return
+	}
+	for _, replica := range p.replicas {
+		replica.mu.Lock()
+		if !replica.ejectedUntil.IsZero() && now.After(replica.ejectedUntil) {
+			p.readmitLocked(replica)
+		}
+		replica.mu.Unlock()
+	}
+}
+
+func (p *upstreamPool) readmitLocked(replica *upstreamReplica) {
+	replica.ejectedUntil = time.Time{}
+	replica.ejectReason = ""
+	replica.consecutiveFailures = 0
+	utils.Log.Infof("upstream replica readmitted: upstream=%s replica=%s", p.name, replica.url.String())
+}
+
+// startHealthCheck 启动后台主动探活：
+// 1) 被摘除且冷却期已过的副本探活成功后恢复；
+// 2) 正常副本探活失败也会被摘除，避免等真实流量失败才发现。
+func (p *upstreamPool) startHealthCheck() {
+	if p.health.IntervalMs <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(msDuration(p.health.IntervalMs))
+		defer ticker.Stop()
+		for range ticker.C {
+			for _, replica := range p.replicas {
+				p.probe(replica)
+			}
+		}
+	}()
+}
+
+func (p *upstreamPool) probe(replica *upstreamReplica) {
+	ctx, cancel := context.WithTimeout(context.Background(), msDuration(p.health.TimeoutMs))
+	defer cancel()
+
+	probeURL := buildUpstreamURL(replica.url, &url.URL{Path: p.health.Path})
+	ok := false
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, probeURL, nil)
+	if err == nil {
+		rewriteUpstreamHeaders(req.Header, p.apiKey)
+		resp, doErr := p.client.Do(req)
+		if doErr == nil {
+			ok = resp.StatusCode >= 200 && resp.StatusCode < 300
+			_ = resp.Body.Close()
+		} else {
+			err = doErr
+		}
+	}
+
+	now := time.Now()
+	replica.mu.Lock()
+	defer replica.mu.Unlock()
+	replica.lastProbeAt = now
+	replica.lastProbeOK = ok
+	if ok {
+		if !replica.ejectedUntil.IsZero() && now.After(replica.ejectedUntil) {
+			p.readmitLocked(replica)
+		}
+		return
+	}
+	if replica.ejectedUntil.IsZero() {
+		reason := "health check failed"
+		if err != nil {
+			reason = "health check failed: " + err.Error()
+		}
+		replica.ejectedUntil = now.Add(msDuration(p.ejection.CooldownMs))
+		replica.ejectReason = reason
+		utils.Log.Errorf("upstream replica ejected: upstream=%s replica=%s reason=%s", p.name, replica.url.String(), reason)
+	}
+}
+
+// snapshot 返回副本状态快照。
+func (p *upstreamPool) snapshot() []upstreamReplicaState {
+	out := make([]upstreamReplicaState, 0, len(p.replicas))
+	for _, replica := range p.replicas {
+		replica.mu.Lock()
+		state := upstreamReplicaState{
+			URL:                 replica.url.String(),
+			Weight:              replica.weight,
+			InFlight:            atomic.LoadInt64(&replica.inFlight),
+			Healthy:             replica.ejectedUntil.IsZero(),
+			ConsecutiveFailures: replica.consecutiveFailures,
+			EjectReason:         replica.ejectReason,
+			LastProbeOK:         replica.lastProbeOK,
+		}
+		if !replica.ejectedUntil.IsZero() {
+			state.EjectedUntil = replica.ejectedUntil.UTC().Format(time.RFC3339)
+		}
+		if !replica.lastProbeAt.IsZero() {
+			state.LastProbeAt = replica.lastProbeAt.UTC().Format(time.RFC3339)
+		}
+		replica.mu.Unlock()
+		out = append(out, state)
+	}
+	return out
+}
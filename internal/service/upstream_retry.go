@@ -0,0 +1,230 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nanami9426/imgo/internal/utils"
+)
+
+const (
+	contextKeyUpstreamName     = "upstream_name"
+	contextKeyUpstreamAttempts = "upstream_attempts"
+	contextKeyAPIKeyModels     = "api_key_allowed_models"
+
+	chatCompletionsPath = "/v1/chat/completions"
+
+	// 丢弃失败响应 body 时最多读取的字节数，读完可以让连接回到连接池复用。
+	maxDrainBodyBytes = 64 * 1024
+)
+
+// chatUpstreamResult 是最终被采用的上游响应，release 需要在响应转发结束后调用。
+type chatUpstreamResult struct {
+	resp    *http.Response
+	rt      *upstreamRuntime
+	replica *upstreamReplica
+	ticket  *admissionTicket
+}
+
+func (r *chatUpstreamResult) release() {
+	r.replica.release()
+	r.ticket.release()
+}
+
+// close 放弃该响应（例如要降级到下一个模型），释放连接与副本在途计数。
+func (r *chatUpstreamResult) close() {
+	drainAndClose(r.resp.Body)
+	r.release()
+}
+
+// chatUpstreamFailure 描述一次完整重试流程后仍未拿到上游响应的原因。
+type chatUpstreamFailure struct {
+	rt          *upstreamRuntime
+	circuitOpen bool
+	retryAfter  time.Duration
+	// admissionErr 非 nil 表示上游并发已满，请求在准入队列中被拒绝或超时。
+	admissionErr error
+	err          error
+}
+
+// write 把失败原因以对应格式写给客户端。
+func (f *chatUpstreamFailure) write(c *gin.Context) {
+	if f.circuitOpen {
+		abortCircuitOpen(c, f.rt, f.retryAfter)
+		return
+	}
+	if f.admissionErr != nil {
+		abortAdmission(c, f.admissionErr)
+		return
+	}
+	writeUpstreamError(c.Writer)
+}
+
+// doChatCompletionWithRetry 在首字节写给客户端之前做重试与故障转移：
+// 1) 连接失败或上游返回可重试状态码（默认 429/502/503）时重试；
+// 2) 每次重试跳过本请求已失败过的副本，开启 failover_upstreams 时轮换到下一个能服务该模型的上游；
+// 3) 熔断中的上游直接跳过，全部熔断时返回 circuitOpen 失败；
+// 3.1) 上游配置了并发上限时先在准入队列中排队，被拒绝或超时返回 admissionErr 失败；
+// 4) 上游带 Retry-After 时按其等待，超过 max_retry_after_ms 则不再重试，直接返回上游响应；
+// 5) 失败的尝试追加到 attempts，由 APILoggingMiddleware 逐条落库。
+// 返回的 result 与 failure 有且只有一个非 nil，错误响应由调用方决定如何写出。
+func doChatCompletionWithRetry(c *gin.Context, candidates []*upstreamRuntime, model string, rawBody []byte, attempts *[]utils.UpstreamAttempt) (*chatUpstreamResult, *chatUpstreamFailure) {
+	cfg := utils.GetRetryConfig()
+	ctx := c.Request.Context()
+	tried := map[*upstreamReplica]struct{}{}
+	upstreamIdx := 0
+
+	for attempt := 1; ; attempt++ {
+		idx, retryAfter, allowed := nextAllowedUpstream(candidates, upstreamIdx)
+		if !allowed {
+			// 所有候选上游都处于熔断中：快速失败，不再等待拨号超时。
+			return nil, &chatUpstreamFailure{rt: candidates[upstreamIdx], circuitOpen: true, retryAfter: retryAfter}
+		}
+		upstreamIdx = idx
+		rt := candidates[upstreamIdx]
+		ticket, err := admitUpstream(c, rt, model)
+		if err != nil {
+			rt.breaker.record(breakerIgnored)
+			return nil, &chatUpstreamFailure{rt: rt, admissionErr: err}
+		}
+		replica := rt.pool.pick(tried)
+		replica.acquire()
+
+		startedAt := time.Now()
+		resp, err := sendChatUpstreamRequest(c, rt, replica, rawBody)
+		statusCode := 0
+		if resp != nil {
+			statusCode = resp.StatusCode
+		}
+		rt.reportResult(replica, statusCode, err)
+		c.Set(contextKeyUpstreamName, rt.cfg.Name)
+
+		wait, retry := retryDecision(cfg, attempt, resp, err)
+		if !retry || ctx.Err() != nil {
+			if err != nil {
+				replica.release()
+				ticket.release()
+				return nil, &chatUpstreamFailure{rt: rt, err: err}
+			}
+			return &chatUpstreamResult{resp: resp, rt: rt, replica: replica, ticket: ticket}, nil
+		}
+
+		record := utils.UpstreamAttempt{
+			Attempt:    len(*attempts) + 1,
+			Upstream:   rt.cfg.Name,
+			Replica:    replica.url.String(),
+			Model:      model,
+			StatusCode: statusCode,
+			LatencyMs:  int(time.Since(startedAt).Milliseconds()),
+		}
+		if err != nil {
+			record.Error = err.Error()
+		} else {
+			record.Error = fmt.Sprintf("upstream status %d", statusCode)
+			drainAndClose(resp.Body)
+		}
+		*attempts = append(*attempts, record)
+		replica.release()
+		ticket.release()
+		tried[replica] = struct{}{}
+
+		if cfg.FailoverUpstreams && len(candidates) > 1 {
+			upstreamIdx = (upstreamIdx + 1) % len(candidates)
+		}
+		if !sleepWithContext(ctx, wait) {
+			return nil, &chatUpstreamFailure{rt: rt, err: ctx.Err()}
+		}
+	}
+}
+
+// nextAllowedUpstream 从 start 开始找第一个熔断器放行的上游。
+// 全部拒绝时返回最短的 Retry-After，供快速失败响应使用。
+func nextAllowedUpstream(candidates []*upstreamRuntime, start int) (int, time.Duration, bool) {
+	var minRetryAfter time.Duration
+	for i := 0; i < len(candidates); i++ {
+		idx := (start + i) % len(candidates)
+		allowed, retryAfter := candidates[idx].breaker.allow()
+		if allowed {
+			return idx, 0, true
+		}
+		if minRetryAfter == 0 || retryAfter < minRetryAfter {
+			minRetryAfter = retryAfter
+		}
+	}
+	return start, minRetryAfter, false
+}
+
+// sendChatUpstreamRequest 用缓冲好的请求体构造一次上游请求，保证每次重试都能完整重放。
+// 兼容接口（如 /v1/messages）已在入口转换为 chat/completions 请求，因此上游路径固定为 chat/completions。
+func sendChatUpstreamRequest(c *gin.Context, rt *upstreamRuntime, replica *upstreamReplica, rawBody []byte) (*http.Response, error) {
+	requestURL := &url.URL{Path: chatCompletionsPath, RawQuery: c.Request.URL.RawQuery}
+	req, err := http.NewRequestWithContext(
+		c.Request.Context(),
+		c.Request.Method,
+		buildUpstreamURL(replica.url, requestURL),
+		bytes.NewReader(rawBody),
+	)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = c.Request.Header.Clone()
+	rewriteUpstreamHeaders(req.Header, rt.cfg.APIKey)
+	req.ContentLength = int64(len(rawBody))
+	if userID, ok := c.Get("user_id"); ok {
+		req.Header.Set("X-User-ID", fmt.Sprintf("%v", userID))
+	}
+	req.Host = replica.url.Host
+	return rt.client.Do(req)
+}
+
+// retryDecision 判断第 attempt 次尝试后是否需要重试，以及重试前的等待时间。
+func retryDecision(cfg utils.RetryConfig, attempt int, resp *http.Response, err error) (time.Duration, bool) {
+	if attempt >= cfg.MaxAttempts {
+		return 0, false
+	}
+	if err != nil {
+		if errors.Is(err, context.Canceled) {
+			return 0, false
+		}
+		return cfg.Backoff(attempt), true
+	}
+	if resp == nil || !cfg.ShouldRetryStatus(resp.StatusCode) {
+		return 0, false
+	}
+	if retryAfter, ok := utils.ParseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+		if retryAfter > time.Duration(cfg.MaxRetryAfterMs)*time.Millisecond {
+			return 0, false
+		}
+		return retryAfter, true
+	}
+	return cfg.Backoff(attempt), true
+}
+
+func sleepWithContext(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+func drainAndClose(body io.ReadCloser) {
+	if body == nil {
+		return
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(body, maxDrainBodyBytes))
+	_ = body.Close()
+}
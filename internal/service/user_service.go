@@ -45,8 +45,9 @@ type CheckTokenReq struct {
 }
 
 type CreateAPIKeyReq struct {
-	Name      string `json:"name" form:"name" binding:"required"`
-	ExpiresAt string `json:"expires_at" form:"expires_at"`
+	Name          string `json:"name" form:"name" binding:"required"`
+	ExpiresAt     string `json:"expires_at" form:"expires_at"`
+	AllowedModels string `json:"allowed_models" form:"allowed_models"`
 }
 
 type RevokeAPIKeyReq struct {
@@ -62,6 +63,8 @@ type apiKeyMetaResp struct {
 	ExpiresAt  *string `json:"expires_at,omitempty"`
 	LastUsedAt *string `json:"last_used_at,omitempty"`
 	LastUsedIP string  `json:"last_used_ip,omitempty"`
+
+	AllowedModels []string `json:"allowed_models,omitempty"`
 }
 
 type createAPIKeyResp struct {
@@ -72,6 +75,8 @@ type createAPIKeyResp struct {
 	Status    string  `json:"status"`
 	CreatedAt string  `json:"created_at"`
 	ExpiresAt *string `json:"expires_at,omitempty"`
+
+	AllowedModels []string `json:"allowed_models,omitempty"`
 }
 
 // @Summary 用户列表
@@ -308,6 +313,7 @@ func CheckToken(c *gin.Context) {
 // @Param Authorization header string true "Bearer JWT"
 // @Param name formData string true "API Key 名称"
 // @Param expires_at formData string false "过期时间 (RFC3339)"
+// @Param allowed_models formData string false "可用模型，逗号分隔，支持 * 通配；为空表示沿用用户权限"
 // @Router /user/create_api_key [post]
 func CreateAPIKey(c *gin.Context) {
 	userID, ok := parseUserID(c)
@@ -338,6 +344,8 @@ func CreateAPIKey(c *gin.Context) {
 		expiresAt = &parsed
 	}
 
+	allowedModels := utils.ParseModelPatterns(req.AllowedModels)
+
 	prefix, fullKey, secretHash, err := generateAPIKeyTokenFn()
 	if err != nil {
 		utils.Fail(c, http.StatusOK, utils.StatInternalError, "生成 API Key 失败", err)
@@ -352,6 +360,8 @@ func CreateAPIKey(c *gin.Context) {
 		SecretHash: secretHash,
 		Status:     models.APIKeyStatusActive,
 		ExpiresAt:  expiresAt,
+
+		AllowedModels: strings.Join(allowedModels, ","),
 	}
 	if err := createAPIKeyFn(apiKey); err != nil {
 		utils.Fail(c, http.StatusOK, utils.StatDatabaseError, "创建 API Key 失败", err)
@@ -366,6 +376,8 @@ func CreateAPIKey(c *gin.Context) {
 		Status:    apiKey.Status,
 		CreatedAt: apiKey.CreatedAt.UTC().Format(time.RFC3339Nano),
 		ExpiresAt: formatOptionalTime(apiKey.ExpiresAt),
+
+		AllowedModels: allowedModels,
 	})
 }
 
@@ -444,6 +456,8 @@ func buildAPIKeyMetaResp(apiKey *models.APIKey) apiKeyMetaResp {
 		ExpiresAt:  formatOptionalTime(apiKey.ExpiresAt),
 		LastUsedAt: formatOptionalTime(apiKey.LastUsedAt),
 		LastUsedIP: apiKey.LastUsedIP,
+
+		AllowedModels: utils.ParseModelPatterns(apiKey.AllowedModels),
 	}
 }
 
@@ -3,23 +3,21 @@ package service
 import (
 	"fmt"
 	"io"
-	"net"
 	"net/http"
-	"net/http/httputil"
 	"net/url"
 	"path"
 	"strings"
-	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/nanami9426/imgo/internal/utils"
 )
 
-func rewriteUpstreamHeaders(header http.Header) {
+func rewriteUpstreamHeaders(header http.Header, upstreamAPIKey string) {
 	header.Del("Host")
 	header.Del("Accept-Encoding")
+	header.Del("X-Api-Key")
 
-	apiKey := strings.TrimSpace(utils.UpstreamAPIKey)
+	apiKey := strings.TrimSpace(upstreamAPIKey)
 	if apiKey == "" {
 		// 不把网关自身 JWT / API Key 透传给第三方上游。
 		header.Del("Authorization")
@@ -48,112 +46,88 @@ func buildUpstreamURL(target *url.URL, requestURL *url.URL) string {
 	return upstreamURL.String()
 }
 
+// ProxyToVLLM 透传其余 /v1 路由。
+// 带 JSON body 的请求按 model 字段（别名先解析为真实模型名）选择上游，其余请求走默认上游。
 func ProxyToVLLM() gin.HandlerFunc {
-	upstream := utils.UpstreamBaseURL
-	target, err := url.Parse(upstream)
-	if err != nil || target.Scheme == "" || target.Host == "" {
-		// 启动时配置有问题，直接返回handler，所有请求500
-		return func(c *gin.Context) {
-			utils.Abort(c, http.StatusInternalServerError, utils.StatInternalError, "invalid VLLM_URL: "+upstream, nil)
-		}
-	}
-
-	proxy := httputil.NewSingleHostReverseProxy(target)
-	originalDirector := proxy.Director
-	proxy.Director = func(req *http.Request) {
-		originalDirector(req)
-		rewriteUpstreamHeaders(req.Header)
-		req.Host = target.Host
-	}
-	proxy.FlushInterval = 50 * time.Millisecond
-	proxy.Transport = &http.Transport{
-		Proxy: http.ProxyFromEnvironment,
-		// 自定义拨号上下文，控制TCP连接的行为
-		DialContext: (&net.Dialer{
-			Timeout:   10 * time.Second,
-			KeepAlive: 30 * time.Second,
-		}).DialContext,
-
-		MaxIdleConns:          100,
-		MaxIdleConnsPerHost:   100,
-		IdleConnTimeout:       90 * time.Second,
-		TLSHandshakeTimeout:   10 * time.Second,
-		ExpectContinueTimeout: 1 * time.Second,
-		// 禁用HTTP压缩，网关、代理服务器自己解压再压缩会浪费CPU资源
-		DisableCompression: true,
-	}
-	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadGateway)
-		_, _ = w.Write([]byte(`{"error":{"message":"upstream error","type":"bad_gateway"}}`))
-	}
+	initUpstreamRuntimes()
 	return func(c *gin.Context) {
+		model, err := peekRequestModel(c)
+		if err != nil {
+			utils.Abort(c, http.StatusBadRequest, utils.StatInvalidParam, "读取请求体失败", err)
+			return
+		}
+		if !modelAllowed(c, model) {
+			abortModelNotFound(c, model)
+			return
+		}
+		rt, ok := resolveUpstreamRuntime(c, model)
+		if !ok {
+			return
+		}
+		if allowed, retryAfter := rt.breaker.allow(); !allowed {
+			abortCircuitOpen(c, rt, retryAfter)
+			return
+		}
+		ticket, err := admitUpstream(c, rt, model)
+		if err != nil {
+			// 没有真正发出请求，只归还熔断器的半开探测名额。
+			rt.breaker.record(breakerIgnored)
+			abortAdmission(c, err)
+			return
+		}
+		defer ticket.release()
 		if user_id, ok := c.Get("user_id"); ok {
 			c.Request.Header.Set("X-User-ID", fmt.Sprintf("%v", user_id))
 		}
-		proxy.ServeHTTP(c.Writer, c.Request)
+		replica := rt.pool.pick(nil)
+		replica.acquire()
+		defer replica.release()
+		replica.proxy.ServeHTTP(c.Writer, c.Request)
 	}
 }
 
+// ChatCompletionsHandler 按请求中的 model 路由到对应上游，并流式回写响应。
+// 首字节写出前的失败会按 retry 配置重试/故障转移，仍失败时按 model_fallbacks 降级到下一个模型；
+// 开始写响应后不再重试。
+// 开启 response_cache 时，temperature=0 的请求先查缓存，未命中则在响应完整转发后写入缓存；
+// 开启 coalesce 时，相同的非流式 temperature=0 在途请求合并为一次上游调用。
 func ChatCompletionsHandler() gin.HandlerFunc {
-	upstream := utils.UpstreamBaseURL
-	target, err := url.Parse(upstream)
-	if err != nil || target.Scheme == "" || target.Host == "" {
-		// 启动时配置有问题，直接返回handler，所有请求500
-		return func(c *gin.Context) {
-			utils.Abort(c, http.StatusInternalServerError, utils.StatInternalError, "invalid VLLM_URL: "+upstream, nil)
-		}
-	}
-
-	transport := &http.Transport{
-		Proxy: http.ProxyFromEnvironment,
-		DialContext: (&net.Dialer{
-			Timeout:   10 * time.Second,
-			KeepAlive: 30 * time.Second,
-		}).DialContext,
-		MaxIdleConns:          100,
-		MaxIdleConnsPerHost:   100,
-		IdleConnTimeout:       90 * time.Second,
-		TLSHandshakeTimeout:   10 * time.Second,
-		ExpectContinueTimeout: 1 * time.Second,
-		DisableCompression:    true,
-	}
-	client := &http.Client{
-		// http.Client.Timeout 是一个总超时
-		// 包含建立连接、重定向、读取响应 body（包括 stream 期间一直读）等整个请求生命周期。
-		// 设置为0表示不启用这个总超时，请求可以一直持续下去。
-		Timeout:   0,
-		Transport: transport,
-	}
+	initUpstreamRuntimes()
 	return func(c *gin.Context) {
-		req, err := http.NewRequestWithContext(
-			c.Request.Context(),
-			c.Request.Method,
-			buildUpstreamURL(target, c.Request.URL),
-			c.Request.Body,
-		)
+		rawBody, err := readRequestBody(c)
 		if err != nil {
-			utils.Abort(c, http.StatusInternalServerError, utils.StatInternalError, "build request failed", err)
+			utils.Abort(c, http.StatusBadRequest, utils.StatInvalidParam, "读取请求体失败", err)
 			return
 		}
-
-		req.Header = c.Request.Header.Clone()
-		rewriteUpstreamHeaders(req.Header)
-		req.ContentLength = c.Request.ContentLength
-		if userID, ok := c.Get("user_id"); ok {
-			req.Header.Set("X-User-ID", fmt.Sprintf("%v", userID))
+		rawBody, _ = resolveRequestModelAlias(c, rawBody)
+		payload := decodeChatPayload(rawBody)
+		cache := prepareResponseCache(c, payload)
+		if cache != nil && cache.serveHit(c) {
+			return
 		}
-		req.Host = target.Host
-
-		resp, err := client.Do(req)
-		if err != nil {
-			c.Writer.Header().Set("Content-Type", "application/json")
-			c.Writer.WriteHeader(http.StatusBadGateway)
-			_, _ = c.Writer.Write([]byte(`{"error":{"message":"upstream error","type":"bad_gateway"}}`))
+		if coalesce := prepareCoalesce(payload); coalesce != nil && coalesce.serve(c, rawBody, cache) {
+			return
+		}
+		result, ok := forwardChatCompletionWithFallback(c, rawBody)
+		if !ok {
 			return
 		}
+		defer result.release()
+		resp := result.resp
 		defer resp.Body.Close()
 
+		var body io.Reader = resp.Body
+		completed := false
+		if cache != nil {
+			capture := cache.newCapture()
+			body = io.TeeReader(resp.Body, capture)
+			defer func() {
+				if completed && !capture.overflow {
+					cache.store(c, resp.StatusCode, resp.Header.Get("Content-Type"), capture.buf.Bytes())
+				}
+			}()
+		}
+
 		for k, vv := range resp.Header {
 			if isHopByHopOrCORSHeader(k) {
 				continue
@@ -182,7 +156,8 @@ func ChatCompletionsHandler() gin.HandlerFunc {
 		if isStream {
 			flusher, ok := c.Writer.(http.Flusher)
 			if !ok {
-				_, _ = io.Copy(c.Writer, resp.Body)
+				_, err := io.Copy(c.Writer, body)
+				completed = err == nil
 				return
 			}
 			buf := make([]byte, 8*1024)
@@ -192,7 +167,7 @@ func ChatCompletionsHandler() gin.HandlerFunc {
 					return
 				default:
 				}
-				n, readErr := resp.Body.Read(buf)
+				n, readErr := body.Read(buf)
 				if n > 0 {
 					if _, writeErr := c.Writer.Write(buf[:n]); writeErr != nil {
 						return
@@ -201,6 +176,7 @@ func ChatCompletionsHandler() gin.HandlerFunc {
 				}
 				if readErr != nil {
 					if readErr == io.EOF {
+						completed = true
 						return
 					}
 					return
@@ -208,7 +184,8 @@ func ChatCompletionsHandler() gin.HandlerFunc {
 			}
 		}
 
-		_, _ = io.Copy(c.Writer, resp.Body)
+		_, err = io.Copy(c.Writer, body)
+		completed = err == nil
 	}
 }
 
@@ -0,0 +1,345 @@
+package tokenizer
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// defaultPretokenizePattern 是 cl100k 风格的预分词正则。
+// Go 的 regexp 不支持 \s+(?!\S)，由 splitPieces 在匹配后把末尾一个空白让给下一个片段来等价实现。
+const defaultPretokenizePattern = `(?i:'s|'t|'re|'ve|'m|'ll|'d)|[^\r\n\p{L}\p{N}]?\p{L}+|\p{N}{1,3}| ?[^\s\p{L}\p{N}]+[\r\n]*|\s*[\r\n]+|\s+`
+
+// bpeTokenizer 是字节级 BPE：先按正则切片，每个片段内反复合并优先级最高的相邻 token 对。
+type bpeTokenizer struct {
+	name    string
+	vocab   *bpeVocab
+	pattern *regexp.Regexp
+}
+
+// bpeVocab 是 BPE 词表：ranks 为 token 字节串到 id 的映射；
+// merges 为 HF merges 中相邻 token 对的合并顺序，为 nil 时（tiktoken）以合并结果的 id 作为合并优先级。
+type bpeVocab struct {
+	ranks  map[string]int
+	merges map[mergePair]int
+	// wholePieces 表示片段整体在词表中时直接输出该 token（tiktoken 与 HF 的 ignore_merges）。
+	wholePieces bool
+}
+
+type mergePair struct {
+	left  string
+	right string
+}
+
+func newBPETokenizer(name string, vocab *bpeVocab, pattern *regexp.Regexp) (*bpeTokenizer, error) {
+	// 字节级 BPE 要求 256 个单字节都在词表中，否则任意文本不一定能编码。
+	for b := 0; b < 256; b++ {
+		if _, ok := vocab.ranks[string([]byte{byte(b)})]; !ok {
+			return nil, fmt.Errorf("vocabulary is not byte-level: missing byte 0x%02x", b)
+		}
+	}
+	return &bpeTokenizer{name: name, vocab: vocab, pattern: pattern}, nil
+}
+
+func (t *bpeTokenizer) Name() string {
+	return t.name
+}
+
+func (t *bpeTokenizer) Count(text string) int {
+	return len(t.Encode(text))
+}
+
+func (t *bpeTokenizer) Encode(text string) []int {
+	ids := make([]int, 0, len(text)/3+1)
+	for _, piece := range t.splitPieces(text) {
+		if t.vocab.wholePieces {
+			if id, ok := t.vocab.ranks[piece]; ok {
+				ids = append(ids, id)
+				continue
+			}
+		}
+		ids = t.mergePiece([]byte(piece), ids)
+	}
+	return ids
+}
+
+// splitPieces 按预分词正则切片；纯空白片段后面紧跟非空白字符时让出最后一个空白，与 \s+(?!\S) 行为一致。
+func (t *bpeTokenizer) splitPieces(text string) []string {
+	var pieces []string
+	for start := 0; start < len(text); {
+		loc := t.pattern.FindStringIndex(text[start:])
+		if loc == nil {
+			break
+		}
+		if loc[1] == loc[0] {
+			// 空匹配时前进一个字符，避免死循环。
+			_, size := utf8.DecodeRuneInString(text[start:])
+			start += size
+			continue
+		}
+		begin, end := start+loc[0], start+loc[1]
+		piece := text[begin:end]
+		if end < len(text) && isYieldableSpace(piece) {
+			if next, _ := utf8.DecodeRuneInString(text[end:]); !unicode.IsSpace(next) {
+				_, size := utf8.DecodeLastRuneInString(piece)
+				end -= size
+				piece = text[begin:end]
+			}
+		}
+		pieces = append(pieces, piece)
+		start = end
+	}
+	return pieces
+}
+
+// isYieldableSpace 判断片段是否是可以让出末尾空白的多字符空白（以换行结尾的片段保持原样）。
+func isYieldableSpace(piece string) bool {
+	if utf8.RuneCountInString(piece) < 2 || strings.TrimSpace(piece) != "" {
+		return false
+	}
+	last, _ := utf8.DecodeLastRuneInString(piece)
+	return last != '\n' && last != '\r'
+}
+
+// mergePiece 对单个片段做 BPE 合并，结果追加到 ids。
+// token 以起始位置组成链表，相邻 token 对按合并优先级放入小顶堆（同优先级先合并靠左的），
+// 每次合并只为新 token 与左右邻居生成两个新候选，已失效的候选在出堆时丢弃，整体为 O(n log n)。
+func (t *bpeTokenizer) mergePiece(piece []byte, ids []int) []int {
+	n := len(piece)
+	if n == 0 {
+		return ids
+	}
+	// next[i]/prev[i] 是起始于 i 的 token 的右/左邻居起始位置，n 与 -1 表示片段两端；merged[i] 表示该 token 已并入左邻居。
+	next := make([]int, n)
+	prev := make([]int, n)
+	merged := make([]bool, n)
+	for i := range next {
+		next[i] = i + 1
+		prev[i] = i - 1
+	}
+	candidates := make(mergeHeap, 0, n)
+	push := func(left int) {
+		right := next[left]
+		if right >= n {
+			return
+		}
+		if rank := t.pairRank(piece, left, right, next[right]); rank != math.MaxInt {
+			heap.Push(&candidates, mergeCandidate{rank: rank, left: left, right: right, end: next[right]})
+		}
+	}
+	for i := 0; i+1 < n; i++ {
+		push(i)
+	}
+
+	for candidates.Len() > 0 {
+		c := heap.Pop(&candidates).(mergeCandidate)
+		// 左右 token 在入堆后被其他合并改变过时，该候选已失效。
+		if merged[c.left] || next[c.left] != c.right || next[c.right] != c.end {
+			continue
+		}
+		merged[c.right] = true
+		next[c.left] = c.end
+		if c.end < n {
+			prev[c.end] = c.left
+		}
+		push(c.left)
+		if prev[c.left] >= 0 {
+			push(prev[c.left])
+		}
+	}
+	for i := 0; i < n; i = next[i] {
+		ids = append(ids, t.vocab.ranks[string(piece[i:next[i]])])
+	}
+	return ids
+}
+
+// pairRank 返回 piece[left:right] 与 piece[right:end] 两个 token 的合并优先级（越小越先合并），不能合并时为 math.MaxInt。
+func (t *bpeTokenizer) pairRank(piece []byte, left int, right int, end int) int {
+	var rank int
+	var ok bool
+	if t.vocab.merges != nil {
+		rank, ok = t.vocab.merges[mergePair{
+			left:  string(piece[left:right]),
+			right: string(piece[right:end]),
+		}]
+	} else {
+		rank, ok = t.vocab.ranks[string(piece[left:end])]
+	}
+	if !ok {
+		return math.MaxInt
+	}
+	return rank
+}
+
+// mergeCandidate 是一次候选合并：起始于 left、right 的相邻 token，end 为右 token 的结束位置。
+type mergeCandidate struct {
+	rank  int
+	left  int
+	right int
+	end   int
+}
+
+// mergeHeap 按合并优先级排序，同优先级时靠左的先合并，与逐轮扫描取最小值的结果一致。
+type mergeHeap []mergeCandidate
+
+func (h mergeHeap) Len() int { return len(h) }
+
+func (h mergeHeap) Less(i, j int) bool {
+	if h[i].rank != h[j].rank {
+		return h[i].rank < h[j].rank
+	}
+	return h[i].left < h[j].left
+}
+
+func (h mergeHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *mergeHeap) Push(x any) { *h = append(*h, x.(mergeCandidate)) }
+
+func (h *mergeHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// loadTiktokenRanks 读取 tiktoken 格式的词表：每行 "<base64 token> <rank>"。
+func loadTiktokenRanks(path string) (map[string]int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ranks := map[string]int{}
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected \"<token> <rank>\"", path, lineNo)
+		}
+		token, err := base64.StdEncoding.DecodeString(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid base64 token: %w", path, lineNo, err)
+		}
+		rank, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid rank: %w", path, lineNo, err)
+		}
+		ranks[string(token)] = rank
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return ranks, nil
+}
+
+type hfTokenizerFile struct {
+	Model struct {
+		Type         string            `json:"type"`
+		Vocab        map[string]int    `json:"vocab"`
+		Merges       []json.RawMessage `json:"merges"`
+		IgnoreMerges bool              `json:"ignore_merges"`
+	} `json:"model"`
+}
+
+// loadHFVocab 读取 HuggingFace tokenizer.json 中的字节级 BPE 词表（GPT-2 / Qwen / Llama 3 等），
+// 按 model.merges 的顺序合并（兼容 "a b" 字符串与 ["a","b"] 两种写法）；没有 merges 时退化为以词表 id 作为合并优先级。
+// 非字节级词表（SentencePiece）不支持。
+func loadHFVocab(path string) (*bpeVocab, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file hfTokenizerFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if file.Model.Type != "" && file.Model.Type != "BPE" {
+		return nil, fmt.Errorf("%s: unsupported model type %s", path, file.Model.Type)
+	}
+	decoder := byteLevelDecoder()
+	decode := func(token string) (string, error) {
+		raw := make([]byte, 0, len(token))
+		for _, r := range token {
+			b, ok := decoder[r]
+			if !ok {
+				return "", fmt.Errorf("%s: token %q is not byte-level encoded", path, token)
+			}
+			raw = append(raw, b)
+		}
+		return string(raw), nil
+	}
+
+	vocab := &bpeVocab{
+		ranks:       make(map[string]int, len(file.Model.Vocab)),
+		wholePieces: file.Model.IgnoreMerges || len(file.Model.Merges) == 0,
+	}
+	for token, id := range file.Model.Vocab {
+		raw, err := decode(token)
+		if err != nil {
+			return nil, err
+		}
+		vocab.ranks[raw] = id
+	}
+	if len(file.Model.Merges) == 0 {
+		return vocab, nil
+	}
+	vocab.merges = make(map[mergePair]int, len(file.Model.Merges))
+	for i, item := range file.Model.Merges {
+		var pair [2]string
+		var line string
+		if err := json.Unmarshal(item, &line); err == nil {
+			left, right, ok := strings.Cut(line, " ")
+			if !ok {
+				return nil, fmt.Errorf("%s: merges[%d]: expected \"<left> <right>\"", path, i)
+			}
+			pair = [2]string{left, right}
+		} else if err := json.Unmarshal(item, &pair); err != nil {
+			return nil, fmt.Errorf("%s: merges[%d]: %w", path, i, err)
+		}
+		left, err := decode(pair[0])
+		if err != nil {
+			return nil, err
+		}
+		right, err := decode(pair[1])
+		if err != nil {
+			return nil, err
+		}
+		key := mergePair{left: left, right: right}
+		if _, ok := vocab.merges[key]; !ok {
+			vocab.merges[key] = i
+		}
+	}
+	return vocab, nil
+}
+
+// byteLevelDecoder 返回 GPT-2 bytes_to_unicode 映射的逆映射：可见字符映射为自身，其余字节映射到 U+0100 之后。
+func byteLevelDecoder() map[rune]byte {
+	decoder := make(map[rune]byte, 256)
+	visible := func(b int) bool {
+		return (b >= '!' && b <= '~') || (b >= 0xA1 && b <= 0xAC) || (b >= 0xAE && b <= 0xFF)
+	}
+	n := 0
+	for b := 0; b < 256; b++ {
+		if visible(b) {
+			decoder[rune(b)] = byte(b)
+			continue
+		}
+		decoder[rune(256+n)] = byte(b)
+		n++
+	}
+	return decoder
+}
@@ -0,0 +1,293 @@
+package tokenizer
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/nanami9426/imgo/internal/utils"
+)
+
+// writeTiktokenFixture 写入一个最小的 tiktoken 词表：256 个单字节（rank 即字节值）加上 extra 中的合并结果。
+func writeTiktokenFixture(t *testing.T, extra map[string]int) string {
+	t.Helper()
+	var b strings.Builder
+	for i := 0; i < 256; i++ {
+		fmt.Fprintf(&b, "%s %d\n", base64.StdEncoding.EncodeToString([]byte{byte(i)}), i)
+	}
+	for token, rank := range extra {
+		fmt.Fprintf(&b, "%s %d\n", base64.StdEncoding.EncodeToString([]byte(token)), rank)
+	}
+	path := filepath.Join(t.TempDir(), "fixture.tiktoken")
+	if err := os.WriteFile(path, []byte(b.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// writeHFFixture 写入一个最小的 HF tokenizer.json：256 个单字节（id 即字节值）加上 extra，merges 原样写入。
+func writeHFFixture(t *testing.T, extra map[string]int, merges []interface{}, ignoreMerges bool) string {
+	t.Helper()
+	encoder := map[byte]rune{}
+	for r, b := range byteLevelDecoder() {
+		encoder[b] = r
+	}
+	encode := func(s string) string {
+		var out []rune
+		for _, b := range []byte(s) {
+			out = append(out, encoder[b])
+		}
+		return string(out)
+	}
+	vocab := map[string]int{}
+	for i := 0; i < 256; i++ {
+		vocab[encode(string([]byte{byte(i)}))] = i
+	}
+	for token, id := range extra {
+		vocab[encode(token)] = id
+	}
+	encodedMerges := make([]interface{}, 0, len(merges))
+	for _, m := range merges {
+		switch v := m.(type) {
+		case string:
+			left, right, _ := strings.Cut(v, " ")
+			encodedMerges = append(encodedMerges, encode(left)+" "+encode(right))
+		case [2]string:
+			encodedMerges = append(encodedMerges, []string{encode(v[0]), encode(v[1])})
+		}
+	}
+	model := map[string]interface{}{"type": "BPE", "vocab": vocab, "ignore_merges": ignoreMerges}
+	if len(encodedMerges) > 0 {
+		model["merges"] = encodedMerges
+	}
+	data, err := json.Marshal(map[string]interface{}{"model": model})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "tokenizer.json")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func mustLoadFamily(t *testing.T, cfg FamilyConfig) Tokenizer {
+	t.Helper()
+	tok, err := loadFamily(cfg)
+	if err != nil {
+		t.Fatalf("loadFamily: %v", err)
+	}
+	return tok
+}
+
+func TestTiktokenEncode(t *testing.T) {
+	path := writeTiktokenFixture(t, map[string]int{
+		"he": 256, "ll": 257, "llo": 258, "hello": 259, " w": 260, "or": 261, "aa": 262,
+	})
+	tok := mustLoadFamily(t, FamilyConfig{Name: "fixture", Models: []string{"*"}, File: path})
+
+	tests := []struct {
+		name string
+		text string
+		want []int
+	}{
+		{name: "empty", text: "", want: []int{}},
+		{name: "whole piece in vocab", text: "hello", want: []int{259}},
+		{name: "merge by rank", text: "hellos", want: []int{259, 's'}},
+		{name: "leading space piece", text: "hello world", want: []int{259, 260, 261, 'l', 'd'}},
+		{name: "trailing space yields to next piece", text: "  x", want: []int{' ', ' ', 'x'}},
+		{name: "digits split by three", text: "12345", want: []int{'1', '2', '3', '4', '5'}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tok.Encode(tt.text)
+			if !slices.Equal(got, tt.want) {
+				t.Fatalf("Encode(%q) = %v, want %v", tt.text, got, tt.want)
+			}
+			if tok.Count(tt.text) != len(tt.want) {
+				t.Fatalf("Count(%q) = %d, want %d", tt.text, tok.Count(tt.text), len(tt.want))
+			}
+		})
+	}
+}
+
+func TestTiktokenLongPiece(t *testing.T) {
+	path := writeTiktokenFixture(t, map[string]int{"aa": 256})
+	tok := mustLoadFamily(t, FamilyConfig{Name: "fixture", Models: []string{"*"}, File: path})
+
+	if got := tok.Count(strings.Repeat("a", 1001)); got != 501 {
+		t.Fatalf("Count = %d, want 501", got)
+	}
+	// 超长片段（无空白的长文本、base64 等）整体合并，开销为 O(n log n)，这里只确认能在测试时限内完成。
+	if got := tok.Count(strings.Repeat("a", 1<<20)); got != 1<<19 {
+		t.Fatalf("Count = %d, want %d", got, 1<<19)
+	}
+}
+
+// naiveMergePiece 是逐轮扫描全部相邻 token 对、合并优先级最高（同优先级取最左）的一对的参考实现。
+func naiveMergePiece(tok *bpeTokenizer, piece []byte) []int {
+	parts := make([]int, len(piece)+1)
+	for i := range parts {
+		parts[i] = i
+	}
+	for {
+		best, bestRank := -1, math.MaxInt
+		for i := 0; i+2 < len(parts); i++ {
+			if rank := tok.pairRank(piece, parts[i], parts[i+1], parts[i+2]); rank < bestRank {
+				best, bestRank = i, rank
+			}
+		}
+		if best < 0 {
+			break
+		}
+		parts = slices.Delete(parts, best+1, best+2)
+	}
+	ids := []int{}
+	for i := 0; i+1 < len(parts); i++ {
+		ids = append(ids, tok.vocab.ranks[string(piece[parts[i]:parts[i+1]])])
+	}
+	return ids
+}
+
+func TestMergePieceMatchesNaive(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	const alphabet = "abc"
+	randomString := func(n int) string {
+		b := make([]byte, n)
+		for i := range b {
+			b[i] = alphabet[rng.IntN(len(alphabet))]
+		}
+		return string(b)
+	}
+
+	for round := 0; round < 20; round++ {
+		// 随机词表：所有单字节，加上随机的多字节 token 与随机的 merges 顺序。
+		ranks := map[string]int{}
+		for b := 0; b < 256; b++ {
+			ranks[string([]byte{byte(b)})] = b
+		}
+		merges := map[mergePair]int{}
+		for i := 0; i < 30; i++ {
+			left, right := randomString(1+rng.IntN(2)), randomString(1+rng.IntN(2))
+			if _, ok := ranks[left+right]; !ok {
+				ranks[left+right] = 256 + len(ranks)
+			}
+			if _, ok := merges[mergePair{left: left, right: right}]; !ok {
+				merges[mergePair{left: left, right: right}] = rng.IntN(10)
+			}
+		}
+		for _, vocab := range []*bpeVocab{{ranks: ranks}, {ranks: ranks, merges: merges}} {
+			tok := &bpeTokenizer{name: "random", vocab: vocab}
+			for i := 0; i < 50; i++ {
+				piece := []byte(randomString(rng.IntN(40)))
+				got := tok.mergePiece(piece, []int{})
+				want := naiveMergePiece(tok, piece)
+				if !slices.Equal(got, want) {
+					t.Fatalf("mergePiece(%q) = %v, want %v", piece, got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestHFEncodeFollowsMerges(t *testing.T) {
+	// "bc" 的 id 比 "ab" 小，但 merges 中 "a b" 在前，应先合并 ab。
+	extra := map[string]int{"bc": 256, "ab": 300, "xyz": 400}
+	merges := []interface{}{"a b", [2]string{"b", "c"}}
+
+	tests := []struct {
+		name         string
+		merges       []interface{}
+		ignoreMerges bool
+		text         string
+		want         []int
+	}{
+		{name: "merges order", merges: merges, text: "abc", want: []int{300, 'c'}},
+		{name: "byte-level space", merges: merges, text: " ab", want: []int{' ', 300}},
+		{name: "no merge for piece", merges: merges, text: "xyz", want: []int{'x', 'y', 'z'}},
+		{name: "ignore merges uses whole piece", merges: merges, ignoreMerges: true, text: "xyz", want: []int{400}},
+		{name: "without merges falls back to id order", text: "abc", want: []int{'a', 256}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeHFFixture(t, extra, tt.merges, tt.ignoreMerges)
+			tok := mustLoadFamily(t, FamilyConfig{Name: "fixture", Models: []string{"*"}, File: path})
+			if got := tok.Encode(tt.text); !slices.Equal(got, tt.want) {
+				t.Fatalf("Encode(%q) = %v, want %v", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadFamilyErrors(t *testing.T) {
+	dir := t.TempDir()
+	badTiktoken := filepath.Join(dir, "bad.tiktoken")
+	if err := os.WriteFile(badTiktoken, []byte("YQ==\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	partial := filepath.Join(dir, "partial.tiktoken")
+	if err := os.WriteFile(partial, []byte("YQ== 0\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	badHF := filepath.Join(dir, "bad.json")
+	if err := os.WriteFile(badHF, []byte(`{"model":{"type":"Unigram","vocab":{}}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		cfg  FamilyConfig
+	}{
+		{name: "missing fields", cfg: FamilyConfig{Name: "x", File: partial}},
+		{name: "malformed tiktoken line", cfg: FamilyConfig{Name: "x", Models: []string{"*"}, File: badTiktoken}},
+		{name: "not byte-level", cfg: FamilyConfig{Name: "x", Models: []string{"*"}, File: partial}},
+		{name: "unsupported hf model", cfg: FamilyConfig{Name: "x", Models: []string{"*"}, File: badHF}},
+		{name: "unknown format", cfg: FamilyConfig{Name: "x", Models: []string{"*"}, File: partial, Format: "spm"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := loadFamily(tt.cfg); err == nil {
+				t.Fatal("expected error")
+			}
+		})
+	}
+}
+
+func TestInitFallsBackForMissingVocab(t *testing.T) {
+	utils.V.Set(cfgTokenizerFamilies, []map[string]interface{}{
+		{"name": "missing", "models": []string{"Qwen/*"}, "file": filepath.Join(t.TempDir(), "none.json")},
+	})
+	t.Cleanup(func() {
+		utils.V.Set(cfgTokenizerFamilies, nil)
+		Init()
+	})
+
+	Init()
+	if tok := ForModel("Qwen/Qwen2-7B"); Exact(tok) {
+		t.Fatalf("ForModel returned %s, want heuristic", tok.Name())
+	}
+}
+
+func TestHeuristicCount(t *testing.T) {
+	tests := []struct {
+		text string
+		want int
+	}{
+		{text: "", want: 0},
+		{text: "abcd", want: 1},
+		{text: "abcde", want: 2},
+		{text: "你好 world", want: 4},
+	}
+	for _, tt := range tests {
+		if got := heuristic.Count(tt.text); got != tt.want {
+			t.Errorf("Count(%q) = %d, want %d", tt.text, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package tokenizer
+
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
+// heuristicTokenizer 在没有词表时估算 token 数：
+// 中日韩文字每个字符约 1 个 token（按 UTF-8 字节数会高估约 3 倍），其余文本按 ceil(bytes/4)。
+type heuristicTokenizer struct{}
+
+func (heuristicTokenizer) Name() string {
+	return "heuristic"
+}
+
+func (heuristicTokenizer) Encode(text string) []int {
+	return nil
+}
+
+func (heuristicTokenizer) Count(text string) int {
+	cjk, otherBytes := 0, 0
+	for _, r := range text {
+		if isCJK(r) {
+			cjk++
+			continue
+		}
+		otherBytes += utf8.RuneLen(r)
+	}
+	return cjk + (otherBytes+3)/4
+}
+
+func isCJK(r rune) bool {
+	return unicode.Is(unicode.Han, r) ||
+		unicode.Is(unicode.Hiragana, r) ||
+		unicode.Is(unicode.Katakana, r) ||
+		unicode.Is(unicode.Hangul, r) ||
+		(r >= 0x3000 && r <= 0x303F) || // 中日韩标点
+		(r >= 0xFF00 && r <= 0xFFEF) // 全角字符
+}
@@ -0,0 +1,232 @@
+// Package tokenizer 提供网关侧的 token 计数：按模型族加载 BPE 词表，没有词表的模型退化为 CJK 友好的启发式估算。
+// 用于限流的 token 维度计费、上游缺少 usage 时的用量估算以及 POST /v1/tokenize。
+package tokenizer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/nanami9426/imgo/internal/utils"
+)
+
+// config/app.yaml 对应的配置键：
+//
+//	tokenizer:
+//	 families:                       # 按顺序匹配，第一个匹配的模型族生效
+//	  - name: qwen2
+//	    models: ["Qwen/*"]           # 匹配真实模型名，支持 * / ? 通配
+//	    file: config/tokenizers/qwen2/tokenizer.json
+//	    format: hf                   # tiktoken / hf，省略时按文件名判断
+//	  - name: cl100k
+//	    models: ["gpt-4*", "gpt-3.5*"]
+//	    file: config/tokenizers/cl100k_base.tiktoken
+//	    pattern: ""                  # 预分词正则，省略时使用 cl100k 风格的默认正则
+const (
+	cfgTokenizerFamilies = "tokenizer.families"
+)
+
+const (
+	FormatTiktoken = "tiktoken"
+	FormatHF       = "hf"
+
+	// 与 OpenAI 的计数口径一致：每条消息额外 3 个 token（角色与分隔符），回复前缀再加 3 个。
+	tokensPerMessage  = 3
+	tokensReplyPrimer = 3
+)
+
+// Tokenizer 统计文本的 token 数。
+type Tokenizer interface {
+	// Name 返回模型族名称，启发式估算为 "heuristic"。
+	Name() string
+	// Encode 返回 token id，无法给出精确 id 的分词器返回 nil。
+	Encode(text string) []int
+	// Count 返回 token 数。
+	Count(text string) int
+}
+
+// FamilyConfig 是一个模型族的分词器配置。
+type FamilyConfig struct {
+	Name    string   `mapstructure:"name" json:"name"`
+	Models  []string `mapstructure:"models" json:"models"`
+	File    string   `mapstructure:"file" json:"file"`
+	Format  string   `mapstructure:"format" json:"format"`
+	Pattern string   `mapstructure:"pattern" json:"pattern"`
+}
+
+type family struct {
+	models    []string
+	tokenizer Tokenizer
+}
+
+var (
+	families   []family
+	familiesMu sync.RWMutex
+
+	heuristic Tokenizer = heuristicTokenizer{}
+)
+
+// Init 在服务启动阶段加载全部模型族的词表：词表文件不存在时记录日志并退化为启发式估算，配置或词表内容错误时直接 panic。
+func Init() {
+	var list []FamilyConfig
+	if utils.V.IsSet(cfgTokenizerFamilies) {
+		if err := utils.V.UnmarshalKey(cfgTokenizerFamilies, &list); err != nil {
+			panic(fmt.Errorf("invalid tokenizer.families config: %w", err))
+		}
+	}
+	loaded := make([]family, 0, len(list))
+	for i, cfg := range list {
+		tok, err := loadFamily(cfg)
+		if errors.Is(err, fs.ErrNotExist) {
+			// 词表文件缺失时不阻止启动，该模型族按启发式估算。
+			utils.Log.Errorf("tokenizer.families[%d]: vocab file not found, falling back to heuristic: %v", i, err)
+			continue
+		}
+		if err != nil {
+			panic(fmt.Errorf("tokenizer.families[%d]: %w", i, err))
+		}
+		loaded = append(loaded, family{models: cfg.Models, tokenizer: tok})
+		utils.Log.Infof("tokenizer loaded: family=%s file=%s", tok.Name(), cfg.File)
+	}
+	familiesMu.Lock()
+	families = loaded
+	familiesMu.Unlock()
+}
+
+func loadFamily(cfg FamilyConfig) (Tokenizer, error) {
+	cfg.Name = strings.TrimSpace(cfg.Name)
+	cfg.File = strings.TrimSpace(cfg.File)
+	if cfg.Name == "" || cfg.File == "" || len(cfg.Models) == 0 {
+		return nil, fmt.Errorf("name, file and models are required")
+	}
+	pattern := defaultPretokenizePattern
+	if strings.TrimSpace(cfg.Pattern) != "" {
+		pattern = cfg.Pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern: %w", err)
+	}
+	format := strings.ToLower(strings.TrimSpace(cfg.Format))
+	if format == "" {
+		format = FormatTiktoken
+		if strings.HasSuffix(strings.ToLower(cfg.File), ".json") {
+			format = FormatHF
+		}
+	}
+	var vocab *bpeVocab
+	switch format {
+	case FormatTiktoken:
+		var ranks map[string]int
+		ranks, err = loadTiktokenRanks(cfg.File)
+		vocab = &bpeVocab{ranks: ranks, wholePieces: true}
+	case FormatHF:
+		vocab, err = loadHFVocab(cfg.File)
+	default:
+		return nil, fmt.Errorf("format must be tiktoken or hf")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newBPETokenizer(cfg.Name, vocab, re)
+}
+
+// ForModel 返回模型（真实模型名）对应的分词器，没有配置词表时返回启发式估算。
+func ForModel(model string) Tokenizer {
+	model = strings.TrimSpace(model)
+	familiesMu.RLock()
+	defer familiesMu.RUnlock()
+	for _, f := range families {
+		for _, pattern := range f.models {
+			if utils.MatchModelPattern(pattern, model) {
+				return f.tokenizer
+			}
+		}
+	}
+	return heuristic
+}
+
+// Exact 表示分词器基于词表，计数与上游一致（不含 chat 模板带来的差异）。
+func Exact(tok Tokenizer) bool {
+	_, ok := tok.(*bpeTokenizer)
+	return ok
+}
+
+// CountMessages 统计 chat messages 的 prompt token：每条消息按 CountMessage 计数，再加上回复前缀的固定开销。
+func CountMessages(tok Tokenizer, messages []interface{}) int {
+	if len(messages) == 0 {
+		return 0
+	}
+	total := tokensReplyPrimer
+	for _, item := range messages {
+		if msg, ok := item.(map[string]interface{}); ok {
+			total += CountMessage(tok, msg)
+		}
+	}
+	return total
+}
+
+// CountMessage 统计单条消息的 token：角色、name 与文本内容，加上消息分隔的固定开销；图片等非文本内容不计入。
+func CountMessage(tok Tokenizer, msg map[string]interface{}) int {
+	total := tokensPerMessage
+	if role, ok := msg["role"].(string); ok {
+		total += tok.Count(role)
+	}
+	if name, ok := msg["name"].(string); ok {
+		total += tok.Count(name)
+	}
+	return total + countContent(tok, msg["content"])
+}
+
+// countContent 兼容字符串、多段内容数组以及对象中的 text/content 字段。
+func countContent(tok Tokenizer, v interface{}) int {
+	switch val := v.(type) {
+	case string:
+		return tok.Count(val)
+	case []interface{}:
+		total := 0
+		for _, item := range val {
+			total += countContent(tok, item)
+		}
+		return total
+	case map[string]interface{}:
+		if text, ok := val["text"].(string); ok {
+			return tok.Count(text)
+		}
+		if content, ok := val["content"].(string); ok {
+			return tok.Count(content)
+		}
+		return 0
+	default:
+		return 0
+	}
+}
+
+// CountInput 统计 completions 的 prompt、embeddings 的 input 或任意 JSON 值：
+// 字符串按分词器计数，数字视为已分好的 token id 计 1，数组与对象递归累加。
+func CountInput(tok Tokenizer, v interface{}) int {
+	switch val := v.(type) {
+	case string:
+		return tok.Count(val)
+	case json.Number, float64:
+		return 1
+	case []interface{}:
+		total := 0
+		for _, item := range val {
+			total += CountInput(tok, item)
+		}
+		return total
+	case map[string]interface{}:
+		total := 0
+		for _, item := range val {
+			total += CountInput(tok, item)
+		}
+		return total
+	default:
+		return 0
+	}
+}
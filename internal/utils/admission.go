@@ -0,0 +1,71 @@
+package utils
+
+import (
+	"fmt"
+	"sync"
+)
+
+// 准入控制默认值说明：
+// default_weight 为未单独配置用户的排队权重，权重越大，排队时分到的并发份额越多。
+const (
+	defaultAdmissionWeight = 1.0
+)
+
+// config/app.yaml 对应的配置键。
+// 各上游的并发上限与队列参数在 upstreams[].admission 中配置，这里只放全局的用户权重：
+//
+//	admission:
+//	 default_weight: 1
+//	 user_weights:
+//	  - user_id: 10001
+//	    weight: 4
+const (
+	cfgAdmissionDefaultWeight = "admission.default_weight"
+	cfgAdmissionUserWeights   = "admission.user_weights"
+)
+
+// AdmissionUserWeight 为指定用户设置排队权重。
+type AdmissionUserWeight struct {
+	UserID int64   `mapstructure:"user_id"`
+	Weight float64 `mapstructure:"weight"`
+}
+
+var (
+	admissionDefaultWeight = defaultAdmissionWeight
+	admissionUserWeights   map[int64]float64
+	admissionWeightsMu     sync.RWMutex
+)
+
+// InitAdmissionConfig 在服务启动阶段加载排队权重。
+func InitAdmissionConfig() {
+	defaultWeight := V.GetFloat64(cfgAdmissionDefaultWeight)
+	if defaultWeight <= 0 {
+		defaultWeight = defaultAdmissionWeight
+	}
+	var list []AdmissionUserWeight
+	if V.IsSet(cfgAdmissionUserWeights) {
+		if err := V.UnmarshalKey(cfgAdmissionUserWeights, &list); err != nil {
+			panic(fmt.Errorf("invalid admission.user_weights config: %w", err))
+		}
+	}
+	weights := make(map[int64]float64, len(list))
+	for _, item := range list {
+		if item.UserID > 0 && item.Weight > 0 {
+			weights[item.UserID] = item.Weight
+		}
+	}
+	admissionWeightsMu.Lock()
+	admissionDefaultWeight = defaultWeight
+	admissionUserWeights = weights
+	admissionWeightsMu.Unlock()
+}
+
+// GetAdmissionWeight 返回用户的排队权重。
+func GetAdmissionWeight(userID int64) float64 {
+	admissionWeightsMu.RLock()
+	defer admissionWeightsMu.RUnlock()
+	if w, ok := admissionUserWeights[userID]; ok {
+		return w
+	}
+	return admissionDefaultWeight
+}
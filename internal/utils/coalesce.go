@@ -0,0 +1,128 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// 请求合并默认值说明：
+// 1) 默认关闭，需要显式开启；
+// 2) lock_ttl_ms 是跨实例 leader 持锁的最长时间，应覆盖一次上游调用的耗时；
+// 3) follower 每 poll_interval_ms 查询一次结果，最多等待 wait_timeout_ms，超时后自行转发；
+// 4) leader 发布的结果保留 result_ttl_ms，只用于让等待中的 follower 取走。
+const (
+	defaultCoalesceLockTTLMs      = 60000
+	defaultCoalesceWaitTimeoutMs  = 60000
+	defaultCoalescePollIntervalMs = 50
+	defaultCoalesceResultTTLMs    = 10000
+	defaultCoalesceRedisPrefix    = "cf:chat"
+)
+
+// config/app.yaml 对应的配置键。
+const (
+	cfgCoalesceEnabled        = "coalesce.enabled"
+	cfgCoalesceLockTTLMs      = "coalesce.lock_ttl_ms"
+	cfgCoalesceWaitTimeoutMs  = "coalesce.wait_timeout_ms"
+	cfgCoalescePollIntervalMs = "coalesce.poll_interval_ms"
+	cfgCoalesceResultTTLMs    = "coalesce.result_ttl_ms"
+	cfgCoalesceRedisPrefix    = "coalesce.redis_prefix"
+)
+
+// CoalesceConfig 为 chat/completions 相同在途请求合并的配置。
+type CoalesceConfig struct {
+	Enabled        bool
+	LockTTLMs      int
+	WaitTimeoutMs  int
+	PollIntervalMs int
+	ResultTTLMs    int
+	RedisPrefix    string
+}
+
+var (
+	coalesceConfig   CoalesceConfig
+	coalesceConfigMu sync.RWMutex
+)
+
+// releaseCoalesceLockScript 只删除自己持有的锁，避免锁过期后误删其他实例新加的锁。
+var releaseCoalesceLockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// InitCoalesceConfig 在服务启动阶段加载请求合并配置。
+func InitCoalesceConfig() {
+	cfg := CoalesceConfig{
+		Enabled:        V.GetBool(cfgCoalesceEnabled),
+		LockTTLMs:      V.GetInt(cfgCoalesceLockTTLMs),
+		WaitTimeoutMs:  V.GetInt(cfgCoalesceWaitTimeoutMs),
+		PollIntervalMs: V.GetInt(cfgCoalescePollIntervalMs),
+		ResultTTLMs:    V.GetInt(cfgCoalesceResultTTLMs),
+		RedisPrefix:    strings.TrimSpace(V.GetString(cfgCoalesceRedisPrefix)),
+	}
+	if cfg.LockTTLMs <= 0 {
+		cfg.LockTTLMs = defaultCoalesceLockTTLMs
+	}
+	if cfg.WaitTimeoutMs <= 0 {
+		cfg.WaitTimeoutMs = defaultCoalesceWaitTimeoutMs
+	}
+	if cfg.PollIntervalMs <= 0 {
+		cfg.PollIntervalMs = defaultCoalescePollIntervalMs
+	}
+	if cfg.ResultTTLMs <= 0 {
+		cfg.ResultTTLMs = defaultCoalesceResultTTLMs
+	}
+	if cfg.RedisPrefix == "" {
+		cfg.RedisPrefix = defaultCoalesceRedisPrefix
+	}
+	coalesceConfigMu.Lock()
+	coalesceConfig = cfg
+	coalesceConfigMu.Unlock()
+}
+
+// GetCoalesceConfig 返回当前请求合并配置。
+func GetCoalesceConfig() CoalesceConfig {
+	coalesceConfigMu.RLock()
+	defer coalesceConfigMu.RUnlock()
+	return coalesceConfig
+}
+
+// BuildCoalesceKeys 生成跨实例合并用的锁 key 与结果 key。
+// key 格式：
+//
+//	<prefix>:lock:<model>:<sha256>
+//	<prefix>:result:<model>:<sha256>
+func BuildCoalesceKeys(cfg CoalesceConfig, requestHash string) (string, string) {
+	return cfg.RedisPrefix + ":lock:" + requestHash, cfg.RedisPrefix + ":result:" + requestHash
+}
+
+// AcquireCoalesceLock 尝试成为跨实例 leader，token 用于释放时校验锁归属。
+func AcquireCoalesceLock(ctx context.Context, key string, token string, ttl time.Duration) (bool, error) {
+	if RDB == nil {
+		return false, errors.New("redis not initialized")
+	}
+	return RDB.SetNX(ctx, key, token, ttl).Result()
+}
+
+// ReleaseCoalesceLock 释放自己持有的锁。
+func ReleaseCoalesceLock(ctx context.Context, key string, token string) error {
+	if RDB == nil {
+		return errors.New("redis not initialized")
+	}
+	return releaseCoalesceLockScript.Run(ctx, RDB, []string{key}, token).Err()
+}
+
+// CoalesceLockExists 判断 leader 是否仍持有锁；锁不存在说明 leader 已结束（成功或失败）。
+func CoalesceLockExists(ctx context.Context, key string) (bool, error) {
+	if RDB == nil {
+		return false, errors.New("redis not initialized")
+	}
+	n, err := RDB.Exists(ctx, key).Result()
+	return n > 0, err
+}
@@ -0,0 +1,81 @@
+package utils
+
+import (
+	"strings"
+	"sync"
+)
+
+// 会话滚动摘要默认值说明：
+// 1) 默认关闭，需要显式开启；
+// 2) 会话消息数（不含摘要）达到 threshold 后，才对被挤出历史窗口的轮次生成摘要；
+// 3) 被挤出且尚未摘要的消息累计到 batch_messages 条才调用一次上游，避免每轮都重新摘要；
+// 4) 摘要请求最多生成 max_tokens 个 token，超过 timeout_ms 放弃本次摘要。
+const (
+	defaultConversationSummaryThreshold     = 40
+	defaultConversationSummaryBatchMessages = 10
+	defaultConversationSummaryMaxTokens     = 512
+	defaultConversationSummaryTimeoutMs     = 60000
+)
+
+// config/app.yaml 对应的配置键。
+const (
+	cfgConversationSummaryEnabled       = "conversation_summary.enabled"
+	cfgConversationSummaryThreshold     = "conversation_summary.threshold"
+	cfgConversationSummaryBatchMessages = "conversation_summary.batch_messages"
+	cfgConversationSummaryModel         = "conversation_summary.model"
+	cfgConversationSummaryMaxTokens     = "conversation_summary.max_tokens"
+	cfgConversationSummaryTimeoutMs     = "conversation_summary.timeout_ms"
+	cfgConversationSummaryPrompt        = "conversation_summary.prompt"
+)
+
+// ConversationSummaryConfig 为长会话滚动摘要的配置。
+// Model 为空时使用会话本轮实际使用的模型；Prompt 为空时使用内置的摘要指令。
+type ConversationSummaryConfig struct {
+	Enabled       bool
+	Threshold     int
+	BatchMessages int
+	Model         string
+	MaxTokens     int
+	TimeoutMs     int
+	Prompt        string
+}
+
+var (
+	conversationSummaryConfig   ConversationSummaryConfig
+	conversationSummaryConfigMu sync.RWMutex
+)
+
+// InitConversationSummaryConfig 在服务启动阶段加载会话摘要配置。
+func InitConversationSummaryConfig() {
+	cfg := ConversationSummaryConfig{
+		Enabled:       V.GetBool(cfgConversationSummaryEnabled),
+		Threshold:     V.GetInt(cfgConversationSummaryThreshold),
+		BatchMessages: V.GetInt(cfgConversationSummaryBatchMessages),
+		Model:         strings.TrimSpace(V.GetString(cfgConversationSummaryModel)),
+		MaxTokens:     V.GetInt(cfgConversationSummaryMaxTokens),
+		TimeoutMs:     V.GetInt(cfgConversationSummaryTimeoutMs),
+		Prompt:        strings.TrimSpace(V.GetString(cfgConversationSummaryPrompt)),
+	}
+	if cfg.Threshold <= 0 {
+		cfg.Threshold = defaultConversationSummaryThreshold
+	}
+	if cfg.BatchMessages <= 0 {
+		cfg.BatchMessages = defaultConversationSummaryBatchMessages
+	}
+	if cfg.MaxTokens <= 0 {
+		cfg.MaxTokens = defaultConversationSummaryMaxTokens
+	}
+	if cfg.TimeoutMs <= 0 {
+		cfg.TimeoutMs = defaultConversationSummaryTimeoutMs
+	}
+	conversationSummaryConfigMu.Lock()
+	conversationSummaryConfig = cfg
+	conversationSummaryConfigMu.Unlock()
+}
+
+// GetConversationSummaryConfig 返回当前会话摘要配置。
+func GetConversationSummaryConfig() ConversationSummaryConfig {
+	conversationSummaryConfigMu.RLock()
+	defer conversationSummaryConfigMu.RUnlock()
+	return conversationSummaryConfig
+}
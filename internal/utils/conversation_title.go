@@ -0,0 +1,73 @@
+package utils
+
+import (
+	"strings"
+	"sync"
+)
+
+// 会话自动标题默认值说明：
+// 1) 默认关闭，需要显式开启；
+// 2) 标题请求最多生成 max_tokens 个 token，超过 timeout_ms 放弃，保留截取首条 user 消息的默认标题；
+// 3) 发给标题模型的每条消息最多保留 max_input_runes 个字符，控制标题请求的开销。
+const (
+	defaultConversationTitleMaxTokens     = 32
+	defaultConversationTitleTimeoutMs     = 30000
+	defaultConversationTitleMaxInputRunes = 1000
+)
+
+// config/app.yaml 对应的配置键。
+const (
+	cfgConversationTitleEnabled       = "conversation_title.enabled"
+	cfgConversationTitleModel         = "conversation_title.model"
+	cfgConversationTitleMaxTokens     = "conversation_title.max_tokens"
+	cfgConversationTitleTimeoutMs     = "conversation_title.timeout_ms"
+	cfgConversationTitleMaxInputRunes = "conversation_title.max_input_runes"
+	cfgConversationTitlePrompt        = "conversation_title.prompt"
+)
+
+// ConversationTitleConfig 为会话自动标题的配置。
+// Model 为空时使用会话本轮实际使用的模型；Prompt 为空时使用内置的标题指令。
+type ConversationTitleConfig struct {
+	Enabled       bool
+	Model         string
+	MaxTokens     int
+	TimeoutMs     int
+	MaxInputRunes int
+	Prompt        string
+}
+
+var (
+	conversationTitleConfig   ConversationTitleConfig
+	conversationTitleConfigMu sync.RWMutex
+)
+
+// InitConversationTitleConfig 在服务启动阶段加载会话自动标题配置。
+func InitConversationTitleConfig() {
+	cfg := ConversationTitleConfig{
+		Enabled:       V.GetBool(cfgConversationTitleEnabled),
+		Model:         strings.TrimSpace(V.GetString(cfgConversationTitleModel)),
+		MaxTokens:     V.GetInt(cfgConversationTitleMaxTokens),
+		TimeoutMs:     V.GetInt(cfgConversationTitleTimeoutMs),
+		MaxInputRunes: V.GetInt(cfgConversationTitleMaxInputRunes),
+		Prompt:        strings.TrimSpace(V.GetString(cfgConversationTitlePrompt)),
+	}
+	if cfg.MaxTokens <= 0 {
+		cfg.MaxTokens = defaultConversationTitleMaxTokens
+	}
+	if cfg.TimeoutMs <= 0 {
+		cfg.TimeoutMs = defaultConversationTitleTimeoutMs
+	}
+	if cfg.MaxInputRunes <= 0 {
+		cfg.MaxInputRunes = defaultConversationTitleMaxInputRunes
+	}
+	conversationTitleConfigMu.Lock()
+	conversationTitleConfig = cfg
+	conversationTitleConfigMu.Unlock()
+}
+
+// GetConversationTitleConfig 返回当前会话自动标题配置。
+func GetConversationTitleConfig() ConversationTitleConfig {
+	conversationTitleConfigMu.RLock()
+	defer conversationTitleConfigMu.RUnlock()
+	return conversationTitleConfig
+}
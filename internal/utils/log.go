@@ -25,3 +25,10 @@ func (l *Logger) Errorf(format string, args ...any) {
 	}
 	l.std.Printf("ERROR: "+format, args...)
 }
+
+func (l *Logger) Infof(format string, args ...any) {
+	if l == nil || l.std == nil {
+		return
+	}
+	l.std.Printf("INFO: "+format, args...)
+}
@@ -0,0 +1,114 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// config/app.yaml 对应的配置键。
+// 用户级模型权限由运维配置，模式支持 * / ? 通配，匹配真实模型名：
+//
+//	model_access:
+//	 default_models: ["*"]
+//	 users:
+//	  - user_id: 10001
+//	    models: ["Qwen/*"]
+//
+// API Key 可以在创建时进一步收窄（allowed_models），但不能超出所属用户的权限。
+const (
+	cfgModelAccessDefaultModels = "model_access.default_models"
+	cfgModelAccessUsers         = "model_access.users"
+
+	defaultModelAccessPattern = "*"
+)
+
+// ModelAccessUser 为指定用户配置可用模型。
+type ModelAccessUser struct {
+	UserID int64    `mapstructure:"user_id"`
+	Models []string `mapstructure:"models"`
+}
+
+var (
+	modelAccessDefault []string
+	modelAccessUsers   map[int64][]string
+	modelAccessMu      sync.RWMutex
+)
+
+// InitModelAccessConfig 在服务启动阶段加载用户级模型权限，未配置时所有用户可用全部模型。
+func InitModelAccessConfig() {
+	defaults := []string{defaultModelAccessPattern}
+	if V.IsSet(cfgModelAccessDefaultModels) {
+		defaults = normalizeModelPatterns(V.GetStringSlice(cfgModelAccessDefaultModels))
+	}
+	var list []ModelAccessUser
+	if V.IsSet(cfgModelAccessUsers) {
+		if err := V.UnmarshalKey(cfgModelAccessUsers, &list); err != nil {
+			panic(fmt.Errorf("invalid model_access.users config: %w", err))
+		}
+	}
+	users := make(map[int64][]string, len(list))
+	for _, item := range list {
+		if item.UserID > 0 {
+			users[item.UserID] = normalizeModelPatterns(item.Models)
+		}
+	}
+	modelAccessMu.Lock()
+	modelAccessDefault = defaults
+	modelAccessUsers = users
+	modelAccessMu.Unlock()
+}
+
+// ParseModelPatterns 解析逗号分隔的模型模式列表（API Key 的 allowed_models 字段）。
+func ParseModelPatterns(raw string) []string {
+	return normalizeModelPatterns(strings.Split(raw, ","))
+}
+
+func normalizeModelPatterns(list []string) []string {
+	out := make([]string, 0, len(list))
+	for _, pattern := range list {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			out = append(out, pattern)
+		}
+	}
+	return out
+}
+
+// ModelAllowed 判断用户（以及可选的 API Key 限制）能否使用 model。
+// model 需为真实模型名；apiKeyPatterns 为空表示 API Key 不额外限制。
+func ModelAllowed(userID int64, apiKeyPatterns []string, model string) bool {
+	model = strings.TrimSpace(model)
+	if model == "" {
+		return true
+	}
+	modelAccessMu.RLock()
+	userPatterns, ok := modelAccessUsers[userID]
+	if !ok {
+		userPatterns = modelAccessDefault
+	}
+	modelAccessMu.RUnlock()
+	if !matchAnyModelPattern(userPatterns, model) {
+		return false
+	}
+	return len(apiKeyPatterns) == 0 || matchAnyModelPattern(apiKeyPatterns, model)
+}
+
+func matchAnyModelPattern(patterns []string, model string) bool {
+	for _, pattern := range patterns {
+		if MatchModelPattern(pattern, model) {
+			return true
+		}
+	}
+	return false
+}
+
+// ModelNotFoundError 是模型不存在或无权使用时的 OpenAI 风格错误。
+// 与 OpenAI 一致，无权使用的模型同样返回 model_not_found，不暴露模型是否存在。
+func ModelNotFoundError(model string) *Error {
+	return &Error{
+		Message: fmt.Sprintf("The model `%s` does not exist or you do not have access to it.", model),
+		Type:    "invalid_request_error",
+		Param:   "model",
+		Code:    "model_not_found",
+	}
+}
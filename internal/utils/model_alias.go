@@ -0,0 +1,81 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// config/app.yaml 对应的配置键。
+// 别名是对外公开的模型名，请求进入网关时改写为真实模型名：
+//
+//	model_aliases:
+//	 - alias: chat-default
+//	   model: Qwen/Qwen2.5-7B-Instruct
+const (
+	cfgModelAliases = "model_aliases"
+)
+
+// ModelAlias 是一条模型别名配置。
+type ModelAlias struct {
+	Alias string `mapstructure:"alias" json:"alias"`
+	Model string `mapstructure:"model" json:"model"`
+}
+
+var (
+	modelAliases    []ModelAlias
+	modelAliasIndex map[string]string
+	modelAliasesMu  sync.RWMutex
+)
+
+// InitModelAliasConfig 在服务启动阶段加载模型别名。
+// 别名不能与目标模型同名，也不能指向另一个别名（只解析一层，避免成环）。
+func InitModelAliasConfig() {
+	var list []ModelAlias
+	if V.IsSet(cfgModelAliases) {
+		if err := V.UnmarshalKey(cfgModelAliases, &list); err != nil {
+			panic(fmt.Errorf("invalid model_aliases config: %w", err))
+		}
+	}
+	out := make([]ModelAlias, 0, len(list))
+	index := make(map[string]string, len(list))
+	for _, item := range list {
+		item.Alias = strings.TrimSpace(item.Alias)
+		item.Model = strings.TrimSpace(item.Model)
+		if item.Alias == "" || item.Model == "" || item.Alias == item.Model {
+			continue
+		}
+		if _, ok := index[item.Alias]; ok {
+			panic(fmt.Errorf("duplicate model alias: %s", item.Alias))
+		}
+		index[item.Alias] = item.Model
+		out = append(out, item)
+	}
+	for _, item := range out {
+		if _, ok := index[item.Model]; ok {
+			panic(fmt.Errorf("model alias %s points to another alias %s", item.Alias, item.Model))
+		}
+	}
+	modelAliasesMu.Lock()
+	modelAliases = out
+	modelAliasIndex = index
+	modelAliasesMu.Unlock()
+}
+
+// ResolveModelAlias 把别名解析为真实模型名，不是别名时原样返回（去掉首尾空白）。
+func ResolveModelAlias(model string) string {
+	model = strings.TrimSpace(model)
+	modelAliasesMu.RLock()
+	defer modelAliasesMu.RUnlock()
+	if target, ok := modelAliasIndex[model]; ok {
+		return target
+	}
+	return model
+}
+
+// GetModelAliases 返回别名列表副本，顺序与配置一致。
+func GetModelAliases() []ModelAlias {
+	modelAliasesMu.RLock()
+	defer modelAliasesMu.RUnlock()
+	return append([]ModelAlias(nil), modelAliases...)
+}
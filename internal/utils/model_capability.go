@@ -0,0 +1,267 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// config/app.yaml 对应的配置键。
+// 按顺序匹配真实模型名（支持 * / ? 通配），未列出的模型不做能力与上下文检查；
+// tools/vision/json_mode 省略表示不限制，显式写 false 才会拒绝对应请求：
+//
+//	model_capabilities:
+//	 - models: ["Qwen/Qwen2.5-7B-Instruct"]
+//	   context_length: 32768
+//	   max_output_tokens: 8192
+//	   tools: true
+//	   vision: false
+//	   json_mode: true
+//	   history_token_budget: 0  # 续聊拼接历史的 prompt token 预算，0 表示按 context_length 减去输出预留计算
+//	   overflow: clamp       # prompt + max_tokens 超出窗口时：clamp 收紧 max_tokens / reject 直接拒绝
+const (
+	cfgModelCapabilities = "model_capabilities"
+)
+
+const (
+	ContextOverflowClamp  = "clamp"
+	ContextOverflowReject = "reject"
+)
+
+// ModelCapability 描述一个模型（族）的上下文窗口与功能支持情况。
+type ModelCapability struct {
+	Models          []string `mapstructure:"models" json:"models"`
+	ContextLength   int64    `mapstructure:"context_length" json:"context_length"`
+	MaxOutputTokens int64    `mapstructure:"max_output_tokens" json:"max_output_tokens"`
+	Tools           *bool    `mapstructure:"tools" json:"tools,omitempty"`
+	Vision          *bool    `mapstructure:"vision" json:"vision,omitempty"`
+	JSONMode        *bool    `mapstructure:"json_mode" json:"json_mode,omitempty"`
+	// HistoryTokenBudget 为续聊时整个 prompt（system + 历史 + 本轮）的 token 预算，0 表示由上下文窗口推算。
+	HistoryTokenBudget int64  `mapstructure:"history_token_budget" json:"history_token_budget"`
+	Overflow           string `mapstructure:"overflow" json:"overflow"`
+}
+
+func (m ModelCapability) SupportsTools() bool {
+	return m.Tools == nil || *m.Tools
+}
+
+func (m ModelCapability) SupportsVision() bool {
+	return m.Vision == nil || *m.Vision
+}
+
+func (m ModelCapability) SupportsJSONMode() bool {
+	return m.JSONMode == nil || *m.JSONMode
+}
+
+var (
+	modelCapabilities   []ModelCapability
+	modelCapabilitiesMu sync.RWMutex
+)
+
+// InitModelCapabilityConfig 在服务启动阶段加载模型能力表。
+func InitModelCapabilityConfig() {
+	var list []ModelCapability
+	if V.IsSet(cfgModelCapabilities) {
+		if err := V.UnmarshalKey(cfgModelCapabilities, &list); err != nil {
+			panic(fmt.Errorf("invalid model_capabilities config: %w", err))
+		}
+	}
+	for i := range list {
+		item := &list[i]
+		item.Models = normalizeModelPatterns(item.Models)
+		if len(item.Models) == 0 {
+			panic(fmt.Errorf("model_capabilities[%d].models is required", i))
+		}
+		if item.ContextLength < 0 || item.MaxOutputTokens < 0 || item.HistoryTokenBudget < 0 {
+			panic(fmt.Errorf("model_capabilities[%d]: context_length, max_output_tokens and history_token_budget must be >= 0", i))
+		}
+		item.Overflow = strings.ToLower(strings.TrimSpace(item.Overflow))
+		switch item.Overflow {
+		case "":
+			item.Overflow = ContextOverflowClamp
+		case ContextOverflowClamp, ContextOverflowReject:
+		default:
+			panic(fmt.Errorf("model_capabilities[%d].overflow must be clamp or reject", i))
+		}
+	}
+	modelCapabilitiesMu.Lock()
+	modelCapabilities = list
+	modelCapabilitiesMu.Unlock()
+}
+
+// GetModelCapability 返回第一条匹配真实模型名的能力配置，没有配置时 ok 为 false。
+func GetModelCapability(model string) (ModelCapability, bool) {
+	model = strings.TrimSpace(model)
+	modelCapabilitiesMu.RLock()
+	defer modelCapabilitiesMu.RUnlock()
+	for _, item := range modelCapabilities {
+		if matchAnyModelPattern(item.Models, model) {
+			return item, true
+		}
+	}
+	return ModelCapability{}, false
+}
+
+// CheckModelFeatures 按模型能力表检查请求是否用到了模型不支持的功能（tools / 图片输入 / JSON 模式），
+// 不支持时返回 OpenAI 风格错误；模型不在能力表中时不限制。
+func CheckModelFeatures(model string, payload map[string]interface{}) *Error {
+	capability, ok := GetModelCapability(model)
+	if !ok {
+		return nil
+	}
+	if !capability.SupportsTools() {
+		for _, key := range []string{"tools", "functions"} {
+			if list, ok := payload[key].([]interface{}); ok && len(list) > 0 {
+				return unsupportedFeatureError(model, "tools", key)
+			}
+		}
+	}
+	if !capability.SupportsJSONMode() {
+		if format, ok := payload["response_format"].(map[string]interface{}); ok {
+			if t, _ := format["type"].(string); t == "json_object" || t == "json_schema" {
+				return unsupportedFeatureError(model, "JSON mode", "response_format")
+			}
+		}
+	}
+	if !capability.SupportsVision() {
+		messages, _ := payload["messages"].([]interface{})
+		for i, item := range messages {
+			msg, _ := item.(map[string]interface{})
+			if hasImageContent(msg["content"]) {
+				return unsupportedFeatureError(model, "image input", fmt.Sprintf("messages[%d].content", i))
+			}
+		}
+	}
+	return nil
+}
+
+func hasImageContent(content interface{}) bool {
+	parts, ok := content.([]interface{})
+	if !ok {
+		return false
+	}
+	for _, item := range parts {
+		part, _ := item.(map[string]interface{})
+		switch part["type"] {
+		case "image_url", "input_image", "image":
+			return true
+		}
+	}
+	return false
+}
+
+func unsupportedFeatureError(model string, feature string, param string) *Error {
+	return &Error{
+		Message: fmt.Sprintf("The model `%s` does not support %s.", model, feature),
+		Type:    "invalid_request_error",
+		Param:   param,
+		Code:    "unsupported_parameter",
+	}
+}
+
+// FitContextWindow 按模型能力表检查最终发给上游的 messages 加上输出上限是否超出上下文窗口：
+// 1) max_tokens 超过 max_output_tokens 时按 overflow 收紧或拒绝；
+// 2) prompt 本身已占满窗口时直接拒绝；
+// 3) prompt + max_tokens 超出窗口时按 overflow 把 max_tokens 收紧到剩余空间或拒绝。
+// promptTokens 由调用方用网关分词器估算，只在模型配置了 context_length 时调用；收紧后的 max_tokens 直接写回 payload。
+// 请求未指定 max_tokens 时由上游按剩余空间决定。拒绝时返回 OpenAI 风格错误。
+func FitContextWindow(model string, payload map[string]interface{}, promptTokens func() int64) *Error {
+	capability, ok := GetModelCapability(model)
+	if !ok || (capability.ContextLength <= 0 && capability.MaxOutputTokens <= 0) {
+		return nil
+	}
+	clamp := capability.Overflow == ContextOverflowClamp
+
+	maxTokensKey, maxTokens, hasMaxTokens := RequestedMaxTokens(payload)
+	fitted := maxTokens
+
+	if hasMaxTokens && capability.MaxOutputTokens > 0 && fitted > capability.MaxOutputTokens {
+		if !clamp {
+			return &Error{
+				Message: fmt.Sprintf("%s is too large: %d. This model supports at most %d completion tokens, whereas you provided %d.", maxTokensKey, maxTokens, capability.MaxOutputTokens, maxTokens),
+				Type:    "invalid_request_error",
+				Param:   maxTokensKey,
+				Code:    "invalid_value",
+			}
+		}
+		fitted = capability.MaxOutputTokens
+	}
+
+	if capability.ContextLength > 0 {
+		prompt := promptTokens()
+		if prompt >= capability.ContextLength {
+			return &Error{
+				Message: fmt.Sprintf("This model's maximum context length is %d tokens. However, your messages resulted in %d tokens. Please reduce the length of the messages.", capability.ContextLength, prompt),
+				Type:    "invalid_request_error",
+				Param:   "messages",
+				Code:    "context_length_exceeded",
+			}
+		}
+		if hasMaxTokens && prompt+fitted > capability.ContextLength {
+			if !clamp {
+				return &Error{
+					Message: fmt.Sprintf("This model's maximum context length is %d tokens. However, you requested %d tokens (%d in the messages, %d in the completion). Please reduce the length of the messages or completion.", capability.ContextLength, prompt+fitted, prompt, fitted),
+					Type:    "invalid_request_error",
+					Param:   "messages",
+					Code:    "context_length_exceeded",
+				}
+			}
+			fitted = capability.ContextLength - prompt
+		}
+	}
+
+	if hasMaxTokens && fitted != maxTokens {
+		payload[maxTokensKey] = fitted
+	}
+	return nil
+}
+
+// RequestedMaxTokens 返回请求指定的输出上限及其字段名；与 vLLM 一致，max_completion_tokens 优先于 max_tokens。
+func RequestedMaxTokens(payload map[string]interface{}) (string, int64, bool) {
+	key := "max_tokens"
+	if _, ok := payload["max_completion_tokens"]; ok {
+		key = "max_completion_tokens"
+	}
+	n, ok := ParseInt64Value(payload[key])
+	return key, n, ok && n > 0
+}
+
+// ParseInt64Value 兼容解析常见 JSON 类型为 int64，供 max_tokens 等字段复用。
+func ParseInt64Value(v interface{}) (int64, bool) {
+	switch val := v.(type) {
+	case int:
+		return int64(val), true
+	case int64:
+		return val, true
+	case uint:
+		return int64(val), true
+	case uint64:
+		return int64(val), true
+	case float64:
+		return int64(val), true
+	case json.Number:
+		if n, err := val.Int64(); err == nil {
+			return n, true
+		}
+		if f, err := val.Float64(); err == nil {
+			return int64(f), true
+		}
+		return 0, false
+	case string:
+		s := strings.TrimSpace(val)
+		if s == "" {
+			return 0, false
+		}
+		if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return n, true
+		}
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			return int64(f), true
+		}
+		return 0, false
+	default:
+		return 0, false
+	}
+}
@@ -0,0 +1,69 @@
+package utils
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// config/app.yaml 对应的配置键。
+// 模型名常包含 "." 和 "/"，不能作为 viper map 的 key，因此降级链用列表表示：
+//
+//	model_fallbacks:
+//	 - chain: ["qwen-72b", "qwen-14b", "qwen-1.5b"]
+const (
+	cfgModelFallbacks = "model_fallbacks"
+)
+
+// ModelFallbackChain 是一条降级链，链上任一模型失败时依次尝试其后的模型。
+type ModelFallbackChain struct {
+	Chain []string `mapstructure:"chain"`
+}
+
+var (
+	// modelFallbacks 保存“模型 -> 其后的降级模型列表”，同一模型出现在多条链时以第一条为准。
+	modelFallbacks   map[string][]string
+	modelFallbacksMu sync.RWMutex
+)
+
+// InitModelFallbackConfig 在服务启动阶段加载模型降级链。
+func InitModelFallbackConfig() {
+	var chains []ModelFallbackChain
+	if V.IsSet(cfgModelFallbacks) {
+		if err := V.UnmarshalKey(cfgModelFallbacks, &chains); err != nil {
+			panic(fmt.Errorf("invalid model_fallbacks config: %w", err))
+		}
+	}
+	out := map[string][]string{}
+	for _, item := range chains {
+		chain := make([]string, 0, len(item.Chain))
+		for _, model := range item.Chain {
+			if model = strings.TrimSpace(model); model != "" {
+				chain = append(chain, model)
+			}
+		}
+		for i, model := range chain {
+			if _, ok := out[model]; ok || i == len(chain)-1 {
+				continue
+			}
+			out[model] = append([]string(nil), chain[i+1:]...)
+		}
+	}
+	modelFallbacksMu.Lock()
+	modelFallbacks = out
+	modelFallbacksMu.Unlock()
+}
+
+// GetModelFallbacks 返回 model 的降级模型列表（按优先级），没有配置时返回 nil。
+func GetModelFallbacks(model string) []string {
+	modelFallbacksMu.RLock()
+	defer modelFallbacksMu.RUnlock()
+	list := modelFallbacks[strings.TrimSpace(model)]
+	return append([]string(nil), list...)
+}
+
+// ShouldFallbackStatus 判断上游最终响应是否应触发模型降级：过载（429）或上游不可用（5xx）。
+func ShouldFallbackStatus(statusCode int) bool {
+	return statusCode == http.StatusTooManyRequests || statusCode >= http.StatusInternalServerError
+}
@@ -133,6 +133,12 @@ var (
 // {0, "token"}       => token 级超限
 var consumeChatCompletionQuotaScript *redis.Script
 
+// refundChatCompletionTokenQuotaScript 退还 token 固定窗中已扣除的额度（用于响应缓存命中）。
+// KEYS[1] = token key
+// ARGV[1] = tok_refund
+// 返回实际退还的额度。
+var refundChatCompletionTokenQuotaScript *redis.Script
+
 // InitRateLimitConfig 在服务启动阶段加载并缓存限流配置。
 func InitRateLimitConfig() {
 	setRateLimitConfig(loadRateLimitConfigFromViper())
@@ -141,6 +147,11 @@ func InitRateLimitConfig() {
 		panic(err)
 	}
 	consumeChatCompletionQuotaScript = redis.NewScript(string(luaBytes))
+	refundBytes, err := os.ReadFile("scripts/rate_limit_refund.lua")
+	if err != nil {
+		panic(err)
+	}
+	refundChatCompletionTokenQuotaScript = redis.NewScript(string(refundBytes))
 }
 
 // GetRateLimitConfig 返回当前可用配置。
@@ -312,6 +323,21 @@ func ConsumeChatCompletionQuota(ctx context.Context, userID int64, reqCost int64
 	return &RateLimitExceededError{Dimension: RateLimitDimension(dimension)}
 }
 
+// RefundChatCompletionTokenQuota 退还一次请求在 token 维度的扣费。
+// consumedAt 为扣费时间，用于定位扣费所在窗口；窗口已经过去时退还没有意义，脚本会直接忽略。
+// 请求维度不退还：命中缓存的请求仍然算一次请求。
+func RefundChatCompletionTokenQuota(ctx context.Context, userID int64, tokenCost int64, consumedAt time.Time) error {
+	cfg := GetRateLimitConfig()
+	if cfg.TokenPerMin <= 0 || tokenCost <= 0 {
+		return nil
+	}
+	if RDB == nil {
+		return errors.New("redis not initialized")
+	}
+	_, tokKey, _ := BuildRateLimitWindowKeys(cfg, userID, consumedAt.UTC())
+	return refundChatCompletionTokenQuotaScript.Run(ctx, RDB, []string{tokKey}, tokenCost).Err()
+}
+
 // boolToInt 把布尔值转换为 Lua 脚本可直接使用的 0/1。
 func boolToInt(v bool) int {
 	if v {
@@ -47,6 +47,17 @@ func Abort(c *gin.Context, httpStatus int, code StatCode, message string, err er
 	})
 }
 
+// OpenAIErrorResponse 与 OpenAI 错误结构保持一致：{"error":{...}}。
+// /v1 兼容接口由网关自身拒绝请求时使用，方便 SDK 按官方格式解析。
+type OpenAIErrorResponse struct {
+	Error *Error `json:"error"`
+}
+
+// AbortOpenAI 以 OpenAI 错误格式中断请求。
+func AbortOpenAI(c *gin.Context, httpStatus int, apiErr *Error) {
+	c.AbortWithStatusJSON(httpStatus, OpenAIErrorResponse{Error: apiErr})
+}
+
 func newError(code StatCode, message string, err error) *Error {
 	if strings.TrimSpace(message) == "" {
 		message = StatText(code)
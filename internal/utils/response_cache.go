@@ -0,0 +1,229 @@
+package utils
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// 响应缓存默认值说明：
+// 1) 默认关闭，需要显式开启；
+// 2) ttl_seconds 为全局 TTL，model_ttls 可按模型覆盖，TTL<=0 表示该模型不缓存；
+// 3) 超过 max_body_bytes 的响应不缓存，避免大响应占满 Redis。
+const (
+	defaultResponseCacheTTLSeconds   = 3600
+	defaultResponseCacheMaxBodyBytes = 1 << 20
+	defaultResponseCacheRedisPrefix  = "rc:chat"
+)
+
+// config/app.yaml 对应的配置键。
+// 模型名常包含 "." 和 "/"，按模型覆盖 TTL 用列表表示：
+//
+//	response_cache:
+//	 model_ttls:
+//	  - model: "qwen-*"
+//	    ttl_seconds: 600
+const (
+	cfgResponseCacheEnabled      = "response_cache.enabled"
+	cfgResponseCacheTTLSeconds   = "response_cache.ttl_seconds"
+	cfgResponseCacheMaxBodyBytes = "response_cache.max_body_bytes"
+	cfgResponseCacheRedisPrefix  = "response_cache.redis_prefix"
+	cfgResponseCacheModelTTLs    = "response_cache.model_ttls"
+)
+
+// ResponseCacheModelTTL 为匹配 Model（支持 * / ? 通配）的请求单独设置 TTL。
+type ResponseCacheModelTTL struct {
+	Model      string `mapstructure:"model"`
+	TTLSeconds int    `mapstructure:"ttl_seconds"`
+}
+
+// ResponseCacheConfig 为 chat/completions 确定性请求（temperature=0）的响应缓存配置。
+type ResponseCacheConfig struct {
+	Enabled      bool
+	TTLSeconds   int
+	MaxBodyBytes int
+	RedisPrefix  string
+	ModelTTLs    []ResponseCacheModelTTL
+}
+
+// CachedChatCompletion 是缓存在 Redis 中的一次完整上游响应，响应缓存与请求合并共用。
+// Stream 为 true 时 Body 是原始 SSE 字节流，命中时按事件逐条回放。
+type CachedChatCompletion struct {
+	Stream      bool   `json:"stream"`
+	StatusCode  int    `json:"status_code"`
+	ContentType string `json:"content_type"`
+	Model       string `json:"model"`
+	Body        []byte `json:"body"`
+	CreatedAt   int64  `json:"created_at"`
+}
+
+var (
+	responseCacheConfig   ResponseCacheConfig
+	responseCacheConfigMu sync.RWMutex
+)
+
+// InitResponseCacheConfig 在服务启动阶段加载响应缓存配置。
+func InitResponseCacheConfig() {
+	cfg := ResponseCacheConfig{
+		Enabled:      V.GetBool(cfgResponseCacheEnabled),
+		TTLSeconds:   defaultResponseCacheTTLSeconds,
+		MaxBodyBytes: V.GetInt(cfgResponseCacheMaxBodyBytes),
+		RedisPrefix:  strings.TrimSpace(V.GetString(cfgResponseCacheRedisPrefix)),
+	}
+	if V.IsSet(cfgResponseCacheTTLSeconds) {
+		cfg.TTLSeconds = V.GetInt(cfgResponseCacheTTLSeconds)
+	}
+	if cfg.MaxBodyBytes <= 0 {
+		cfg.MaxBodyBytes = defaultResponseCacheMaxBodyBytes
+	}
+	if cfg.RedisPrefix == "" {
+		cfg.RedisPrefix = defaultResponseCacheRedisPrefix
+	}
+	if V.IsSet(cfgResponseCacheModelTTLs) {
+		if err := V.UnmarshalKey(cfgResponseCacheModelTTLs, &cfg.ModelTTLs); err != nil {
+			panic(fmt.Errorf("invalid response_cache.model_ttls config: %w", err))
+		}
+	}
+	responseCacheConfigMu.Lock()
+	responseCacheConfig = cfg
+	responseCacheConfigMu.Unlock()
+}
+
+// GetResponseCacheConfig 返回当前响应缓存配置。
+func GetResponseCacheConfig() ResponseCacheConfig {
+	responseCacheConfigMu.RLock()
+	defer responseCacheConfigMu.RUnlock()
+	return responseCacheConfig
+}
+
+// TTLForModel 返回 model 的缓存时长，按 model_ttls 顺序取第一个匹配项，没有匹配时用全局 TTL。
+// 返回 0 表示该模型不缓存。
+func (c ResponseCacheConfig) TTLForModel(model string) time.Duration {
+	ttl := c.TTLSeconds
+	for _, item := range c.ModelTTLs {
+		if MatchModelPattern(strings.TrimSpace(item.Model), model) {
+			ttl = item.TTLSeconds
+			break
+		}
+	}
+	if ttl <= 0 {
+		return 0
+	}
+	return time.Duration(ttl) * time.Second
+}
+
+// IsDeterministicChatRequest 判断请求是否显式指定 temperature=0，只有这类请求才允许走缓存。
+func IsDeterministicChatRequest(payload map[string]interface{}) bool {
+	raw, ok := payload["temperature"]
+	if !ok {
+		return false
+	}
+	switch val := raw.(type) {
+	case json.Number:
+		f, err := val.Float64()
+		return err == nil && f == 0
+	case float64:
+		return val == 0
+	case int:
+		return val == 0
+	case int64:
+		return val == 0
+	default:
+		return false
+	}
+}
+
+// HashChatCompletionRequest 用请求体的规范化 JSON 计算请求指纹，格式为 <model>:<sha256>：
+// 1) 对象按 key 排序（encoding/json 对 map 天然有序），数字统一成最短浮点表示；
+// 2) 去掉不影响输出的 user 字段；
+// 3) stream/stream_options 会影响响应格式，保留在哈希内，JSON 与 SSE 视为不同请求。
+func HashChatCompletionRequest(payload map[string]interface{}) (string, error) {
+	canonical := make(map[string]interface{}, len(payload))
+	for k, v := range payload {
+		if k == "user" {
+			continue
+		}
+		canonical[k] = canonicalizeJSONValue(v)
+	}
+	raw, err := json.Marshal(canonical)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(raw)
+	model, _ := payload["model"].(string)
+	return strings.TrimSpace(model) + ":" + hex.EncodeToString(sum[:]), nil
+}
+
+// BuildResponseCacheKey 生成响应缓存 key，格式：<prefix>:<model>:<sha256>。
+func BuildResponseCacheKey(cfg ResponseCacheConfig, payload map[string]interface{}) (string, error) {
+	hash, err := HashChatCompletionRequest(payload)
+	if err != nil {
+		return "", err
+	}
+	return cfg.RedisPrefix + ":" + hash, nil
+}
+
+// canonicalizeJSONValue 把 1、1.0、1e0 这类等价数字归一，避免同一请求因序列化差异错过缓存。
+func canonicalizeJSONValue(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(val))
+		for k, item := range val {
+			out[k] = canonicalizeJSONValue(item)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(val))
+		for i, item := range val {
+			out[i] = canonicalizeJSONValue(item)
+		}
+		return out
+	case json.Number:
+		if f, err := val.Float64(); err == nil {
+			return json.Number(strconv.FormatFloat(f, 'g', -1, 64))
+		}
+		return val
+	default:
+		return val
+	}
+}
+
+// GetCachedChatCompletion 读取缓存，未命中时返回 (nil, nil)。
+func GetCachedChatCompletion(ctx context.Context, key string) (*CachedChatCompletion, error) {
+	if RDB == nil {
+		return nil, errors.New("redis not initialized")
+	}
+	raw, err := RDB.Get(ctx, key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entry CachedChatCompletion
+	if err := json.Unmarshal(raw, &entry); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// SetCachedChatCompletion 写入缓存。
+func SetCachedChatCompletion(ctx context.Context, key string, entry *CachedChatCompletion, ttl time.Duration) error {
+	if RDB == nil {
+		return errors.New("redis not initialized")
+	}
+	raw, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return RDB.Set(ctx, key, raw, ttl).Err()
+}
@@ -0,0 +1,162 @@
+package utils
+
+import (
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 重试默认值说明：
+// 1) max_attempts 为总尝试次数（含首次），默认 1 表示不重试；
+// 2) 退避采用指数退避 + 抖动：base * 2^(n-1)，不超过 max_backoff；
+// 3) 上游 Retry-After 超过 max_retry_after_ms 时不再重试，直接把上游响应返回给调用方。
+const (
+	defaultRetryMaxAttempts     = 1
+	defaultRetryBaseBackoffMs   = 200
+	defaultRetryMaxBackoffMs    = 2000
+	defaultRetryMaxRetryAfterMs = 5000
+	defaultRetryFailover        = true
+	maxRetryMaxAttempts         = 10
+)
+
+// config/app.yaml 对应的配置键。
+const (
+	cfgRetryMaxAttempts       = "retry.max_attempts"
+	cfgRetryBaseBackoffMs     = "retry.base_backoff_ms"
+	cfgRetryMaxBackoffMs      = "retry.max_backoff_ms"
+	cfgRetryMaxRetryAfterMs   = "retry.max_retry_after_ms"
+	cfgRetryOnStatus          = "retry.retry_on_status"
+	cfgRetryFailoverUpstreams = "retry.failover_upstreams"
+)
+
+var defaultRetryOnStatus = []int{http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable}
+
+// RetryConfig 为 chat/completions 首字节前的重试与故障转移配置。
+// FailoverUpstreams 为 true 时，重试会优先换到同样能服务该模型的其他上游。
+type RetryConfig struct {
+	MaxAttempts       int
+	BaseBackoffMs     int
+	MaxBackoffMs      int
+	MaxRetryAfterMs   int
+	RetryOnStatus     map[int]struct{}
+	FailoverUpstreams bool
+}
+
+// UpstreamAttempt 记录一次失败并被重试的上游尝试，供用量中间件落库。
+type UpstreamAttempt struct {
+	Attempt    int
+	Upstream   string
+	Replica    string
+	Model      string
+	StatusCode int
+	Error      string
+	LatencyMs  int
+}
+
+var (
+	retryConfig   RetryConfig
+	retryConfigMu sync.RWMutex
+)
+
+// InitRetryConfig 在服务启动阶段加载重试配置。
+func InitRetryConfig() {
+	cfg := RetryConfig{
+		MaxAttempts:       V.GetInt(cfgRetryMaxAttempts),
+		BaseBackoffMs:     V.GetInt(cfgRetryBaseBackoffMs),
+		MaxBackoffMs:      V.GetInt(cfgRetryMaxBackoffMs),
+		MaxRetryAfterMs:   V.GetInt(cfgRetryMaxRetryAfterMs),
+		RetryOnStatus:     map[int]struct{}{},
+		FailoverUpstreams: defaultRetryFailover,
+	}
+	if V.IsSet(cfgRetryFailoverUpstreams) {
+		cfg.FailoverUpstreams = V.GetBool(cfgRetryFailoverUpstreams)
+	}
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = defaultRetryMaxAttempts
+	}
+	if cfg.MaxAttempts > maxRetryMaxAttempts {
+		cfg.MaxAttempts = maxRetryMaxAttempts
+	}
+	if cfg.BaseBackoffMs <= 0 {
+		cfg.BaseBackoffMs = defaultRetryBaseBackoffMs
+	}
+	if cfg.MaxBackoffMs <= 0 {
+		cfg.MaxBackoffMs = defaultRetryMaxBackoffMs
+	}
+	if cfg.MaxRetryAfterMs <= 0 {
+		cfg.MaxRetryAfterMs = defaultRetryMaxRetryAfterMs
+	}
+	statuses := V.GetIntSlice(cfgRetryOnStatus)
+	if len(statuses) == 0 {
+		statuses = defaultRetryOnStatus
+	}
+	for _, code := range statuses {
+		cfg.RetryOnStatus[code] = struct{}{}
+	}
+
+	retryConfigMu.Lock()
+	retryConfig = cfg
+	retryConfigMu.Unlock()
+}
+
+// GetRetryConfig 返回当前重试配置；未初始化时等价于不重试。
+func GetRetryConfig() RetryConfig {
+	retryConfigMu.RLock()
+	defer retryConfigMu.RUnlock()
+	cfg := retryConfig
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = defaultRetryMaxAttempts
+	}
+	return cfg
+}
+
+// ShouldRetryStatus 判断上游状态码是否属于可重试集合。
+func (c RetryConfig) ShouldRetryStatus(statusCode int) bool {
+	_, ok := c.RetryOnStatus[statusCode]
+	return ok
+}
+
+// Backoff 计算第 attempt 次失败后的等待时间（attempt 从 1 开始）。
+// 采用 equal jitter：一半固定、一半随机，避免多个网关实例同时重试打爆上游。
+func (c RetryConfig) Backoff(attempt int) time.Duration {
+	if attempt < 1 {
+		attempt = 1
+	}
+	d := c.BaseBackoffMs
+	for i := 1; i < attempt && d < c.MaxBackoffMs; i++ {
+		d *= 2
+	}
+	if d > c.MaxBackoffMs {
+		d = c.MaxBackoffMs
+	}
+	half := d / 2
+	if half <= 0 {
+		return time.Duration(d) * time.Millisecond
+	}
+	return time.Duration(half+rand.Intn(half+1)) * time.Millisecond
+}
+
+// ParseRetryAfter 解析 Retry-After 响应头，支持秒数与 HTTP 日期两种格式。
+func ParseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(value); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		d := at.Sub(now)
+		if d < 0 {
+			d = 0
+		}
+		return d, true
+	}
+	return 0, false
+}
@@ -0,0 +1,188 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// config/app.yaml 对应的配置键。
+// 每个 /v1 请求按 method + path 匹配一条路由策略，决定是否放行、是否限流、如何计费以及是否写入 api_usage：
+//
+//	route_policy:
+//	 default:              # 没有匹配任何规则的路径
+//	  action: allow        # allow / deny
+//	 routes:               # 按顺序匹配，先于内置规则
+//	  - path: /v1/tokenize
+//	    methods: ["POST"]
+//	    rate_limit: true
+//	    cost: fixed
+//	    token_cost: 1
+//	    log_usage: true
+//	  - path: /v1/audio/*
+//	    action: deny
+const (
+	cfgRoutePolicyDefault = "route_policy.default"
+	cfgRoutePolicyRoutes  = "route_policy.routes"
+)
+
+const (
+	RouteActionAllow = "allow"
+	RouteActionDeny  = "deny"
+
+	// RouteCostEstimate 按请求体估算 token（chat 类按 messages，completions 按 prompt，embeddings 按 input，其余按整个 JSON 请求体）。
+	RouteCostEstimate = "estimate"
+	// RouteCostFixed 每次请求固定扣 token_cost 个 token 级配额单位。
+	RouteCostFixed = "fixed"
+	// RouteCostNone 只计请求数，不扣 token 级配额。
+	RouteCostNone = "none"
+)
+
+// RoutePolicy 是一条路由策略；path 支持 * / ? 通配（* 可跨越 /），methods 为空表示全部方法。
+type RoutePolicy struct {
+	Path      string   `mapstructure:"path" json:"path"`
+	Methods   []string `mapstructure:"methods" json:"methods,omitempty"`
+	Action    string   `mapstructure:"action" json:"action"`
+	RateLimit bool     `mapstructure:"rate_limit" json:"rate_limit"`
+	Cost      string   `mapstructure:"cost" json:"cost"`
+	TokenCost int64    `mapstructure:"token_cost" json:"token_cost"`
+	LogUsage  bool     `mapstructure:"log_usage" json:"log_usage"`
+}
+
+// Denied 表示该路由被策略禁用。
+func (p RoutePolicy) Denied() bool {
+	return p.Action == RouteActionDeny
+}
+
+func (p RoutePolicy) matches(method string, path string) bool {
+	if !MatchModelPattern(p.Path, path) {
+		return false
+	}
+	if len(p.Methods) == 0 {
+		return true
+	}
+	for _, m := range p.Methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// normalize 补齐默认值并校验取值，index<0 表示 default 策略。
+func (p *RoutePolicy) normalize(index int) error {
+	name := "route_policy.default"
+	if index >= 0 {
+		name = fmt.Sprintf("route_policy.routes[%d]", index)
+		p.Path = strings.TrimSpace(p.Path)
+		if !strings.HasPrefix(p.Path, "/") {
+			return fmt.Errorf("%s.path must start with /", name)
+		}
+	}
+	for i, m := range p.Methods {
+		p.Methods[i] = strings.ToUpper(strings.TrimSpace(m))
+	}
+	p.Action = strings.ToLower(strings.TrimSpace(p.Action))
+	switch p.Action {
+	case "":
+		p.Action = RouteActionAllow
+	case RouteActionAllow, RouteActionDeny:
+	default:
+		return fmt.Errorf("%s.action must be allow or deny", name)
+	}
+	p.Cost = strings.ToLower(strings.TrimSpace(p.Cost))
+	switch p.Cost {
+	case "":
+		p.Cost = RouteCostEstimate
+	case RouteCostEstimate, RouteCostFixed, RouteCostNone:
+	default:
+		return fmt.Errorf("%s.cost must be estimate, fixed or none", name)
+	}
+	if p.TokenCost < 0 {
+		return fmt.Errorf("%s.token_cost must be >= 0", name)
+	}
+	return nil
+}
+
+// builtinRoutePolicies 是网关自身路由的默认策略，排在运维配置的规则之后，可被同路径的配置覆盖。
+func builtinRoutePolicies() []RoutePolicy {
+	metered := func(path string) RoutePolicy {
+		return RoutePolicy{
+			Path:      path,
+			Methods:   []string{"POST"},
+			Action:    RouteActionAllow,
+			RateLimit: true,
+			Cost:      RouteCostEstimate,
+			LogUsage:  true,
+		}
+	}
+	open := func(path string, methods ...string) RoutePolicy {
+		return RoutePolicy{Path: path, Methods: methods, Action: RouteActionAllow, Cost: RouteCostNone}
+	}
+	return []RoutePolicy{
+		metered("/v1/chat/completions"),
+		metered("/v1/messages"),
+		metered("/v1/responses"),
+		metered("/v1/completions"),
+		metered("/v1/embeddings"),
+		metered("/v1/conversations/*/regenerate"),
+		open("/v1/models", "GET"),
+		open("/v1/models/*", "GET"),
+		open("/v1/responses/*", "GET"),
+		open("/v1/tokenize", "POST"),
+		open("/v1/conversations"),
+		open("/v1/conversations/*"),
+	}
+}
+
+var (
+	routePolicies      []RoutePolicy
+	routePolicyDefault = RoutePolicy{Action: RouteActionAllow, Cost: RouteCostNone}
+	routePolicyMu      sync.RWMutex
+)
+
+// InitRoutePolicyConfig 在服务启动阶段加载路由策略，未配置时沿用内置规则，未知路径放行但不限流、不记录用量。
+func InitRoutePolicyConfig() {
+	def := RoutePolicy{Action: RouteActionAllow, Cost: RouteCostNone}
+	if V.IsSet(cfgRoutePolicyDefault) {
+		if err := V.UnmarshalKey(cfgRoutePolicyDefault, &def); err != nil {
+			panic(fmt.Errorf("invalid route_policy.default config: %w", err))
+		}
+	}
+	if err := def.normalize(-1); err != nil {
+		panic(err)
+	}
+	var list []RoutePolicy
+	if V.IsSet(cfgRoutePolicyRoutes) {
+		if err := V.UnmarshalKey(cfgRoutePolicyRoutes, &list); err != nil {
+			panic(fmt.Errorf("invalid route_policy.routes config: %w", err))
+		}
+	}
+	for i := range list {
+		if err := list[i].normalize(i); err != nil {
+			panic(err)
+		}
+	}
+	routePolicyMu.Lock()
+	routePolicies = append(list, builtinRoutePolicies()...)
+	routePolicyDefault = def
+	routePolicyMu.Unlock()
+}
+
+// MatchRoutePolicy 返回第一条匹配的策略；都不匹配时返回 default 策略，matched 为 false。
+func MatchRoutePolicy(method string, path string) (RoutePolicy, bool) {
+	routePolicyMu.RLock()
+	defer routePolicyMu.RUnlock()
+	policies := routePolicies
+	if policies == nil {
+		policies = builtinRoutePolicies()
+	}
+	for _, p := range policies {
+		if p.matches(method, path) {
+			return p, true
+		}
+	}
+	def := routePolicyDefault
+	def.Path = path
+	return def, false
+}
@@ -50,6 +50,31 @@ func InitParam() {
 	InitRateLimitConfig()
 	UpstreamBaseURL = V.GetString("proxy.upstream_base_url")
 	UpstreamAPIKey = V.GetString("proxy.upstream_api_key")
+
+	// upstream.go
+	InitUpstreamConfig()
+	// retry.go
+	InitRetryConfig()
+	// model_fallback.go
+	InitModelFallbackConfig()
+	// response_cache.go
+	InitResponseCacheConfig()
+	// coalesce.go
+	InitCoalesceConfig()
+	// admission.go
+	InitAdmissionConfig()
+	// model_alias.go
+	InitModelAliasConfig()
+	// model_access.go
+	InitModelAccessConfig()
+	// model_capability.go
+	InitModelCapabilityConfig()
+	// route_policy.go
+	InitRoutePolicyConfig()
+	// conversation_summary.go
+	InitConversationSummaryConfig()
+	// conversation_title.go
+	InitConversationTitleConfig()
 }
 
 func InitConfig() {
@@ -0,0 +1,442 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// 上游传输层默认值，与原先单上游写死的 http.Transport 参数保持一致。
+const (
+	defaultUpstreamDialTimeoutMs         = 10000
+	defaultUpstreamKeepAliveMs           = 30000
+	defaultUpstreamIdleConnTimeoutMs     = 90000
+	defaultUpstreamTLSHandshakeTimeoutMs = 10000
+	defaultUpstreamMaxIdleConns          = 100
+	defaultUpstreamMaxIdleConnsPerHost   = 100
+	defaultUpstreamName                  = "default"
+	defaultUpstreamModelsMatch           = "*"
+
+	defaultUpstreamEjectFailures       = 3
+	defaultUpstreamEjectCooldownMs     = 30000
+	defaultUpstreamHealthCheckPath     = "/health"
+	defaultUpstreamHealthCheckInterval = 5000
+	defaultUpstreamHealthCheckTimeout  = 2000
+
+	defaultBreakerConsecutiveFailures = 5
+	defaultBreakerErrorRate           = 0.5
+	defaultBreakerMinRequests         = 20
+	defaultBreakerWindowMs            = 60000
+	defaultBreakerOpenMs              = 30000
+	defaultBreakerHalfOpenMaxRequests = 1
+
+	defaultAdmissionMaxQueue       = 100
+	defaultAdmissionQueueTimeoutMs = 30000
+)
+
+// 负载均衡策略。
+const (
+	UpstreamBalancerRoundRobin    = "round_robin"
+	UpstreamBalancerLeastInFlight = "least_in_flight"
+	UpstreamBalancerWeighted      = "weighted"
+)
+
+// 准入控制的计数范围。
+const (
+	UpstreamAdmissionScopeUpstream = "upstream"
+	UpstreamAdmissionScopeModel    = "model"
+)
+
+// config/app.yaml 对应的配置键。
+const (
+	cfgUpstreams = "upstreams"
+)
+
+// UpstreamTransportConfig 描述单个上游的连接参数（毫秒为单位，<=0 使用默认值）。
+type UpstreamTransportConfig struct {
+	DialTimeoutMs           int  `mapstructure:"dial_timeout_ms"`
+	KeepAliveMs             int  `mapstructure:"keep_alive_ms"`
+	IdleConnTimeoutMs       int  `mapstructure:"idle_conn_timeout_ms"`
+	TLSHandshakeTimeoutMs   int  `mapstructure:"tls_handshake_timeout_ms"`
+	ResponseHeaderTimeoutMs int  `mapstructure:"response_header_timeout_ms"`
+	MaxIdleConns            int  `mapstructure:"max_idle_conns"`
+	MaxIdleConnsPerHost     int  `mapstructure:"max_idle_conns_per_host"`
+	InsecureSkipVerify      bool `mapstructure:"insecure_skip_verify"`
+}
+
+// UpstreamReplicaConfig 是上游下的一个副本地址，Weight 仅在 weighted 策略下生效（<=0 视为 1）。
+type UpstreamReplicaConfig struct {
+	URL    string `mapstructure:"url"`
+	Weight int    `mapstructure:"weight"`
+}
+
+// UpstreamEjectionConfig 是被动摘除配置：
+// 副本连续 ConsecutiveFailures 次连接失败或返回 5xx 后摘除 CooldownMs 毫秒。
+type UpstreamEjectionConfig struct {
+	ConsecutiveFailures int `mapstructure:"consecutive_failures"`
+	CooldownMs          int `mapstructure:"cooldown_ms"`
+}
+
+// UpstreamHealthCheckConfig 是主动探活配置（Path 常用 /health 或 /v1/models）。
+// 默认关闭：配置了 Path 或 IntervalMs > 0 时开启（未配置的一项取默认值），IntervalMs < 0 强制关闭；
+// 关闭时被摘除的副本在冷却期结束后直接恢复。
+type UpstreamHealthCheckConfig struct {
+	Path       string `mapstructure:"path"`
+	IntervalMs int    `mapstructure:"interval_ms"`
+	TimeoutMs  int    `mapstructure:"timeout_ms"`
+}
+
+// UpstreamCircuitBreakerConfig 是上游级熔断配置：
+// 1) 连续失败达到 ConsecutiveFailures，或滚动窗口 WindowMs 内请求数 >= MinRequests 且错误率 >= ErrorRateThreshold 时熔断；
+// 2) 熔断（open）OpenMs 毫秒后进入半开（half_open），最多放行 HalfOpenMaxRequests 个探测请求；
+// 3) 探测成功恢复 closed，失败重新 open。
+type UpstreamCircuitBreakerConfig struct {
+	Disabled            bool    `mapstructure:"disabled"`
+	ConsecutiveFailures int     `mapstructure:"consecutive_failures"`
+	ErrorRateThreshold  float64 `mapstructure:"error_rate_threshold"`
+	MinRequests         int     `mapstructure:"min_requests"`
+	WindowMs            int     `mapstructure:"window_ms"`
+	OpenMs              int     `mapstructure:"open_ms"`
+	HalfOpenMaxRequests int     `mapstructure:"half_open_max_requests"`
+}
+
+// UpstreamAdmissionConfig 是上游准入控制配置：
+// 1) MaxInFlight<=0 表示不限制并发（默认）；
+// 2) 超出并发的请求进入按用户加权公平排队的等待队列，队列最多 MaxQueue 个请求，满了直接拒绝；
+// 3) 排队超过 QueueTimeoutMs 毫秒返回 503；
+// 4) Scope 为 model 时按“上游 + 模型”分别计数，默认整个上游共用一个计数。
+type UpstreamAdmissionConfig struct {
+	MaxInFlight    int    `mapstructure:"max_in_flight"`
+	MaxQueue       int    `mapstructure:"max_queue"`
+	QueueTimeoutMs int    `mapstructure:"queue_timeout_ms"`
+	Scope          string `mapstructure:"scope"`
+}
+
+// UpstreamConfig 是路由表中的一条上游配置。
+// Models 支持三种写法：
+// 1) 精确匹配：Qwen/Qwen2.5-7B-Instruct；
+// 2) 前缀匹配：gpt-4*；
+// 3) 通配匹配：*qwen*、Qwen/*-Instruct（* 可跨越 /，? 匹配单个字符）。
+// Default 为 true 的上游用于承接没有 model 字段的请求（如 GET /v1/models）。
+// Replicas 为空时使用 BaseURL 作为唯一副本。
+type UpstreamConfig struct {
+	Name        string                    `mapstructure:"name"`
+	BaseURL     string                    `mapstructure:"base_url"`
+	APIKey      string                    `mapstructure:"api_key"`
+	Models      []string                  `mapstructure:"models"`
+	Default     bool                      `mapstructure:"default"`
+	Transport   UpstreamTransportConfig   `mapstructure:"transport"`
+	Replicas    []UpstreamReplicaConfig   `mapstructure:"replicas"`
+	Balancer    string                    `mapstructure:"balancer"`
+	Ejection    UpstreamEjectionConfig    `mapstructure:"ejection"`
+	HealthCheck UpstreamHealthCheckConfig `mapstructure:"health_check"`
+
+	CircuitBreaker UpstreamCircuitBreakerConfig `mapstructure:"circuit_breaker"`
+	Admission      UpstreamAdmissionConfig      `mapstructure:"admission"`
+}
+
+// ParseUpstreamURL 解析并校验上游地址。
+func ParseUpstreamURL(raw string) (*url.URL, error) {
+	target, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil {
+		return nil, err
+	}
+	if target.Scheme == "" || target.Host == "" {
+		return nil, fmt.Errorf("invalid upstream url: %q", raw)
+	}
+	return target, nil
+}
+
+// MatchModel 判断该上游是否服务指定模型。
+func (u UpstreamConfig) MatchModel(model string) bool {
+	for _, pattern := range u.Models {
+		if MatchModelPattern(pattern, model) {
+			return true
+		}
+	}
+	return false
+}
+
+// applyDefaults 为未配置（<=0）的连接参数填充默认值。
+func (t *UpstreamTransportConfig) applyDefaults() {
+	if t.DialTimeoutMs <= 0 {
+		t.DialTimeoutMs = defaultUpstreamDialTimeoutMs
+	}
+	if t.KeepAliveMs <= 0 {
+		t.KeepAliveMs = defaultUpstreamKeepAliveMs
+	}
+	if t.IdleConnTimeoutMs <= 0 {
+		t.IdleConnTimeoutMs = defaultUpstreamIdleConnTimeoutMs
+	}
+	if t.TLSHandshakeTimeoutMs <= 0 {
+		t.TLSHandshakeTimeoutMs = defaultUpstreamTLSHandshakeTimeoutMs
+	}
+	if t.MaxIdleConns <= 0 {
+		t.MaxIdleConns = defaultUpstreamMaxIdleConns
+	}
+	if t.MaxIdleConnsPerHost <= 0 {
+		t.MaxIdleConnsPerHost = defaultUpstreamMaxIdleConnsPerHost
+	}
+}
+
+var (
+	// upstreamConfigs 是进程内缓存的路由表，顺序即匹配优先级。
+	upstreamConfigs   []UpstreamConfig
+	upstreamConfigsMu sync.RWMutex
+
+	// ErrUpstreamNotFound 表示没有上游能服务该模型。
+	ErrUpstreamNotFound = errors.New("no upstream for model")
+)
+
+// InitUpstreamConfig 在服务启动阶段加载上游路由表。
+// 未配置 upstreams 时回退到旧的 proxy.upstream_base_url 单上游配置，保证兼容。
+func InitUpstreamConfig() {
+	list, err := loadUpstreamConfigsFromViper()
+	if err != nil {
+		panic(err)
+	}
+	setUpstreamConfigs(list)
+}
+
+// GetUpstreamConfigs 返回路由表副本。
+func GetUpstreamConfigs() []UpstreamConfig {
+	upstreamConfigsMu.RLock()
+	defer upstreamConfigsMu.RUnlock()
+	out := make([]UpstreamConfig, len(upstreamConfigs))
+	copy(out, upstreamConfigs)
+	return out
+}
+
+func setUpstreamConfigs(list []UpstreamConfig) {
+	upstreamConfigsMu.Lock()
+	upstreamConfigs = list
+	upstreamConfigsMu.Unlock()
+}
+
+// ResolveUpstreamForModel 按配置顺序返回第一个匹配 model 的上游。
+// model 为空时返回默认上游。
+func ResolveUpstreamForModel(model string) (UpstreamConfig, error) {
+	list := GetUpstreamConfigs()
+	model = strings.TrimSpace(model)
+	if model == "" {
+		return DefaultUpstream()
+	}
+	for _, item := range list {
+		if item.MatchModel(model) {
+			return item, nil
+		}
+	}
+	return UpstreamConfig{}, ErrUpstreamNotFound
+}
+
+// ResolveUpstreamsForModel 按配置顺序返回所有能服务 model 的上游，供故障转移使用。
+// model 为空时只返回默认上游。
+func ResolveUpstreamsForModel(model string) []UpstreamConfig {
+	model = strings.TrimSpace(model)
+	if model == "" {
+		if item, err := DefaultUpstream(); err == nil {
+			return []UpstreamConfig{item}
+		}
+		return nil
+	}
+	var out []UpstreamConfig
+	for _, item := range GetUpstreamConfigs() {
+		if item.MatchModel(model) {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// DefaultUpstream 返回 default=true 的上游；都没标记时取路由表第一项。
+func DefaultUpstream() (UpstreamConfig, error) {
+	list := GetUpstreamConfigs()
+	if len(list) == 0 {
+		return UpstreamConfig{}, ErrUpstreamNotFound
+	}
+	for _, item := range list {
+		if item.Default {
+			return item, nil
+		}
+	}
+	return list[0], nil
+}
+
+// loadUpstreamConfigsFromViper 读取 upstreams 列表并做校验：
+// 1) name 缺失时按下标生成；name 不允许重复；
+// 2) base_url / replicas 必须是合法的绝对地址；
+// 3) models 为空的上游只作为默认上游使用，不参与模型匹配；
+// 4) transport、负载均衡、摘除与探活中未配置的参数填充默认值。
+func loadUpstreamConfigsFromViper() ([]UpstreamConfig, error) {
+	var list []UpstreamConfig
+	if V.IsSet(cfgUpstreams) {
+		if err := V.UnmarshalKey(cfgUpstreams, &list); err != nil {
+			return nil, fmt.Errorf("invalid upstreams config: %w", err)
+		}
+	}
+	if len(list) == 0 {
+		baseURL := strings.TrimSpace(UpstreamBaseURL)
+		if baseURL == "" {
+			return nil, nil
+		}
+		list = []UpstreamConfig{{
+			Name:    defaultUpstreamName,
+			BaseURL: baseURL,
+			APIKey:  UpstreamAPIKey,
+			Models:  []string{defaultUpstreamModelsMatch},
+			Default: true,
+		}}
+	}
+
+	seen := make(map[string]struct{}, len(list))
+	for i := range list {
+		item := &list[i]
+		item.Name = strings.TrimSpace(item.Name)
+		if item.Name == "" {
+			item.Name = fmt.Sprintf("upstream-%d", i)
+		}
+		if _, ok := seen[item.Name]; ok {
+			return nil, fmt.Errorf("duplicate upstream name: %s", item.Name)
+		}
+		seen[item.Name] = struct{}{}
+		if err := item.normalizeReplicas(); err != nil {
+			return nil, fmt.Errorf("upstream %s: %w", item.Name, err)
+		}
+		models := make([]string, 0, len(item.Models))
+		for _, pattern := range item.Models {
+			if pattern = strings.TrimSpace(pattern); pattern != "" {
+				models = append(models, pattern)
+			}
+		}
+		item.Models = models
+		item.Transport.applyDefaults()
+		item.applyPoolDefaults()
+	}
+	return list, nil
+}
+
+// normalizeReplicas 统一副本列表：未配置 replicas 时以 base_url 作为唯一副本，
+// 并校验每个副本地址；BaseURL 始终指向第一个副本，兼容只读 BaseURL 的逻辑。
+func (u *UpstreamConfig) normalizeReplicas() error {
+	u.BaseURL = strings.TrimSpace(u.BaseURL)
+	if len(u.Replicas) == 0 && u.BaseURL != "" {
+		u.Replicas = []UpstreamReplicaConfig{{URL: u.BaseURL, Weight: 1}}
+	}
+	if len(u.Replicas) == 0 {
+		return errors.New("base_url or replicas is required")
+	}
+	for i := range u.Replicas {
+		replica := &u.Replicas[i]
+		replica.URL = strings.TrimSpace(replica.URL)
+		if _, err := ParseUpstreamURL(replica.URL); err != nil {
+			return err
+		}
+		if replica.Weight <= 0 {
+			replica.Weight = 1
+		}
+	}
+	u.BaseURL = u.Replicas[0].URL
+	return nil
+}
+
+// applyPoolDefaults 为负载均衡、被动摘除、主动探活、熔断与准入控制填充默认值。
+func (u *UpstreamConfig) applyPoolDefaults() {
+	switch strings.ToLower(strings.TrimSpace(u.Balancer)) {
+	case UpstreamBalancerLeastInFlight:
+		u.Balancer = UpstreamBalancerLeastInFlight
+	case UpstreamBalancerWeighted:
+		u.Balancer = UpstreamBalancerWeighted
+	default:
+		u.Balancer = UpstreamBalancerRoundRobin
+	}
+	if u.Ejection.ConsecutiveFailures <= 0 {
+		u.Ejection.ConsecutiveFailures = defaultUpstreamEjectFailures
+	}
+	if u.Ejection.CooldownMs <= 0 {
+		u.Ejection.CooldownMs = defaultUpstreamEjectCooldownMs
+	}
+	// 主动探活需显式开启：path 与 interval_ms 都未配置时关闭，避免向不提供 /health 的托管服务持续探测并误摘除副本。
+	u.HealthCheck.Path = strings.TrimSpace(u.HealthCheck.Path)
+	switch {
+	case u.HealthCheck.IntervalMs < 0:
+	case u.HealthCheck.Path == "" && u.HealthCheck.IntervalMs == 0:
+		u.HealthCheck.IntervalMs = -1
+	case u.HealthCheck.IntervalMs == 0:
+		u.HealthCheck.IntervalMs = defaultUpstreamHealthCheckInterval
+	}
+	if u.HealthCheck.Path == "" {
+		u.HealthCheck.Path = defaultUpstreamHealthCheckPath
+	}
+	if u.HealthCheck.TimeoutMs <= 0 {
+		u.HealthCheck.TimeoutMs = defaultUpstreamHealthCheckTimeout
+	}
+
+	cb := &u.CircuitBreaker
+	if cb.ConsecutiveFailures <= 0 {
+		cb.ConsecutiveFailures = defaultBreakerConsecutiveFailures
+	}
+	if cb.ErrorRateThreshold <= 0 || cb.ErrorRateThreshold > 1 {
+		cb.ErrorRateThreshold = defaultBreakerErrorRate
+	}
+	if cb.MinRequests <= 0 {
+		cb.MinRequests = defaultBreakerMinRequests
+	}
+	if cb.WindowMs <= 0 {
+		cb.WindowMs = defaultBreakerWindowMs
+	}
+	if cb.OpenMs <= 0 {
+		cb.OpenMs = defaultBreakerOpenMs
+	}
+	if cb.HalfOpenMaxRequests <= 0 {
+		cb.HalfOpenMaxRequests = defaultBreakerHalfOpenMaxRequests
+	}
+
+	ad := &u.Admission
+	if ad.MaxQueue <= 0 {
+		ad.MaxQueue = defaultAdmissionMaxQueue
+	}
+	if ad.QueueTimeoutMs <= 0 {
+		ad.QueueTimeoutMs = defaultAdmissionQueueTimeoutMs
+	}
+	if strings.ToLower(strings.TrimSpace(ad.Scope)) == UpstreamAdmissionScopeModel {
+		ad.Scope = UpstreamAdmissionScopeModel
+	} else {
+		ad.Scope = UpstreamAdmissionScopeUpstream
+	}
+}
+
+// MatchModelPattern 实现简单通配匹配：* 匹配任意长度（包括 /），? 匹配单个字符。
+// 不含通配符时为精确匹配。
+func MatchModelPattern(pattern string, model string) bool {
+	p := []rune(strings.TrimSpace(pattern))
+	s := []rune(strings.TrimSpace(model))
+	if len(p) == 0 {
+		return false
+	}
+	pi, si := 0, 0
+	starP, starS := -1, 0
+	for si < len(s) {
+		switch {
+		case pi < len(p) && (p[pi] == '?' || p[pi] == s[si]):
+			pi++
+			si++
+		case pi < len(p) && p[pi] == '*':
+			starP = pi
+			starS = si
+			pi++
+		case starP >= 0:
+			// 回溯：让上一个 * 多吞一个字符。
+			starS++
+			si = starS
+			pi = starP + 1
+		default:
+			return false
+		}
+	}
+	for pi < len(p) && p[pi] == '*' {
+		pi++
+	}
+	return pi == len(p)
+}
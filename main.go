@@ -2,11 +2,13 @@ package main
 
 import (
 	"github.com/nanami9426/imgo/internal/router"
+	"github.com/nanami9426/imgo/internal/tokenizer"
 	"github.com/nanami9426/imgo/internal/utils"
 )
 
 func main() {
 	utils.InitConfig()
+	tokenizer.Init()
 	r := router.Router()
 	r.Run(":5000")
 }
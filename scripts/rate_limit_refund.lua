@@ -0,0 +1,13 @@
+-- KEYS[1] = token key
+local tok_refund = tonumber(ARGV[1]) -- 需要退还的token额度 ARGV[1] = tok_refund
+
+-- 只退还当前窗口内已扣的部分：key 不存在（窗口已过期）时不做任何事，避免生成没有 TTL 的负数 key。
+local tok_current = tonumber(redis.call("GET", KEYS[1]) or "0")
+if tok_current <= 0 or tok_refund <= 0 then
+	return 0
+end
+if tok_refund > tok_current then
+	tok_refund = tok_current
+end
+redis.call("DECRBY", KEYS[1], tok_refund)
+return tok_refund
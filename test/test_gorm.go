@@ -44,4 +44,9 @@ func main() {
 	db.AutoMigrate(&models.APIKey{})
 	db.AutoMigrate(&models.LLMConversation{})
 	db.AutoMigrate(&models.LLMConversationMessage{})
+	db.AutoMigrate(&models.LLMResponse{})
+	// 会话搜索的全文索引（仅 MySQL）
+	if err := models.MigrateLLMConversationFulltextIndexes(db); err != nil {
+		log.Fatal(err)
+	}
 }